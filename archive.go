@@ -0,0 +1,234 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	ArchiveFormatTar   = "tar"
+	ArchiveFormatTarGz = "tar.gz"
+	ArchiveFormatZip   = "zip"
+)
+
+var archiveMimeTypes = map[string]string{
+	ArchiveFormatTar:   "application/x-tar",
+	ArchiveFormatTarGz: "application/gzip",
+	ArchiveFormatZip:   "application/zip",
+}
+
+// requestedArchiveFormat returns the archive format from the archive url param
+// or the Accept header, or an empty string if no archive was requested.
+func requestedArchiveFormat(r *http.Request) (string, error) {
+	if format := r.URL.Query().Get("archive"); format != "" {
+		if _, ok := archiveMimeTypes[format]; !ok {
+			return "", fmt.Errorf("unsupported archive format %q", format)
+		}
+		return format, nil
+	}
+
+	for _, accept := range splitList(r.Header.Get("Accept")) {
+		mimeType := strings.TrimSpace(strings.Split(accept, ";")[0])
+		for format, archiveMimeType := range archiveMimeTypes {
+			if mimeType == archiveMimeType {
+				return format, nil
+			}
+		}
+	}
+	return "", nil
+}
+
+// archiveFilter selects the paths to archive. Patterns without a slash match
+// the base name, others match the path relative to the archived directory.
+type archiveFilter struct {
+	include []string
+	exclude []string
+}
+
+func newArchiveFilter(r *http.Request) (archiveFilter, error) {
+	query := r.URL.Query()
+	filter := archiveFilter{include: query["include"], exclude: query["exclude"]}
+	for _, pattern := range append(filter.include, filter.exclude...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return filter, fmt.Errorf("invalid glob %q: %v", pattern, err)
+		}
+	}
+	return filter, nil
+}
+
+// skip reports whether relPath should be left out of the archive. Directories
+// are only ever skipped by exclude patterns.
+func (x archiveFilter) skip(relPath string, isDir bool) bool {
+	if globsMatch(x.exclude, relPath) {
+		return true
+	}
+	return !isDir && len(x.include) > 0 && !globsMatch(x.include, relPath)
+}
+
+func globsMatch(patterns []string, relPath string) bool {
+	for _, pattern := range patterns {
+		name := relPath
+		if !strings.Contains(pattern, "/") {
+			name = path.Base(relPath)
+		}
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// writeArchiveResponse streams an archive of dirName as the response body.
+// Errors after the response has started can only be logged.
+func writeArchiveResponse(config Config, w http.ResponseWriter, r *http.Request, dirName, format string) {
+	filter, err := newArchiveFilter(r)
+	if err != nil {
+		badRequest(w, err.Error())
+		return
+	}
+
+	name := path.Base(r.URL.Path)
+	if name == "/" || name == "." {
+		name = "root"
+	}
+	w.Header().Set("Content-Type", archiveMimeTypes[format])
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+"."+format))
+
+	switch format {
+	case ArchiveFormatTar:
+		err = writeTar(w, config.Storage, dirName, filter)
+	case ArchiveFormatTarGz:
+		gw := gzip.NewWriter(w)
+		if err = writeTar(gw, config.Storage, dirName, filter); err == nil {
+			err = gw.Close()
+		}
+	case ArchiveFormatZip:
+		err = writeZip(w, config.Storage, dirName, filter)
+	}
+	if err != nil {
+		log.Printf("writing %s archive of %s: %v", format, dirName, err)
+	}
+}
+
+type archiveWalkFunc func(relPath, name string, info os.FileInfo) error
+
+// walkArchive calls fn for each directory, regular file and symlink under
+// dirName that passes the filter. Symlinks are not followed.
+func walkArchive(storage Storage, dirName string, filter archiveFilter, fn archiveWalkFunc) error {
+	dirName = path.Clean("/" + dirName)
+	return walkStorage(storage, dirName, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if name == dirName {
+			return nil
+		}
+		relPath := strings.TrimPrefix(strings.TrimPrefix(name, dirName), "/")
+
+		switch {
+		case filter.skip(relPath, info.IsDir()) && info.IsDir():
+			return filepath.SkipDir
+		case filter.skip(relPath, info.IsDir()):
+			return nil
+		case info.IsDir(), info.Mode().IsRegular(), info.Mode()&os.ModeSymlink != 0:
+			return fn(relPath, name, info)
+		default:
+			return nil
+		}
+	})
+}
+
+func writeTar(w io.Writer, storage Storage, dirName string, filter archiveFilter) error {
+	tw := tar.NewWriter(w)
+	err := walkArchive(storage, dirName, filter, func(relPath, name string, info os.FileInfo) error {
+		var link string
+		if info.Mode()&os.ModeSymlink != 0 {
+			var err error
+			if link, err = storage.Readlink(name); err != nil {
+				return err
+			}
+		}
+
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		uid, gid := fileOwner(info)
+		header.Uid, header.Gid = int(uid), int(gid)
+		header.Name = relPath
+		if info.IsDir() {
+			header.Name += "/"
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		return copyFileTo(tw, storage, name)
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+func writeZip(w io.Writer, storage Storage, dirName string, filter archiveFilter) error {
+	zw := zip.NewWriter(w)
+	err := walkArchive(storage, dirName, filter, func(relPath, name string, info os.FileInfo) error {
+		header, err := zip.FileInfoHeader(info)
+		if err != nil {
+			return err
+		}
+		header.Name = relPath
+		if info.IsDir() {
+			header.Name += "/"
+		} else {
+			header.Method = zip.Deflate
+		}
+
+		fw, err := zw.CreateHeader(header)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			// Zip stores the symlink target as the entry contents.
+			link, err := storage.Readlink(name)
+			if err != nil {
+				return err
+			}
+			_, err = io.WriteString(fw, link)
+			return err
+		case info.Mode().IsRegular():
+			return copyFileTo(fw, storage, name)
+		default:
+			return nil
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+func copyFileTo(w io.Writer, storage Storage, name string) error {
+	f, err := storage.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestHandleGetArchive(t *testing.T) {
+	runTest := func(t *testing.T, target, accept string, wantStatus int, wantContentType string) []byte {
+		t.Helper()
+		httpRequest := httptest.NewRequest(http.MethodGet, target, nil)
+		if accept != "" {
+			httpRequest.Header.Set("Accept", accept)
+		}
+		responseRecorder := httptest.NewRecorder()
+		httpHandler(newConfig(ContentRoot)).ServeHTTP(responseRecorder, httpRequest)
+		resp := responseRecorder.Result()
+		assertResponseHasStatusCode(t, resp, wantStatus)
+		assertResponseHasHeader(t, resp, "Content-Type", wantContentType)
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return body
+	}
+
+	mustMakeArchiveTree := func(t *testing.T) {
+		t.Helper()
+		mustMkDir(t, "/dir", 0755)
+		mustMkDir(t, "/dir/sub", 0750)
+		mustWriteFile(t, []byte("hello\n"), "/dir/file.txt", 0640)
+		mustWriteFile(t, []byte("log\n"), "/dir/sub/app.log", 0600)
+		if err := os.Symlink("file.txt", path.Join(ContentRoot, "/dir/link")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("unsupported format", func(t *testing.T) {
+		mustMakeContentRoot(t)
+		defer mustDeleteContentRoot(t)
+
+		mustMkDir(t, "/dir", 0755)
+		httpRequest := httptest.NewRequest(http.MethodGet, "/dir?archive=rar", nil)
+		responseRecorder := httptest.NewRecorder()
+		httpHandler(newConfig(ContentRoot)).ServeHTTP(responseRecorder, httpRequest)
+		assertHttpResponse(t, responseRecorder.Result(), http.StatusBadRequest, `{
+          "status": "error",
+          "type": "error",
+          "error": {
+            "code": 400,
+            "error": "unsupported archive format \"rar\""
+          }
+        }`)
+	})
+
+	t.Run("tar", func(t *testing.T) {
+		mustMakeContentRoot(t)
+		defer mustDeleteContentRoot(t)
+
+		mustMakeArchiveTree(t)
+		body := runTest(t, "/dir?archive=tar", "", http.StatusOK, "application/x-tar")
+		assertTarEntries(t, bytes.NewReader(body), []string{
+			"file.txt 640 hello\n",
+			"link -> file.txt",
+			"sub/ 750",
+			"sub/app.log 600 log\n",
+		})
+	})
+
+	t.Run("tar.gz from accept header", func(t *testing.T) {
+		mustMakeContentRoot(t)
+		defer mustDeleteContentRoot(t)
+
+		mustMakeArchiveTree(t)
+		body := runTest(t, "/dir", "application/gzip", http.StatusOK, "application/gzip")
+		gr, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertTarEntries(t, gr, []string{
+			"file.txt 640 hello\n",
+			"link -> file.txt",
+			"sub/ 750",
+			"sub/app.log 600 log\n",
+		})
+	})
+
+	t.Run("tar with include and exclude", func(t *testing.T) {
+		mustMakeContentRoot(t)
+		defer mustDeleteContentRoot(t)
+
+		mustMakeArchiveTree(t)
+		body := runTest(t, "/dir?archive=tar&include=*.txt&include=*.log&exclude=sub", "", http.StatusOK, "application/x-tar")
+		assertTarEntries(t, bytes.NewReader(body), []string{
+			"file.txt 640 hello\n",
+		})
+	})
+
+	t.Run("zip", func(t *testing.T) {
+		mustMakeContentRoot(t)
+		defer mustDeleteContentRoot(t)
+
+		mustMakeArchiveTree(t)
+		body := runTest(t, "/dir?archive=zip", "", http.StatusOK, "application/zip")
+		zr, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, f := range zr.File {
+			entry := f.Name
+			switch {
+			case f.Mode()&os.ModeSymlink != 0:
+				entry += " -> " + mustReadZipFile(t, f)
+			case f.Mode().IsDir():
+				entry += " " + octalPerms(f.Mode())
+			default:
+				entry += " " + octalPerms(f.Mode()) + " " + mustReadZipFile(t, f)
+			}
+			got = append(got, entry)
+		}
+		sort.Strings(got)
+		want := []string{
+			"file.txt 640 hello\n",
+			"link -> file.txt",
+			"sub/ 750",
+			"sub/app.log 600 log\n",
+		}
+		if !reflect.DeepEqual(want, got) {
+			t.Errorf("unexpected zip entries:\nwant: %q\ngot:  %q", want, got)
+		}
+	})
+}
+
+// assertTarEntries compares tar entries formatted as "NAME PERMS CONTENTS" or
+// "NAME -> TARGET".
+func assertTarEntries(t *testing.T, r io.Reader, want []string) {
+	t.Helper()
+	var got []string
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		switch header.Typeflag {
+		case tar.TypeSymlink:
+			got = append(got, header.Name+" -> "+header.Linkname)
+		case tar.TypeDir:
+			got = append(got, header.Name+" "+octalPerms(os.FileMode(header.Mode)))
+		default:
+			got = append(got, header.Name+" "+octalPerms(os.FileMode(header.Mode))+" "+string(contents))
+		}
+	}
+	sort.Strings(got)
+	if !reflect.DeepEqual(want, got) {
+		t.Errorf("unexpected tar entries:\nwant: %q\ngot:  %q", want, got)
+	}
+}
+
+func octalPerms(mode os.FileMode) string {
+	return fmt.Sprintf("%o", mode.Perm())
+}
+
+func mustReadZipFile(t *testing.T, f *zip.File) string {
+	t.Helper()
+	rc, err := f.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	contents, err := ioutil.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(contents)
+}
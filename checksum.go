@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+var checksumAlgorithms = map[string]func() hash.Hash{
+	"sha256": sha256.New,
+	"sha1":   sha1.New,
+	"md5":    md5.New,
+	"crc32c": func() hash.Hash { return crc32.New(crc32.MakeTable(crc32.Castagnoli)) },
+}
+
+// contentDigestAlgorithms are the RFC 9530 Content-Digest algorithms we verify.
+var contentDigestAlgorithms = map[string]func() hash.Hash{
+	"sha-256": sha256.New,
+	"sha-512": sha512.New,
+}
+
+const (
+	ChecksumCacheNone    = ""
+	ChecksumCacheXattr   = "xattr"
+	ChecksumCacheSidecar = "sidecar"
+)
+
+const checksumXattrPrefix = "user.file-server.checksum."
+
+var errChecksumMismatch = errors.New("checksum mismatch")
+
+// validateChecksumQuery checks the algorithms in the checksum url param.
+func validateChecksumQuery(r *http.Request) error {
+	return validateChecksums(splitList(r.URL.Query().Get("checksum")))
+}
+
+// validateChecksums checks that the algorithms are supported.
+func validateChecksums(algorithms []string) error {
+	for _, algorithm := range algorithms {
+		if _, ok := checksumAlgorithms[algorithm]; !ok {
+			return fmt.Errorf("unsupported checksum algorithm %q", algorithm)
+		}
+	}
+	return nil
+}
+
+// fileChecksums returns the hex encoded checksums of name for each algorithm,
+// or nil if name is not a regular file.
+func fileChecksums(config Config, name string, algorithms []string) (map[string]string, error) {
+	info, err := config.Storage.Stat(name)
+	if err != nil || !info.Mode().IsRegular() || len(algorithms) == 0 {
+		return nil, err
+	}
+
+	checksums := make(map[string]string)
+	var missing []string
+	for _, algorithm := range algorithms {
+		if sum, ok := cachedChecksum(config, name, info, algorithm); ok {
+			checksums[algorithm] = sum
+		} else {
+			missing = append(missing, algorithm)
+		}
+	}
+	if len(missing) == 0 {
+		return checksums, nil
+	}
+
+	f, err := config.Storage.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	hashes := make([]hash.Hash, len(missing))
+	writers := make([]io.Writer, len(missing))
+	for i, algorithm := range missing {
+		hashes[i] = checksumAlgorithms[algorithm]()
+		writers[i] = hashes[i]
+	}
+	if _, err := io.Copy(io.MultiWriter(writers...), f); err != nil {
+		return nil, err
+	}
+
+	for i, algorithm := range missing {
+		checksums[algorithm] = hex.EncodeToString(hashes[i].Sum(nil))
+		// A failure to cache is not a failure to checksum.
+		if err := cacheChecksum(config, name, info, algorithm, checksums[algorithm]); err != nil {
+			log.Printf("caching %s checksum of %s: %v", algorithm, name, err)
+		}
+	}
+	return checksums, nil
+}
+
+// checksumCacheKey ties a cached checksum to the file size and mtime so edits
+// invalidate it.
+func checksumCacheKey(info os.FileInfo) string {
+	return fmt.Sprintf("%d %d", info.Size(), info.ModTime().UnixNano())
+}
+
+// checksumSidecarName is where a checksum of a file is cached, in a directory
+// of ChecksumCacheDir at the url path of the file. The names of the checksums
+// start with a dot, so they don't collide with those of the directories the
+// files of a directory are cached in.
+func checksumSidecarName(config Config, name, algorithm string) string {
+	return filepath.Join(config.ChecksumCacheDir, filepath.FromSlash(config.urlPath(path.Clean("/"+name))), "."+algorithm)
+}
+
+// forgetChecksums removes the cached checksums of the files at or under the
+// names, after they were removed or renamed.
+func forgetChecksums(config Config, names ...string) {
+	if config.ChecksumCache != ChecksumCacheSidecar {
+		return
+	}
+	for _, name := range names {
+		if path.Clean("/"+name) == "/" && config.MountPath == "" {
+			continue
+		}
+		dirName := filepath.Join(config.ChecksumCacheDir, filepath.FromSlash(config.urlPath(path.Clean("/"+name))))
+		if err := os.RemoveAll(dirName); err != nil {
+			log.Printf("removing the cached checksums of %s: %v", name, err)
+		}
+	}
+}
+
+func cachedChecksum(config Config, name string, info os.FileInfo, algorithm string) (string, bool) {
+	var value []byte
+	var err error
+	switch config.ChecksumCache {
+	case ChecksumCacheXattr:
+		value, err = config.Storage.GetXattr(name, checksumXattrPrefix+algorithm)
+	case ChecksumCacheSidecar:
+		value, err = ioutil.ReadFile(checksumSidecarName(config, name, algorithm))
+	default:
+		return "", false
+	}
+	if err != nil {
+		return "", false
+	}
+
+	key := checksumCacheKey(info) + " "
+	if !strings.HasPrefix(string(value), key) {
+		return "", false
+	}
+	return strings.TrimPrefix(string(value), key), true
+}
+
+func cacheChecksum(config Config, name string, info os.FileInfo, algorithm, sum string) error {
+	value := []byte(checksumCacheKey(info) + " " + sum)
+	switch config.ChecksumCache {
+	case ChecksumCacheXattr:
+		// Setting an xattr doesn't change the mtime, so the key stays valid.
+		return config.Storage.SetXattr(name, checksumXattrPrefix+algorithm, value)
+	case ChecksumCacheSidecar:
+		return writeChecksumSidecar(checksumSidecarName(config, name, algorithm), value)
+	default:
+		return nil
+	}
+}
+
+// writeChecksumSidecar writes a cached checksum to a temporary file that
+// replaces it, so that it is never read half written.
+func writeChecksumSidecar(fileName string, value []byte) error {
+	if err := os.MkdirAll(filepath.Dir(fileName), 0700); err != nil {
+		return err
+	}
+	tmpName := fileName + ".tmp-" + newDeliveryID()
+	if err := ioutil.WriteFile(tmpName, value, 0600); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	if err := os.Rename(tmpName, fileName); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	return nil
+}
+
+// verifySha256 checks contents against an optional hex encoded sha256.
+func verifySha256(contents []byte, want string) error {
+	if want == "" {
+		return nil
+	}
+	sum := sha256.Sum256(contents)
+	if got := hex.EncodeToString(sum[:]); !strings.EqualFold(want, got) {
+		return fmt.Errorf("%w: want sha256 %s, got %s", errChecksumMismatch, want, got)
+	}
+	return nil
+}
+
+// contentDigestMaxSize limits the request bodies buffered to verify their
+// Content-Digest.
+const contentDigestMaxSize = 32 << 20
+
+// verifyContentDigest checks the body of a POST, PUT or PATCH request against a
+// Content-Digest header like `sha-256=:base64=:`, if one is given with a
+// supported algorithm. The body is buffered so it can be read again, and may
+// be up to contentDigestMaxSize.
+func verifyContentDigest(w http.ResponseWriter, r *http.Request) error {
+	header := r.Header.Get("Content-Digest")
+	if header == "" {
+		return nil
+	}
+	switch r.Method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch:
+	default:
+		return nil
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, contentDigestMaxSize))
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return &statusError{http.StatusRequestEntityTooLarge, fmt.Sprintf("bodies with a Content-Digest can't be larger than %d bytes", contentDigestMaxSize)}
+	} else if err != nil {
+		return err
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	for _, item := range splitList(header) {
+		i := strings.Index(item, "=")
+		if i < 0 {
+			return fmt.Errorf("invalid Content-Digest %q", header)
+		}
+		algorithm, value := strings.ToLower(item[:i]), strings.Trim(item[i+1:], ":")
+		newHash, ok := contentDigestAlgorithms[algorithm]
+		if !ok {
+			continue
+		}
+		want, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return fmt.Errorf("invalid Content-Digest %q", header)
+		}
+		h := newHash()
+		h.Write(body)
+		if got := h.Sum(nil); !bytes.Equal(got, want) {
+			return fmt.Errorf("%w: want %s %s, got %s", errChecksumMismatch, algorithm,
+				base64.StdEncoding.EncodeToString(want), base64.StdEncoding.EncodeToString(got))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestChecksums(t *testing.T) {
+	runTest := func(t *testing.T, config Config, method, target, contentDigest, reqBody string, wantStatus int, wantBody string) {
+		t.Helper()
+		httpRequest := httptest.NewRequest(method, target, strings.NewReader(reqBody))
+		if contentDigest != "" {
+			httpRequest.Header.Set("Content-Digest", contentDigest)
+		}
+		responseRecorder := httptest.NewRecorder()
+		httpHandler(config).ServeHTTP(responseRecorder, httpRequest)
+		assertHttpResponse(t, responseRecorder.Result(), wantStatus, wantBody)
+	}
+
+	t.Run("get file checksums", func(t *testing.T) {
+		mustMakeContentRoot(t)
+		defer mustDeleteContentRoot(t)
+
+		mustWriteFile(t, []byte("hello\n"), "/file.txt", 0644)
+		runTest(t, newConfig(ContentRoot), http.MethodGet, "/file.txt?checksum=sha256,md5,crc32c", "", "", http.StatusOK, `{
+          "status": "ok",
+          "type": "file",
+          "file": {
+            "name": "file.txt",
+            "path": "/file.txt",
+            "mime_type": "text/plain; charset=utf-8",
+            "owner": "0",
+            "group": "0",
+            "size": 6,
+            "permissions": "0644",
+            "checksums": {
+              "crc32c": "353dd8be",
+              "md5": "b1946ac92492d2347c6235b4d2611184",
+              "sha256": "5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03"
+            },
+            "contents": "hello\n"
+          }
+        }`)
+	})
+
+	t.Run("unsupported algorithm", func(t *testing.T) {
+		mustMakeContentRoot(t)
+		defer mustDeleteContentRoot(t)
+
+		mustWriteFile(t, []byte("hello\n"), "/file.txt", 0644)
+		runTest(t, newConfig(ContentRoot), http.MethodGet, "/file.txt?checksum=sha3", "", "", http.StatusBadRequest, `{
+          "status": "error",
+          "type": "error",
+          "error": {
+            "code": 400,
+            "error": "unsupported checksum algorithm \"sha3\""
+          }
+        }`)
+	})
+
+	t.Run("cached checksums are invalidated by writes", func(t *testing.T) {
+		mustMakeContentRoot(t)
+		defer mustDeleteContentRoot(t)
+
+		for _, cache := range []string{ChecksumCacheXattr, ChecksumCacheSidecar} {
+			config := newConfig(ContentRoot)
+			config.ChecksumCache = cache
+			config.ChecksumCacheDir = t.TempDir()
+			fileName := path.Join(ContentRoot, "/file.txt")
+
+			mustWriteFile(t, []byte("stale\n"), "/file.txt", 0644)
+			if _, err := fileChecksums(config, "/file.txt", []string{"md5"}); err != nil {
+				t.Fatal(err)
+			}
+			info, err := os.Stat(fileName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := cachedChecksum(config, "/file.txt", info, "md5"); !ok {
+				t.Errorf("%s: checksum was not cached", cache)
+			}
+
+			mustWriteFile(t, []byte("hello\n"), "/file.txt", 0644)
+			later := info.ModTime().Add(time.Second)
+			if err := os.Chtimes(fileName, later, later); err != nil {
+				t.Fatal(err)
+			}
+			checksums, err := fileChecksums(config, "/file.txt", []string{"md5"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want, got := "b1946ac92492d2347c6235b4d2611184", checksums["md5"]; want != got {
+				t.Errorf("%s: want md5 %s, got %s", cache, want, got)
+			}
+		}
+	})
+
+	t.Run("cached checksums are hidden", func(t *testing.T) {
+		mustMakeContentRoot(t)
+		defer mustDeleteContentRoot(t)
+
+		for _, cache := range []string{ChecksumCacheXattr, ChecksumCacheSidecar} {
+			config := newConfig(ContentRoot)
+			config.ChecksumCache = cache
+			config.ChecksumCacheDir = t.TempDir()
+
+			mustWriteFile(t, []byte("hello\n"), "/file.txt", 0644)
+			if _, err := fileChecksums(config, "/file.txt", []string{"md5"}); err != nil {
+				t.Fatal(err)
+			}
+			runTest(t, config, http.MethodGet, "/?xattrs=true", "", "", http.StatusOK, `{
+			  "status": "ok",
+			  "type": "directory",
+			  "directory": {
+				"name": "/",
+				"path": "/",
+				"owner": "0",
+				"group": "0",
+				"size": 4096,
+				"permissions": "0700",
+				"entries": [
+				  {"name": "file.txt", "path": "/file.txt", "type": "file", "owner": "0", "group": "0", "permissions": "0644", "size": 6, "mime_type": "text/plain; charset=utf-8"}
+				]
+			  }
+			}`)
+
+			runTest(t, config, http.MethodDelete, "/file.txt", "", "", http.StatusOK, `{"status": "ok", "type": "deleted"}`)
+			if entries, err := os.ReadDir(config.ChecksumCacheDir); err != nil || len(entries) != 0 {
+				t.Errorf("%s: got %d cached checksums after a delete, %v", cache, len(entries), err)
+			}
+		}
+	})
+
+	t.Run("put with mismatched sha256", func(t *testing.T) {
+		mustMakeContentRoot(t)
+		defer mustDeleteContentRoot(t)
+
+		runTest(t, newConfig(ContentRoot), http.MethodPut, "/file.txt", "",
+			`{"permissions": "0600", "contents": "hello\n", "sha256": "00"}`,
+			http.StatusBadRequest,
+			`{
+			  "status": "error",
+			  "type": "error",
+			  "error": {
+				"code": 400,
+				"error": "test/file.txt: checksum mismatch: want sha256 00, got 5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03"
+			  }
+			}`)
+		assertFileDoesNotExists(t, "/file.txt")
+	})
+
+	t.Run("post with mismatched sha256", func(t *testing.T) {
+		mustMakeContentRoot(t)
+		defer mustDeleteContentRoot(t)
+
+		runTest(t, newConfig(ContentRoot), http.MethodPost, "/", "",
+			`[
+			  {"name": "a.txt", "permissions": "0600", "contents": "hello\n", "sha256": "5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03"},
+			  {"name": "b.txt", "permissions": "0600", "contents": "hello\n", "sha256": "00"}
+			]`,
+			http.StatusBadRequest,
+			`{
+			  "status": "error",
+			  "type": "error",
+			  "error": {
+				"code": 400,
+				"error": "test/b.txt: checksum mismatch: want sha256 00, got 5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03"
+			  }
+			}`)
+		assertFileDoesNotExists(t, "/a.txt")
+	})
+
+	t.Run("put with content digest", func(t *testing.T) {
+		mustMakeContentRoot(t)
+		defer mustDeleteContentRoot(t)
+
+		runTest(t, newConfig(ContentRoot), http.MethodPut, "/file.txt",
+			"sha-256=:Ovp26SxwWp6TGIcTqxaAFDoxQm31zMrBAHQiDcRfEpc=:",
+			`{"permissions": "0600", "contents": "hello\n"}`,
+			http.StatusOK,
+			`{
+			  "status": "ok",
+			  "type": "file",
+			  "file": {
+				"name": "file.txt",
+				"path": "/file.txt",
+				"mime_type": "text/plain; charset=utf-8",
+				"owner": "0",
+				"group": "0",
+				"permissions": "0600",
+				"size": 6,
+				"contents": "hello\n"
+			  }
+			}`)
+		assertFileContents(t, "/file.txt", 0600, "hello\n")
+	})
+
+	t.Run("put with mismatched content digest", func(t *testing.T) {
+		mustMakeContentRoot(t)
+		defer mustDeleteContentRoot(t)
+
+		runTest(t, newConfig(ContentRoot), http.MethodPut, "/file.txt",
+			"sha-256=:Ovp26SxwWp6TGIcTqxaAFDoxQm31zMrBAHQiDcRfEpc=:",
+			`{"permissions": "0600", "contents": "goodbye\n"}`,
+			http.StatusBadRequest,
+			`{
+			  "status": "error",
+			  "type": "error",
+			  "error": {
+				"code": 400,
+				"error": "checksum mismatch: want sha-256 Ovp26SxwWp6TGIcTqxaAFDoxQm31zMrBAHQiDcRfEpc=, got vBSUjTXyn2l4s41zG1Klga7xLPxLpx9wKA12KpLOvJA="
+			  }
+			}`)
+		assertFileDoesNotExists(t, "/file.txt")
+	})
+
+	t.Run("content digest of a get is ignored", func(t *testing.T) {
+		mustMakeContentRoot(t)
+		defer mustDeleteContentRoot(t)
+
+		mustWriteFile(t, []byte("hello\n"), "/file.txt", 0644)
+		httpRequest := httptest.NewRequest(http.MethodGet, "/file.txt", strings.NewReader("ignored"))
+		httpRequest.Header.Set("Content-Digest", "sha-256=:Ovp26SxwWp6TGIcTqxaAFDoxQm31zMrBAHQiDcRfEpc=:")
+		responseRecorder := httptest.NewRecorder()
+		httpHandler(newConfig(ContentRoot)).ServeHTTP(responseRecorder, httpRequest)
+		if code := responseRecorder.Result().StatusCode; code != http.StatusOK {
+			t.Errorf("got status %d", code)
+		}
+	})
+
+	t.Run("put with a content digest and a large body", func(t *testing.T) {
+		mustMakeContentRoot(t)
+		defer mustDeleteContentRoot(t)
+
+		runTest(t, newConfig(ContentRoot), http.MethodPut, "/file.txt",
+			"sha-256=:Ovp26SxwWp6TGIcTqxaAFDoxQm31zMrBAHQiDcRfEpc=:",
+			`{"permissions": "0600", "contents": "`+strings.Repeat("a", contentDigestMaxSize)+`"}`,
+			http.StatusRequestEntityTooLarge,
+			`{
+			  "status": "error",
+			  "type": "error",
+			  "error": {
+				"code": 413,
+				"error": "bodies with a Content-Digest can't be larger than 33554432 bytes"
+			  }
+			}`)
+		assertFileDoesNotExists(t, "/file.txt")
+	})
+}
+
+func TestLoadConfigWithChecksumCache(t *testing.T) {
+	for _, test := range []struct {
+		cache, dir string
+		valid      bool
+	}{
+		{"xattr", "", true},
+		{"sidecar", t.TempDir(), true},
+		{"sidecar", "", false},
+		{"sidecar", path.Join(ContentRoot, "checksums"), false},
+		{"disk", "", false},
+	} {
+		t.Setenv("FILE_SERVER_CONTENT_ROOT", ContentRoot)
+		t.Setenv("FILE_SERVER_CHECKSUM_CACHE", test.cache)
+		t.Setenv("FILE_SERVER_CHECKSUM_CACHE_DIR", test.dir)
+		if _, err := loadConfig(); (err == nil) != test.valid {
+			t.Errorf("got error %v for %q in %q", err, test.cache, test.dir)
+		}
+	}
+}
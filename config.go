@@ -0,0 +1,362 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds the server settings. Use newConfig for the defaults.
+type Config struct {
+	ListenAddress string
+	ContentRoot   string
+	// Storage holds the content. It is the ContentRoot directory on disk
+	// unless another storage is configured, in which case the ContentRoot
+	// only names it in errors.
+	Storage Storage
+	// ObjectStore is the bucket of the StorageObject storage.
+	ObjectStore ObjectStore
+	// OverlayLowerDirs are the directories under the ContentRoot of the
+	// StorageOverlay storage, from the top down.
+	OverlayLowerDirs []string
+	// CASDir keeps the contents of the files of the StorageCAS storage.
+	CASDir string
+	// MemoryMaxSize limits the size of the files of the StorageMemory
+	// storage in bytes, if not zero.
+	MemoryMaxSize int64
+	// EncryptionKeyFile has the master keys the Storage is encrypted with,
+	// if set.
+	EncryptionKeyFile string
+	// Compression compresses the files of the Storage with CompressionGzip or
+	// CompressionZstd, if set. CompressionPaths are globs of the files to
+	// compress, or all of them if empty.
+	Compression      string
+	CompressionPaths []string
+	// SnapshotDir keeps the snapshots of the content directory, if set.
+	SnapshotDir string
+	// Mounts are served under their paths by the http apis instead of the
+	// Storage when set.
+	Mounts []Mount
+	// MountPath is the url path of the mount the apis are served for, which
+	// the paths they return are under.
+	MountPath string
+	// XattrNamespaces are the extended attribute namespaces, like "user",
+	// that may be read and written through the api.
+	XattrNamespaces []string
+	// ChecksumCache is where computed checksums are cached: ChecksumCacheNone,
+	// ChecksumCacheXattr or ChecksumCacheSidecar.
+	ChecksumCache string
+	// ChecksumCacheDir keeps the checksums cached with ChecksumCacheSidecar,
+	// outside the content directory.
+	ChecksumCacheDir string
+	// MimeTypesFile is an optional mime.types file with extra extensions.
+	MimeTypesFile string
+	// WatchPolling forces watching for changes by polling instead of inotify.
+	WatchPolling      bool
+	WatchPollInterval time.Duration
+	// ExpirySweepInterval is how often expired files are removed. They are
+	// never removed if it is zero.
+	ExpirySweepInterval time.Duration
+	// Webhooks are sent the matching change events.
+	Webhooks []Webhook
+	// WebhookQueueDir keeps pending deliveries across restarts when set.
+	WebhookQueueDir string
+	// WebhookMaxAttempts is how many times a delivery is attempted before it
+	// fails. WebhookBackoff is the delay after the first failed attempt, and
+	// doubles with each following one.
+	WebhookMaxAttempts int
+	WebhookBackoff     time.Duration
+	// Hooks are local commands run before and after changes.
+	Hooks []Hook
+	// HookTimeout is how long a hook may run before it is killed, and
+	// HookConcurrency is how many hooks may run at once.
+	HookTimeout     time.Duration
+	HookConcurrency int
+	// WebSocketOrigins are the origins of the pages of other hosts that may
+	// open the websocket, like "https://app.example.com".
+	WebSocketOrigins []string
+	// WebDAV serves the content root over WebDAV under davPath.
+	WebDAV bool
+	// S3ListenAddress serves the S3 compatible api when set. Requests must be
+	// signed with one of the S3Credentials. S3UploadDir holds the parts of
+	// multipart uploads.
+	S3ListenAddress string
+	S3Credentials   []S3Credential
+	S3UploadDir     string
+	// GRPCListenAddress serves the gRPC service when set.
+	GRPCListenAddress string
+	// SFTPListenAddress serves the content root over SFTP when set, to the
+	// clients whose public keys are in SFTPAuthorizedKeysFile.
+	SFTPListenAddress      string
+	SFTPHostKeyFile        string
+	SFTPAuthorizedKeysFile string
+}
+
+func newConfig(contentRoot string) Config {
+	return Config{
+		ListenAddress:      "localhost:8080",
+		ContentRoot:        contentRoot,
+		Storage:            newDiskStorage(contentRoot),
+		XattrNamespaces:    []string{"user"},
+		WatchPollInterval:  2 * time.Second,
+		WebhookMaxAttempts: 10,
+		WebhookBackoff:     time.Second,
+		HookTimeout:        30 * time.Second,
+		HookConcurrency:    4,
+		MemoryMaxSize:      1 << 30,
+		S3UploadDir:        filepath.Join(os.TempDir(), "file-server-s3-uploads"),
+		ObjectStore:        ObjectStore{Region: "us-east-1"},
+	}
+}
+
+// loadConfig reads the config from FILE_SERVER_* environment variables.
+func loadConfig() (Config, error) {
+	config := newConfig(".")
+	if v := os.Getenv("FILE_SERVER_CONTENT_ROOT"); v != "" {
+		config.ContentRoot = v
+		config.Storage = newDiskStorage(v)
+	}
+	if v := os.Getenv("FILE_SERVER_OBJECT_STORE_ENDPOINT"); v != "" {
+		config.ObjectStore.Endpoint = v
+	}
+	if v := os.Getenv("FILE_SERVER_OBJECT_STORE_REGION"); v != "" {
+		config.ObjectStore.Region = v
+	}
+	if v := os.Getenv("FILE_SERVER_OBJECT_STORE_BUCKET"); v != "" {
+		config.ObjectStore.Bucket = v
+	}
+	if v := os.Getenv("FILE_SERVER_OBJECT_STORE_PREFIX"); v != "" {
+		config.ObjectStore.Prefix = v
+	}
+	if v := os.Getenv("FILE_SERVER_OBJECT_STORE_ACCESS_KEY_ID"); v != "" {
+		config.ObjectStore.AccessKeyID = v
+	}
+	if v := os.Getenv("FILE_SERVER_OBJECT_STORE_SECRET_ACCESS_KEY"); v != "" {
+		config.ObjectStore.SecretAccessKey = v
+	}
+	if v := os.Getenv("FILE_SERVER_OVERLAY_LOWER"); v != "" {
+		config.OverlayLowerDirs = splitList(v)
+	}
+	if v := os.Getenv("FILE_SERVER_CAS_DIR"); v != "" {
+		config.CASDir = v
+	}
+	if v := os.Getenv("FILE_SERVER_MEMORY_MAX_SIZE"); v != "" {
+		size, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || size < 0 {
+			return config, fmt.Errorf("FILE_SERVER_MEMORY_MAX_SIZE: invalid size %q", v)
+		}
+		config.MemoryMaxSize = size
+	}
+	if v := os.Getenv("FILE_SERVER_STORAGE"); v != "" {
+		storage, err := newStorage(v, config)
+		if err != nil {
+			return config, fmt.Errorf("FILE_SERVER_STORAGE: %v", err)
+		}
+		config.Storage = storage
+	}
+	if v := os.Getenv("FILE_SERVER_ENCRYPTION_KEY_FILE"); v != "" {
+		config.EncryptionKeyFile = v
+		storage, err := newEncryptedStorageFromKeyFile(config.Storage, config.ContentRoot, v)
+		if err != nil {
+			return config, fmt.Errorf("FILE_SERVER_ENCRYPTION_KEY_FILE: %v", err)
+		}
+		config.Storage = storage
+	}
+	if v := os.Getenv("FILE_SERVER_COMPRESSION_PATHS"); v != "" {
+		config.CompressionPaths = splitList(v)
+	}
+	if v := os.Getenv("FILE_SERVER_COMPRESSION"); v != "" {
+		config.Compression = v
+		// The files are compressed before they are encrypted.
+		storage, err := newCompressedStorage(config.Storage, config.ContentRoot, v, config.CompressionPaths)
+		if err != nil {
+			return config, fmt.Errorf("FILE_SERVER_COMPRESSION: %v", err)
+		}
+		config.Storage = storage
+	}
+	if v := os.Getenv("FILE_SERVER_SNAPSHOT_DIR"); v != "" {
+		if err := checkSnapshotDir(v, config.ContentRoot, config.Storage); err != nil {
+			return config, fmt.Errorf("FILE_SERVER_SNAPSHOT_DIR: %v", err)
+		}
+		config.SnapshotDir = v
+	}
+	if v := os.Getenv("FILE_SERVER_MOUNTS"); v != "" {
+		mounts, err := loadMounts(v, config)
+		if err != nil {
+			return config, fmt.Errorf("FILE_SERVER_MOUNTS: %v", err)
+		}
+		config.Mounts = mounts
+	}
+	if v := os.Getenv("FILE_SERVER_LISTEN_ADDRESS"); v != "" {
+		config.ListenAddress = v
+	}
+	if v, ok := os.LookupEnv("FILE_SERVER_XATTR_NAMESPACES"); ok {
+		config.XattrNamespaces = splitList(v)
+	}
+	if v := os.Getenv("FILE_SERVER_CHECKSUM_CACHE"); v != "" {
+		switch v {
+		case ChecksumCacheXattr, ChecksumCacheSidecar:
+		default:
+			return config, fmt.Errorf("FILE_SERVER_CHECKSUM_CACHE: unknown checksum cache %q", v)
+		}
+		config.ChecksumCache = v
+	}
+	config.ChecksumCacheDir = os.Getenv("FILE_SERVER_CHECKSUM_CACHE_DIR")
+	if config.ChecksumCache == ChecksumCacheSidecar && config.ChecksumCacheDir == "" {
+		return config, fmt.Errorf("FILE_SERVER_CHECKSUM_CACHE_DIR: must be set with FILE_SERVER_CHECKSUM_CACHE=sidecar")
+	}
+	if config.ChecksumCacheDir != "" {
+		absDir, err := filepath.Abs(config.ChecksumCacheDir)
+		if err != nil {
+			return config, fmt.Errorf("FILE_SERVER_CHECKSUM_CACHE_DIR: %v", err)
+		}
+		absRoot, err := filepath.Abs(config.ContentRoot)
+		if err != nil {
+			return config, fmt.Errorf("FILE_SERVER_CHECKSUM_CACHE_DIR: %v", err)
+		}
+		if rel, err := filepath.Rel(absRoot, absDir); err == nil && rel != ".." && !strings.HasPrefix(rel, "../") {
+			return config, fmt.Errorf("FILE_SERVER_CHECKSUM_CACHE_DIR: %s is in the content directory", config.ChecksumCacheDir)
+		}
+	}
+	if v := os.Getenv("FILE_SERVER_MIME_TYPES"); v != "" {
+		config.MimeTypesFile = v
+	}
+	if v := os.Getenv("FILE_SERVER_WATCH_POLLING"); v != "" {
+		config.WatchPolling = v == "true"
+	}
+	if v := os.Getenv("FILE_SERVER_WATCH_POLL_INTERVAL"); v != "" {
+		interval, err := time.ParseDuration(v)
+		if err != nil {
+			return config, fmt.Errorf("FILE_SERVER_WATCH_POLL_INTERVAL: %v", err)
+		}
+		config.WatchPollInterval = interval
+	}
+	if v := os.Getenv("FILE_SERVER_EXPIRY_SWEEP_INTERVAL"); v != "" {
+		interval, err := time.ParseDuration(v)
+		if err != nil {
+			return config, fmt.Errorf("FILE_SERVER_EXPIRY_SWEEP_INTERVAL: %v", err)
+		}
+		config.ExpirySweepInterval = interval
+	}
+	if v := os.Getenv("FILE_SERVER_WEBHOOKS"); v != "" {
+		webhooks, err := loadWebhooks(v)
+		if err != nil {
+			return config, fmt.Errorf("FILE_SERVER_WEBHOOKS: %v", err)
+		}
+		config.Webhooks = webhooks
+	}
+	if v := os.Getenv("FILE_SERVER_WEBHOOK_QUEUE"); v != "" {
+		config.WebhookQueueDir = v
+	}
+	if v := os.Getenv("FILE_SERVER_WEBHOOK_MAX_ATTEMPTS"); v != "" {
+		attempts, err := strconv.Atoi(v)
+		if err != nil || attempts < 1 {
+			return config, fmt.Errorf("FILE_SERVER_WEBHOOK_MAX_ATTEMPTS: invalid number of attempts %q", v)
+		}
+		config.WebhookMaxAttempts = attempts
+	}
+	if v := os.Getenv("FILE_SERVER_WEBHOOK_BACKOFF"); v != "" {
+		backoff, err := time.ParseDuration(v)
+		if err != nil {
+			return config, fmt.Errorf("FILE_SERVER_WEBHOOK_BACKOFF: %v", err)
+		}
+		config.WebhookBackoff = backoff
+	}
+	if v := os.Getenv("FILE_SERVER_WEBSOCKET_ORIGINS"); v != "" {
+		config.WebSocketOrigins = splitList(v)
+	}
+	if v := os.Getenv("FILE_SERVER_WEBDAV"); v != "" {
+		config.WebDAV = v == "true"
+	}
+	if v := os.Getenv("FILE_SERVER_S3_LISTEN_ADDRESS"); v != "" {
+		config.S3ListenAddress = v
+	}
+	if v := os.Getenv("FILE_SERVER_S3_CREDENTIALS"); v != "" {
+		credentials, err := loadS3Credentials(v)
+		if err != nil {
+			return config, fmt.Errorf("FILE_SERVER_S3_CREDENTIALS: %v", err)
+		}
+		config.S3Credentials = credentials
+	}
+	if config.S3ListenAddress != "" && len(config.S3Credentials) == 0 {
+		return config, fmt.Errorf("FILE_SERVER_S3_CREDENTIALS: required to serve the S3 api")
+	}
+	if v := os.Getenv("FILE_SERVER_S3_UPLOADS"); v != "" {
+		config.S3UploadDir = v
+	}
+	if v := os.Getenv("FILE_SERVER_GRPC_LISTEN_ADDRESS"); v != "" {
+		config.GRPCListenAddress = v
+	}
+	if v := os.Getenv("FILE_SERVER_SFTP_LISTEN_ADDRESS"); v != "" {
+		config.SFTPListenAddress = v
+	}
+	if v := os.Getenv("FILE_SERVER_SFTP_HOST_KEY"); v != "" {
+		config.SFTPHostKeyFile = v
+	}
+	if v := os.Getenv("FILE_SERVER_SFTP_AUTHORIZED_KEYS"); v != "" {
+		config.SFTPAuthorizedKeysFile = v
+	}
+	if config.SFTPListenAddress != "" && config.SFTPHostKeyFile == "" {
+		return config, fmt.Errorf("FILE_SERVER_SFTP_HOST_KEY: required to serve sftp")
+	}
+	if config.SFTPListenAddress != "" && config.SFTPAuthorizedKeysFile == "" {
+		return config, fmt.Errorf("FILE_SERVER_SFTP_AUTHORIZED_KEYS: required to serve sftp")
+	}
+	// The other apis serve the Storage, which isn't served over http with
+	// mounts, and would otherwise ignore the modes and limits of the mounts.
+	if len(config.Mounts) > 0 {
+		for _, name := range []string{"FILE_SERVER_S3_LISTEN_ADDRESS", "FILE_SERVER_GRPC_LISTEN_ADDRESS", "FILE_SERVER_SFTP_LISTEN_ADDRESS"} {
+			if os.Getenv(name) != "" {
+				return config, fmt.Errorf("%s: can't be set with FILE_SERVER_MOUNTS", name)
+			}
+		}
+	}
+	if v := os.Getenv("FILE_SERVER_HOOKS"); v != "" {
+		hooks, err := loadHooks(v)
+		if err != nil {
+			return config, fmt.Errorf("FILE_SERVER_HOOKS: %v", err)
+		}
+		config.Hooks = hooks
+	}
+	if v := os.Getenv("FILE_SERVER_HOOK_TIMEOUT"); v != "" {
+		timeout, err := time.ParseDuration(v)
+		if err != nil {
+			return config, fmt.Errorf("FILE_SERVER_HOOK_TIMEOUT: %v", err)
+		}
+		config.HookTimeout = timeout
+	}
+	if v := os.Getenv("FILE_SERVER_HOOK_CONCURRENCY"); v != "" {
+		concurrency, err := strconv.Atoi(v)
+		if err != nil || concurrency < 1 {
+			return config, fmt.Errorf("FILE_SERVER_HOOK_CONCURRENCY: invalid concurrency %q", v)
+		}
+		config.HookConcurrency = concurrency
+	}
+	return config, nil
+}
+
+// urlPath returns the url path clients see for a path of the storage.
+func (x Config) urlPath(name string) string {
+	switch {
+	case x.MountPath == "":
+		return name
+	case name == "/":
+		return x.MountPath
+	default:
+		return x.MountPath + name
+	}
+}
+
+// splitList splits a comma separated list, dropping empty items.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
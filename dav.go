@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+// davPath is the prefix the WebDAV endpoint is served under instead of content.
+const davPath = "/.dav"
+
+// davNamespace is the xml namespace of the FileMeta properties.
+const davNamespace = "urn:file-server:"
+
+// davXattrPrefix prefixes the extended attributes that hold dead properties.
+// The rest of the name is the property name in {namespace}local form.
+const davXattrPrefix = "user.file-server.dav."
+
+func isDavRequest(r *http.Request) bool {
+	return r.URL.Path == davPath || strings.HasPrefix(r.URL.Path, davPath+"/")
+}
+
+// newDavHandler returns a WebDAV handler for the content root.
+func newDavHandler(config Config, hooks *Hooks) http.Handler {
+	return &webdav.Handler{
+		Prefix:     davPath,
+		FileSystem: davFileSystem{config: config, hooks: hooks},
+		LockSystem: webdav.NewMemLS(),
+	}
+}
+
+// davFileSystem is the content root as a webdav.FileSystem. It runs the same
+// hooks as the json api, and its files hold the FileMeta fields and any dead
+// properties.
+type davFileSystem struct {
+	config Config
+	hooks  *Hooks
+}
+
+func (x davFileSystem) fileName(name string) string {
+	return path.Join(x.config.ContentRoot, path.Clean("/"+name))
+}
+
+func (x davFileSystem) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	return x.config.Storage.Mkdir(name, perm)
+}
+
+func (x davFileSystem) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	urlPath := path.Clean("/" + name)
+	fileName := x.fileName(name)
+
+	// Puts and copies are buffered so that the pre-hooks can check them
+	// before they land.
+	if flag&(os.O_CREATE|os.O_TRUNC) == os.O_CREATE|os.O_TRUNC {
+		event := HookEvent{Operation: HookOperationPut, URLPath: urlPath, FileName: fileName, Permissions: perm}
+		if x.hooks.any(event) {
+			if info, err := x.config.Storage.Stat(urlPath); err == nil && info.IsDir() {
+				return nil, os.ErrExist
+			}
+			if _, err := x.config.Storage.Stat(path.Dir(urlPath)); err != nil {
+				return nil, err
+			}
+			return &davUpload{storage: x.config.Storage, hooks: x.hooks, event: event}, nil
+		}
+	}
+
+	// Properties are patched through files opened for writing, which fails
+	// for directories.
+	if flag == os.O_RDWR {
+		if info, err := x.config.Storage.Stat(urlPath); err == nil && info.IsDir() {
+			flag = os.O_RDONLY
+		}
+	}
+
+	f, err := x.config.Storage.OpenFile(urlPath, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &davFile{File: f, config: x.config, name: urlPath}, nil
+}
+
+// RemoveAll and Rename refuse the root, as webdav.Dir does.
+func (x davFileSystem) RemoveAll(ctx context.Context, name string) error {
+	urlPath := path.Clean("/" + name)
+	if urlPath == "/" {
+		return os.ErrInvalid
+	}
+	event := HookEvent{
+		Operation: HookOperationDelete,
+		URLPath:   urlPath,
+		FileName:  x.fileName(name),
+		Recursive: true,
+	}
+	if err := x.hooks.Pre(event, nil); err != nil {
+		log.Println(err)
+		return err
+	}
+	if err := x.config.Storage.RemoveAll(urlPath); err != nil {
+		return err
+	}
+	forgetChecksums(x.config, urlPath)
+	x.hooks.Post(event, nil)
+	return nil
+}
+
+func (x davFileSystem) Rename(ctx context.Context, oldName, newName string) error {
+	oldURLPath, urlPath := path.Clean("/"+oldName), path.Clean("/"+newName)
+	if oldURLPath == "/" || urlPath == "/" {
+		return os.ErrInvalid
+	}
+	err := renameFile(x.config, x.hooks, oldURLPath, urlPath)
+	var hookErr *HookError
+	if errors.As(err, &hookErr) {
+		log.Println(err)
+	}
+	return err
+}
+
+func (x davFileSystem) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	return x.config.Storage.Stat(name)
+}
+
+// davFile holds the owner, group and permissions as properties in the
+// davNamespace, and other dead properties in extended attributes. Only the
+// permissions of the davNamespace properties can be changed.
+type davFile struct {
+	webdav.File
+	config Config
+	name   string
+}
+
+// Readdir leaves out temporary files.
+func (x *davFile) Readdir(count int) ([]os.FileInfo, error) {
+	infos, err := x.File.Readdir(count)
+	listed := infos[:0]
+	for _, info := range infos {
+		if !isTempFileName(info.Name()) {
+			listed = append(listed, info)
+		}
+	}
+	return listed, err
+}
+
+func (x *davFile) DeadProps() (map[xml.Name]webdav.Property, error) {
+	info, err := x.Stat()
+	if err != nil {
+		return nil, err
+	}
+	meta := NewFileMeta(x.name, info)
+	props := map[xml.Name]webdav.Property{}
+	for local, value := range map[string]string{
+		"owner":       meta.Owner,
+		"group":       meta.Group,
+		"permissions": meta.Permissions,
+	} {
+		name := xml.Name{Space: davNamespace, Local: local}
+		props[name] = webdav.Property{XMLName: name, InnerXML: []byte(value)}
+	}
+
+	if !xattrAllowed(davXattrPrefix, x.config.XattrNamespaces) {
+		return props, nil
+	}
+	names, err := x.config.Storage.ListXattrs(x.name)
+	if errors.Is(err, errXattrUnsupported) || errors.Is(err, syscall.ENOTSUP) {
+		return props, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, xattr := range names {
+		name, ok := davPropertyName(xattr)
+		if !ok {
+			continue
+		}
+		value, err := x.config.Storage.GetXattr(x.name, xattr)
+		if err != nil {
+			return nil, err
+		}
+		props[name] = webdav.Property{XMLName: name, InnerXML: value}
+	}
+	return props, nil
+}
+
+// Patch checks all the patches before applying any of them. Setting the
+// owner or group to what they already are is allowed, so that copies keep
+// their properties.
+func (x *davFile) Patch(patches []webdav.Proppatch) ([]webdav.Propstat, error) {
+	info, err := x.Stat()
+	if err != nil {
+		return nil, err
+	}
+	meta := NewFileMeta(x.name, info)
+
+	ok := webdav.Propstat{Status: http.StatusOK}
+	forbidden := webdav.Propstat{Status: http.StatusForbidden}
+	for _, patch := range patches {
+		for _, prop := range patch.Props {
+			if x.canPatch(meta, prop, patch.Remove) {
+				ok.Props = append(ok.Props, webdav.Property{XMLName: prop.XMLName})
+			} else {
+				forbidden.Props = append(forbidden.Props, webdav.Property{XMLName: prop.XMLName})
+			}
+		}
+	}
+	if len(forbidden.Props) > 0 {
+		failed := webdav.Propstat{Status: webdav.StatusFailedDependency, Props: ok.Props}
+		if len(failed.Props) == 0 {
+			return []webdav.Propstat{forbidden}, nil
+		}
+		return []webdav.Propstat{forbidden, failed}, nil
+	}
+
+	for _, patch := range patches {
+		for _, prop := range patch.Props {
+			if err := x.patch(prop, patch.Remove); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return []webdav.Propstat{ok}, nil
+}
+
+func (x *davFile) canPatch(meta FileMeta, prop webdav.Property, remove bool) bool {
+	if prop.XMLName.Space != davNamespace {
+		return xattrAllowed(davXattrPrefix, x.config.XattrNamespaces)
+	}
+	value := string(prop.InnerXML)
+	switch {
+	case remove:
+		return false
+	case prop.XMLName.Local == "owner":
+		return value == meta.Owner
+	case prop.XMLName.Local == "group":
+		return value == meta.Group
+	case prop.XMLName.Local == "permissions":
+		_, err := strconv.ParseUint(value, 8, 32)
+		return err == nil
+	default:
+		return false
+	}
+}
+
+func (x *davFile) patch(prop webdav.Property, remove bool) error {
+	switch {
+	case prop.XMLName.Space != davNamespace:
+		break
+	case prop.XMLName.Local == "permissions":
+		perms, _ := strconv.ParseUint(string(prop.InnerXML), 8, 32)
+		return x.config.Storage.Chmod(x.name, os.FileMode(perms))
+	default:
+		// The owner and group are unchanged.
+		return nil
+	}
+
+	xattr := davXattrPrefix + "{" + prop.XMLName.Space + "}" + prop.XMLName.Local
+	if remove {
+		return x.config.Storage.RemoveXattr(x.name, xattr)
+	}
+	return x.config.Storage.SetXattr(x.name, xattr, prop.InnerXML)
+}
+
+// davPropertyName parses the property name of a dead property xattr.
+func davPropertyName(xattr string) (xml.Name, bool) {
+	if !strings.HasPrefix(xattr, davXattrPrefix+"{") {
+		return xml.Name{}, false
+	}
+	name := strings.TrimPrefix(xattr, davXattrPrefix+"{")
+	i := strings.LastIndex(name, "}")
+	if i < 0 {
+		return xml.Name{}, false
+	}
+	return xml.Name{Space: name[:i], Local: name[i+1:]}, true
+}
+
+// davUpload buffers the contents of a put, and writes them on Close if the
+// pre-hooks pass.
+type davUpload struct {
+	storage  Storage
+	hooks    *Hooks
+	event    HookEvent
+	contents bytes.Buffer
+}
+
+func (x *davUpload) Write(p []byte) (int, error) {
+	return x.contents.Write(p)
+}
+
+func (x *davUpload) Close() error {
+	x.event.Size = x.contents.Len()
+	if err := x.hooks.Pre(x.event, x.contents.Bytes()); err != nil {
+		log.Println(err)
+		return err
+	}
+	if err := writeFile(x.storage, x.event.URLPath, x.contents.Bytes(), x.event.Permissions); err != nil {
+		return err
+	}
+	x.hooks.Post(x.event, x.contents.Bytes())
+	return nil
+}
+
+func (x *davUpload) Stat() (os.FileInfo, error) {
+	return davUploadInfo{x}, nil
+}
+
+func (x *davUpload) Read(p []byte) (int, error) {
+	return 0, fmt.Errorf("%s is write only", x.event.URLPath)
+}
+
+func (x *davUpload) Seek(offset int64, whence int) (int64, error) {
+	return 0, fmt.Errorf("%s is write only", x.event.URLPath)
+}
+
+func (x *davUpload) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, fmt.Errorf("%s is not a directory", x.event.URLPath)
+}
+
+// davUploadInfo describes the buffered contents of an upload.
+type davUploadInfo struct {
+	upload *davUpload
+}
+
+func (x davUploadInfo) Name() string       { return path.Base(x.upload.event.URLPath) }
+func (x davUploadInfo) Size() int64        { return int64(x.upload.contents.Len()) }
+func (x davUploadInfo) Mode() os.FileMode  { return x.upload.event.Permissions }
+func (x davUploadInfo) ModTime() time.Time { return time.Now() }
+func (x davUploadInfo) IsDir() bool        { return false }
+func (x davUploadInfo) Sys() interface{}   { return nil }
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// davStep is one request of a litmus style sequence.
+type davStep struct {
+	name       string
+	method     string
+	target     string
+	headers    map[string]string
+	body       string
+	wantStatus int
+	// wantBody are substrings of the response body.
+	wantBody []string
+}
+
+func TestWebDAV(t *testing.T) {
+	runSteps := func(t *testing.T, config Config, steps []davStep) {
+		t.Helper()
+		mustMakeContentRoot(t)
+		defer mustDeleteContentRoot(t)
+
+		server := httptest.NewServer(httpHandler(config))
+		defer server.Close()
+
+		var lockToken string
+		for _, step := range steps {
+			req, err := http.NewRequest(step.method, server.URL+step.target, strings.NewReader(step.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for key, value := range step.headers {
+				value = strings.ReplaceAll(value, "SERVER", server.URL)
+				value = strings.ReplaceAll(value, "TOKEN", lockToken)
+				req.Header.Set(key, value)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, err := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if resp.StatusCode != step.wantStatus {
+				t.Fatalf("%s: want status %d, got %d: %s", step.name, step.wantStatus, resp.StatusCode, body)
+			}
+			for _, want := range step.wantBody {
+				if !strings.Contains(string(body), want) {
+					t.Errorf("%s: want body containing %q, got %s", step.name, want, body)
+				}
+			}
+			if token := resp.Header.Get("Lock-Token"); token != "" {
+				lockToken = token
+			}
+		}
+	}
+
+	config := newConfig(ContentRoot)
+	config.WebDAV = true
+
+	t.Run("basic", func(t *testing.T) {
+		runSteps(t, config, []davStep{
+			{name: "options", method: http.MethodOptions, target: "/.dav/", wantStatus: http.StatusOK},
+			{name: "put_get", method: http.MethodPut, target: "/.dav/res", body: "hello\n", wantStatus: http.StatusCreated},
+			{name: "put_get", method: http.MethodGet, target: "/.dav/res", wantStatus: http.StatusOK, wantBody: []string{"hello\n"}},
+			{name: "put_no_parent", method: http.MethodPut, target: "/.dav/409me/noparent.txt", body: "hello\n", wantStatus: http.StatusConflict},
+			{name: "delete", method: http.MethodDelete, target: "/.dav/res", wantStatus: http.StatusNoContent},
+			{name: "delete_null", method: http.MethodDelete, target: "/.dav/res", wantStatus: http.StatusNotFound},
+			{name: "mkcol", method: "MKCOL", target: "/.dav/coll/", wantStatus: http.StatusCreated},
+			{name: "mkcol_again", method: "MKCOL", target: "/.dav/coll/", wantStatus: http.StatusMethodNotAllowed},
+			{name: "mkcol_no_parent", method: "MKCOL", target: "/.dav/409me/coll/", wantStatus: http.StatusConflict},
+			{name: "mkcol_with_body", method: "MKCOL", target: "/.dav/coll2/", body: "junk", wantStatus: http.StatusUnsupportedMediaType},
+			{name: "delete_coll", method: http.MethodDelete, target: "/.dav/coll/", wantStatus: http.StatusNoContent},
+		})
+	})
+
+	t.Run("copymove", func(t *testing.T) {
+		runSteps(t, config, []davStep{
+			{name: "copy_init", method: http.MethodPut, target: "/.dav/src", body: "source\n", wantStatus: http.StatusCreated},
+			{name: "copy_simple", method: "COPY", target: "/.dav/src", headers: map[string]string{"Destination": "SERVER/.dav/dest"}, wantStatus: http.StatusCreated},
+			{name: "copy_overwrite", method: "COPY", target: "/.dav/src", headers: map[string]string{"Destination": "SERVER/.dav/dest", "Overwrite": "F"}, wantStatus: http.StatusPreconditionFailed},
+			{name: "copy_overwrite", method: "COPY", target: "/.dav/src", headers: map[string]string{"Destination": "SERVER/.dav/dest", "Overwrite": "T"}, wantStatus: http.StatusNoContent},
+			{name: "copy_nodestcoll", method: "COPY", target: "/.dav/src", headers: map[string]string{"Destination": "SERVER/.dav/nonesuch/dest"}, wantStatus: http.StatusConflict},
+			{name: "copy_coll", method: "MKCOL", target: "/.dav/ccsrc/", wantStatus: http.StatusCreated},
+			{name: "copy_coll", method: http.MethodPut, target: "/.dav/ccsrc/foo", body: "foo\n", wantStatus: http.StatusCreated},
+			{name: "copy_coll", method: "COPY", target: "/.dav/ccsrc/", headers: map[string]string{"Destination": "SERVER/.dav/ccdest/", "Depth": "infinity"}, wantStatus: http.StatusCreated},
+			{name: "copy_coll", method: http.MethodGet, target: "/.dav/ccdest/foo", wantStatus: http.StatusOK, wantBody: []string{"foo\n"}},
+			{name: "move", method: "MOVE", target: "/.dav/src", headers: map[string]string{"Destination": "SERVER/.dav/moved"}, wantStatus: http.StatusCreated},
+			{name: "move", method: http.MethodGet, target: "/.dav/src", wantStatus: http.StatusNotFound},
+			{name: "move_overwrite", method: "MOVE", target: "/.dav/moved", headers: map[string]string{"Destination": "SERVER/.dav/dest", "Overwrite": "F"}, wantStatus: http.StatusPreconditionFailed},
+			{name: "move_overwrite", method: "MOVE", target: "/.dav/moved", headers: map[string]string{"Destination": "SERVER/.dav/dest", "Overwrite": "T"}, wantStatus: http.StatusNoContent},
+			{name: "move_coll", method: "MOVE", target: "/.dav/ccdest/", headers: map[string]string{"Destination": "SERVER/.dav/ccmoved/"}, wantStatus: http.StatusCreated},
+			{name: "move_coll", method: http.MethodGet, target: "/.dav/ccmoved/foo", wantStatus: http.StatusOK, wantBody: []string{"foo\n"}},
+		})
+	})
+
+	t.Run("props", func(t *testing.T) {
+		setProp := `<?xml version="1.0" encoding="utf-8"?>
+<propertyupdate xmlns="DAV:" xmlns:t="http://example.com/neon/litmus/"><set><prop><t:prop0>value0</t:prop0></prop></set></propertyupdate>`
+		removeProp := `<?xml version="1.0" encoding="utf-8"?>
+<propertyupdate xmlns="DAV:" xmlns:t="http://example.com/neon/litmus/"><remove><prop><t:prop0/></prop></remove></propertyupdate>`
+		setPerms := `<?xml version="1.0" encoding="utf-8"?>
+<propertyupdate xmlns="DAV:" xmlns:f="urn:file-server:"><set><prop><f:permissions>0600</f:permissions></prop></set></propertyupdate>`
+		setOwner := `<?xml version="1.0" encoding="utf-8"?>
+<propertyupdate xmlns="DAV:" xmlns:f="urn:file-server:"><set><prop><f:owner>1</f:owner></prop></set></propertyupdate>`
+		setLive := `<?xml version="1.0" encoding="utf-8"?>
+<propertyupdate xmlns="DAV:"><set><prop><getcontentlength>1</getcontentlength></prop></set></propertyupdate>`
+		propfind := `<?xml version="1.0" encoding="utf-8"?>
+<propfind xmlns="DAV:" xmlns:t="http://example.com/neon/litmus/" xmlns:f="urn:file-server:"><prop><getcontentlength/><getcontenttype/><t:prop0/><f:permissions/><f:owner/></prop></propfind>`
+		depth0 := map[string]string{"Depth": "0"}
+
+		runSteps(t, config, []davStep{
+			{name: "propinit", method: http.MethodPut, target: "/.dav/prop.txt", body: "hello\n", wantStatus: http.StatusCreated},
+			{name: "propfind_d0", method: "PROPFIND", target: "/.dav/prop.txt", headers: depth0, body: propfind, wantStatus: http.StatusMultiStatus,
+				wantBody: []string{"<D:getcontentlength>6</D:getcontentlength>", "text/plain; charset=utf-8", ">0644</permissions>", ">0</owner>"}},
+			{name: "propset", method: "PROPPATCH", target: "/.dav/prop.txt", body: setProp, wantStatus: http.StatusMultiStatus, wantBody: []string{"HTTP/1.1 200 OK"}},
+			{name: "propget", method: "PROPFIND", target: "/.dav/prop.txt", headers: depth0, body: propfind, wantStatus: http.StatusMultiStatus, wantBody: []string{">value0</prop0>"}},
+			{name: "propcopy", method: "COPY", target: "/.dav/prop.txt", headers: map[string]string{"Destination": "SERVER/.dav/prop2.txt"}, wantStatus: http.StatusCreated},
+			{name: "propcopy", method: "PROPFIND", target: "/.dav/prop2.txt", headers: depth0, body: propfind, wantStatus: http.StatusMultiStatus, wantBody: []string{">value0</prop0>"}},
+			{name: "propremove", method: "PROPPATCH", target: "/.dav/prop.txt", body: removeProp, wantStatus: http.StatusMultiStatus, wantBody: []string{"HTTP/1.1 200 OK"}},
+			{name: "propremove", method: "PROPFIND", target: "/.dav/prop.txt", headers: depth0, body: propfind, wantStatus: http.StatusMultiStatus, wantBody: []string{"HTTP/1.1 404 Not Found"}},
+			{name: "chmod", method: "PROPPATCH", target: "/.dav/prop.txt", body: setPerms, wantStatus: http.StatusMultiStatus, wantBody: []string{"HTTP/1.1 200 OK"}},
+			{name: "chmod", method: "PROPFIND", target: "/.dav/prop.txt", headers: depth0, body: propfind, wantStatus: http.StatusMultiStatus, wantBody: []string{">0600</permissions>"}},
+			{name: "chown_forbidden", method: "PROPPATCH", target: "/.dav/prop.txt", body: setOwner, wantStatus: http.StatusMultiStatus, wantBody: []string{"HTTP/1.1 403 Forbidden"}},
+			{name: "live_forbidden", method: "PROPPATCH", target: "/.dav/prop.txt", body: setLive, wantStatus: http.StatusMultiStatus, wantBody: []string{"HTTP/1.1 403 Forbidden"}},
+			{name: "propcoll", method: "MKCOL", target: "/.dav/pcoll/", wantStatus: http.StatusCreated},
+			{name: "propcoll", method: "PROPPATCH", target: "/.dav/pcoll/", body: setProp, wantStatus: http.StatusMultiStatus, wantBody: []string{"HTTP/1.1 200 OK"}},
+			{name: "propfind_d1", method: "PROPFIND", target: "/.dav/", headers: map[string]string{"Depth": "1"}, body: propfind, wantStatus: http.StatusMultiStatus,
+				wantBody: []string{"/.dav/prop.txt", "/.dav/prop2.txt", "/.dav/pcoll/"}},
+		})
+	})
+
+	t.Run("locks", func(t *testing.T) {
+		lockInfo := `<?xml version="1.0" encoding="utf-8"?>
+<lockinfo xmlns="DAV:"><lockscope><exclusive/></lockscope><locktype><write/></locktype><owner>litmus</owner></lockinfo>`
+		runSteps(t, config, []davStep{
+			{name: "lock_init", method: http.MethodPut, target: "/.dav/lockme", body: "hello\n", wantStatus: http.StatusCreated},
+			{name: "lock_excl", method: "LOCK", target: "/.dav/lockme", body: lockInfo, wantStatus: http.StatusOK, wantBody: []string{"<D:owner>litmus</D:owner>"}},
+			{name: "notowner_modify", method: http.MethodPut, target: "/.dav/lockme", body: "changed\n", wantStatus: http.StatusLocked},
+			{name: "notowner_delete", method: http.MethodDelete, target: "/.dav/lockme", wantStatus: http.StatusLocked},
+			{name: "owner_modify", method: http.MethodPut, target: "/.dav/lockme", headers: map[string]string{"If": "(TOKEN)"}, body: "changed\n", wantStatus: http.StatusCreated},
+			{name: "unlock", method: "UNLOCK", target: "/.dav/lockme", headers: map[string]string{"Lock-Token": "TOKEN"}, wantStatus: http.StatusNoContent},
+			{name: "unlocked_delete", method: http.MethodDelete, target: "/.dav/lockme", wantStatus: http.StatusNoContent},
+		})
+	})
+
+	t.Run("pre hooks", func(t *testing.T) {
+		config := config
+		config.Hooks = []Hook{{
+			Stage:   HookStagePre,
+			Paths:   []string{"/*.yaml"},
+			Command: []string{"sh", "-c", `! grep -q tab`},
+		}}
+		runSteps(t, config, []davStep{
+			{name: "valid", method: http.MethodPut, target: "/.dav/app.yaml", body: "key: value\n", wantStatus: http.StatusCreated},
+			{name: "rejected", method: http.MethodPut, target: "/.dav/app.yaml", body: "key:\ttab\n", wantStatus: http.StatusMethodNotAllowed},
+			{name: "unchanged", method: http.MethodGet, target: "/.dav/app.yaml", wantStatus: http.StatusOK, wantBody: []string{"key: value\n"}},
+			{name: "tabs", method: http.MethodPut, target: "/.dav/tabs.txt", body: "key:\ttab\n", wantStatus: http.StatusCreated},
+			{name: "rejected_move", method: "MOVE", target: "/.dav/tabs.txt", headers: map[string]string{"Destination": "SERVER/.dav/tabs.yaml"}, wantStatus: http.StatusForbidden},
+			{name: "not_moved", method: http.MethodGet, target: "/.dav/tabs.yaml", wantStatus: http.StatusNotFound},
+			{name: "valid_move", method: "MOVE", target: "/.dav/app.yaml", headers: map[string]string{"Destination": "SERVER/.dav/moved.yaml"}, wantStatus: http.StatusCreated},
+		})
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		mustMakeContentRoot(t)
+		defer mustDeleteContentRoot(t)
+
+		httpRequest := httptest.NewRequest("PROPFIND", "/.dav/", nil)
+		responseRecorder := httptest.NewRecorder()
+		httpHandler(newConfig(ContentRoot)).ServeHTTP(responseRecorder, httpRequest)
+		assertResponseHasStatusCode(t, responseRecorder.Result(), http.StatusMethodNotAllowed)
+	})
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"syscall"
+	"time"
+)
+
+// expiryXattr holds the RFC 3339 time a file expires at.
+const expiryXattr = "user.file-server.expires_at"
+
+// expiryLocks serializes writing files with their expiry and removing them
+// once expired, by their path with the content root.
+var expiryLocks fileLocks
+
+// parseExpiry returns when a file written with a ttl, a duration like "24h",
+// or an expires_at time expires. It is the zero time if neither is set.
+func parseExpiry(fileName, ttl string, expiresAt *time.Time, now time.Time) (time.Time, error) {
+	switch {
+	case ttl != "" && expiresAt != nil:
+		return time.Time{}, &statusError{http.StatusBadRequest, fileName + " has both a ttl and an expires_at"}
+	case ttl != "":
+		d, err := time.ParseDuration(ttl)
+		if err != nil || d <= 0 {
+			return time.Time{}, &statusError{http.StatusBadRequest, fmt.Sprintf("%s has an invalid ttl %q", fileName, ttl)}
+		}
+		return now.Add(d).UTC(), nil
+	case expiresAt != nil:
+		if !expiresAt.After(now) {
+			return time.Time{}, &statusError{http.StatusBadRequest, fileName + " has an expires_at in the past"}
+		}
+		return expiresAt.UTC(), nil
+	default:
+		return time.Time{}, nil
+	}
+}
+
+// fileExpiry returns when a file expires, or the zero time if it doesn't.
+func fileExpiry(storage Storage, name string) (time.Time, error) {
+	value, err := storage.GetXattr(name, expiryXattr)
+	if isNoXattr(err) {
+		return time.Time{}, nil
+	} else if err != nil {
+		return time.Time{}, err
+	}
+	return time.Parse(time.RFC3339Nano, string(value))
+}
+
+// setFileExpiry sets when a file expires, or makes it permanent if expiresAt
+// is the zero time.
+func setFileExpiry(storage Storage, name string, expiresAt time.Time) error {
+	if expiresAt.IsZero() {
+		if err := storage.RemoveXattr(name, expiryXattr); err != nil && !isNoXattr(err) {
+			return err
+		}
+		return nil
+	}
+	return storage.SetXattr(name, expiryXattr, []byte(expiresAt.UTC().Format(time.RFC3339Nano)))
+}
+
+// checkExpiry returns an error if the storage can't keep when the file at
+// name expires, before it is written. The file is checked, or its directory if
+// it doesn't exist yet.
+func checkExpiry(storage Storage, name, fileName string) error {
+	_, err := storage.ListXattrs(name)
+	if os.IsNotExist(err) {
+		_, err = storage.ListXattrs(path.Dir(name))
+	}
+	if isXattrUnsupported(err) {
+		return errExpiryUnsupported(fileName)
+	}
+	return err
+}
+
+// writeExpiringFile writes a file and sets when it expires. A file created by
+// the write is removed again if its expiry can't be set.
+func writeExpiringFile(storage Storage, name, fileName string, data []byte, perm os.FileMode, expiresAt time.Time) error {
+	defer expiryLocks.lock(fileName)()
+	_, err := storage.Lstat(name)
+	created := os.IsNotExist(err)
+	if err := writeFile(storage, name, data, perm); err != nil {
+		return err
+	}
+	if err := setFileExpiry(storage, name, expiresAt); err != nil {
+		if created {
+			storage.Remove(name)
+		}
+		if isXattrUnsupported(err) {
+			return &statusError{http.StatusNotImplemented, fileName + " can't expire: the storage doesn't support extended attributes"}
+		}
+		return err
+	}
+	return nil
+}
+
+func errExpiryUnsupported(fileName string) error {
+	return &statusError{http.StatusNotImplemented, fileName + " can't expire: the storage doesn't support extended attributes"}
+}
+
+// isNoXattr reports whether an error is for a missing extended attribute, or
+// one that can't be there.
+func isNoXattr(err error) bool {
+	return errors.Is(err, syscall.ENODATA) || isXattrUnsupported(err)
+}
+
+// isXattrUnsupported reports whether an error is for a storage without
+// extended attributes.
+func isXattrUnsupported(err error) bool {
+	return errors.Is(err, syscall.ENOTSUP) || errors.Is(err, errXattrUnsupported)
+}
+
+// reapExpired removes the files of a storage with contentRoot that have
+// expired by now, and returns how many it removed.
+func reapExpired(storage Storage, contentRoot string, now time.Time) (int, error) {
+	removed := 0
+	err := walkStorage(storage, "/", func(name string, info os.FileInfo, err error) error {
+		switch {
+		case os.IsNotExist(err):
+			return nil
+		case err != nil:
+			return err
+		case !info.Mode().IsRegular():
+			return nil
+		}
+		expiresAt, err := fileExpiry(storage, name)
+		if err != nil {
+			log.Printf("reading the expiry of %s: %v", name, err)
+			return nil
+		}
+		if expiresAt.IsZero() || now.Before(expiresAt) {
+			return nil
+		}
+		// The file may have been replaced since, so its expiry is read again
+		// under the lock writers take.
+		defer expiryLocks.lock(path.Join(contentRoot, name))()
+		if expiresAt, err = fileExpiry(storage, name); err != nil || expiresAt.IsZero() || now.Before(expiresAt) {
+			return nil
+		}
+		if err := storage.Remove(name); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		removed++
+		return nil
+	})
+	return removed, err
+}
+
+// runExpiryReaper removes the expired files of the storage, or of the mounts
+// that aren't read only, every ExpirySweepInterval.
+func runExpiryReaper(config Config) {
+	if config.ExpirySweepInterval <= 0 {
+		return
+	}
+	mounts := []Mount{{ContentRoot: config.ContentRoot, storage: config.Storage}}
+	if len(config.Mounts) > 0 {
+		mounts = nil
+		for _, mount := range config.Mounts {
+			if !mount.ReadOnly {
+				mounts = append(mounts, mount)
+			}
+		}
+	}
+	ticker := time.NewTicker(config.ExpirySweepInterval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		for _, mount := range mounts {
+			removed, err := reapExpired(mount.storage, mount.ContentRoot, now)
+			if err != nil {
+				log.Printf("removing the expired files of %s: %v", mount.ContentRoot, err)
+			}
+			if removed > 0 {
+				log.Printf("removed %d expired files from %s", removed, mount.ContentRoot)
+			}
+		}
+	}
+}
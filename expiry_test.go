@@ -0,0 +1,205 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseExpiry(t *testing.T) {
+	now := time.Date(2026, 1, 2, 15, 4, 5, 0, time.UTC)
+	past, future := now.Add(-time.Hour), now.Add(time.Hour)
+	for _, test := range []struct {
+		name      string
+		ttl       string
+		expiresAt *time.Time
+		want      time.Time
+		valid     bool
+	}{
+		{"none", "", nil, time.Time{}, true},
+		{"ttl", "24h", nil, now.Add(24 * time.Hour), true},
+		{"expires at", "", &future, future, true},
+		{"invalid ttl", "a day", nil, time.Time{}, false},
+		{"negative ttl", "-1h", nil, time.Time{}, false},
+		{"past expires at", "", &past, time.Time{}, false},
+		{"both", "1h", &future, time.Time{}, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := parseExpiry("test/file.txt", test.ttl, test.expiresAt, now)
+			if valid := err == nil; valid != test.valid {
+				t.Errorf("got error %v", err)
+			}
+			if !got.Equal(test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	forEachStorage(t, testExpiry)
+}
+
+func testExpiry(t *testing.T) {
+	runTest := func(t *testing.T, method, target string, reqBody string, wantStatus int, wantBody string) {
+		t.Helper()
+		httpRequest := httptest.NewRequest(method, target, strings.NewReader(reqBody))
+		responseRecorder := httptest.NewRecorder()
+		httpHandler(newTestConfig()).ServeHTTP(responseRecorder, httpRequest)
+		assertHttpResponse(t, responseRecorder.Result(), wantStatus, wantBody)
+	}
+
+	t.Run("put with an expiry", func(t *testing.T) {
+		mustMakeContentRoot(t)
+		defer mustDeleteContentRoot(t)
+
+		runTest(t, http.MethodPut, "/scratch.txt",
+			`{"permissions": "0600", "contents": "hello\n", "expires_at": "2999-01-01T00:00:00Z"}`,
+			http.StatusOK,
+			`{
+			  "status": "ok",
+			  "type": "file",
+			  "file": {
+				"name": "scratch.txt",
+				"path": "/scratch.txt",
+				"mime_type": "text/plain; charset=utf-8",
+				"owner": "0",
+				"group": "0",
+				"permissions": "0600",
+				"size": 6,
+				"contents": "hello\n",
+				"expires_at": "2999-01-01T00:00:00Z"
+			  }
+			}`)
+
+		// Replacing the file without an expiry makes it permanent.
+		runTest(t, http.MethodPut, "/scratch.txt",
+			`{"permissions": "0600", "contents": "kept\n"}`,
+			http.StatusOK,
+			`{
+			  "status": "ok",
+			  "type": "file",
+			  "file": {
+				"name": "scratch.txt",
+				"path": "/scratch.txt",
+				"mime_type": "text/plain; charset=utf-8",
+				"owner": "0",
+				"group": "0",
+				"permissions": "0600",
+				"size": 5,
+				"contents": "kept\n"
+			  }
+			}`)
+	})
+
+	t.Run("invalid ttl", func(t *testing.T) {
+		mustMakeContentRoot(t)
+		defer mustDeleteContentRoot(t)
+
+		runTest(t, http.MethodPost, "/",
+			`[{"name": "a.txt", "permissions": "0600", "contents": "a\n", "ttl": "tomorrow"}]`,
+			http.StatusBadRequest,
+			`{
+			  "status": "error",
+			  "type": "error",
+			  "error": {
+				"code": 400,
+				"error": "test/a.txt has an invalid ttl \"tomorrow\""
+			  }
+			}`)
+	})
+
+	t.Run("expired files are removed", func(t *testing.T) {
+		mustMakeContentRoot(t)
+		defer mustDeleteContentRoot(t)
+
+		runTest(t, http.MethodPost, "/uploads",
+			`[
+			  {"name": "day.txt", "permissions": "0600", "contents": "a\n", "expires_at": "2999-01-01T00:00:00Z"},
+			  {"name": "week.txt", "permissions": "0600", "contents": "b\n", "expires_at": "2999-01-07T00:00:00Z"},
+			  {"name": "kept.txt", "permissions": "0600", "contents": "c\n"}
+			]`,
+			http.StatusOK,
+			`{
+			  "status": "ok",
+			  "type": "directory",
+			  "directory": {
+				"name": "uploads",
+				"path": "/uploads",
+				"owner": "0",
+				"group": "0",
+				"permissions": "0700",
+				"size": 4096,
+				"entries": [
+				  {"name": "day.txt", "path": "/uploads/day.txt", "type": "file", "owner": "0", "group": "0", "permissions": "0600", "size": 2, "mime_type": "text/plain; charset=utf-8", "expires_at": "2999-01-01T00:00:00Z"},
+				  {"name": "kept.txt", "path": "/uploads/kept.txt", "type": "file", "owner": "0", "group": "0", "permissions": "0600", "size": 2, "mime_type": "text/plain; charset=utf-8"},
+				  {"name": "week.txt", "path": "/uploads/week.txt", "type": "file", "owner": "0", "group": "0", "permissions": "0600", "size": 2, "mime_type": "text/plain; charset=utf-8", "expires_at": "2999-01-07T00:00:00Z"}
+				]
+			  }
+			}`)
+
+		removed, err := reapExpired(testStorage, ContentRoot, time.Date(2999, 1, 2, 0, 0, 0, 0, time.UTC))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if removed != 1 {
+			t.Errorf("removed %d files, want 1", removed)
+		}
+		if _, err := testStorage.Stat("/uploads/day.txt"); !os.IsNotExist(err) {
+			t.Errorf("got error %v for an expired file", err)
+		}
+		for _, name := range []string{"/uploads/week.txt", "/uploads/kept.txt"} {
+			if _, err := testStorage.Stat(name); err != nil {
+				t.Errorf("got error %v for %s", err, name)
+			}
+		}
+	})
+}
+
+// noXattrStorage is a storage that can't set extended attributes, and can't
+// list them either unless listable.
+type noXattrStorage struct {
+	Storage
+	listable bool
+}
+
+func (x noXattrStorage) ListXattrs(name string) ([]string, error) {
+	if x.listable {
+		return x.Storage.ListXattrs(name)
+	}
+	return nil, errXattrUnsupported
+}
+
+func (x noXattrStorage) SetXattr(name, attr string, value []byte) error {
+	return errXattrUnsupported
+}
+
+func TestExpiryWithoutXattrs(t *testing.T) {
+	for _, listable := range []bool{false, true} {
+		config := newConfig(ContentRoot)
+		config.Storage = noXattrStorage{newMemStorage(ContentRoot), listable}
+		for _, test := range []struct {
+			method, target, body string
+		}{
+			{http.MethodPut, "/scratch.txt", `{"permissions": "0600", "contents": "hello\n", "ttl": "1h"}`},
+			{http.MethodPost, "/", `[{"name": "scratch.txt", "permissions": "0600", "contents": "hello\n", "ttl": "1h"}]`},
+		} {
+			responseRecorder := httptest.NewRecorder()
+			httpHandler(config).ServeHTTP(responseRecorder, httptest.NewRequest(test.method, test.target, strings.NewReader(test.body)))
+			assertHttpResponse(t, responseRecorder.Result(), http.StatusNotImplemented, `{
+			  "status": "error",
+			  "type": "error",
+			  "error": {
+				"code": 501,
+				"error": "test/scratch.txt can't expire: the storage doesn't support extended attributes"
+			  }
+			}`)
+			if _, err := config.Storage.Stat("/scratch.txt"); !os.IsNotExist(err) {
+				t.Errorf("got error %v for a file that can't expire", err)
+			}
+		}
+	}
+}
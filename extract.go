@@ -0,0 +1,426 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const ExtractStatusExtracted = "extracted"
+const ExtractStatusRejected = "rejected"
+
+// postedArchiveFormat returns the format of an archive request body from the
+// archive url param or the Content-Type, or an empty string for json bodies.
+func postedArchiveFormat(r *http.Request) (string, error) {
+	if format := r.URL.Query().Get("archive"); format != "" {
+		if _, ok := archiveMimeTypes[format]; !ok {
+			return "", fmt.Errorf("unsupported archive format %q", format)
+		}
+		return format, nil
+	}
+
+	contentType := strings.TrimSpace(strings.Split(r.Header.Get("Content-Type"), ";")[0])
+	for format, mimeType := range archiveMimeTypes {
+		if contentType == mimeType {
+			return format, nil
+		}
+	}
+	return "", nil
+}
+
+// handlePostArchive extracts an archive request body into the directory.
+func handlePostArchive(config Config, hooks *Hooks, w http.ResponseWriter, r *http.Request, format string) {
+	dirName := path.Join(config.ContentRoot, r.URL.Path)
+
+	mask, err := strconv.ParseUint(r.URL.Query().Get("mask"), 8, 32)
+	switch {
+	case r.URL.Query().Get("mask") == "":
+		mask = 0022
+	case err != nil:
+		badRequest(w, fmt.Sprintf("invalid octal mask %q", r.URL.Query().Get("mask")))
+		return
+	}
+	x := extractor{
+		storage:   config.Storage,
+		urlPath:   r.URL.Path,
+		mountPath: config.MountPath,
+		mask:      os.FileMode(mask),
+		dryRun:    r.URL.Query().Get("dry_run") == "true",
+		dirTimes:  make(map[string]time.Time),
+	}
+
+	info, err := config.Storage.Stat(r.URL.Path)
+	switch {
+	case err == nil && info.IsDir():
+		break
+	case os.IsNotExist(err) && x.dryRun:
+		break
+	case os.IsNotExist(err):
+		if err := config.Storage.MkdirAll(r.URL.Path, 0700); err != nil {
+			internalServerError(w, err)
+			return
+		}
+	case err != nil:
+		internalServerError(w, err)
+		return
+	default:
+		badRequest(w, dirName+" is not a directory")
+		return
+	}
+
+	// Archives are too big to pass to hooks, so they only run for the directory.
+	event := HookEvent{Operation: HookOperationExtract, URLPath: r.URL.Path, FileName: dirName}
+	if err := hooks.Pre(event, nil); err != nil {
+		hookFailed(w, err)
+		return
+	}
+
+	switch format {
+	case ArchiveFormatTar:
+		err = x.extractTar(r.Body)
+	case ArchiveFormatTarGz:
+		var gr *gzip.Reader
+		if gr, err = gzip.NewReader(r.Body); err == nil {
+			err = x.extractTar(gr)
+		}
+	case ArchiveFormatZip:
+		err = x.extractZip(r.Body)
+	}
+	if err == nil {
+		err = x.setDirTimes()
+	}
+
+	var archiveErr archiveError
+	switch {
+	case err == nil:
+		if !x.dryRun {
+			hooks.Post(event, nil)
+		}
+		writeResponse(w, ResponseBody{
+			Status:  "ok",
+			Type:    ResponseTypeExtract,
+			Extract: &ExtractData{DryRun: x.dryRun, Entries: x.entries},
+		})
+	case errors.As(err, &archiveErr):
+		badRequest(w, err.Error())
+	default:
+		internalServerError(w, err)
+	}
+}
+
+// archiveError is a malformed archive, as opposed to a failure to extract it.
+type archiveError struct {
+	err error
+}
+
+func (x archiveError) Error() string {
+	return fmt.Sprintf("invalid archive: %v", x.err)
+}
+
+type extractor struct {
+	storage Storage
+	urlPath string
+	// mountPath is the url path of the mount the storage is under, if any.
+	mountPath string
+	mask      os.FileMode
+	dryRun    bool
+	entries   []ExtractEntry
+	dirTimes  map[string]time.Time
+	// links are the symlinks extracted so far, relative to the target
+	// directory.
+	links []string
+}
+
+func (x *extractor) extractTar(r io.Reader) error {
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return archiveError{err}
+		}
+		if header.Typeflag == tar.TypeXGlobalHeader {
+			continue
+		}
+		if err := x.extract(header.Name, header.FileInfo().Mode(), header.Linkname, header.ModTime, tr); err != nil {
+			return err
+		}
+	}
+}
+
+func (x *extractor) extractZip(r io.Reader) error {
+	// Zip archives can't be read as a stream, so buffer the body on disk.
+	tmp, err := ioutil.TempFile("", "file-server-*.zip")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	size, err := io.Copy(tmp, r)
+	if err != nil {
+		return err
+	}
+	zr, err := zip.NewReader(tmp, size)
+	if err != nil {
+		return archiveError{err}
+	}
+
+	for _, f := range zr.File {
+		if err := x.extractZipFile(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (x *extractor) extractZipFile(f *zip.File) error {
+	rc, err := f.Open()
+	if err != nil {
+		return archiveError{err}
+	}
+	defer rc.Close()
+
+	var linkname string
+	if f.Mode()&os.ModeSymlink != 0 {
+		// Zip stores the symlink target as the entry contents.
+		target, err := ioutil.ReadAll(rc)
+		if err != nil {
+			return archiveError{err}
+		}
+		linkname = string(target)
+	}
+	return x.extract(f.Name, f.Mode(), linkname, f.Modified, rc)
+}
+
+// extract writes a single archive entry and records the result. Entries that
+// are unsafe or unsupported are rejected without stopping the extraction.
+func (x *extractor) extract(name string, mode os.FileMode, linkname string, modified time.Time, contents io.Reader) error {
+	relPath := path.Clean("/" + name)[1:]
+	entry := ExtractEntry{
+		Path:        path.Join("/", x.mountPath, x.urlPath, relPath),
+		Permissions: fmt.Sprintf("0%o", mode.Perm()&^x.mask),
+		Status:      ExtractStatusExtracted,
+	}
+	switch {
+	case mode.IsDir():
+		entry.Type = DirectoryEntryTypeDirectory
+	case mode.IsRegular():
+		entry.Type = DirectoryEntryTypeFile
+	case mode&os.ModeSymlink != 0:
+		// Symlink permissions are ignored on linux and always shown as 0777.
+		entry.Type = DirectoryEntryTypeSymlink
+		entry.Permissions = "0777"
+	default:
+		entry.Type = DirectoryEntryTypeUnsupported
+	}
+
+	if err := x.check(name, relPath, entry.Type, linkname); err != nil {
+		entry.Status = ExtractStatusRejected
+		entry.Error = err.Error()
+		x.entries = append(x.entries, entry)
+		return nil
+	}
+
+	fileName := path.Join(x.urlPath, relPath)
+	var err error
+	switch {
+	case x.dryRun:
+		if entry.Type == DirectoryEntryTypeFile {
+			var size int64
+			size, err = io.Copy(ioutil.Discard, contents)
+			entry.Size = uint64(size)
+		}
+	case entry.Type == DirectoryEntryTypeDirectory:
+		err = x.extractDir(fileName, mode.Perm()&^x.mask, modified)
+	case entry.Type == DirectoryEntryTypeFile:
+		entry.Size, err = x.extractFile(fileName, mode.Perm()&^x.mask, modified, contents)
+	case entry.Type == DirectoryEntryTypeSymlink:
+		err = x.extractSymlink(fileName, linkname)
+		if err == nil && !x.linksInside() {
+			// The new symlink makes one extracted before it escape.
+			entry.Status = ExtractStatusRejected
+			entry.Error = "symlink target escapes the target directory"
+			err = x.storage.Remove(fileName)
+		} else if err == nil {
+			x.links = append(x.links, relPath)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	x.entries = append(x.entries, entry)
+	return nil
+}
+
+// check rejects entries that would be written outside of the target directory,
+// either directly, through a symlink or by creating a symlink that escapes.
+func (x *extractor) check(name, relPath, entryType, linkname string) error {
+	switch {
+	case path.IsAbs(name), escapes(path.Clean(name)):
+		return errors.New("path escapes the target directory")
+	case relPath == "":
+		return errors.New("path is the target directory")
+	case entryType == DirectoryEntryTypeUnsupported:
+		return errors.New("unsupported entry type")
+	case entryType == DirectoryEntryTypeSymlink && path.IsAbs(linkname):
+		return errors.New("symlink target is absolute")
+	case entryType == DirectoryEntryTypeSymlink && !x.inside(path.Dir(relPath)+"/"+linkname):
+		return errors.New("symlink target escapes the target directory")
+	}
+
+	parent := x.urlPath
+	for _, dir := range strings.Split(path.Dir(relPath), "/") {
+		if dir == "." {
+			break
+		}
+		parent = path.Join(parent, dir)
+		info, err := x.storage.Lstat(parent)
+		if err == nil && info.Mode()&os.ModeSymlink != 0 {
+			return errors.New("path traverses a symlink")
+		}
+	}
+	return nil
+}
+
+// escapes reports whether a clean relative path leaves its directory.
+func escapes(relPath string) bool {
+	return relPath == ".." || strings.HasPrefix(relPath, "../")
+}
+
+// inside reports whether a path relative to the target directory stays inside
+// of it once the symlinks that exist are evaluated. Components that don't
+// exist are taken as directories.
+func (x *extractor) inside(relPath string) bool {
+	resolved := ""
+	pending := strings.Split(relPath, "/")
+	for links := 0; len(pending) > 0; {
+		part := pending[0]
+		pending = pending[1:]
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			if resolved == "" {
+				return false
+			}
+			if resolved = path.Dir(resolved); resolved == "." {
+				resolved = ""
+			}
+			continue
+		}
+
+		next := path.Join(resolved, part)
+		info, err := x.storage.Lstat(path.Join(x.urlPath, next))
+		if err != nil || info.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+		if links++; links > 255 {
+			return false
+		}
+		target, err := x.storage.Readlink(path.Join(x.urlPath, next))
+		if err != nil || path.IsAbs(target) {
+			return false
+		}
+		pending = append(strings.Split(target, "/"), pending...)
+	}
+	return true
+}
+
+// linksInside reports whether the extracted symlinks all stay inside of the
+// target directory, which a later symlink in their targets can change.
+func (x *extractor) linksInside() bool {
+	for _, relPath := range x.links {
+		target, err := x.storage.Readlink(path.Join(x.urlPath, relPath))
+		if err == nil && !x.inside(path.Dir(relPath)+"/"+target) {
+			return false
+		}
+	}
+	return true
+}
+
+// removeSymlink removes a symlink where an entry is extracted, so that it is
+// replaced rather than written through.
+func (x *extractor) removeSymlink(fileName string) error {
+	info, err := x.storage.Lstat(fileName)
+	if err != nil || info.Mode()&os.ModeSymlink == 0 {
+		return nil
+	}
+	return x.storage.Remove(fileName)
+}
+
+func (x *extractor) extractDir(fileName string, perms os.FileMode, modified time.Time) error {
+	if err := x.removeSymlink(fileName); err != nil {
+		return err
+	}
+	if err := x.storage.MkdirAll(fileName, 0700); err != nil {
+		return err
+	}
+	if err := x.storage.Chmod(fileName, perms); err != nil {
+		return err
+	}
+	// Extracting the directory contents changes its mtime, so set it last.
+	x.dirTimes[fileName] = modified
+	return nil
+}
+
+func (x *extractor) extractFile(fileName string, perms os.FileMode, modified time.Time, contents io.Reader) (uint64, error) {
+	if err := x.storage.MkdirAll(path.Dir(fileName), 0700); err != nil {
+		return 0, err
+	}
+	if err := x.removeSymlink(fileName); err != nil {
+		return 0, err
+	}
+
+	f, err := x.storage.OpenFile(fileName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perms)
+	if err != nil {
+		return 0, err
+	}
+	size, err := io.Copy(f, contents)
+	if err != nil {
+		f.Close()
+		return 0, archiveError{err}
+	}
+	if err := f.Close(); err != nil {
+		return 0, err
+	}
+
+	// OpenFile only applies perms to new files and is subject to the umask.
+	if err := x.storage.Chmod(fileName, perms); err != nil {
+		return 0, err
+	}
+	return uint64(size), x.storage.Chtimes(fileName, modified, modified)
+}
+
+func (x *extractor) extractSymlink(fileName, linkname string) error {
+	if err := x.storage.MkdirAll(path.Dir(fileName), 0700); err != nil {
+		return err
+	}
+	if err := x.storage.Remove(fileName); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return x.storage.Symlink(linkname, fileName)
+}
+
+func (x *extractor) setDirTimes() error {
+	for dirName, modified := range x.dirTimes {
+		if err := x.storage.Chtimes(dirName, modified, modified); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestHandlePostArchive(t *testing.T) {
+	runTest := func(t *testing.T, target, contentType string, reqBody []byte, wantStatus int, wantBody string) {
+		t.Helper()
+		httpRequest := httptest.NewRequest(http.MethodPost, target, bytes.NewReader(reqBody))
+		httpRequest.Header.Set("Content-Type", contentType)
+		responseRecorder := httptest.NewRecorder()
+		httpHandler(newConfig(ContentRoot)).ServeHTTP(responseRecorder, httpRequest)
+		assertHttpResponse(t, responseRecorder.Result(), wantStatus, wantBody)
+	}
+
+	modified := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	tarball := mustMakeTar(t, []tar.Header{
+		{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0777, ModTime: modified},
+		{Name: "dir/file.txt", Typeflag: tar.TypeReg, Mode: 0666, ModTime: modified, Size: 6},
+		{Name: "dir/link", Typeflag: tar.TypeSymlink, Linkname: "file.txt", ModTime: modified},
+		{Name: "../evil.txt", Typeflag: tar.TypeReg, Mode: 0644, ModTime: modified, Size: 6},
+		{Name: "escape", Typeflag: tar.TypeSymlink, Linkname: "/etc", ModTime: modified},
+		{Name: "up", Typeflag: tar.TypeSymlink, Linkname: "dir/../..", ModTime: modified},
+	})
+
+	t.Run("extract tar", func(t *testing.T) {
+		mustMakeContentRoot(t)
+		defer mustDeleteContentRoot(t)
+
+		runTest(t, "/site", "application/x-tar", tarball, http.StatusOK, `{
+		  "status": "ok",
+		  "type": "extract",
+		  "extract": {
+			"dry_run": false,
+			"entries": [
+			  {"path": "/site/dir", "type": "directory", "permissions": "0755", "size": 0, "status": "extracted"},
+			  {"path": "/site/dir/file.txt", "type": "file", "permissions": "0644", "size": 6, "status": "extracted"},
+			  {"path": "/site/dir/link", "type": "symlink", "permissions": "0777", "size": 0, "status": "extracted"},
+			  {"path": "/site/evil.txt", "type": "file", "permissions": "0644", "size": 0, "status": "rejected", "error": "path escapes the target directory"},
+			  {"path": "/site/escape", "type": "symlink", "permissions": "0777", "size": 0, "status": "rejected", "error": "symlink target is absolute"},
+			  {"path": "/site/up", "type": "symlink", "permissions": "0777", "size": 0, "status": "rejected", "error": "symlink target escapes the target directory"}
+			]
+		  }
+		}`)
+		assertFileContents(t, "/site/dir/file.txt", 0644, "hello\n")
+		assertFileDoesNotExists(t, "/evil.txt")
+		assertFileDoesNotExists(t, "/site/escape")
+
+		info, err := os.Stat(path.Join(ContentRoot, "/site/dir"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !info.ModTime().Equal(modified) {
+			t.Errorf("want directory mtime %v, got %v", modified, info.ModTime())
+		}
+	})
+
+	t.Run("dry run", func(t *testing.T) {
+		mustMakeContentRoot(t)
+		defer mustDeleteContentRoot(t)
+
+		runTest(t, "/site?dry_run=true&mask=0", "application/x-tar", tarball[:0], http.StatusOK, `{
+		  "status": "ok",
+		  "type": "extract",
+		  "extract": {"dry_run": true, "entries": null}
+		}`)
+		runTest(t, "/site?dry_run=true&mask=0", "application/x-tar", tarball, http.StatusOK, `{
+		  "status": "ok",
+		  "type": "extract",
+		  "extract": {
+			"dry_run": true,
+			"entries": [
+			  {"path": "/site/dir", "type": "directory", "permissions": "0777", "size": 0, "status": "extracted"},
+			  {"path": "/site/dir/file.txt", "type": "file", "permissions": "0666", "size": 6, "status": "extracted"},
+			  {"path": "/site/dir/link", "type": "symlink", "permissions": "0777", "size": 0, "status": "extracted"},
+			  {"path": "/site/evil.txt", "type": "file", "permissions": "0644", "size": 0, "status": "rejected", "error": "path escapes the target directory"},
+			  {"path": "/site/escape", "type": "symlink", "permissions": "0777", "size": 0, "status": "rejected", "error": "symlink target is absolute"},
+			  {"path": "/site/up", "type": "symlink", "permissions": "0777", "size": 0, "status": "rejected", "error": "symlink target escapes the target directory"}
+			]
+		  }
+		}`)
+		assertFileDoesNotExists(t, "/site")
+	})
+
+	t.Run("writes through symlinks are rejected", func(t *testing.T) {
+		mustMakeContentRoot(t)
+		defer mustDeleteContentRoot(t)
+
+		mustMkDir(t, "/site", 0700)
+		mustMkDir(t, "/outside", 0700)
+		if err := os.Symlink("../outside", path.Join(ContentRoot, "/site/link")); err != nil {
+			t.Fatal(err)
+		}
+		runTest(t, "/site", "application/x-tar", mustMakeTar(t, []tar.Header{
+			{Name: "link/file.txt", Typeflag: tar.TypeReg, Mode: 0644, ModTime: modified, Size: 6},
+		}), http.StatusOK, `{
+		  "status": "ok",
+		  "type": "extract",
+		  "extract": {
+			"dry_run": false,
+			"entries": [
+			  {"path": "/site/link/file.txt", "type": "file", "permissions": "0644", "size": 0, "status": "rejected", "error": "path traverses a symlink"}
+			]
+		  }
+		}`)
+		assertFileDoesNotExists(t, "/outside/file.txt")
+	})
+
+	t.Run("symlinks are evaluated", func(t *testing.T) {
+		mustMakeContentRoot(t)
+		defer mustDeleteContentRoot(t)
+
+		runTest(t, "/site", "application/x-tar", mustMakeTar(t, []tar.Header{
+			{Name: "c/", Typeflag: tar.TypeDir, Mode: 0755, ModTime: modified},
+			{Name: "c/d", Typeflag: tar.TypeSymlink, Linkname: "..", ModTime: modified},
+			{Name: "f", Typeflag: tar.TypeSymlink, Linkname: "c/d/../pwned", ModTime: modified},
+			{Name: "g", Typeflag: tar.TypeSymlink, Linkname: "e/../c", ModTime: modified},
+			{Name: "e", Typeflag: tar.TypeSymlink, Linkname: "c/d", ModTime: modified},
+			{Name: "g", Typeflag: tar.TypeReg, Mode: 0644, ModTime: modified, Size: 6},
+			{Name: "..foo", Typeflag: tar.TypeReg, Mode: 0644, ModTime: modified, Size: 6},
+		}), http.StatusOK, `{
+		  "status": "ok",
+		  "type": "extract",
+		  "extract": {
+			"dry_run": false,
+			"entries": [
+			  {"path": "/site/c", "type": "directory", "permissions": "0755", "size": 0, "status": "extracted"},
+			  {"path": "/site/c/d", "type": "symlink", "permissions": "0777", "size": 0, "status": "extracted"},
+			  {"path": "/site/f", "type": "symlink", "permissions": "0777", "size": 0, "status": "rejected", "error": "symlink target escapes the target directory"},
+			  {"path": "/site/g", "type": "symlink", "permissions": "0777", "size": 0, "status": "extracted"},
+			  {"path": "/site/e", "type": "symlink", "permissions": "0777", "size": 0, "status": "rejected", "error": "symlink target escapes the target directory"},
+			  {"path": "/site/g", "type": "file", "permissions": "0644", "size": 6, "status": "extracted"},
+			  {"path": "/site/..foo", "type": "file", "permissions": "0644", "size": 6, "status": "extracted"}
+			]
+		  }
+		}`)
+		assertFileDoesNotExists(t, "/pwned")
+		assertFileDoesNotExists(t, "/site/e")
+		assertFileContents(t, "/site/g", 0644, "hello\n")
+		assertFileContents(t, "/site/..foo", 0644, "hello\n")
+	})
+
+	t.Run("extract zip", func(t *testing.T) {
+		mustMakeContentRoot(t)
+		defer mustDeleteContentRoot(t)
+
+		var buf bytes.Buffer
+		zw := zip.NewWriter(&buf)
+		header := &zip.FileHeader{Name: "../../file.txt", Modified: modified}
+		header.SetMode(0600)
+		fw, err := zw.CreateHeader(header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write([]byte("hello\n"))
+		header = &zip.FileHeader{Name: "ok.txt", Modified: modified}
+		header.SetMode(0600)
+		if fw, err = zw.CreateHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		fw.Write([]byte("hello\n"))
+		if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		runTest(t, "/", "application/zip", buf.Bytes(), http.StatusOK, `{
+		  "status": "ok",
+		  "type": "extract",
+		  "extract": {
+			"dry_run": false,
+			"entries": [
+			  {"path": "/file.txt", "type": "file", "permissions": "0600", "size": 0, "status": "rejected", "error": "path escapes the target directory"},
+			  {"path": "/ok.txt", "type": "file", "permissions": "0600", "size": 6, "status": "extracted"}
+			]
+		  }
+		}`)
+		assertFileContents(t, "/ok.txt", 0600, "hello\n")
+	})
+
+	t.Run("invalid archive", func(t *testing.T) {
+		mustMakeContentRoot(t)
+		defer mustDeleteContentRoot(t)
+
+		runTest(t, "/", "application/zip", []byte("not a zip"), http.StatusBadRequest, `{
+          "status": "error",
+          "type": "error",
+          "error": {
+            "code": 400,
+            "error": "invalid archive: zip: not a valid zip file"
+          }
+        }`)
+	})
+}
+
+// mustMakeTar builds a tar archive where every regular file contains "hello\n".
+func mustMakeTar(t *testing.T, headers []tar.Header) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for i := range headers {
+		if err := tw.WriteHeader(&headers[i]); err != nil {
+			t.Fatal(err)
+		}
+		if headers[i].Typeflag == tar.TypeReg {
+			if _, err := tw.Write([]byte("hello\n")); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
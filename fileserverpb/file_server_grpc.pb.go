@@ -0,0 +1,333 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.6.2
+// - protoc             (unknown)
+// source: file_server.proto
+
+package fileserverpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	FileServer_Stat_FullMethodName   = "/fileserver.v1.FileServer/Stat"
+	FileServer_Read_FullMethodName   = "/fileserver.v1.FileServer/Read"
+	FileServer_Write_FullMethodName  = "/fileserver.v1.FileServer/Write"
+	FileServer_List_FullMethodName   = "/fileserver.v1.FileServer/List"
+	FileServer_Delete_FullMethodName = "/fileserver.v1.FileServer/Delete"
+	FileServer_Watch_FullMethodName  = "/fileserver.v1.FileServer/Watch"
+)
+
+// FileServerClient is the client API for FileServer service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// FileServer mirrors the json api. Paths are relative to the content root and
+// use forward slashes, like the url paths of the json api.
+type FileServerClient interface {
+	// Stat returns the metadata of a file or directory.
+	Stat(ctx context.Context, in *StatRequest, opts ...grpc.CallOption) (*FileMeta, error)
+	// Read streams the contents of a file in chunks. The first response also
+	// has the file metadata.
+	Read(ctx context.Context, in *ReadRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[ReadResponse], error)
+	// Write creates or replaces a file. The first request has the header, the
+	// following ones the contents.
+	Write(ctx context.Context, opts ...grpc.CallOption) (grpc.ClientStreamingClient[WriteRequest, FileMeta], error)
+	// List returns a directory and its entries.
+	List(ctx context.Context, in *ListRequest, opts ...grpc.CallOption) (*ListResponse, error)
+	// Delete removes a file, or a directory when it is empty or recursive is set.
+	Delete(ctx context.Context, in *DeleteRequest, opts ...grpc.CallOption) (*DeleteResponse, error)
+	// Watch streams the change events for a path until the call is cancelled.
+	Watch(ctx context.Context, in *WatchRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[WatchEvent], error)
+}
+
+type fileServerClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewFileServerClient(cc grpc.ClientConnInterface) FileServerClient {
+	return &fileServerClient{cc}
+}
+
+func (c *fileServerClient) Stat(ctx context.Context, in *StatRequest, opts ...grpc.CallOption) (*FileMeta, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(FileMeta)
+	err := c.cc.Invoke(ctx, FileServer_Stat_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *fileServerClient) Read(ctx context.Context, in *ReadRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[ReadResponse], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &FileServer_ServiceDesc.Streams[0], FileServer_Read_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[ReadRequest, ReadResponse]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type FileServer_ReadClient = grpc.ServerStreamingClient[ReadResponse]
+
+func (c *fileServerClient) Write(ctx context.Context, opts ...grpc.CallOption) (grpc.ClientStreamingClient[WriteRequest, FileMeta], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &FileServer_ServiceDesc.Streams[1], FileServer_Write_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[WriteRequest, FileMeta]{ClientStream: stream}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type FileServer_WriteClient = grpc.ClientStreamingClient[WriteRequest, FileMeta]
+
+func (c *fileServerClient) List(ctx context.Context, in *ListRequest, opts ...grpc.CallOption) (*ListResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ListResponse)
+	err := c.cc.Invoke(ctx, FileServer_List_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *fileServerClient) Delete(ctx context.Context, in *DeleteRequest, opts ...grpc.CallOption) (*DeleteResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(DeleteResponse)
+	err := c.cc.Invoke(ctx, FileServer_Delete_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *fileServerClient) Watch(ctx context.Context, in *WatchRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[WatchEvent], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &FileServer_ServiceDesc.Streams[2], FileServer_Watch_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[WatchRequest, WatchEvent]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type FileServer_WatchClient = grpc.ServerStreamingClient[WatchEvent]
+
+// FileServerServer is the server API for FileServer service.
+// All implementations must embed UnimplementedFileServerServer
+// for forward compatibility.
+//
+// FileServer mirrors the json api. Paths are relative to the content root and
+// use forward slashes, like the url paths of the json api.
+type FileServerServer interface {
+	// Stat returns the metadata of a file or directory.
+	Stat(context.Context, *StatRequest) (*FileMeta, error)
+	// Read streams the contents of a file in chunks. The first response also
+	// has the file metadata.
+	Read(*ReadRequest, grpc.ServerStreamingServer[ReadResponse]) error
+	// Write creates or replaces a file. The first request has the header, the
+	// following ones the contents.
+	Write(grpc.ClientStreamingServer[WriteRequest, FileMeta]) error
+	// List returns a directory and its entries.
+	List(context.Context, *ListRequest) (*ListResponse, error)
+	// Delete removes a file, or a directory when it is empty or recursive is set.
+	Delete(context.Context, *DeleteRequest) (*DeleteResponse, error)
+	// Watch streams the change events for a path until the call is cancelled.
+	Watch(*WatchRequest, grpc.ServerStreamingServer[WatchEvent]) error
+	mustEmbedUnimplementedFileServerServer()
+}
+
+// UnimplementedFileServerServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedFileServerServer struct{}
+
+func (UnimplementedFileServerServer) Stat(context.Context, *StatRequest) (*FileMeta, error) {
+	return nil, status.Error(codes.Unimplemented, "method Stat not implemented")
+}
+func (UnimplementedFileServerServer) Read(*ReadRequest, grpc.ServerStreamingServer[ReadResponse]) error {
+	return status.Error(codes.Unimplemented, "method Read not implemented")
+}
+func (UnimplementedFileServerServer) Write(grpc.ClientStreamingServer[WriteRequest, FileMeta]) error {
+	return status.Error(codes.Unimplemented, "method Write not implemented")
+}
+func (UnimplementedFileServerServer) List(context.Context, *ListRequest) (*ListResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "method List not implemented")
+}
+func (UnimplementedFileServerServer) Delete(context.Context, *DeleteRequest) (*DeleteResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "method Delete not implemented")
+}
+func (UnimplementedFileServerServer) Watch(*WatchRequest, grpc.ServerStreamingServer[WatchEvent]) error {
+	return status.Error(codes.Unimplemented, "method Watch not implemented")
+}
+func (UnimplementedFileServerServer) mustEmbedUnimplementedFileServerServer() {}
+func (UnimplementedFileServerServer) testEmbeddedByValue()                    {}
+
+// UnsafeFileServerServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to FileServerServer will
+// result in compilation errors.
+type UnsafeFileServerServer interface {
+	mustEmbedUnimplementedFileServerServer()
+}
+
+func RegisterFileServerServer(s grpc.ServiceRegistrar, srv FileServerServer) {
+	// If the following call panics, it indicates UnimplementedFileServerServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&FileServer_ServiceDesc, srv)
+}
+
+func _FileServer_Stat_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(StatRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(FileServerServer).Stat(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: FileServer_Stat_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(FileServerServer).Stat(ctx, req.(*StatRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _FileServer_Read_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(ReadRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(FileServerServer).Read(m, &grpc.GenericServerStream[ReadRequest, ReadResponse]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type FileServer_ReadServer = grpc.ServerStreamingServer[ReadResponse]
+
+func _FileServer_Write_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(FileServerServer).Write(&grpc.GenericServerStream[WriteRequest, FileMeta]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type FileServer_WriteServer = grpc.ClientStreamingServer[WriteRequest, FileMeta]
+
+func _FileServer_List_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(FileServerServer).List(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: FileServer_List_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(FileServerServer).List(ctx, req.(*ListRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _FileServer_Delete_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DeleteRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(FileServerServer).Delete(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: FileServer_Delete_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(FileServerServer).Delete(ctx, req.(*DeleteRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _FileServer_Watch_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(FileServerServer).Watch(m, &grpc.GenericServerStream[WatchRequest, WatchEvent]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type FileServer_WatchServer = grpc.ServerStreamingServer[WatchEvent]
+
+// FileServer_ServiceDesc is the grpc.ServiceDesc for FileServer service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var FileServer_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "fileserver.v1.FileServer",
+	HandlerType: (*FileServerServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Stat",
+			Handler:    _FileServer_Stat_Handler,
+		},
+		{
+			MethodName: "List",
+			Handler:    _FileServer_List_Handler,
+		},
+		{
+			MethodName: "Delete",
+			Handler:    _FileServer_Delete_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Read",
+			Handler:       _FileServer_Read_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "Write",
+			Handler:       _FileServer_Write_Handler,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "Watch",
+			Handler:       _FileServer_Watch_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "file_server.proto",
+}
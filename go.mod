@@ -1,3 +1,19 @@
 module file-server
 
-go 1.16
+go 1.26.0
+
+require (
+	github.com/klauspost/compress v1.20.0
+	github.com/pkg/sftp v1.13.11
+	golang.org/x/crypto v0.57.0
+	golang.org/x/net v0.60.0
+	golang.org/x/sys v0.48.0
+	google.golang.org/grpc v1.84.0
+	google.golang.org/protobuf v1.36.11
+)
+
+require (
+	github.com/kr/fs v0.1.0 // indirect
+	golang.org/x/text v0.42.0 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20260706201446-f0a921348800 // indirect
+)
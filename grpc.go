@@ -0,0 +1,300 @@
+package main
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative fileserverpb/file_server.proto
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	pb "file-server/fileserverpb"
+)
+
+// grpcChunkSize is the default size of the chunks streamed by Read.
+const grpcChunkSize = 64 * 1024
+
+// newGRPCServer returns the server of the FileServer gRPC service. It shares
+// the file operations and hooks of the json api, but has its own watcher.
+func newGRPCServer(config Config, hooks *Hooks) *grpc.Server {
+	server := grpc.NewServer()
+	pb.RegisterFileServerServer(server, &fileServerService{
+		config:  config,
+		watcher: newWatcher(config),
+		hooks:   hooks,
+	})
+	return server
+}
+
+type fileServerService struct {
+	pb.UnimplementedFileServerServer
+	config  Config
+	watcher *Watcher
+	hooks   *Hooks
+}
+
+func (x *fileServerService) Stat(ctx context.Context, req *pb.StatRequest) (*pb.FileMeta, error) {
+	urlPath := grpcPath(req.Path)
+	options, err := grpcMetaOptions(req.Options)
+	if err != nil {
+		return nil, err
+	}
+	meta, err := statFileMeta(x.config, options, urlPath)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return grpcFileMeta(meta), nil
+}
+
+func (x *fileServerService) Read(req *pb.ReadRequest, stream pb.FileServer_ReadServer) error {
+	urlPath := grpcPath(req.Path)
+	fileName := path.Join(x.config.ContentRoot, urlPath)
+
+	f, err := x.config.Storage.Open(urlPath)
+	if err != nil {
+		return grpcError(err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return grpcError(err)
+	}
+	if !info.Mode().IsRegular() {
+		return status.Error(codes.InvalidArgument, fileName+" is not a file")
+	}
+	if req.Offset < 0 || req.Length < 0 || req.Offset > info.Size() {
+		return status.Errorf(codes.OutOfRange, "invalid range %d+%d of %s", req.Offset, req.Length, fileName)
+	}
+
+	meta, err := statFileMeta(x.config, metaOptions{}, urlPath)
+	if err != nil {
+		return grpcError(err)
+	}
+
+	length := info.Size() - req.Offset
+	if req.Length > 0 && req.Length < length {
+		length = req.Length
+	}
+	chunkSize := grpcChunkSize
+	if req.ChunkSize > 0 {
+		chunkSize = int(req.ChunkSize)
+	}
+
+	r := io.NewSectionReader(f, req.Offset, length)
+	buf := make([]byte, chunkSize)
+	response := &pb.ReadResponse{Meta: grpcFileMeta(meta)}
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 || response.Meta != nil {
+			response.Data = buf[:n]
+			if err := stream.Send(response); err != nil {
+				return err
+			}
+			response = &pb.ReadResponse{}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return grpcError(err)
+		}
+	}
+}
+
+func (x *fileServerService) Write(stream pb.FileServer_WriteServer) error {
+	req, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	header := req.GetHeader()
+	if header == nil {
+		return status.Error(codes.InvalidArgument, "the first request must be the header")
+	}
+
+	var contents []byte
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if req.GetHeader() != nil {
+			return status.Error(codes.InvalidArgument, "only the first request may be the header")
+		}
+		contents = append(contents, req.GetData()...)
+	}
+
+	urlPath := grpcPath(header.Path)
+	if err := putFile(x.config, x.hooks, urlPath, contents, header.Permissions, header.Sha256, time.Time{}); err != nil {
+		return grpcError(err)
+	}
+	meta, err := statFileMeta(x.config, metaOptions{}, urlPath)
+	if err != nil {
+		return grpcError(err)
+	}
+	return stream.SendAndClose(grpcFileMeta(meta))
+}
+
+func (x *fileServerService) List(ctx context.Context, req *pb.ListRequest) (*pb.ListResponse, error) {
+	urlPath := grpcPath(req.Path)
+	dirName := path.Join(x.config.ContentRoot, urlPath)
+
+	info, err := x.config.Storage.Stat(urlPath)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	if !info.IsDir() {
+		return nil, status.Error(codes.InvalidArgument, dirName+" is not a directory")
+	}
+
+	options, err := grpcMetaOptions(req.Options)
+	if err != nil {
+		return nil, err
+	}
+	dirData, err := readDirData(x.config, options, urlPath)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	response := &pb.ListResponse{Directory: grpcFileMeta(dirData.FileMeta)}
+	for _, entry := range dirData.Entries {
+		response.Entries = append(response.Entries, &pb.DirectoryEntry{
+			Meta: grpcFileMeta(entry.FileMeta),
+			Type: entry.Type,
+		})
+	}
+	return response, nil
+}
+
+func (x *fileServerService) Delete(ctx context.Context, req *pb.DeleteRequest) (*pb.DeleteResponse, error) {
+	if err := deleteFile(x.config, x.hooks, grpcPath(req.Path), req.Recursive); err != nil {
+		return nil, grpcError(err)
+	}
+	return &pb.DeleteResponse{}, nil
+}
+
+// Watch streams change events like handleWatch. The response headers are sent
+// once subscribed. A subscriber that falls too far behind gets an Aborted
+// error, and can resume from its last event id.
+func (x *fileServerService) Watch(req *pb.WatchRequest, stream pb.FileServer_WatchServer) error {
+	urlPath := grpcPath(req.Path)
+	if _, err := x.config.Storage.Stat(urlPath); err != nil {
+		return grpcError(err)
+	}
+
+	sub, replay, err := x.watcher.Subscribe(urlPath, req.Recursive, req.LastEventId)
+	if err != nil {
+		return grpcError(err)
+	}
+	defer x.watcher.Unsubscribe(sub)
+	if err := stream.SendHeader(metadata.MD{}); err != nil {
+		return err
+	}
+
+	for _, event := range replay {
+		if err := stream.Send(grpcWatchEvent(event)); err != nil {
+			return err
+		}
+	}
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case event, ok := <-sub.events:
+			if !ok {
+				return status.Error(codes.Aborted, "too far behind, resume from the last event id")
+			}
+			if err := stream.Send(grpcWatchEvent(event)); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// grpcPath cleans a request path so that it stays inside the content root.
+func grpcPath(p string) string {
+	return path.Clean("/" + p)
+}
+
+func grpcMetaOptions(options *pb.MetaOptions) (metaOptions, error) {
+	if err := validateChecksums(options.GetChecksums()); err != nil {
+		return metaOptions{}, status.Error(codes.InvalidArgument, err.Error())
+	}
+	return metaOptions{Xattrs: options.GetXattrs(), Checksums: options.GetChecksums()}, nil
+}
+
+func grpcFileMeta(meta FileMeta) *pb.FileMeta {
+	m := &pb.FileMeta{
+		Name:        meta.Name,
+		Path:        meta.Path,
+		Owner:       meta.Owner,
+		Group:       meta.Group,
+		Permissions: meta.Permissions,
+		Size:        meta.Size,
+		Modified:    timestamppb.New(meta.Modified),
+		MimeType:    meta.MimeType,
+		Checksums:   meta.Checksums,
+	}
+	if meta.Xattrs != nil {
+		m.Xattrs = make(map[string][]byte, len(meta.Xattrs))
+		for name, value := range meta.Xattrs {
+			// The values were encoded by readXattrs.
+			m.Xattrs[name], _ = base64.StdEncoding.DecodeString(value)
+		}
+	}
+	return m
+}
+
+func grpcWatchEvent(event WatchEvent) *pb.WatchEvent {
+	e := &pb.WatchEvent{
+		Id:      event.ID,
+		Type:    event.Type,
+		Path:    event.Path,
+		OldPath: event.OldPath,
+	}
+	if event.Meta != nil {
+		e.Meta = grpcFileMeta(*event.Meta)
+	}
+	return e
+}
+
+// grpcError converts an error of the shared file operations to a status error,
+// with the codes matching the status codes of the json api.
+func grpcError(err error) error {
+	var statusErr *statusError
+	var hookErr *HookError
+	var exitErr *exec.ExitError
+	switch {
+	case errors.As(err, &statusErr):
+		switch statusErr.code {
+		case http.StatusBadRequest:
+			return status.Error(codes.InvalidArgument, statusErr.reason)
+		case http.StatusForbidden:
+			return status.Error(codes.PermissionDenied, statusErr.reason)
+		case http.StatusNotFound:
+			return status.Error(codes.NotFound, statusErr.reason)
+		}
+	case errors.As(err, &hookErr) && !hookErr.TimedOut && errors.As(hookErr.Err, &exitErr):
+		return status.Error(codes.FailedPrecondition, fmt.Sprintf("%v: %s", err, strings.TrimSpace(hookErr.Stderr)))
+	case os.IsNotExist(err):
+		return status.Error(codes.NotFound, err.Error())
+	}
+	log.Println(err)
+	return status.Error(codes.Internal, err.Error())
+}
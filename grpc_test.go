@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	pb "file-server/fileserverpb"
+)
+
+func TestGRPCServer(t *testing.T) {
+	mustMakeContentRoot(t)
+	defer mustDeleteContentRoot(t)
+
+	config := newConfig(ContentRoot)
+	client := mustDialGRPC(t, config)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	t.Run("write and read", func(t *testing.T) {
+		stream, err := client.Write(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		requests := []*pb.WriteRequest{
+			{Request: &pb.WriteRequest_Header{Header: &pb.WriteHeader{Path: "/dir/file.txt", Permissions: "0600"}}},
+			{Request: &pb.WriteRequest_Data{Data: []byte("hello ")}},
+			{Request: &pb.WriteRequest_Data{Data: []byte("world\n")}},
+		}
+		for _, req := range requests {
+			if err := stream.Send(req); err != nil {
+				t.Fatal(err)
+			}
+		}
+		meta, err := stream.CloseAndRecv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if meta.Path != "/dir/file.txt" || meta.Size != 12 || meta.Permissions != "0600" || meta.MimeType != "text/plain; charset=utf-8" {
+			t.Errorf("got meta %v", meta)
+		}
+		assertFileContents(t, "/dir/file.txt", 0600, "hello world\n")
+
+		reads, err := client.Read(ctx, &pb.ReadRequest{Path: "/dir/file.txt", Offset: 2, Length: 7, ChunkSize: 4})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var chunks []string
+		for {
+			resp, err := reads.Recv()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (len(chunks) == 0) != (resp.Meta != nil) {
+				t.Errorf("got meta %v in chunk %d", resp.Meta, len(chunks))
+			}
+			chunks = append(chunks, string(resp.Data))
+		}
+		if len(chunks) != 2 || chunks[0] != "llo " || chunks[1] != "wor" {
+			t.Errorf("got chunks %q", chunks)
+		}
+	})
+
+	t.Run("write checks sha256", func(t *testing.T) {
+		stream, err := client.Write(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		header := &pb.WriteHeader{Path: "/bad.txt", Permissions: "0600", Sha256: "00"}
+		if err := stream.Send(&pb.WriteRequest{Request: &pb.WriteRequest_Header{Header: header}}); err != nil {
+			t.Fatal(err)
+		}
+		_, err = stream.CloseAndRecv()
+		assertGRPCCode(t, err, codes.InvalidArgument)
+		assertFileDoesNotExists(t, "/bad.txt")
+	})
+
+	t.Run("stat and list", func(t *testing.T) {
+		meta, err := client.Stat(ctx, &pb.StatRequest{Path: "dir/file.txt", Options: &pb.MetaOptions{Checksums: []string{"sha256"}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := "a948904f2f0f479b8f8197694b30184b0d2ed1c1cd2a1ec0fb85d299a192a447"; meta.Checksums["sha256"] != want {
+			t.Errorf("got checksums %v, want sha256 %s", meta.Checksums, want)
+		}
+
+		_, err = client.Stat(ctx, &pb.StatRequest{Path: "/missing.txt"})
+		assertGRPCCode(t, err, codes.NotFound)
+		_, err = client.Stat(ctx, &pb.StatRequest{Path: "dir/file.txt", Options: &pb.MetaOptions{Checksums: []string{"bogus"}}})
+		assertGRPCCode(t, err, codes.InvalidArgument)
+
+		list, err := client.List(ctx, &pb.ListRequest{Path: "/dir"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if list.Directory.Name != "dir" || len(list.Entries) != 1 || list.Entries[0].Type != DirectoryEntryTypeFile || list.Entries[0].Meta.Path != "/dir/file.txt" {
+			t.Errorf("got list %v", list)
+		}
+
+		_, err = client.List(ctx, &pb.ListRequest{Path: "/dir/file.txt"})
+		assertGRPCCode(t, err, codes.InvalidArgument)
+		_, err = client.List(ctx, &pb.ListRequest{Path: "/dir", Options: &pb.MetaOptions{Checksums: []string{"bogus"}}})
+		assertGRPCCode(t, err, codes.InvalidArgument)
+	})
+
+	t.Run("paths stay inside the content root", func(t *testing.T) {
+		list, err := client.List(ctx, &pb.ListRequest{Path: "../.."})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if list.Directory.Path != "/" || len(list.Entries) != 1 || list.Entries[0].Meta.Name != "dir" {
+			t.Errorf("got list %v", list)
+		}
+	})
+
+	t.Run("watch and delete", func(t *testing.T) {
+		watchCtx, stopWatch := context.WithCancel(ctx)
+		defer stopWatch()
+		events, err := client.Watch(watchCtx, &pb.WatchRequest{Path: "/dir"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := events.Header(); err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = client.Delete(ctx, &pb.DeleteRequest{Path: "/dir"})
+		assertGRPCCode(t, err, codes.InvalidArgument)
+		if _, err := client.Delete(ctx, &pb.DeleteRequest{Path: "/dir/file.txt"}); err != nil {
+			t.Fatal(err)
+		}
+		assertFileDoesNotExists(t, "/dir/file.txt")
+
+		event, err := events.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if event.Type != WatchEventDelete || event.Path != "/dir/file.txt" {
+			t.Errorf("got event %v", event)
+		}
+	})
+}
+
+func mustDialGRPC(t *testing.T, config Config) pb.FileServerClient {
+	t.Helper()
+	listener := bufconn.Listen(1024 * 1024)
+	server := newGRPCServer(config, newHooks(config))
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) { return listener.Dial() }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return pb.NewFileServerClient(conn)
+}
+
+func assertGRPCCode(t *testing.T, err error, want codes.Code) {
+	t.Helper()
+	if got := status.Code(err); got != want {
+		t.Errorf("got code %v (%v), want %v", got, err, want)
+	}
+}
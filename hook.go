@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"time"
+)
+
+const (
+	HookStagePre  = "pre"
+	HookStagePost = "post"
+)
+
+const (
+	HookOperationPut     = "put"
+	HookOperationPost    = "post"
+	HookOperationDelete  = "delete"
+	HookOperationExtract = "extract"
+)
+
+// hookMaxStderr is how much of a failed hook's stderr is kept and returned.
+const hookMaxStderr = 64 * 1024
+
+// hookWaitDelay is how long a hook that timed out, or that exited while a
+// child it started still has its stderr open, is waited for before it is
+// given up on.
+const hookWaitDelay = time.Second
+
+// Hook is a local command that runs before or after the changes to paths
+// matching any of its globs. Empty Paths or Operations match everything.
+type Hook struct {
+	Stage      string   `json:"stage"`
+	Paths      []string `json:"paths"`
+	Operations []string `json:"operations"`
+	Command    []string `json:"command"`
+}
+
+// loadHooks reads a json list of hooks.
+func loadHooks(fileName string) ([]Hook, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	var hooks []Hook
+	if err := json.Unmarshal(data, &hooks); err != nil {
+		return nil, fmt.Errorf("%s: %v", fileName, err)
+	}
+	for _, hook := range hooks {
+		if hook.Stage != HookStagePre && hook.Stage != HookStagePost {
+			return nil, fmt.Errorf("%s: invalid hook stage %q", fileName, hook.Stage)
+		}
+		if len(hook.Command) == 0 {
+			return nil, fmt.Errorf("%s: hook has no command", fileName)
+		}
+		for _, pattern := range hook.Paths {
+			if _, err := path.Match(pattern, "/"); err != nil {
+				return nil, fmt.Errorf("%s: invalid path glob %q", fileName, pattern)
+			}
+		}
+	}
+	return hooks, nil
+}
+
+// HookEvent describes the change a hook runs for. It is passed to the
+// command in FILE_SERVER_HOOK_* environment variables.
+type HookEvent struct {
+	Operation string
+	URLPath   string
+	FileName  string
+	// Permissions and Size describe the new contents of puts and posts.
+	Permissions os.FileMode
+	Size        int
+	Recursive   bool
+}
+
+func (x HookEvent) env(stage string) []string {
+	env := append(os.Environ(),
+		"FILE_SERVER_HOOK_STAGE="+stage,
+		"FILE_SERVER_HOOK_OPERATION="+x.Operation,
+		"FILE_SERVER_HOOK_PATH="+x.URLPath,
+		"FILE_SERVER_HOOK_FILE="+x.FileName,
+	)
+	switch x.Operation {
+	case HookOperationPut, HookOperationPost:
+		env = append(env,
+			fmt.Sprintf("FILE_SERVER_HOOK_PERMISSIONS=0%o", x.Permissions),
+			"FILE_SERVER_HOOK_SIZE="+strconv.Itoa(x.Size),
+		)
+	case HookOperationDelete:
+		env = append(env, "FILE_SERVER_HOOK_RECURSIVE="+strconv.FormatBool(x.Recursive))
+	}
+	return env
+}
+
+func (x Hook) matches(stage string, event HookEvent) bool {
+	if x.Stage != stage {
+		return false
+	}
+	if len(x.Operations) > 0 && !containsString(x.Operations, event.Operation) {
+		return false
+	}
+	if len(x.Paths) == 0 {
+		return true
+	}
+	for _, pattern := range x.Paths {
+		if ok, _ := path.Match(pattern, event.URLPath); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// HookError is returned when a hook fails. Failed pre-hooks abort the change.
+type HookError struct {
+	Stage    string
+	Command  string
+	Stderr   string
+	TimedOut bool
+	Err      error
+}
+
+func (x *HookError) Error() string {
+	if x.TimedOut {
+		return fmt.Sprintf("%s hook %s timed out", x.Stage, x.Command)
+	}
+	return fmt.Sprintf("%s hook %s failed: %v", x.Stage, x.Command, x.Err)
+}
+
+// Hooks runs the configured hooks, at most config.HookConcurrency at a time.
+type Hooks struct {
+	config Config
+	slots  chan struct{}
+}
+
+func newHooks(config Config) *Hooks {
+	concurrency := config.HookConcurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	return &Hooks{config: config, slots: make(chan struct{}, concurrency)}
+}
+
+// with returns hooks for the config that share the slots of these.
+func (x *Hooks) with(config Config) *Hooks {
+	return &Hooks{config: config, slots: x.slots}
+}
+
+// any reports whether any pre or post hooks match the event.
+func (x *Hooks) any(event HookEvent) bool {
+	for _, hook := range x.config.Hooks {
+		if hook.matches(HookStagePre, event) || hook.matches(HookStagePost, event) {
+			return true
+		}
+	}
+	return false
+}
+
+// Pre runs the matching pre-hooks in order, stopping at the first that fails.
+// stdin is the new contents for puts and posts.
+func (x *Hooks) Pre(event HookEvent, stdin []byte) error {
+	for _, hook := range x.config.Hooks {
+		if !hook.matches(HookStagePre, event) {
+			continue
+		}
+		if err := x.run(hook, HookStagePre, event, stdin); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Post runs the matching post-hooks. The change has already been made, so
+// failures are only logged.
+func (x *Hooks) Post(event HookEvent, stdin []byte) {
+	for _, hook := range x.config.Hooks {
+		if !hook.matches(HookStagePost, event) {
+			continue
+		}
+		if err := x.run(hook, HookStagePost, event, stdin); err != nil {
+			log.Printf("%s: %v", event.URLPath, err)
+		}
+	}
+}
+
+func (x *Hooks) run(hook Hook, stage string, event HookEvent, stdin []byte) error {
+	x.slots <- struct{}{}
+	defer func() { <-x.slots }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), x.config.HookTimeout)
+	defer cancel()
+
+	stderr := &hookStderr{}
+	cmd := exec.CommandContext(ctx, hook.Command[0], hook.Command[1:]...)
+	cmd.WaitDelay = hookWaitDelay
+	// Hooks run in the content root when it is on disk.
+	if storage, ok := diskStorageOf(x.config.Storage); ok {
+		cmd.Dir = storage.root
+	}
+	cmd.Env = event.env(stage)
+	cmd.Stdin = bytes.NewReader(stdin)
+	cmd.Stderr = stderr
+	err := cmd.Run()
+	if err == nil {
+		return nil
+	}
+
+	hookErr := &HookError{
+		Stage:    stage,
+		Command:  hook.Command[0],
+		Stderr:   stderr.String(),
+		TimedOut: errors.Is(ctx.Err(), context.DeadlineExceeded),
+		Err:      err,
+	}
+	return hookErr
+}
+
+// hookStderr keeps the first hookMaxStderr bytes written to it, and discards
+// the rest.
+type hookStderr struct {
+	buf bytes.Buffer
+}
+
+func (x *hookStderr) Write(p []byte) (int, error) {
+	if n := hookMaxStderr - x.buf.Len(); n > 0 {
+		x.buf.Write(p[:min(n, len(p))])
+	}
+	return len(p), nil
+}
+
+func (x *hookStderr) String() string {
+	return x.buf.String()
+}
+
+// hookFailed writes the error response for a failed pre-hook. Hooks that
+// reject the change are bad requests, while hooks that time out or can't be
+// run are server errors.
+func hookFailed(w http.ResponseWriter, err error) {
+	var hookErr *HookError
+	if !errors.As(err, &hookErr) {
+		internalServerError(w, err)
+		return
+	}
+
+	code := http.StatusBadRequest
+	var exitErr *exec.ExitError
+	if hookErr.TimedOut || !errors.As(hookErr.Err, &exitErr) {
+		log.Println(err)
+		code = http.StatusInternalServerError
+	}
+	writeResponse(w, ResponseBody{
+		Status: "error",
+		Type:   ResponseTypeError,
+		Error:  &ErrorData{Code: code, Error: err.Error(), Stderr: hookErr.Stderr},
+	})
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHooks(t *testing.T) {
+	runTest := func(t *testing.T, config Config, method string, target string, reqBody string, wantStatus int, wantBody string) {
+		t.Helper()
+		httpRequest := httptest.NewRequest(method, target, strings.NewReader(reqBody))
+		responseRecorder := httptest.NewRecorder()
+		httpHandler(config).ServeHTTP(responseRecorder, httpRequest)
+		assertHttpResponse(t, responseRecorder.Result(), wantStatus, wantBody)
+	}
+
+	lint := Hook{
+		Stage:      HookStagePre,
+		Paths:      []string{"/configs/*.yaml"},
+		Operations: []string{HookOperationPut, HookOperationPost},
+		Command:    []string{"sh", "-c", `if grep -q tab; then echo "$FILE_SERVER_HOOK_PATH: tabs are not allowed" >&2; exit 1; fi`},
+	}
+
+	t.Run("failing pre hook aborts put", func(t *testing.T) {
+		mustMakeContentRoot(t)
+		defer mustDeleteContentRoot(t)
+
+		config := newConfig(ContentRoot)
+		config.Hooks = []Hook{lint}
+		runTest(t, config, http.MethodPut, "/configs/app.yaml", `{"permissions": "0600", "contents": "key:\ttab\n"}`, http.StatusBadRequest, `{
+          "status": "error",
+          "type": "error",
+          "error": {
+            "code": 400,
+            "error": "pre hook sh failed: exit status 1",
+            "stderr": "/configs/app.yaml: tabs are not allowed\n"
+          }
+        }`)
+		assertFileDoesNotExists(t, "/configs/app.yaml")
+	})
+
+	t.Run("failing pre hook aborts whole post", func(t *testing.T) {
+		mustMakeContentRoot(t)
+		defer mustDeleteContentRoot(t)
+
+		config := newConfig(ContentRoot)
+		config.Hooks = []Hook{lint}
+		runTest(t, config, http.MethodPost, "/configs", `[
+          {"name": "good.yaml", "permissions": "0600", "contents": "key: value\n"},
+          {"name": "bad.yaml", "permissions": "0600", "contents": "key:\ttab\n"}
+        ]`, http.StatusBadRequest, `{
+          "status": "error",
+          "type": "error",
+          "error": {
+            "code": 400,
+            "error": "pre hook sh failed: exit status 1",
+            "stderr": "/configs/bad.yaml: tabs are not allowed\n"
+          }
+        }`)
+		assertFileDoesNotExists(t, "/configs/good.yaml")
+	})
+
+	t.Run("passing pre hook and post hook", func(t *testing.T) {
+		mustMakeContentRoot(t)
+		defer mustDeleteContentRoot(t)
+
+		config := newConfig(ContentRoot)
+		config.Hooks = []Hook{lint, {
+			Stage:   HookStagePost,
+			Command: []string{"sh", "-c", `echo "$FILE_SERVER_HOOK_OPERATION $FILE_SERVER_HOOK_PATH $FILE_SERVER_HOOK_PERMISSIONS $FILE_SERVER_HOOK_SIZE" >> hooks.log`},
+		}}
+		httpRequest := httptest.NewRequest(http.MethodPut, "/configs/app.yaml", strings.NewReader(`{"permissions": "0640", "contents": "key: value\n"}`))
+		responseRecorder := httptest.NewRecorder()
+		httpHandler(config).ServeHTTP(responseRecorder, httpRequest)
+		assertResponseHasStatusCode(t, responseRecorder.Result(), http.StatusOK)
+
+		assertFileContents(t, "/configs/app.yaml", 0640, "key: value\n")
+		assertFileContents(t, "/hooks.log", 0644, "put /configs/app.yaml 0640 11\n")
+	})
+
+	t.Run("failing pre hook aborts delete", func(t *testing.T) {
+		mustMakeContentRoot(t)
+		defer mustDeleteContentRoot(t)
+
+		mustWriteFile(t, []byte("hello\n"), "/keep.txt", 0600)
+		config := newConfig(ContentRoot)
+		config.Hooks = []Hook{{
+			Stage:      HookStagePre,
+			Operations: []string{HookOperationDelete},
+			Command:    []string{"sh", "-c", `echo "$FILE_SERVER_HOOK_PATH is protected" >&2; exit 2`},
+		}}
+		runTest(t, config, http.MethodDelete, "/keep.txt", "", http.StatusBadRequest, `{
+          "status": "error",
+          "type": "error",
+          "error": {
+            "code": 400,
+            "error": "pre hook sh failed: exit status 2",
+            "stderr": "/keep.txt is protected\n"
+          }
+        }`)
+		assertFileExists(t, "/keep.txt")
+	})
+
+	t.Run("pre hook timeout", func(t *testing.T) {
+		mustMakeContentRoot(t)
+		defer mustDeleteContentRoot(t)
+
+		config := newConfig(ContentRoot)
+		config.HookTimeout = 50 * time.Millisecond
+		config.Hooks = []Hook{{Stage: HookStagePre, Command: []string{"sleep", "5"}}}
+		runTest(t, config, http.MethodPut, "/file.txt", `{"permissions": "0600"}`, http.StatusInternalServerError, `{
+          "status": "error",
+          "type": "error",
+          "error": {
+            "code": 500,
+            "error": "pre hook sleep timed out"
+          }
+        }`)
+		assertFileDoesNotExists(t, "/file.txt")
+	})
+
+	t.Run("failing post hook names its stage", func(t *testing.T) {
+		mustMakeContentRoot(t)
+		defer mustDeleteContentRoot(t)
+
+		config := newConfig(ContentRoot)
+		hook := Hook{Stage: HookStagePost, Command: []string{"sh", "-c", "exit 1"}}
+		err := newHooks(config).run(hook, HookStagePost, HookEvent{Operation: HookOperationDelete, URLPath: "/file.txt"}, nil)
+		if err == nil || err.Error() != "post hook sh failed: exit status 1" {
+			t.Errorf("got error %v", err)
+		}
+	})
+
+	t.Run("children keeping stderr open are not waited for", func(t *testing.T) {
+		mustMakeContentRoot(t)
+		defer mustDeleteContentRoot(t)
+
+		config := newConfig(ContentRoot)
+		hook := Hook{Stage: HookStagePre, Command: []string{"sh", "-c", "sleep 10 & head -c 100000 /dev/zero >&2; exit 1"}}
+		start := time.Now()
+		err := newHooks(config).run(hook, HookStagePre, HookEvent{Operation: HookOperationPut, URLPath: "/file.txt"}, nil)
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Errorf("waited %v for the hook", elapsed)
+		}
+		var hookErr *HookError
+		if !errors.As(err, &hookErr) {
+			t.Fatalf("got error %v", err)
+		}
+		if len(hookErr.Stderr) != hookMaxStderr {
+			t.Errorf("got %d bytes of stderr, want %d", len(hookErr.Stderr), hookMaxStderr)
+		}
+	})
+}
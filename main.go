@@ -4,50 +4,140 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"path"
 	"strconv"
 	"syscall"
+	"time"
 )
 
 func main() {
-	contentRoot := os.Getenv("FILE_SERVER_CONTENT_ROOT")
-	if contentRoot == "" {
-		contentRoot = "."
+	config, err := loadConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if config.MimeTypesFile != "" {
+		if err := loadMimeTypes(config.MimeTypesFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+	go runExpiryReaper(config)
+	// The apis share the hook slots, so that at most
+	// FILE_SERVER_HOOK_CONCURRENCY hooks run at once.
+	hooks := newHooks(config)
+
+	if config.S3ListenAddress != "" {
+		go func() {
+			log.Printf("serving s3 on %s...", config.S3ListenAddress)
+			log.Fatal(http.ListenAndServe(config.S3ListenAddress, s3Handler(config, hooks)))
+		}()
+	}
+
+	if config.GRPCListenAddress != "" {
+		listener, err := net.Listen("tcp", config.GRPCListenAddress)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go func() {
+			log.Printf("serving grpc on %s...", config.GRPCListenAddress)
+			log.Fatal(newGRPCServer(config, hooks).Serve(listener))
+		}()
 	}
 
-	listenAddress := os.Getenv("FILE_SERVER_LISTEN_ADDRESS")
-	if listenAddress == "" {
-		listenAddress = "localhost:8080"
+	if config.SFTPListenAddress != "" {
+		server, err := newSFTPServer(config, hooks)
+		if err != nil {
+			log.Fatal(err)
+		}
+		listener, err := net.Listen("tcp", config.SFTPListenAddress)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go func() {
+			log.Printf("serving sftp on %s...", config.SFTPListenAddress)
+			log.Fatal(server.Serve(listener))
+		}()
 	}
 
-	log.Printf("listening on %s...", listenAddress)
-	log.Fatal(http.ListenAndServe(listenAddress, httpHandler(contentRoot)))
+	log.Printf("listening on %s...", config.ListenAddress)
+	log.Fatal(http.ListenAndServe(config.ListenAddress, httpHandlerWithHooks(config, hooks)))
 }
 
-func httpHandler(contentRoot string) http.Handler {
+func httpHandler(config Config) http.Handler {
+	return httpHandlerWithHooks(config, newHooks(config))
+}
+
+// httpHandlerWithHooks is httpHandler with hooks that may be shared with the
+// other apis.
+func httpHandlerWithHooks(config Config, hooks *Hooks) http.Handler {
+	if len(config.Mounts) > 0 {
+		return mountsHandler(config, hooks)
+	}
+	watcher := newWatcher(config)
+	return apiHandler(config, watcher, newWebhooks(config, watcher), hooks)
+}
+
+// apiHandler serves the http apis of the storage of the config.
+func apiHandler(config Config, watcher *Watcher, webhooks *Webhooks, hooks *Hooks) http.Handler {
+	dav := newDavHandler(config, hooks)
+	snapshots := newSnapshots(config)
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		switch r.Method {
-		case http.MethodGet:
-			handleGet(contentRoot, w, r)
-		case http.MethodPost:
-			handlePost(contentRoot, w, r)
-		case http.MethodPut:
-			handlePut(contentRoot, w, r)
-		case http.MethodDelete:
-			handleDelete(contentRoot, w, r)
+		switch {
+		case r.URL.Path == webSocketPath:
+			handleWebSocket(config, watcher, hooks, w, r)
+		case config.WebDAV && isDavRequest(r):
+			dav.ServeHTTP(w, r)
+		case isWebhookDeliveriesRequest(r):
+			handleWebhookDeliveries(webhooks, w, r)
+		case isUsageRequest(r):
+			handleUsage(config, w, r)
+		case isSnapshotsRequest(r):
+			handleSnapshots(config, snapshots, w, r)
+		case isWatchRequest(r):
+			handleWatch(config, watcher, w, r)
 		default:
-			writeErrorResponse(w, http.StatusMethodNotAllowed, "method not allowed")
+			handleRequest(config, hooks, w, r)
 		}
 	})
 }
 
-func handleGet(contentRoot string, w http.ResponseWriter, r *http.Request) {
-	fileName := path.Join(contentRoot, r.URL.Path)
-	fileInfo, err := os.Stat(fileName)
+// handleRequest handles the json api requests.
+func handleRequest(config Config, hooks *Hooks, w http.ResponseWriter, r *http.Request) {
+	if err := validateChecksumQuery(r); err != nil {
+		badRequest(w, err.Error())
+		return
+	}
+	var statusErr *statusError
+	switch err := verifyContentDigest(w, r); {
+	case errors.As(err, &statusErr):
+		writeError(w, err)
+		return
+	case err != nil:
+		badRequest(w, err.Error())
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		handleGet(config, w, r)
+	case http.MethodPost:
+		handlePost(config, hooks, w, r)
+	case http.MethodPut:
+		handlePut(config, hooks, w, r)
+	case http.MethodDelete:
+		handleDelete(config, hooks, w, r)
+	case http.MethodPatch:
+		handlePatch(config, w, r)
+	default:
+		writeErrorResponse(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func handleGet(config Config, w http.ResponseWriter, r *http.Request) {
+	fileInfo, err := config.Storage.Stat(r.URL.Path)
 	switch {
 	case err == nil:
 		break
@@ -59,74 +149,125 @@ func handleGet(contentRoot string, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	archiveFormat, err := requestedArchiveFormat(r)
+	if err != nil {
+		badRequest(w, err.Error())
+		return
+	}
+
 	switch {
+	case fileInfo.Mode().IsDir() && archiveFormat != "":
+		writeArchiveResponse(config, w, r, r.URL.Path, archiveFormat)
+	case fileInfo.Mode().IsRegular() && r.URL.Query().Get("raw") == "true":
+		writeRawFileResponse(config, w, r, r.URL.Path)
 	case fileInfo.Mode().IsRegular():
-		writeFileResponse(w, r.URL.Path, fileName)
+		writeFileResponse(config, w, r, r.URL.Path)
 	case fileInfo.Mode().IsDir():
-		writeDirResponse(w, r.URL.Path, fileName)
+		writeDirResponse(config, w, r, r.URL.Path)
 	default:
 		badRequest(w, "unsupported file type")
 	}
 }
 
-func handlePut(contentRoot string, w http.ResponseWriter, r *http.Request) {
+func handlePut(config Config, hooks *Hooks, w http.ResponseWriter, r *http.Request) {
 	var data PutFileRequest
 	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
 		invalidJson(w, err)
 		return
 	}
 
-	fileName := path.Join(contentRoot, r.URL.Path)
-	dirName := path.Dir(fileName)
+	expiresAt, err := parseExpiry(path.Join(config.ContentRoot, r.URL.Path), data.TTL, data.ExpiresAt, time.Now())
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := putFile(config, hooks, r.URL.Path, []byte(data.Contents), data.Permissions, data.Sha256, expiresAt); err != nil {
+		writeError(w, err)
+		return
+	}
+	writeFileResponse(config, w, r, r.URL.Path)
+}
+
+// putFile creates or replaces the file at urlPath, creating its parent
+// directories. The file expires at expiresAt, or never if it is the zero
+// time. It is shared by the apis.
+func putFile(config Config, hooks *Hooks, urlPath string, contents []byte, permissions, sha256 string, expiresAt time.Time) error {
+	fileName := path.Join(config.ContentRoot, urlPath)
+	dirName := path.Dir(urlPath)
 
-	_, err := os.Stat(dirName)
+	_, err := config.Storage.Stat(dirName)
 	switch {
 	case os.IsNotExist(err):
-		if err := os.MkdirAll(dirName, 0700); err != nil {
-			internalServerError(w, err)
-			return
+		if err := config.Storage.MkdirAll(dirName, 0700); err != nil {
+			return err
 		}
 	case err != nil:
-		internalServerError(w, err)
-		return
+		return err
 	}
 
-	info, err := os.Stat(fileName)
+	info, err := config.Storage.Stat(urlPath)
 	switch {
 	case err == nil && info.Mode().IsRegular():
 		break
 	case os.IsNotExist(err):
 		break
 	case err != nil:
-		internalServerError(w, err)
+		return err
 	default:
-		badRequest(w, fileName+" is not a file")
-		return
+		return &statusError{http.StatusBadRequest, fileName + " is not a file"}
 	}
 
-	perms, err := strconv.ParseUint(data.Permissions, 8, 32)
+	perms, err := strconv.ParseUint(permissions, 8, 32)
 	if err != nil {
-		invalidPermissions(w, fileName)
-		return
+		return invalidPermissionsError(fileName)
 	}
 
-	if err := os.WriteFile(fileName, []byte(data.Contents), os.FileMode(perms)); err != nil {
-		internalServerError(w, err)
-		return
+	if err := verifySha256(contents, sha256); err != nil {
+		return &statusError{http.StatusBadRequest, fmt.Sprintf("%s: %v", fileName, err)}
+	}
+	if !expiresAt.IsZero() {
+		if err := checkExpiry(config.Storage, urlPath, fileName); err != nil {
+			return err
+		}
+	}
+
+	event := HookEvent{
+		Operation:   HookOperationPut,
+		URLPath:     urlPath,
+		FileName:    fileName,
+		Permissions: os.FileMode(perms),
+		Size:        len(contents),
+	}
+	if err := hooks.Pre(event, contents); err != nil {
+		return err
 	}
 
-	writeFileResponse(w, r.URL.Path, fileName)
+	if err := writeExpiringFile(config.Storage, urlPath, fileName, contents, os.FileMode(perms), expiresAt); err != nil {
+		return err
+	}
+	hooks.Post(event, contents)
+	return nil
 }
 
-func handlePost(contentRoot string, w http.ResponseWriter, r *http.Request) {
-	dirName := path.Join(contentRoot, r.URL.Path)
+func handlePost(config Config, hooks *Hooks, w http.ResponseWriter, r *http.Request) {
+	archiveFormat, err := postedArchiveFormat(r)
+	if err != nil {
+		badRequest(w, err.Error())
+		return
+	}
+	if archiveFormat != "" {
+		handlePostArchive(config, hooks, w, r, archiveFormat)
+		return
+	}
+
+	dirName := path.Join(config.ContentRoot, r.URL.Path)
 
-	info, err := os.Stat(dirName)
+	info, err := config.Storage.Stat(r.URL.Path)
 	switch {
 	case err == nil && info.IsDir():
 		break
 	case os.IsNotExist(err):
-		if err := os.MkdirAll(dirName, 0700); err != nil {
+		if err := config.Storage.MkdirAll(r.URL.Path, 0700); err != nil {
 			internalServerError(w, err)
 			return
 		}
@@ -146,9 +287,11 @@ func handlePost(contentRoot string, w http.ResponseWriter, r *http.Request) {
 	}
 
 	type createFileArgs struct {
-		fileName string
-		content  []byte
-		perms    os.FileMode
+		name      string
+		content   []byte
+		perms     os.FileMode
+		expiresAt time.Time
+		event     HookEvent
 	}
 	var args []createFileArgs
 	for _, fileData := range data {
@@ -158,59 +301,146 @@ func handlePost(contentRoot string, w http.ResponseWriter, r *http.Request) {
 			invalidPermissions(w, fileName)
 			return
 		}
+		if err := verifySha256([]byte(fileData.Contents), fileData.Sha256); err != nil {
+			badRequest(w, fmt.Sprintf("%s: %v", fileName, err))
+			return
+		}
+		expiresAt, err := parseExpiry(fileName, fileData.TTL, fileData.ExpiresAt, time.Now())
+		if err == nil && !expiresAt.IsZero() {
+			err = checkExpiry(config.Storage, path.Join(r.URL.Path, fileData.Name), fileName)
+		}
+		if err != nil {
+			writeError(w, err)
+			return
+		}
 
 		args = append(args, createFileArgs{
-			fileName,
+			path.Join(r.URL.Path, fileData.Name),
 			[]byte(fileData.Contents),
 			os.FileMode(perms),
+			expiresAt,
+			HookEvent{
+				Operation:   HookOperationPost,
+				URLPath:     path.Join(r.URL.Path, fileData.Name),
+				FileName:    fileName,
+				Permissions: os.FileMode(perms),
+				Size:        len(fileData.Contents),
+			},
 		})
 	}
 
+	// All the files are checked before any are written.
 	for i := range args {
-		if err := os.WriteFile(args[i].fileName, args[i].content, args[i].perms); err != nil {
-			internalServerError(w, err)
+		if err := hooks.Pre(args[i].event, args[i].content); err != nil {
+			hookFailed(w, err)
 			return
 		}
 	}
-	writeDirResponse(w, r.URL.Path, dirName)
+
+	for i := range args {
+		if err := writeExpiringFile(config.Storage, args[i].name, args[i].event.FileName, args[i].content, args[i].perms, args[i].expiresAt); err != nil {
+			writeError(w, err)
+			return
+		}
+		hooks.Post(args[i].event, args[i].content)
+	}
+	writeDirResponse(config, w, r, r.URL.Path)
+}
+
+func handleDelete(config Config, hooks *Hooks, w http.ResponseWriter, r *http.Request) {
+	if err := deleteFile(config, hooks, r.URL.Path, r.FormValue("recursive") == "true"); err != nil {
+		writeError(w, err)
+		return
+	}
+	writeResponse(w, ResponseBody{Status: "ok", Type: ResponseTypeDeleted})
 }
 
-func handleDelete(contentRoot string, w http.ResponseWriter, r *http.Request) {
-	fileName := path.Join(contentRoot, r.URL.Path)
+// deleteFile removes the file or directory at urlPath. Directories must be
+// empty unless recursive is set.
+func deleteFile(config Config, hooks *Hooks, urlPath string, recursive bool) error {
+	fileName := path.Join(config.ContentRoot, urlPath)
+
+	event := HookEvent{
+		Operation: HookOperationDelete,
+		URLPath:   urlPath,
+		FileName:  fileName,
+		Recursive: recursive,
+	}
+	if err := hooks.Pre(event, nil); err != nil {
+		return err
+	}
 
 	var err error
-	if r.FormValue("recursive") == "true" {
-		err = os.RemoveAll(fileName)
+	if recursive {
+		err = config.Storage.RemoveAll(urlPath)
 	} else {
-		err = os.Remove(fileName)
+		err = config.Storage.Remove(urlPath)
+	}
+	if errors.Is(err, syscall.ENOTEMPTY) {
+		return &statusError{http.StatusBadRequest, err.Error()}
 	}
+	if err != nil {
+		return err
+	}
+	forgetChecksums(config, urlPath)
+	hooks.Post(event, nil)
+	return nil
+}
 
-	switch {
-	case err == nil:
-		writeResponse(w, ResponseBody{Status: "ok", Type: ResponseTypeDeleted})
-	case errors.Is(err, syscall.ENOTEMPTY):
-		badRequest(w, err.Error())
-	case os.IsNotExist(err):
-		notFound(w, err)
-	default:
-		internalServerError(w, err)
+// renameFile moves a file. Files moved to a path that put hooks match are
+// checked by them like new uploads, and directories can't be moved there at
+// all.
+func renameFile(config Config, hooks *Hooks, oldURLPath, urlPath string) error {
+	info, err := config.Storage.Stat(oldURLPath)
+	if err != nil {
+		return err
 	}
+	event := HookEvent{Operation: HookOperationPut, URLPath: urlPath, FileName: path.Join(config.ContentRoot, urlPath), Permissions: info.Mode().Perm()}
+	if !hooks.any(event) {
+		if err := config.Storage.Rename(oldURLPath, urlPath); err != nil {
+			return err
+		}
+		forgetChecksums(config, oldURLPath, urlPath)
+		return nil
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a file", oldURLPath)
+	}
+
+	contents, err := readFile(config.Storage, oldURLPath)
+	if err != nil {
+		return err
+	}
+	event.Size = len(contents)
+	if err := hooks.Pre(event, contents); err != nil {
+		return err
+	}
+	if err := config.Storage.Rename(oldURLPath, urlPath); err != nil {
+		return err
+	}
+	forgetChecksums(config, oldURLPath, urlPath)
+	hooks.Post(event, contents)
+	return nil
 }
 
-func writeFileResponse(w http.ResponseWriter, urlPath, filePath string) {
-	fileInfo, err := os.Stat(filePath)
+func writeFileResponse(config Config, w http.ResponseWriter, r *http.Request, name string) {
+	fileInfo, err := config.Storage.Stat(name)
 	if err != nil {
 		internalServerError(w, err)
 		return
 	}
 
-	contents, err := ioutil.ReadFile(filePath)
+	contents, err := readFile(config.Storage, name)
 	if err != nil {
 		internalServerError(w, err)
 		return
 	}
 
-	fileData := NewFileData(urlPath, fileInfo, string(contents))
+	fileData := NewFileData(config.urlPath(r.URL.Path), fileInfo, string(contents))
+	if err := addExtraMeta(config, requestedMetaOptions(r), &fileData.FileMeta, name); err != nil {
+		internalServerError(w, err)
+		return
+	}
 	writeResponse(w, ResponseBody{
 		Status: "ok",
 		Type:   ResponseTypeFile,
@@ -218,22 +448,37 @@ func writeFileResponse(w http.ResponseWriter, urlPath, filePath string) {
 	})
 }
 
-func writeDirResponse(w http.ResponseWriter, urlPath, dirName string) {
-	dirInfo, err := os.Stat(dirName)
+// writeRawFileResponse writes the file contents as the response body with its
+// mime type as the Content-Type. Range and conditional requests are supported.
+func writeRawFileResponse(config Config, w http.ResponseWriter, r *http.Request, name string) {
+	f, err := config.Storage.Open(name)
 	if err != nil {
 		internalServerError(w, err)
 		return
 	}
+	defer f.Close()
 
-	dirEntries, err := os.ReadDir(dirName)
+	fileInfo, err := f.Stat()
 	if err != nil {
 		internalServerError(w, err)
 		return
 	}
 
-	dirData := NewDirectoryData(urlPath, dirInfo, dirEntries)
-	if urlPath == "/" {
-		dirData.Name = "/"
+	mimeType, err := detectMimeType(config.Storage, name)
+	if err != nil {
+		internalServerError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", mimeType)
+	http.ServeContent(w, r, fileInfo.Name(), fileInfo.ModTime(), f)
+}
+
+func writeDirResponse(config Config, w http.ResponseWriter, r *http.Request, name string) {
+	dirData, err := readDirData(config, requestedMetaOptions(r), name)
+	if err != nil {
+		internalServerError(w, err)
+		return
 	}
 	writeResponse(w, ResponseBody{
 		Status:    "ok",
@@ -242,6 +487,119 @@ func writeDirResponse(w http.ResponseWriter, urlPath, dirName string) {
 	})
 }
 
+// readDirData reads the directory at urlPath and its entries.
+func readDirData(config Config, options metaOptions, urlPath string) (DirectoryData, error) {
+	dirInfo, err := config.Storage.Stat(urlPath)
+	if err != nil {
+		return DirectoryData{}, err
+	}
+
+	dirEntries, err := config.Storage.ReadDir(urlPath)
+	if err != nil {
+		return DirectoryData{}, err
+	}
+	dirEntries = withoutTempFiles(dirEntries)
+
+	dirData := NewDirectoryData(config.urlPath(urlPath), dirInfo, dirEntries)
+	if config.urlPath(urlPath) == "/" {
+		dirData.Name = "/"
+	}
+	if err := addExtraMeta(config, options, &dirData.FileMeta, urlPath); err != nil {
+		return DirectoryData{}, err
+	}
+	for i, entry := range dirData.Entries {
+		if entry.Type == DirectoryEntryTypeSymlink {
+			continue
+		}
+		if err := addExtraMeta(config, options, &dirData.Entries[i].FileMeta, path.Join(urlPath, entry.Name)); err != nil {
+			return DirectoryData{}, err
+		}
+	}
+	return dirData, nil
+}
+
+func writeMetaResponse(config Config, w http.ResponseWriter, r *http.Request, name string) {
+	meta, err := statFileMeta(config, requestedMetaOptions(r), name)
+	if err != nil {
+		internalServerError(w, err)
+		return
+	}
+	writeResponse(w, ResponseBody{
+		Status: "ok",
+		Type:   ResponseTypeMeta,
+		Meta:   &meta,
+	})
+}
+
+// statFileMeta returns the metadata of the file at urlPath.
+func statFileMeta(config Config, options metaOptions, urlPath string) (FileMeta, error) {
+	fileInfo, err := config.Storage.Stat(urlPath)
+	if err != nil {
+		return FileMeta{}, err
+	}
+
+	meta := NewFileMeta(config.urlPath(urlPath), fileInfo)
+	if config.urlPath(urlPath) == "/" {
+		meta.Name = "/"
+	}
+	if err := addExtraMeta(config, options, &meta, urlPath); err != nil {
+		return FileMeta{}, err
+	}
+	return meta, nil
+}
+
+// metaOptions selects the optional metadata that is read from the file.
+type metaOptions struct {
+	Xattrs    bool
+	Checksums []string
+}
+
+// requestedMetaOptions returns the optional metadata asked for in the url
+// query.
+func requestedMetaOptions(r *http.Request) metaOptions {
+	return metaOptions{
+		Xattrs:    r.URL.Query().Get("xattrs") == "true",
+		Checksums: splitList(r.URL.Query().Get("checksum")),
+	}
+}
+
+// addExtraMeta adds the metadata that has to be read from the file itself: the
+// mime type, and the optional metadata selected by options.
+func addExtraMeta(config Config, options metaOptions, meta *FileMeta, name string) error {
+	info, err := config.Storage.Stat(name)
+	if err != nil {
+		return err
+	}
+	if info.Mode().IsRegular() {
+		if meta.MimeType, err = detectMimeType(config.Storage, name); err != nil {
+			return err
+		}
+		expiresAt, err := fileExpiry(config.Storage, name)
+		if err != nil {
+			return err
+		}
+		if !expiresAt.IsZero() {
+			meta.ExpiresAt = &expiresAt
+		}
+	}
+
+	if options.Xattrs {
+		xattrs, err := readXattrs(config.Storage, name, config.XattrNamespaces)
+		if err != nil {
+			return err
+		}
+		meta.Xattrs = xattrs
+	}
+	if len(options.Checksums) > 0 {
+		checksums, err := fileChecksums(config, name, options.Checksums)
+		if err != nil {
+			return err
+		}
+		meta.Checksums = checksums
+	}
+	return nil
+}
+
 func notFound(w http.ResponseWriter, err error) {
 	writeErrorResponse(w, http.StatusNotFound, err.Error())
 }
@@ -251,7 +609,15 @@ func invalidJson(w http.ResponseWriter, err error) {
 }
 
 func invalidPermissions(w http.ResponseWriter, fileName string) {
-	badRequest(w, fmt.Sprintf("%s has invalid octal permissions", fileName))
+	writeError(w, invalidPermissionsError(fileName))
+}
+
+func invalidPermissionsError(fileName string) error {
+	return &statusError{http.StatusBadRequest, fmt.Sprintf("%s has invalid octal permissions", fileName)}
+}
+
+func forbidden(w http.ResponseWriter, reason string) {
+	writeErrorResponse(w, http.StatusForbidden, reason)
 }
 
 func badRequest(w http.ResponseWriter, reason string) {
@@ -263,12 +629,50 @@ func internalServerError(w http.ResponseWriter, err error) {
 	writeErrorResponse(w, http.StatusInternalServerError, err.Error())
 }
 
+// statusError is an error of the shared file operations with the http status
+// code it is reported with.
+type statusError struct {
+	code   int
+	reason string
+}
+
+func (x *statusError) Error() string {
+	return x.reason
+}
+
+// writeError writes the error response for an error of the shared file
+// operations.
+func writeError(w http.ResponseWriter, err error) {
+	var statusErr *statusError
+	var hookErr *HookError
+	switch {
+	case errors.As(err, &statusErr):
+		writeErrorResponse(w, statusErr.code, statusErr.reason)
+	case errors.As(err, &hookErr):
+		hookFailed(w, err)
+	case os.IsNotExist(err):
+		notFound(w, err)
+	case errors.Is(err, syscall.EROFS):
+		forbidden(w, err.Error())
+	case errors.Is(err, syscall.EFBIG):
+		writeErrorResponse(w, http.StatusRequestEntityTooLarge, err.Error())
+	case errors.Is(err, syscall.ENOSPC):
+		writeErrorResponse(w, http.StatusInsufficientStorage, err.Error())
+	default:
+		internalServerError(w, err)
+	}
+}
+
 func writeErrorResponse(w http.ResponseWriter, code int, reason string) {
-	writeResponse(w, ResponseBody{
+	writeResponse(w, errorResponseBody(code, reason))
+}
+
+func errorResponseBody(code int, reason string) ResponseBody {
+	return ResponseBody{
 		Status: "error",
 		Type:   ResponseTypeError,
 		Error:  &ErrorData{Code: code, Error: reason},
-	})
+	}
 }
 
 func writeResponse(w http.ResponseWriter, response ResponseBody) {
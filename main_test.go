@@ -2,23 +2,34 @@ package main
 
 import (
 	"encoding/json"
-	"io/ioutil"
+	"mime"
 	"net/http"
 	"net/http/httptest"
 	"os"
-	"path"
 	"strings"
 	"testing"
+	"time"
 )
 
 const ContentRoot = "test"
 
+func init() {
+	// Don't depend on the mime.types files installed on the system.
+	if err := mime.AddExtensionType(".txt", "text/plain; charset=utf-8"); err != nil {
+		panic(err)
+	}
+}
+
 func TestHandleGet(t *testing.T) {
+	forEachStorage(t, testHandleGet)
+}
+
+func testHandleGet(t *testing.T) {
 	runTest := func(t *testing.T, target string, wantStatus int, wantBody string) {
 		t.Helper()
 		httpRequest := httptest.NewRequest(http.MethodGet, target, nil)
 		responseRecorder := httptest.NewRecorder()
-		httpHandler(ContentRoot).ServeHTTP(responseRecorder, httpRequest)
+		httpHandler(newTestConfig()).ServeHTTP(responseRecorder, httpRequest)
 		assertHttpResponse(t, responseRecorder.Result(), wantStatus, wantBody)
 	}
 
@@ -47,7 +58,9 @@ func TestHandleGet(t *testing.T) {
           "file": {
             "name": "file.txt",
 			"path": "/file.txt",
+			"mime_type": "text/plain; charset=utf-8",
             "owner": "0",
+            "group": "0",
             "size": 6,
             "permissions": "0644",
             "contents": "hello\n"
@@ -69,13 +82,16 @@ func TestHandleGet(t *testing.T) {
             "name": "/",
 			"path": "/",
             "owner": "0",
+            "group": "0",
             "size": 4096,
             "permissions": "0700",
             "entries": [
 			  {
                 "name": ".hidden.txt",
                 "path": "/.hidden.txt",
+                "mime_type": "text/plain; charset=utf-8",
                 "owner": "0",
+                "group": "0",
                 "size": 6,
                 "permissions": "0644",
 				"type": "file"
@@ -84,6 +100,7 @@ func TestHandleGet(t *testing.T) {
                 "name": "cheetos",
                 "path": "/cheetos",
                 "owner": "0",
+                "group": "0",
                 "size": 4096,
                 "permissions": "0755",
 				"type": "directory"
@@ -91,7 +108,9 @@ func TestHandleGet(t *testing.T) {
               {
                 "name": "file.txt",
                 "path": "/file.txt",
+                "mime_type": "text/plain; charset=utf-8",
                 "owner": "0",
+                "group": "0",
                 "size": 6,
                 "permissions": "0644",
 				"type": "file"
@@ -114,13 +133,16 @@ func TestHandleGet(t *testing.T) {
             "name": "cheetos",
 			"path": "/cheetos",
             "owner": "0",
+            "group": "0",
             "size": 4096,
             "permissions": "0755",
             "entries": [
               {
                 "name": "file.txt",
                 "path": "/cheetos/file.txt",
+                "mime_type": "text/plain; charset=utf-8",
                 "owner": "0",
+                "group": "0",
                 "permissions": "0644",
                 "size": 6,
 				"type": "file"
@@ -132,11 +154,15 @@ func TestHandleGet(t *testing.T) {
 }
 
 func TestHandlePut(t *testing.T) {
+	forEachStorage(t, testHandlePut)
+}
+
+func testHandlePut(t *testing.T) {
 	runTest := func(t *testing.T, target string, reqBody string, wantStatus int, wantBody string) {
 		t.Helper()
 		httpRequest := httptest.NewRequest(http.MethodPut, target, strings.NewReader(reqBody))
 		responseRecorder := httptest.NewRecorder()
-		httpHandler(ContentRoot).ServeHTTP(responseRecorder, httpRequest)
+		httpHandler(newTestConfig()).ServeHTTP(responseRecorder, httpRequest)
 		assertHttpResponse(t, responseRecorder.Result(), wantStatus, wantBody)
 	}
 
@@ -205,7 +231,9 @@ func TestHandlePut(t *testing.T) {
 			  "file": {
 				"name": "file.txt",
 				"path": "/new/file.txt",
+				"mime_type": "text/plain; charset=utf-8",
 				"owner": "0",
+				"group": "0",
 				"permissions": "0600",
 				"size": 6,
 				"contents": "hello\n"
@@ -216,11 +244,15 @@ func TestHandlePut(t *testing.T) {
 }
 
 func TestHandlePost(t *testing.T) {
+	forEachStorage(t, testHandlePost)
+}
+
+func testHandlePost(t *testing.T) {
 	runTest := func(t *testing.T, target string, reqBody string, wantStatus int, wantBody string) {
 		t.Helper()
 		httpRequest := httptest.NewRequest(http.MethodPost, target, strings.NewReader(reqBody))
 		responseRecorder := httptest.NewRecorder()
-		httpHandler(ContentRoot).ServeHTTP(responseRecorder, httpRequest)
+		httpHandler(newTestConfig()).ServeHTTP(responseRecorder, httpRequest)
 		assertHttpResponse(t, responseRecorder.Result(), wantStatus, wantBody)
 	}
 
@@ -273,13 +305,16 @@ func TestHandlePost(t *testing.T) {
 				 "name": "new",
 				 "path": "/new/",
 				 "owner": "0",
+				 "group": "0",
 				 "permissions": "0700",
 				 "size": 4096,
 				 "entries": [
 				   {
 					 "name": "file.txt",
 					 "path": "/new/file.txt",
+					 "mime_type": "text/plain; charset=utf-8",
 					 "owner": "0",
+					 "group": "0",
 					 "permissions": "0600",
 					 "size": 6,
 					 "type": "file"
@@ -292,11 +327,15 @@ func TestHandlePost(t *testing.T) {
 }
 
 func TestHandleDelete(t *testing.T) {
+	forEachStorage(t, testHandleDelete)
+}
+
+func testHandleDelete(t *testing.T) {
 	runTest := func(t *testing.T, target string, wantStatus int, wantBody string) {
 		t.Helper()
 		httpRequest := httptest.NewRequest(http.MethodDelete, target, nil)
 		responseRecorder := httptest.NewRecorder()
-		httpHandler(ContentRoot).ServeHTTP(responseRecorder, httpRequest)
+		httpHandler(newTestConfig()).ServeHTTP(responseRecorder, httpRequest)
 		assertHttpResponse(t, responseRecorder.Result(), wantStatus, wantBody)
 	}
 
@@ -360,9 +399,45 @@ func TestHandleDelete(t *testing.T) {
 	})
 }
 
+// testStorage is the storage of the content root used by the helpers below
+// and newTestConfig. It is the disk unless set by forEachStorage.
+var testStorage Storage = newDiskStorage(ContentRoot)
+
+// forEachStorage runs the test against each storage in turn.
+func forEachStorage(t *testing.T, test func(t *testing.T)) {
+	for _, kind := range []string{StorageDisk, StorageMemory, StorageObject, StorageCAS} {
+		t.Run(kind, func(t *testing.T) {
+			config := newConfig(ContentRoot)
+			switch kind {
+			case StorageObject:
+				_, config.ObjectStore = newFakeObjectStore(t)
+			case StorageCAS:
+				config.CASDir = t.TempDir()
+			}
+			storage, err := newStorage(kind, config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Start without a content root, like the disk.
+			if err := storage.RemoveAll("/"); err != nil {
+				t.Fatal(err)
+			}
+			testStorage = storage
+			defer func() { testStorage = newDiskStorage(ContentRoot) }()
+			test(t)
+		})
+	}
+}
+
+func newTestConfig() Config {
+	config := newConfig(ContentRoot)
+	config.Storage = testStorage
+	return config
+}
+
 func mustMakeContentRoot(t *testing.T) {
 	t.Helper()
-	err := os.Mkdir(ContentRoot, 0700)
+	err := testStorage.Mkdir("/", 0700)
 	switch {
 	case err == nil:
 		break
@@ -375,49 +450,48 @@ func mustMakeContentRoot(t *testing.T) {
 
 func mustDeleteContentRoot(t *testing.T) {
 	t.Helper()
-	if err := os.RemoveAll(ContentRoot); err != nil {
+	if err := testStorage.RemoveAll("/"); err != nil {
 		t.Fatal(err)
 	}
 }
 
 func mustWriteFile(t *testing.T, data []byte, name string, perm os.FileMode) {
 	t.Helper()
-	if err := os.WriteFile(path.Join(ContentRoot, name), data, perm); err != nil {
+	if err := writeFile(testStorage, name, data, perm); err != nil {
 		t.Fatal(err)
 	}
 }
 
 func mustMkDir(t *testing.T, name string, perm os.FileMode) {
 	t.Helper()
-	if err := os.Mkdir(path.Join(ContentRoot, name), perm); err != nil {
+	if err := testStorage.Mkdir(name, perm); err != nil {
 		t.Fatal(err)
 	}
 }
 
 func assertFileExists(t *testing.T, target string) {
 	t.Helper()
-	_, err := os.Stat(path.Join(ContentRoot, target))
+	_, err := testStorage.Stat(target)
 	if err != nil {
-		t.Errorf("os.Stat() failed: `%v`", err)
+		t.Errorf("Stat() failed: `%v`", err)
 		return
 	}
 }
 
 func assertFileContents(t *testing.T, target string, wantPerms os.FileMode, wantContents string) {
 	t.Helper()
-	fileName := path.Join(ContentRoot, target)
-	stat, err := os.Stat(fileName)
+	stat, err := testStorage.Stat(target)
 	if err != nil {
-		t.Errorf("os.Stat() failed: %v", err)
+		t.Errorf("Stat() failed: %v", err)
 		return
 	}
 	if want, got := wantPerms, stat.Mode().Perm(); want != got {
 		t.Errorf("want perms %v, got perms %v", want, got)
 	}
 
-	gotContents, err := ioutil.ReadFile(fileName)
+	gotContents, err := readFile(testStorage, target)
 	if err != nil {
-		t.Errorf("ioutil.ReadFile() failed: %v", err)
+		t.Errorf("readFile() failed: %v", err)
 		return
 	}
 	if want, got := wantContents, string(gotContents); want != got {
@@ -427,7 +501,7 @@ func assertFileContents(t *testing.T, target string, wantPerms os.FileMode, want
 
 func assertFileDoesNotExists(t *testing.T, target string) {
 	t.Helper()
-	if _, err := os.Stat(path.Join(ContentRoot, target)); !os.IsNotExist(err) {
+	if _, err := testStorage.Stat(target); !os.IsNotExist(err) {
 		t.Fatalf("wanted error like `%v`, got error `%v`", os.ErrNotExist, err)
 	}
 }
@@ -466,9 +540,34 @@ func assertResponseHasBody(t *testing.T, resp *http.Response, want string) {
 		t.Errorf("invalid json: %v", err)
 	}
 
+	ignoreUnsetModTimes(wantResponse, &gotResponse)
 	assertEqualResponseBody(t, wantResponse, gotResponse)
 }
 
+// ignoreUnsetModTimes clears modification times in got that are not set in
+// want, since most tests can't predict them.
+func ignoreUnsetModTimes(want ResponseBody, got *ResponseBody) {
+	ignore := func(want FileMeta, got *FileMeta) {
+		if want.Modified.IsZero() {
+			got.Modified = time.Time{}
+		}
+	}
+	if want.File != nil && got.File != nil {
+		ignore(want.File.FileMeta, &got.File.FileMeta)
+	}
+	if want.Meta != nil && got.Meta != nil {
+		ignore(*want.Meta, got.Meta)
+	}
+	if want.Directory != nil && got.Directory != nil {
+		ignore(want.Directory.FileMeta, &got.Directory.FileMeta)
+		for i := range got.Directory.Entries {
+			if i < len(want.Directory.Entries) {
+				ignore(want.Directory.Entries[i].FileMeta, &got.Directory.Entries[i].FileMeta)
+			}
+		}
+	}
+}
+
 func assertEqualResponseBody(t *testing.T, want, got ResponseBody) {
 	t.Helper()
 	wantJson, _ := json.MarshalIndent(want, "", "  ")
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+// loadMimeTypes registers the extensions listed in a mime.types file. Each
+// line is a mime type followed by its extensions without the leading dot.
+func loadMimeTypes(fileName string) error {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		for _, ext := range fields[1:] {
+			if err := mime.AddExtensionType("."+ext, fields[0]); err != nil {
+				return err
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+// detectMimeType returns the mime type of a regular file from its extension,
+// falling back to sniffing its contents.
+func detectMimeType(storage Storage, name string) (string, error) {
+	if mimeType := mime.TypeByExtension(path.Ext(name)); mimeType != "" {
+		return mimeType, nil
+	}
+
+	f, err := storage.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	// DetectContentType considers at most the first 512 bytes.
+	buf := make([]byte, 512)
+	n, err := io.ReadFull(f, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	return http.DetectContentType(buf[:n]), nil
+}
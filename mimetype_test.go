@@ -0,0 +1,57 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"testing"
+)
+
+func TestDetectMimeType(t *testing.T) {
+	mustMakeContentRoot(t)
+	defer mustDeleteContentRoot(t)
+
+	mustWriteFile(t, []byte("text/x-fancy fancy fcy\n# comment\n"), "/mime.types", 0644)
+	if err := loadMimeTypes(path.Join(ContentRoot, "/mime.types")); err != nil {
+		t.Fatal(err)
+	}
+
+	mustWriteFile(t, []byte("hello\n"), "/file.fcy", 0644)
+	mustWriteFile(t, []byte("<html><body>hello</body></html>"), "/index", 0644)
+	mustWriteFile(t, []byte("\x89PNG\x0D\x0A\x1A\x0A"), "/image", 0644)
+	for fileName, want := range map[string]string{
+		"/file.fcy": "text/x-fancy; charset=utf-8",
+		"/index":    "text/html; charset=utf-8",
+		"/image":    "image/png",
+	} {
+		got, err := detectMimeType(newDiskStorage(ContentRoot), fileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want != got {
+			t.Errorf("%s: want mime type %q, got %q", fileName, want, got)
+		}
+	}
+}
+
+func TestHandleGetRaw(t *testing.T) {
+	mustMakeContentRoot(t)
+	defer mustDeleteContentRoot(t)
+
+	mustWriteFile(t, []byte("<html><body>hello</body></html>"), "/index", 0644)
+	httpRequest := httptest.NewRequest(http.MethodGet, "/index?raw=true", nil)
+	responseRecorder := httptest.NewRecorder()
+	httpHandler(newConfig(ContentRoot)).ServeHTTP(responseRecorder, httpRequest)
+
+	resp := responseRecorder.Result()
+	assertResponseHasStatusCode(t, resp, http.StatusOK)
+	assertResponseHasHeader(t, resp, "Content-Type", "text/html; charset=utf-8")
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := "<html><body>hello</body></html>", string(body); want != got {
+		t.Errorf("want body %q, got %q", want, got)
+	}
+}
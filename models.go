@@ -1,25 +1,43 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"os"
 	"path"
 	"strconv"
-	"syscall"
+	"time"
 )
 
 type ResponseBody struct {
-	Status    string         `json:"status"`
-	Type      string         `json:"type"`
-	Error     *ErrorData     `json:"error,omitempty"`
-	File      *FileData      `json:"file,omitempty"`
-	Directory *DirectoryData `json:"directory,omitempty"`
+	Status     string            `json:"status"`
+	Type       string            `json:"type"`
+	Error      *ErrorData        `json:"error,omitempty"`
+	File       *FileData         `json:"file,omitempty"`
+	Directory  *DirectoryData    `json:"directory,omitempty"`
+	Meta       *FileMeta         `json:"meta,omitempty"`
+	Extract    *ExtractData      `json:"extract,omitempty"`
+	Deliveries []WebhookDelivery `json:"deliveries,omitempty"`
+	Mounts     []MountData       `json:"mounts,omitempty"`
+	Usage      *UsageData        `json:"usage,omitempty"`
+	Snapshots  []SnapshotData    `json:"snapshots,omitempty"`
+	Snapshot   *SnapshotData     `json:"snapshot,omitempty"`
 }
 
 const ResponseTypeFile = "file"
 const ResponseTypeDirectory = "directory"
 const ResponseTypeDeleted = "deleted"
+const ResponseTypeMeta = "meta"
+const ResponseTypeExtract = "extract"
+const ResponseTypeSubscribed = "subscribed"
+const ResponseTypeUnsubscribed = "unsubscribed"
+const ResponseTypeDeliveries = "deliveries"
+const ResponseTypeMounts = "mounts"
+const ResponseTypeUsage = "usage"
+const ResponseTypeSnapshots = "snapshots"
+const ResponseTypeSnapshot = "snapshot"
+const ResponseTypeRestored = "restored"
 const ResponseTypeError = "error"
 
 func (x ResponseBody) Code() int {
@@ -36,6 +54,8 @@ func (x ResponseBody) Code() int {
 type ErrorData struct {
 	Code  int    `json:"code"`
 	Error string `json:"error"`
+	// Stderr is the output of a failed pre-hook.
+	Stderr string `json:"stderr,omitempty"`
 }
 
 type FileData struct {
@@ -53,9 +73,14 @@ type DirectoryData struct {
 }
 
 func NewDirectoryData(dirPath string, fileInfo os.FileInfo, dirEntries []os.DirEntry) DirectoryData {
-	entries := make([]DirectoryEntry, len(dirEntries))
-	for i := range dirEntries {
-		entries[i] = NewDirectoryEntry(dirPath, dirEntries[i])
+	entries := make([]DirectoryEntry, 0, len(dirEntries))
+	for _, dirEntry := range dirEntries {
+		// Entries removed while the directory is read are left out.
+		info, err := dirEntry.Info()
+		if err != nil {
+			continue
+		}
+		entries = append(entries, NewDirectoryEntry(dirPath, info))
 	}
 
 	return DirectoryData{
@@ -74,8 +99,7 @@ const DirectoryEntryTypeDirectory = ResponseTypeDirectory
 const DirectoryEntryTypeSymlink = "symlink"
 const DirectoryEntryTypeUnsupported = "unsupported"
 
-func NewDirectoryEntry(dirPath string, dirEntry os.DirEntry) DirectoryEntry {
-	info, _ := dirEntry.Info()
+func NewDirectoryEntry(dirPath string, info os.FileInfo) DirectoryEntry {
 	var entryType string
 	switch {
 	case info.Mode().IsRegular():
@@ -94,32 +118,160 @@ func NewDirectoryEntry(dirPath string, dirEntry os.DirEntry) DirectoryEntry {
 	}
 }
 
-type FileMeta struct {
-	Name        string `json:"name"`
+type WatchEvent struct {
+	ID      uint64    `json:"id"`
+	Type    string    `json:"type"`
+	Path    string    `json:"path"`
+	OldPath string    `json:"old_path,omitempty"`
+	Meta    *FileMeta `json:"meta,omitempty"`
+}
+
+const WatchEventCreate = "create"
+const WatchEventModify = "modify"
+const WatchEventDelete = "delete"
+const WatchEventRename = "rename"
+
+type WebSocketRequest struct {
+	// ID is echoed in the response, and identifies subscriptions.
+	ID    string            `json:"id"`
+	Op    string            `json:"op"`
+	Path  string            `json:"path"`
+	Query map[string]string `json:"query,omitempty"`
+	// Body is the json request body of put, post and patch ops.
+	Body        json.RawMessage `json:"body,omitempty"`
+	Recursive   bool            `json:"recursive,omitempty"`
+	LastEventID uint64          `json:"last_event_id,omitempty"`
+}
+
+type WebSocketMessage struct {
+	ID           string        `json:"id,omitempty"`
+	Subscription string        `json:"subscription,omitempty"`
+	Response     *ResponseBody `json:"response,omitempty"`
+	Event        *WatchEvent   `json:"event,omitempty"`
+}
+
+type WebhookPayload struct {
+	Delivery string     `json:"delivery"`
+	Event    WatchEvent `json:"event"`
+}
+
+type WebhookDelivery struct {
+	ID      string    `json:"id"`
+	URL     string    `json:"url"`
+	Status  string    `json:"status"`
+	Created time.Time `json:"created"`
+	// NextAttempt is only set for pending deliveries that failed an attempt.
+	NextAttempt *time.Time       `json:"next_attempt,omitempty"`
+	Event       WatchEvent       `json:"event"`
+	Attempts    []WebhookAttempt `json:"attempts"`
+}
+
+type WebhookAttempt struct {
+	Time       time.Time `json:"time"`
+	StatusCode int       `json:"status_code,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+type MountData struct {
+	Path        string `json:"path"`
+	Storage     string `json:"storage"`
+	ReadOnly    bool   `json:"read_only"`
+	MaxFileSize int64  `json:"max_file_size,omitempty"`
+}
+
+type UsageData struct {
+	Path string `json:"path"`
+	// Files counts the regular files, of which CompressedFiles are stored
+	// compressed.
+	Files           int   `json:"files"`
+	CompressedFiles int   `json:"compressed_files"`
+	LogicalSize     int64 `json:"logical_size"`
+	PhysicalSize    int64 `json:"physical_size"`
+}
+
+type SnapshotData struct {
+	Name    string    `json:"name"`
+	Created time.Time `json:"created"`
+	// Linked, Cloned and Copied count how the files were copied when the
+	// snapshot was made or restored.
+	Linked int `json:"linked,omitempty"`
+	Cloned int `json:"cloned,omitempty"`
+	Copied int `json:"copied,omitempty"`
+}
+
+type PostSnapshotRequest struct {
+	Name string `json:"name,omitempty"`
+}
+
+type ExtractData struct {
+	DryRun  bool           `json:"dry_run"`
+	Entries []ExtractEntry `json:"entries"`
+}
+
+type ExtractEntry struct {
 	Path        string `json:"path"`
-	Owner       string `json:"owner"`
+	Type        string `json:"type"`
 	Permissions string `json:"permissions"`
 	Size        uint64 `json:"size"`
+	Status      string `json:"status"`
+	Error       string `json:"error,omitempty"`
+}
+
+type FileMeta struct {
+	Name        string    `json:"name"`
+	Path        string    `json:"path"`
+	Owner       string    `json:"owner"`
+	Group       string    `json:"group"`
+	Permissions string    `json:"permissions"`
+	Size        uint64    `json:"size"`
+	Modified    time.Time `json:"modified"`
+	// MimeType is detected from the extension or contents of regular files.
+	MimeType string `json:"mime_type,omitempty"`
+	// Xattrs are the base64 encoded extended attributes. Only set if requested.
+	Xattrs map[string]string `json:"xattrs,omitempty"`
+	// Checksums are hex encoded digests keyed by algorithm. Only set if requested.
+	Checksums map[string]string `json:"checksums,omitempty"`
+	// ExpiresAt is when the file is removed, if it expires.
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
 }
 
 func NewFileMeta(filePath string, fileInfo os.FileInfo) FileMeta {
-	userId := strconv.FormatUint(uint64(fileInfo.Sys().(*syscall.Stat_t).Uid), 10)
+	uid, gid := fileOwner(fileInfo)
 	return FileMeta{
 		Name:        path.Base(filePath),
 		Path:        filePath,
-		Owner:       userId,
+		Owner:       strconv.FormatUint(uint64(uid), 10),
+		Group:       strconv.FormatUint(uint64(gid), 10),
 		Size:        uint64(fileInfo.Size()),
 		Permissions: fmt.Sprintf("0%o", fileInfo.Mode().Perm()),
+		Modified:    fileInfo.ModTime().UTC(),
 	}
 }
 
 type PostFileRequest struct {
-	Name        string `json:"name"`
-	Permissions string `json:"permissions"`
-	Contents    string `json:"contents,omitempty"`
+	Name        string     `json:"name"`
+	Permissions string     `json:"permissions"`
+	Contents    string     `json:"contents,omitempty"`
+	Sha256      string     `json:"sha256,omitempty"`
+	TTL         string     `json:"ttl,omitempty"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
 }
 
 type PutFileRequest struct {
-	Permissions string `json:"permissions"`
-	Contents     string `json:"contents,omitempty"`
+	Permissions string     `json:"permissions"`
+	Contents    string     `json:"contents,omitempty"`
+	Sha256      string     `json:"sha256,omitempty"`
+	TTL         string     `json:"ttl,omitempty"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+}
+
+type PatchFileRequest struct {
+	Permissions string `json:"permissions,omitempty"`
+	Owner       string `json:"owner,omitempty"`
+	Group       string `json:"group,omitempty"`
+	Modified    string `json:"modified,omitempty"`
+	Recursive   bool   `json:"recursive,omitempty"`
+	// Xattrs maps extended attribute names to base64 encoded values to set,
+	// or to null to remove the attribute.
+	Xattrs map[string]*string `json:"xattrs,omitempty"`
 }
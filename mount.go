@@ -0,0 +1,379 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Mount serves a storage of its own under a url path of the http apis, in
+// place of the content root.
+type Mount struct {
+	Path string `json:"path"`
+	// Storage is the kind of storage, StorageDisk if empty.
+	Storage string `json:"storage"`
+	// ContentRoot is the directory of a StorageDisk mount, and names the
+	// other kinds in errors.
+	ContentRoot string `json:"content_root"`
+	// ObjectStore is the bucket of a StorageObject mount. The one of the
+	// config is used if nil.
+	ObjectStore *ObjectStore `json:"object_store"`
+	// LowerDirs are the directories under the ContentRoot of a
+	// StorageOverlay mount.
+	LowerDirs []string `json:"lower_dirs"`
+	// CASDir keeps the contents of the files of a StorageCAS mount.
+	CASDir string `json:"cas_dir"`
+	// EncryptionKeyFile has the master keys the mount is encrypted with, if
+	// set.
+	EncryptionKeyFile string `json:"encryption_key_file"`
+	// Compression compresses the files of the mount matching
+	// CompressionPaths, or all of them if empty, if set.
+	Compression      string   `json:"compression"`
+	CompressionPaths []string `json:"compression_paths"`
+	// SnapshotDir keeps the snapshots of a StorageDisk mount, if set.
+	SnapshotDir string `json:"snapshot_dir"`
+	// ReadOnly refuses all changes.
+	ReadOnly bool `json:"read_only"`
+	// MaxFileSize limits the size of files written, if not zero.
+	MaxFileSize int64 `json:"max_file_size"`
+
+	storage Storage
+}
+
+// loadMounts reads a json list of mounts and makes their storages.
+func loadMounts(fileName string, config Config) ([]Mount, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	var mounts []Mount
+	if err := json.Unmarshal(data, &mounts); err != nil {
+		return nil, fmt.Errorf("%s: %v", fileName, err)
+	}
+	paths := make(map[string]bool)
+	for i := range mounts {
+		mount := &mounts[i]
+		if !strings.HasPrefix(mount.Path, "/") || path.Clean(mount.Path) != mount.Path || mount.Path == "/" {
+			return nil, fmt.Errorf("%s: invalid mount path %q", fileName, mount.Path)
+		}
+		if paths[mount.Path] {
+			return nil, fmt.Errorf("%s: mount path %s is used twice", fileName, mount.Path)
+		}
+		paths[mount.Path] = true
+		if mount.Storage == "" {
+			mount.Storage = StorageDisk
+		}
+		if mount.ContentRoot == "" {
+			if mount.Storage == StorageDisk {
+				return nil, fmt.Errorf("%s: mount %s has no content_root", fileName, mount.Path)
+			}
+			mount.ContentRoot = strings.TrimPrefix(mount.Path, "/")
+		}
+		if mount.MaxFileSize < 0 {
+			return nil, fmt.Errorf("%s: mount %s has a negative max_file_size", fileName, mount.Path)
+		}
+
+		storageConfig := config
+		storageConfig.ContentRoot = mount.ContentRoot
+		if mount.ObjectStore != nil {
+			storageConfig.ObjectStore = *mount.ObjectStore
+		}
+		storageConfig.OverlayLowerDirs = mount.LowerDirs
+		storageConfig.CASDir = mount.CASDir
+		storage, err := newStorage(mount.Storage, storageConfig)
+		if err != nil {
+			return nil, fmt.Errorf("%s: mount %s: %v", fileName, mount.Path, err)
+		}
+		if mount.EncryptionKeyFile != "" {
+			if storage, err = newEncryptedStorageFromKeyFile(storage, mount.ContentRoot, mount.EncryptionKeyFile); err != nil {
+				return nil, fmt.Errorf("%s: mount %s: %v", fileName, mount.Path, err)
+			}
+		}
+		if mount.Compression != "" {
+			if storage, err = newCompressedStorage(storage, mount.ContentRoot, mount.Compression, mount.CompressionPaths); err != nil {
+				return nil, fmt.Errorf("%s: mount %s: %v", fileName, mount.Path, err)
+			}
+		}
+		if mount.SnapshotDir != "" {
+			if err := checkSnapshotDir(mount.SnapshotDir, mount.ContentRoot, storage); err != nil {
+				return nil, fmt.Errorf("%s: mount %s: %v", fileName, mount.Path, err)
+			}
+		}
+		mount.setStorage(storage)
+	}
+	return mounts, nil
+}
+
+// setStorage sets the storage of the mount, limited to its mode and limits.
+func (x *Mount) setStorage(storage Storage) {
+	if x.MaxFileSize > 0 {
+		storage = &limitedStorage{Storage: storage, root: x.ContentRoot, maxFileSize: x.MaxFileSize}
+	}
+	if x.ReadOnly {
+		storage = readOnlyStorage{Storage: storage, root: x.ContentRoot}
+	}
+	x.storage = storage
+}
+
+// config returns the config of the apis served under the mount.
+func (x Mount) config(config Config) Config {
+	config.Mounts = nil
+	config.ContentRoot = x.ContentRoot
+	config.Storage = x.storage
+	config.SnapshotDir = x.SnapshotDir
+	config.MountPath = x.Path
+	return config
+}
+
+// match reports whether urlPath is the mount path or under it.
+func (x Mount) match(urlPath string) bool {
+	return urlPath == x.Path || strings.HasPrefix(urlPath, x.Path+"/")
+}
+
+// mountsHandler routes the requests to the http apis of the mount their path
+// is under, which see the path relative to the mount. The mounts share the
+// webhooks and the hook slots. GET / lists the mounts.
+func mountsHandler(config Config, hooks *Hooks) http.Handler {
+	mounts := append([]Mount(nil), config.Mounts...)
+	// The longest paths are matched first, for mounts inside other mounts.
+	sort.Slice(mounts, func(i, j int) bool { return len(mounts[i].Path) > len(mounts[j].Path) })
+	watchers := make([]*Watcher, len(mounts))
+	for i, mount := range mounts {
+		watchers[i] = newWatcher(mount.config(config))
+	}
+	webhooks := newWebhooks(config, watchers...)
+	handlers := make([]http.Handler, len(mounts))
+	for i, mount := range mounts {
+		mountConfig := mount.config(config)
+		handlers[i] = apiHandler(mountConfig, watchers[i], webhooks, hooks.with(mountConfig))
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i, mount := range mounts {
+			if !mount.match(r.URL.Path) {
+				continue
+			}
+			if mount.ReadOnly && !isReadRequest(r) {
+				forbidden(w, mount.Path+" is read only")
+				return
+			}
+			r2 := r.Clone(r.Context())
+			r2.URL.Path = "/" + strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, mount.Path), "/")
+			r2.URL.RawPath = ""
+			handlers[i].ServeHTTP(w, r2)
+			return
+		}
+
+		switch {
+		case r.URL.Path != "/":
+			notFound(w, fmt.Errorf("%s is not under a mount", r.URL.Path))
+		case r.Method != http.MethodGet:
+			writeErrorResponse(w, http.StatusMethodNotAllowed, "method not allowed")
+		default:
+			writeMountsResponse(config, w)
+		}
+	})
+}
+
+// isReadRequest reports whether the request can't change the content. The
+// WebDAV methods that do are refused too, and the websocket is left to the
+// read only storage.
+func isReadRequest(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, "PROPFIND":
+		return true
+	}
+	return false
+}
+
+func writeMountsResponse(config Config, w http.ResponseWriter) {
+	mounts := make([]MountData, len(config.Mounts))
+	for i, mount := range config.Mounts {
+		mounts[i] = MountData{
+			Path:        mount.Path,
+			Storage:     mount.Storage,
+			ReadOnly:    mount.ReadOnly,
+			MaxFileSize: mount.MaxFileSize,
+		}
+	}
+	sort.Slice(mounts, func(i, j int) bool { return mounts[i].Path < mounts[j].Path })
+	writeResponse(w, ResponseBody{
+		Status: "ok",
+		Type:   ResponseTypeMounts,
+		Mounts: mounts,
+	})
+}
+
+// readOnlyStorage refuses changes to a storage with syscall.EROFS, like a
+// read only filesystem.
+type readOnlyStorage struct {
+	Storage
+	// root names the storage in errors.
+	root string
+}
+
+func (x readOnlyStorage) Unwrap() Storage {
+	return x.Storage
+}
+
+func (x readOnlyStorage) fileName(name string) string {
+	return path.Join(x.root, path.Clean("/"+name))
+}
+
+func (x readOnlyStorage) pathError(op, name string) error {
+	return &os.PathError{Op: op, Path: x.fileName(name), Err: syscall.EROFS}
+}
+
+func (x readOnlyStorage) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0 {
+		return nil, x.pathError("open", name)
+	}
+	return x.Storage.OpenFile(name, flag, perm)
+}
+
+func (x readOnlyStorage) Mkdir(name string, perm os.FileMode) error {
+	return x.pathError("mkdir", name)
+}
+
+func (x readOnlyStorage) MkdirAll(name string, perm os.FileMode) error {
+	return x.pathError("mkdir", name)
+}
+
+func (x readOnlyStorage) Remove(name string) error {
+	return x.pathError("remove", name)
+}
+
+func (x readOnlyStorage) RemoveAll(name string) error {
+	return x.pathError("unlinkat", name)
+}
+
+func (x readOnlyStorage) Rename(oldName, newName string) error {
+	return &os.LinkError{Op: "rename", Old: x.fileName(oldName), New: x.fileName(newName), Err: syscall.EROFS}
+}
+
+func (x readOnlyStorage) Chmod(name string, mode os.FileMode) error {
+	return x.pathError("chmod", name)
+}
+
+func (x readOnlyStorage) Chown(name string, uid, gid int) error {
+	return x.pathError("chown", name)
+}
+
+func (x readOnlyStorage) Lchown(name string, uid, gid int) error {
+	return x.pathError("lchown", name)
+}
+
+func (x readOnlyStorage) Chtimes(name string, atime, mtime time.Time) error {
+	return x.pathError("chtimes", name)
+}
+
+func (x readOnlyStorage) Truncate(name string, size int64) error {
+	return x.pathError("truncate", name)
+}
+
+func (x readOnlyStorage) Symlink(target, newName string) error {
+	return &os.LinkError{Op: "symlink", Old: target, New: x.fileName(newName), Err: syscall.EROFS}
+}
+
+func (x readOnlyStorage) SetXattr(name, attr string, value []byte) error {
+	return syscall.EROFS
+}
+
+func (x readOnlyStorage) RemoveXattr(name, attr string) error {
+	return syscall.EROFS
+}
+
+// limitedStorage refuses to make files larger than maxFileSize with
+// syscall.EFBIG, like a filesystem with a file size limit.
+type limitedStorage struct {
+	Storage
+	// root names the storage in errors.
+	root        string
+	maxFileSize int64
+}
+
+func (x *limitedStorage) Unwrap() Storage {
+	return x.Storage
+}
+
+func (x *limitedStorage) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	f, err := x.Storage.OpenFile(name, flag, perm)
+	if err != nil || flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return f, err
+	}
+	return &limitedFile{File: f, name: path.Join(x.root, path.Clean("/"+name)), flag: flag, maxFileSize: x.maxFileSize}, nil
+}
+
+func (x *limitedStorage) Open(name string) (File, error) {
+	return x.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (x *limitedStorage) Truncate(name string, size int64) error {
+	if size > x.maxFileSize {
+		return &os.PathError{Op: "truncate", Path: path.Join(x.root, path.Clean("/"+name)), Err: syscall.EFBIG}
+	}
+	return x.Storage.Truncate(name, size)
+}
+
+// readBody reads what is written to a file at offset from body, up to the
+// size the file may have.
+func (x *limitedStorage) readBody(name string, body io.Reader, offset int64) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(body, max(0, x.maxFileSize-offset)+1))
+	if err == nil && offset+int64(len(data)) > x.maxFileSize {
+		return nil, &os.PathError{Op: "write", Path: path.Join(x.root, path.Clean("/"+name)), Err: syscall.EFBIG}
+	}
+	return data, err
+}
+
+// limitedFile is a file of a limitedStorage opened for writing.
+type limitedFile struct {
+	File
+	// name is the name of the file in errors.
+	name        string
+	flag        int
+	maxFileSize int64
+}
+
+// check returns an error if writing n bytes at offset makes the file too
+// large.
+func (x *limitedFile) check(op string, offset int64, n int) error {
+	if offset+int64(n) > x.maxFileSize {
+		return &os.PathError{Op: op, Path: x.name, Err: syscall.EFBIG}
+	}
+	return nil
+}
+
+func (x *limitedFile) Write(p []byte) (int, error) {
+	var offset int64
+	var err error
+	if x.flag&os.O_APPEND != 0 {
+		var info os.FileInfo
+		if info, err = x.File.Stat(); err == nil {
+			offset = info.Size()
+		}
+	} else {
+		offset, err = x.File.Seek(0, io.SeekCurrent)
+	}
+	if err != nil {
+		return 0, err
+	}
+	if err := x.check("write", offset, len(p)); err != nil {
+		return 0, err
+	}
+	return x.File.Write(p)
+}
+
+func (x *limitedFile) WriteAt(p []byte, offset int64) (int, error) {
+	if err := x.check("write", offset, len(p)); err != nil {
+		return 0, err
+	}
+	return x.File.WriteAt(p, offset)
+}
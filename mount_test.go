@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMounts(t *testing.T) {
+	newMount := func(path string, readOnly bool, maxFileSize int64) Mount {
+		mount := Mount{Path: path, Storage: StorageMemory, ContentRoot: strings.TrimPrefix(path, "/"), ReadOnly: readOnly, MaxFileSize: maxFileSize}
+		storage := newMemStorage(mount.ContentRoot)
+		if err := writeFile(storage, "/file.txt", []byte(path+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		mount.setStorage(storage)
+		return mount
+	}
+	config := newConfig(ContentRoot)
+	config.Mounts = []Mount{
+		newMount("/scratch", false, 10),
+		newMount("/artifacts", true, 0),
+		newMount("/artifacts/nested", false, 0),
+	}
+	handler := httpHandler(config)
+	runTest := func(t *testing.T, method, target, reqBody string, wantStatus int, wantBody string) {
+		t.Helper()
+		httpRequest := httptest.NewRequest(method, target, strings.NewReader(reqBody))
+		responseRecorder := httptest.NewRecorder()
+		handler.ServeHTTP(responseRecorder, httpRequest)
+		assertHttpResponse(t, responseRecorder.Result(), wantStatus, wantBody)
+	}
+
+	t.Run("root lists the mounts", func(t *testing.T) {
+		runTest(t, http.MethodGet, "/", "", http.StatusOK, `{
+		  "status": "ok",
+		  "type": "mounts",
+		  "mounts": [
+		    {"path": "/artifacts", "storage": "memory", "read_only": true},
+		    {"path": "/artifacts/nested", "storage": "memory", "read_only": false},
+		    {"path": "/scratch", "storage": "memory", "read_only": false, "max_file_size": 10}
+		  ]
+		}`)
+	})
+
+	t.Run("paths are routed to the longest mount", func(t *testing.T) {
+		runTest(t, http.MethodGet, "/artifacts/nested/file.txt", "", http.StatusOK, `{
+		  "status": "ok",
+		  "type": "file",
+		  "file": {
+		    "name": "file.txt",
+		    "path": "/artifacts/nested/file.txt",
+		    "owner": "0",
+		    "group": "0",
+		    "permissions": "0644",
+		    "size": 18,
+		    "mime_type": "text/plain; charset=utf-8",
+		    "contents": "/artifacts/nested\n"
+		  }
+		}`)
+		runTest(t, http.MethodGet, "/other/file.txt", "", http.StatusNotFound, `{
+		  "status": "error",
+		  "type": "error",
+		  "error": {
+		    "code": 404,
+		    "error": "/other/file.txt is not under a mount"
+		  }
+		}`)
+	})
+
+	t.Run("read only mounts refuse changes", func(t *testing.T) {
+		runTest(t, http.MethodPut, "/artifacts/file.txt", `{"contents": "changed\n", "permissions": "0644"}`, http.StatusForbidden, `{
+		  "status": "error",
+		  "type": "error",
+		  "error": {
+		    "code": 403,
+		    "error": "/artifacts is read only"
+		  }
+		}`)
+		storage := config.Mounts[1].storage
+		if err := writeFile(storage, "/file.txt", []byte("changed\n"), 0644); err == nil || err.Error() != "open artifacts/file.txt: read-only file system" {
+			t.Errorf("got error %v writing to the read only storage", err)
+		}
+	})
+
+	t.Run("files are limited in size", func(t *testing.T) {
+		runTest(t, http.MethodPut, "/scratch/big.txt", `{"contents": "hello world\n", "permissions": "0644"}`, http.StatusRequestEntityTooLarge, `{
+		  "status": "error",
+		  "type": "error",
+		  "error": {
+		    "code": 413,
+		    "error": "write scratch/big.txt: file too large"
+		  }
+		}`)
+		runTest(t, http.MethodPut, "/scratch/small.txt", `{"contents": "hello\n", "permissions": "0644"}`, http.StatusOK, `{
+		  "status": "ok",
+		  "type": "file",
+		  "file": {
+		    "name": "small.txt",
+		    "path": "/scratch/small.txt",
+		    "owner": "0",
+		    "group": "0",
+		    "permissions": "0644",
+		    "size": 6,
+		    "mime_type": "text/plain; charset=utf-8",
+		    "contents": "hello\n"
+		  }
+		}`)
+		runTest(t, http.MethodPatch, "/scratch/small.txt?append=true", "world\n", http.StatusRequestEntityTooLarge, `{
+		  "status": "error",
+		  "type": "error",
+		  "error": {
+		    "code": 413,
+		    "error": "write scratch/small.txt: file too large"
+		  }
+		}`)
+		runTest(t, http.MethodPatch, "/scratch/small.txt?truncate=11", "", http.StatusRequestEntityTooLarge, `{
+		  "status": "error",
+		  "type": "error",
+		  "error": {
+		    "code": 413,
+		    "error": "truncate scratch/small.txt: file too large"
+		  }
+		}`)
+	})
+}
+
+func TestMountWebhooks(t *testing.T) {
+	receiver := newWebhookReceiver(0)
+	defer receiver.Close()
+
+	queueDir := t.TempDir()
+	queued := WebhookDelivery{
+		ID:      "queued",
+		URL:     receiver.URL,
+		Status:  WebhookDeliveryPending,
+		Created: time.Now().UTC(),
+		Event:   WatchEvent{ID: 1, Type: WatchEventDelete, Path: "/scratch/gone.txt"},
+	}
+	data, err := json.Marshal(queued)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(queueDir, "queued.json"), data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config := newConfig(ContentRoot)
+	config.WatchPollInterval = 10 * time.Millisecond
+	config.WebhookQueueDir = queueDir
+	config.Webhooks = []Webhook{{URL: receiver.URL}}
+	for _, mountPath := range []string{"/scratch", "/artifacts"} {
+		mount := Mount{Path: mountPath, Storage: StorageMemory, ContentRoot: strings.TrimPrefix(mountPath, "/")}
+		mount.setStorage(newMemStorage(mount.ContentRoot))
+		config.Mounts = append(config.Mounts, mount)
+	}
+	server := httptest.NewServer(httpHandler(config))
+	defer server.Close()
+
+	// Wait for the watchers to start polling before making a change.
+	time.Sleep(50 * time.Millisecond)
+	req, err := http.NewRequest(http.MethodPut, server.URL+"/artifacts/new.txt", strings.NewReader(`{"contents": "new\n", "permissions": "0644"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	// The deliveries of all the mounts are listed under any of them.
+	deliveries := waitForWebhookDeliveries(t, server.URL+"/scratch", WebhookDeliveryDelivered, 2)
+	paths := map[string]bool{}
+	for _, delivery := range deliveries {
+		paths[delivery.Event.Path] = true
+	}
+	if !paths["/scratch/gone.txt"] || !paths["/artifacts/new.txt"] {
+		t.Errorf("got deliveries %+v", deliveries)
+	}
+	if got := len(waitForWebhookDeliveries(t, server.URL+"/artifacts", WebhookDeliveryDelivered, 2)); got != 2 {
+		t.Errorf("got %d deliveries under /artifacts, want 2", got)
+	}
+	if requests := receiver.Requests(); len(requests) != 2 {
+		t.Errorf("got %d webhook requests, want 2", len(requests))
+	}
+}
+
+func TestLoadMounts(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		json  string
+		valid bool
+	}{
+		{"valid", `[{"path": "/data", "content_root": "test"}, {"path": "/tmp", "storage": "memory", "read_only": true}]`, true},
+		{"relative path", `[{"path": "data", "content_root": "test"}]`, false},
+		{"root path", `[{"path": "/", "content_root": "test"}]`, false},
+		{"unclean path", `[{"path": "/data/", "content_root": "test"}]`, false},
+		{"same path twice", `[{"path": "/data", "content_root": "test"}, {"path": "/data", "storage": "memory"}]`, false},
+		{"disk without content root", `[{"path": "/data"}]`, false},
+		{"unknown storage", `[{"path": "/data", "storage": "tape"}]`, false},
+		{"missing encryption key file", `[{"path": "/data", "storage": "memory", "encryption_key_file": "/nonexistent/keys"}]`, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			f, err := ioutil.TempFile("", "mounts")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.Remove(f.Name())
+			if _, err := f.WriteString(test.json); err != nil {
+				t.Fatal(err)
+			}
+			f.Close()
+
+			_, err = loadMounts(f.Name(), newConfig(ContentRoot))
+			if valid := err == nil; valid != test.valid {
+				t.Errorf("got error %v", err)
+			}
+		})
+	}
+}
+
+func TestLoadConfigWithMounts(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "mounts.json")
+	if err := ioutil.WriteFile(fileName, []byte(`[{"path": "/data", "storage": "memory"}]`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("FILE_SERVER_MOUNTS", fileName)
+	if _, err := loadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("FILE_SERVER_GRPC_LISTEN_ADDRESS", "localhost:9090")
+	if _, err := loadConfig(); err == nil || err.Error() != "FILE_SERVER_GRPC_LISTEN_ADDRESS: can't be set with FILE_SERVER_MOUNTS" {
+		t.Errorf("got error %v", err)
+	}
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/user"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+func handlePatch(config Config, w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	switch {
+	case query.Get("append") == "true", query.Get("truncate") != "", r.Header.Get("Content-Range") != "":
+		handlePatchContents(config, w, r)
+	default:
+		handlePatchMeta(config, w, r)
+	}
+}
+
+func handlePatchMeta(config Config, w http.ResponseWriter, r *http.Request) {
+	fileName := path.Join(config.ContentRoot, r.URL.Path)
+	info, err := config.Storage.Stat(r.URL.Path)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	var data PatchFileRequest
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		invalidJson(w, err)
+		return
+	}
+
+	change, err := newMetaChange(data, config.XattrNamespaces)
+	switch {
+	case err == nil:
+		break
+	case errors.Is(err, errInvalidPermissions):
+		invalidPermissions(w, fileName)
+		return
+	case errors.Is(err, errXattrNotAllowed), errors.Is(err, errXattrReserved):
+		forbidden(w, err.Error())
+		return
+	default:
+		badRequest(w, err.Error())
+		return
+	}
+
+	if data.Recursive && info.IsDir() {
+		err = walkStorage(config.Storage, r.URL.Path, func(name string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			return change.apply(config.Storage, name, info.Mode())
+		})
+	} else {
+		err = change.apply(config.Storage, r.URL.Path, info.Mode())
+	}
+
+	switch {
+	case err == nil:
+		writeMetaResponse(config, w, r, r.URL.Path)
+	case errors.Is(err, syscall.EPERM):
+		forbidden(w, err.Error())
+	case errors.Is(err, syscall.EINVAL):
+		badRequest(w, err.Error())
+	default:
+		writeError(w, err)
+	}
+}
+
+// handlePatchContents appends to, writes into or truncates an existing file.
+func handlePatchContents(config Config, w http.ResponseWriter, r *http.Request) {
+	fileName := path.Join(config.ContentRoot, r.URL.Path)
+	info, err := config.Storage.Stat(r.URL.Path)
+	switch {
+	case err == nil && info.Mode().IsRegular():
+		break
+	case err != nil:
+		writeError(w, err)
+		return
+	default:
+		badRequest(w, fileName+" is not a file")
+		return
+	}
+
+	query := r.URL.Query()
+	appendData := query.Get("append") == "true"
+	contentRange := r.Header.Get("Content-Range")
+	truncate := query.Get("truncate")
+	if appendData && contentRange != "" {
+		badRequest(w, "append and Content-Range are mutually exclusive")
+		return
+	}
+
+	truncateSize := int64(-1)
+	if truncate != "" {
+		size, err := strconv.ParseInt(truncate, 10, 64)
+		if err != nil || size < 0 {
+			badRequest(w, fmt.Sprintf("invalid truncate length %q", truncate))
+			return
+		}
+		truncateSize = size
+	}
+
+	// The body is read and checked before the file is truncated, so that a
+	// request that fails leaves the file as it was.
+	var data []byte
+	var start int64
+	switch {
+	case appendData:
+		start = info.Size()
+		if truncateSize >= 0 {
+			start = truncateSize
+		}
+		data, err = readFileBody(config.Storage, r.URL.Path, r.Body, start)
+	case contentRange != "":
+		var end int64
+		start, end, err = parseContentRange(contentRange)
+		if err != nil {
+			badRequest(w, err.Error())
+			return
+		}
+		data, err = readRangeBody(config.Storage, r.URL.Path, r.Body, start, end)
+	}
+	if err == nil && truncateSize >= 0 {
+		err = config.Storage.Truncate(r.URL.Path, truncateSize)
+	}
+	if err == nil {
+		switch {
+		case appendData:
+			err = appendFile(config.Storage, r.URL.Path, data)
+		case contentRange != "":
+			err = writeFileAt(config.Storage, r.URL.Path, data, start)
+		}
+	}
+
+	switch {
+	case err == nil:
+		writeMetaResponse(config, w, r, r.URL.Path)
+	case errors.Is(err, errContentLength):
+		badRequest(w, err.Error())
+	default:
+		writeError(w, err)
+	}
+}
+
+var errContentLength = errors.New("body length does not match Content-Range")
+
+// patchBodyMaxSize bounds the bodies of appends and ranged writes, which are
+// read into memory before they are written.
+const patchBodyMaxSize = 32 << 20
+
+// readFileBody reads what is written to a file of a storage at offset from
+// body, up to patchBodyMaxSize and the size its files may have if it is
+// limited.
+func readFileBody(storage Storage, name string, body io.Reader, offset int64) ([]byte, error) {
+	for {
+		if x, ok := storage.(*limitedStorage); ok && x.maxFileSize-offset < patchBodyMaxSize {
+			return x.readBody(name, body, offset)
+		}
+		wrapper, ok := storage.(storageWrapper)
+		if !ok {
+			break
+		}
+		storage = wrapper.Unwrap()
+	}
+	data, err := io.ReadAll(io.LimitReader(body, patchBodyMaxSize+1))
+	if err == nil && len(data) > patchBodyMaxSize {
+		return nil, &statusError{http.StatusRequestEntityTooLarge, fmt.Sprintf("appended and ranged bodies can't be larger than %d bytes", patchBodyMaxSize)}
+	}
+	return data, err
+}
+
+// readRangeBody reads what is written to name at the inclusive byte range
+// start-end. No more of the body than the range is read.
+func readRangeBody(storage Storage, name string, body io.Reader, start, end int64) ([]byte, error) {
+	data, err := readFileBody(storage, name, io.LimitReader(body, end-start+2), start)
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) != end-start+1 {
+		return nil, errContentLength
+	}
+	return data, nil
+}
+
+// appendFile appends data to name with a single write so concurrent appenders
+// can't interleave within a record.
+func appendFile(storage Storage, name string, data []byte) error {
+	f, err := storage.OpenFile(name, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// writeFileAt writes data to name at offset.
+func writeFileAt(storage Storage, name string, data []byte, offset int64) error {
+	f, err := storage.OpenFile(name, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteAt(data, offset); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// parseContentRange parses a header like "bytes 0-499/1234" or "bytes 0-499/*".
+func parseContentRange(header string) (start, end int64, err error) {
+	invalid := fmt.Errorf("invalid Content-Range %q", header)
+	if !strings.HasPrefix(header, "bytes ") {
+		return 0, 0, invalid
+	}
+	spec := strings.TrimPrefix(header, "bytes ")
+	if i := strings.Index(spec, "/"); i >= 0 {
+		spec = spec[:i]
+	}
+	bounds := strings.Split(spec, "-")
+	if len(bounds) != 2 {
+		return 0, 0, invalid
+	}
+	if start, err = strconv.ParseInt(bounds[0], 10, 64); err != nil {
+		return 0, 0, invalid
+	}
+	if end, err = strconv.ParseInt(bounds[1], 10, 64); err != nil {
+		return 0, 0, invalid
+	}
+	if start < 0 || end < start {
+		return 0, 0, invalid
+	}
+	return start, end, nil
+}
+
+var errInvalidPermissions = errors.New("invalid octal permissions")
+
+// metaChange is a parsed PatchFileRequest. Unset fields are left unchanged.
+type metaChange struct {
+	perms        *os.FileMode
+	uid          int
+	gid          int
+	modified     *time.Time
+	setXattrs    map[string][]byte
+	removeXattrs []string
+}
+
+func newMetaChange(data PatchFileRequest, xattrNamespaces []string) (metaChange, error) {
+	change := metaChange{uid: -1, gid: -1}
+
+	if data.Permissions != "" {
+		perms, err := strconv.ParseUint(data.Permissions, 8, 32)
+		if err != nil {
+			return change, errInvalidPermissions
+		}
+		mode := os.FileMode(perms)
+		change.perms = &mode
+	}
+
+	var err error
+	if change.uid, err = lookupUid(data.Owner); err != nil {
+		return change, err
+	}
+	if change.gid, err = lookupGid(data.Group); err != nil {
+		return change, err
+	}
+
+	switch data.Modified {
+	case "":
+		break
+	case "now":
+		now := time.Now()
+		change.modified = &now
+	default:
+		modified, err := time.Parse(time.RFC3339, data.Modified)
+		if err != nil {
+			return change, fmt.Errorf("invalid modified time: %v", err)
+		}
+		change.modified = &modified
+	}
+
+	if change.setXattrs, change.removeXattrs, err = parseXattrs(data.Xattrs, xattrNamespaces); err != nil {
+		return change, err
+	}
+
+	return change, nil
+}
+
+// apply changes the metadata of name. Symlinks only have their ownership
+// changed since chmod, chtimes and xattrs would follow the link.
+func (x metaChange) apply(storage Storage, name string, mode os.FileMode) error {
+	if x.uid != -1 || x.gid != -1 {
+		if err := storage.Lchown(name, x.uid, x.gid); err != nil {
+			return err
+		}
+	}
+	if mode&os.ModeSymlink != 0 {
+		return nil
+	}
+	if x.perms != nil {
+		if err := storage.Chmod(name, *x.perms); err != nil {
+			return err
+		}
+	}
+	for attr, value := range x.setXattrs {
+		if err := storage.SetXattr(name, attr, value); err != nil {
+			return err
+		}
+	}
+	for _, attr := range x.removeXattrs {
+		if err := storage.RemoveXattr(name, attr); err != nil {
+			return err
+		}
+	}
+	if x.modified != nil {
+		if err := storage.Chtimes(name, *x.modified, *x.modified); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lookupUid resolves a numeric user id or user name. An empty owner is -1.
+func lookupUid(owner string) (int, error) {
+	if owner == "" {
+		return -1, nil
+	}
+	if uid, err := strconv.Atoi(owner); err == nil {
+		return uid, nil
+	}
+	u, err := user.Lookup(owner)
+	if err != nil {
+		return -1, err
+	}
+	return strconv.Atoi(u.Uid)
+}
+
+// lookupGid resolves a numeric group id or group name. An empty group is -1.
+func lookupGid(group string) (int, error) {
+	if group == "" {
+		return -1, nil
+	}
+	if gid, err := strconv.Atoi(group); err == nil {
+		return gid, nil
+	}
+	g, err := user.LookupGroup(group)
+	if err != nil {
+		return -1, err
+	}
+	return strconv.Atoi(g.Gid)
+}
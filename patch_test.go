@@ -0,0 +1,317 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestHandlePatch(t *testing.T) {
+	runTest := func(t *testing.T, target string, reqBody string, wantStatus int, wantBody string) {
+		t.Helper()
+		httpRequest := httptest.NewRequest(http.MethodPatch, target, strings.NewReader(reqBody))
+		responseRecorder := httptest.NewRecorder()
+		httpHandler(newConfig(ContentRoot)).ServeHTTP(responseRecorder, httpRequest)
+		assertHttpResponse(t, responseRecorder.Result(), wantStatus, wantBody)
+	}
+
+	t.Run("file does not exist", func(t *testing.T) {
+		mustMakeContentRoot(t)
+		defer mustDeleteContentRoot(t)
+
+		runTest(t, "/file.txt", `{"permissions": "0600"}`, http.StatusNotFound, `{
+          "status": "error",
+          "type": "error",
+          "error": {
+            "code": 404,
+            "error": "stat test/file.txt: no such file or directory"
+          }
+        }`)
+	})
+
+	t.Run("invalid permissions", func(t *testing.T) {
+		mustMakeContentRoot(t)
+		defer mustDeleteContentRoot(t)
+
+		mustWriteFile(t, []byte("hello\n"), "/file.txt", 0644)
+		runTest(t, "/file.txt", `{"permissions": "0x600"}`, http.StatusBadRequest, `{
+          "status": "error",
+          "type": "error",
+          "error": {
+            "code": 400,
+            "error": "test/file.txt has invalid octal permissions"
+          }
+        }`)
+	})
+
+	t.Run("unknown owner", func(t *testing.T) {
+		mustMakeContentRoot(t)
+		defer mustDeleteContentRoot(t)
+
+		mustWriteFile(t, []byte("hello\n"), "/file.txt", 0644)
+		runTest(t, "/file.txt", `{"owner": "no-such-user"}`, http.StatusBadRequest, `{
+          "status": "error",
+          "type": "error",
+          "error": {
+            "code": 400,
+            "error": "user: unknown user no-such-user"
+          }
+        }`)
+	})
+
+	t.Run("chmod, chown and touch file", func(t *testing.T) {
+		mustMakeContentRoot(t)
+		defer mustDeleteContentRoot(t)
+
+		mustWriteFile(t, []byte("hello\n"), "/file.txt", 0644)
+		runTest(t, "/file.txt",
+			`{"permissions": "0600", "owner": "daemon", "group": "1", "modified": "2021-06-01T12:00:00Z"}`,
+			http.StatusOK,
+			`{
+			  "status": "ok",
+			  "type": "meta",
+			  "meta": {
+				"name": "file.txt",
+				"path": "/file.txt",
+				"mime_type": "text/plain; charset=utf-8",
+				"owner": "1",
+				"group": "1",
+				"permissions": "0600",
+				"size": 6,
+				"modified": "2021-06-01T12:00:00Z"
+			  }
+			}`)
+		assertFileContents(t, "/file.txt", 0600, "hello\n")
+	})
+
+	t.Run("recursive chmod directory", func(t *testing.T) {
+		mustMakeContentRoot(t)
+		defer mustDeleteContentRoot(t)
+
+		mustMkDir(t, "/dir", 0700)
+		mustWriteFile(t, []byte("hello\n"), "/dir/file.txt", 0600)
+		runTest(t, "/dir", `{"permissions": "0755", "recursive": true}`, http.StatusOK, `{
+		  "status": "ok",
+		  "type": "meta",
+		  "meta": {
+			"name": "dir",
+			"path": "/dir",
+			"owner": "0",
+			"group": "0",
+			"permissions": "0755",
+			"size": 4096
+		  }
+		}`)
+		assertFileContents(t, "/dir/file.txt", 0755, "hello\n")
+	})
+
+	t.Run("symlinks are not followed", func(t *testing.T) {
+		mustMakeContentRoot(t)
+		defer mustDeleteContentRoot(t)
+
+		mustMkDir(t, "/dir", 0700)
+		mustWriteFile(t, []byte("hello\n"), "/file.txt", 0600)
+		if err := os.Symlink("../file.txt", path.Join(ContentRoot, "/dir/link")); err != nil {
+			t.Fatal(err)
+		}
+		runTest(t, "/dir", `{"permissions": "0750", "recursive": true}`, http.StatusOK, `{
+		  "status": "ok",
+		  "type": "meta",
+		  "meta": {
+			"name": "dir",
+			"path": "/dir",
+			"owner": "0",
+			"group": "0",
+			"permissions": "0750",
+			"size": 4096
+		  }
+		}`)
+		assertFileContents(t, "/file.txt", 0600, "hello\n")
+	})
+
+	t.Run("read only storage", func(t *testing.T) {
+		storage := newMemStorage(ContentRoot)
+		if err := writeFile(storage, "/file.txt", []byte("hello\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		config := newConfig(ContentRoot)
+		config.Storage = readOnlyStorage{Storage: storage, root: ContentRoot}
+		httpRequest := httptest.NewRequest(http.MethodPatch, "/file.txt", strings.NewReader(`{"permissions": "0600"}`))
+		responseRecorder := httptest.NewRecorder()
+		httpHandler(config).ServeHTTP(responseRecorder, httpRequest)
+		assertHttpResponse(t, responseRecorder.Result(), http.StatusForbidden, `{
+		  "status": "error",
+		  "type": "error",
+		  "error": {
+			"code": 403,
+			"error": "chmod test/file.txt: read-only file system"
+		  }
+		}`)
+	})
+}
+
+func TestHandlePatchContents(t *testing.T) {
+	runTest := func(t *testing.T, target, contentRange, reqBody string, wantStatus int, wantBody string) {
+		t.Helper()
+		httpRequest := httptest.NewRequest(http.MethodPatch, target, strings.NewReader(reqBody))
+		if contentRange != "" {
+			httpRequest.Header.Set("Content-Range", contentRange)
+		}
+		responseRecorder := httptest.NewRecorder()
+		httpHandler(newConfig(ContentRoot)).ServeHTTP(responseRecorder, httpRequest)
+		assertHttpResponse(t, responseRecorder.Result(), wantStatus, wantBody)
+	}
+
+	t.Run("target is not a file", func(t *testing.T) {
+		mustMakeContentRoot(t)
+		defer mustDeleteContentRoot(t)
+
+		mustMkDir(t, "/dir", 0700)
+		runTest(t, "/dir?append=true", "", "hello\n", http.StatusBadRequest, `{
+          "status": "error",
+          "type": "error",
+          "error": {
+            "code": 400,
+            "error": "test/dir is not a file"
+          }
+        }`)
+	})
+
+	t.Run("append", func(t *testing.T) {
+		mustMakeContentRoot(t)
+		defer mustDeleteContentRoot(t)
+
+		mustWriteFile(t, []byte("hello\n"), "/file.txt", 0644)
+		runTest(t, "/file.txt?append=true", "", "world\n", http.StatusOK, `{
+		  "status": "ok",
+		  "type": "meta",
+		  "meta": {
+			"name": "file.txt",
+			"path": "/file.txt",
+			"mime_type": "text/plain; charset=utf-8",
+			"owner": "0",
+			"group": "0",
+			"permissions": "0644",
+			"size": 12
+		  }
+		}`)
+		assertFileContents(t, "/file.txt", 0644, "hello\nworld\n")
+	})
+
+	t.Run("write at offset", func(t *testing.T) {
+		mustMakeContentRoot(t)
+		defer mustDeleteContentRoot(t)
+
+		mustWriteFile(t, []byte("hello\n"), "/file.txt", 0644)
+		runTest(t, "/file.txt", "bytes 1-4/*", "ELLO", http.StatusOK, `{
+		  "status": "ok",
+		  "type": "meta",
+		  "meta": {
+			"name": "file.txt",
+			"path": "/file.txt",
+			"mime_type": "text/plain; charset=utf-8",
+			"owner": "0",
+			"group": "0",
+			"permissions": "0644",
+			"size": 6
+		  }
+		}`)
+		assertFileContents(t, "/file.txt", 0644, "hELLO\n")
+	})
+
+	t.Run("content range does not match body", func(t *testing.T) {
+		mustMakeContentRoot(t)
+		defer mustDeleteContentRoot(t)
+
+		mustWriteFile(t, []byte("hello\n"), "/file.txt", 0644)
+		runTest(t, "/file.txt", "bytes 1-2/*", "ELLO", http.StatusBadRequest, `{
+          "status": "error",
+          "type": "error",
+          "error": {
+            "code": 400,
+            "error": "body length does not match Content-Range"
+          }
+        }`)
+		assertFileContents(t, "/file.txt", 0644, "hello\n")
+	})
+
+	t.Run("invalid content range", func(t *testing.T) {
+		mustMakeContentRoot(t)
+		defer mustDeleteContentRoot(t)
+
+		mustWriteFile(t, []byte("hello\n"), "/file.txt", 0644)
+		runTest(t, "/file.txt", "bytes 4-1/*", "ELLO", http.StatusBadRequest, `{
+          "status": "error",
+          "type": "error",
+          "error": {
+            "code": 400,
+            "error": "invalid Content-Range \"bytes 4-1/*\""
+          }
+        }`)
+	})
+
+	t.Run("truncate", func(t *testing.T) {
+		mustMakeContentRoot(t)
+		defer mustDeleteContentRoot(t)
+
+		mustWriteFile(t, []byte("hello\n"), "/file.txt", 0644)
+		runTest(t, "/file.txt?truncate=2", "", "", http.StatusOK, `{
+		  "status": "ok",
+		  "type": "meta",
+		  "meta": {
+			"name": "file.txt",
+			"path": "/file.txt",
+			"mime_type": "text/plain; charset=utf-8",
+			"owner": "0",
+			"group": "0",
+			"permissions": "0644",
+			"size": 2
+		  }
+		}`)
+		assertFileContents(t, "/file.txt", 0644, "he")
+	})
+
+	t.Run("failed writes do not truncate", func(t *testing.T) {
+		mustMakeContentRoot(t)
+		defer mustDeleteContentRoot(t)
+
+		mustWriteFile(t, []byte("hello\n"), "/file.txt", 0644)
+		runTest(t, "/file.txt?truncate=0", "bytes 4-1/*", "ELLO", http.StatusBadRequest, `{
+          "status": "error",
+          "type": "error",
+          "error": {
+            "code": 400,
+            "error": "invalid Content-Range \"bytes 4-1/*\""
+          }
+        }`)
+		assertFileContents(t, "/file.txt", 0644, "hello\n")
+		runTest(t, "/file.txt?truncate=0", "bytes 0-9/*", "short", http.StatusBadRequest, `{
+          "status": "error",
+          "type": "error",
+          "error": {
+            "code": 400,
+            "error": "body length does not match Content-Range"
+          }
+        }`)
+		assertFileContents(t, "/file.txt", 0644, "hello\n")
+	})
+
+	t.Run("bodies are bounded", func(t *testing.T) {
+		mustMakeContentRoot(t)
+		defer mustDeleteContentRoot(t)
+
+		mustWriteFile(t, []byte("hello\n"), "/file.txt", 0644)
+		runTest(t, "/file.txt?append=true", "", strings.Repeat("a", patchBodyMaxSize+1), http.StatusRequestEntityTooLarge, `{
+          "status": "error",
+          "type": "error",
+          "error": {
+            "code": 413,
+            "error": "appended and ranged bodies can't be larger than 33554432 bytes"
+          }
+        }`)
+		assertFileContents(t, "/file.txt", 0644, "hello\n")
+	})
+}
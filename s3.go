@@ -0,0 +1,764 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const s3XMLNamespace = "http://s3.amazonaws.com/doc/2006-03-01/"
+
+// s3DefaultMaxKeys is how many keys ListObjectsV2 returns by default, and at most.
+const s3DefaultMaxKeys = 1000
+
+var (
+	errS3NoSuchBucket   = &S3Error{http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist"}
+	errS3NoSuchKey      = &S3Error{http.StatusNotFound, "NoSuchKey", "The specified key does not exist"}
+	errS3NoSuchUpload   = &S3Error{http.StatusNotFound, "NoSuchUpload", "The specified multipart upload does not exist"}
+	errS3InvalidKey     = &S3Error{http.StatusBadRequest, "InvalidArgument", "Keys may not have empty, . or .. segments"}
+	errS3InvalidPart    = &S3Error{http.StatusBadRequest, "InvalidPart", "One or more of the specified parts could not be found"}
+	errS3InvalidOrder   = &S3Error{http.StatusBadRequest, "InvalidPartOrder", "The list of parts was not in ascending order"}
+	errS3MalformedXML   = &S3Error{http.StatusBadRequest, "MalformedXML", "The XML you provided was not well-formed"}
+	errS3BadDigest      = &S3Error{http.StatusBadRequest, "BadDigest", "The Content-MD5 you specified did not match what was received"}
+	errS3NotImplemented = &S3Error{http.StatusNotImplemented, "NotImplemented", "A header or query you provided implies functionality that is not implemented"}
+)
+
+// s3Handler serves an S3 compatible api for the content root. Buckets are
+// the directories in the content root, and keys are the paths to the files
+// under them. Objects put and deleted run the same hooks as the json api.
+func s3Handler(config Config, hooks *Hooks) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := verifyS3Request(config.S3Credentials, r, time.Now()); err != nil {
+			writeS3Error(w, r, err)
+			return
+		}
+
+		bucket, key := splitS3Path(r.URL.Path)
+		query := r.URL.Query()
+		var err error
+		switch {
+		case bucket == "" && r.Method == http.MethodGet:
+			err = handleS3ListBuckets(config, w)
+		case bucket == "":
+			err = errS3NotImplemented
+		case key == "" && r.Method == http.MethodHead:
+			err = handleS3HeadBucket(config, bucket)
+		case key == "" && r.Method == http.MethodGet && query.Get("list-type") == "2":
+			err = handleS3ListObjects(config, w, r, bucket)
+		case key == "":
+			err = errS3NotImplemented
+		case r.Header.Get("X-Amz-Copy-Source") != "":
+			err = errS3NotImplemented
+		case r.Method == http.MethodPost && query.Has("uploads"):
+			err = handleS3CreateMultipartUpload(config, w, r, bucket, key)
+		case r.Method == http.MethodPut && query.Has("uploadId"):
+			err = handleS3UploadPart(config, w, r, bucket, key)
+		case r.Method == http.MethodPost && query.Has("uploadId"):
+			err = handleS3CompleteMultipartUpload(config, hooks, w, r, bucket, key)
+		case r.Method == http.MethodDelete && query.Has("uploadId"):
+			err = handleS3AbortMultipartUpload(config, w, r, bucket, key)
+		case r.Method == http.MethodGet, r.Method == http.MethodHead:
+			err = handleS3GetObject(config, w, r, bucket, key)
+		case r.Method == http.MethodPut:
+			err = handleS3PutObject(config, hooks, w, r, bucket, key)
+		case r.Method == http.MethodDelete:
+			err = handleS3DeleteObject(config, hooks, w, bucket, key)
+		default:
+			err = errS3NotImplemented
+		}
+		if err != nil {
+			writeS3Error(w, r, err)
+		}
+	})
+}
+
+// splitS3Path splits a path style url path into the bucket and key.
+func splitS3Path(urlPath string) (bucket, key string) {
+	urlPath = strings.TrimPrefix(urlPath, "/")
+	if i := strings.Index(urlPath, "/"); i >= 0 {
+		return urlPath[:i], urlPath[i+1:]
+	}
+	return urlPath, ""
+}
+
+// s3BucketDir returns the directory of a bucket, which must exist.
+func s3BucketDir(config Config, bucket string) (string, error) {
+	if bucket == "." || bucket == ".." || strings.HasPrefix(bucket, ".") {
+		return "", errS3NoSuchBucket
+	}
+	dirName := "/" + bucket
+	info, err := config.Storage.Stat(dirName)
+	switch {
+	case os.IsNotExist(err), err == nil && !info.IsDir():
+		return "", errS3NoSuchBucket
+	case err != nil:
+		return "", err
+	}
+	return dirName, nil
+}
+
+// s3ObjectFile returns the file of a key. Keys map directly to paths, so
+// they can't have segments that would change when the path is cleaned.
+func s3ObjectFile(config Config, bucket, key string) (string, error) {
+	dirName, err := s3BucketDir(config, bucket)
+	if err != nil {
+		return "", err
+	}
+	for _, segment := range strings.Split(strings.TrimSuffix(key, "/"), "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return "", errS3InvalidKey
+		}
+	}
+	return path.Join(dirName, key), nil
+}
+
+type s3ListAllMyBucketsResult struct {
+	XMLName xml.Name   `xml:"ListAllMyBucketsResult"`
+	Xmlns   string     `xml:"xmlns,attr"`
+	Owner   s3Owner    `xml:"Owner"`
+	Buckets []s3Bucket `xml:"Buckets>Bucket"`
+}
+
+type s3Owner struct {
+	ID          string `xml:"ID"`
+	DisplayName string `xml:"DisplayName"`
+}
+
+type s3Bucket struct {
+	Name         string `xml:"Name"`
+	CreationDate string `xml:"CreationDate"`
+}
+
+func handleS3ListBuckets(config Config, w http.ResponseWriter) error {
+	entries, err := config.Storage.ReadDir("/")
+	if err != nil {
+		return err
+	}
+	result := s3ListAllMyBucketsResult{Xmlns: s3XMLNamespace, Owner: s3Owner{ID: "file-server", DisplayName: "file-server"}}
+	for _, entry := range entries {
+		if !entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		result.Buckets = append(result.Buckets, s3Bucket{Name: entry.Name(), CreationDate: s3Time(info.ModTime())})
+	}
+	return writeS3Response(w, result)
+}
+
+func handleS3HeadBucket(config Config, bucket string) error {
+	_, err := s3BucketDir(config, bucket)
+	return err
+}
+
+type s3ListBucketResult struct {
+	XMLName               xml.Name           `xml:"ListBucketResult"`
+	Xmlns                 string             `xml:"xmlns,attr"`
+	Name                  string             `xml:"Name"`
+	Prefix                string             `xml:"Prefix"`
+	Delimiter             string             `xml:"Delimiter,omitempty"`
+	StartAfter            string             `xml:"StartAfter,omitempty"`
+	ContinuationToken     string             `xml:"ContinuationToken,omitempty"`
+	NextContinuationToken string             `xml:"NextContinuationToken,omitempty"`
+	EncodingType          string             `xml:"EncodingType,omitempty"`
+	KeyCount              int                `xml:"KeyCount"`
+	MaxKeys               int                `xml:"MaxKeys"`
+	IsTruncated           bool               `xml:"IsTruncated"`
+	Contents              []s3Object         `xml:"Contents"`
+	CommonPrefixes        []s3CommonPrefixes `xml:"CommonPrefixes"`
+}
+
+type s3Object struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int64  `xml:"Size"`
+	StorageClass string `xml:"StorageClass"`
+}
+
+type s3CommonPrefixes struct {
+	Prefix string `xml:"Prefix"`
+}
+
+// handleS3ListObjects implements ListObjectsV2. Keys are listed in byte
+// order, which isn't the order directories are walked in, so all the keys
+// under the prefix are collected and sorted first.
+func handleS3ListObjects(config Config, w http.ResponseWriter, r *http.Request, bucket string) error {
+	dirName, err := s3BucketDir(config, bucket)
+	if err != nil {
+		return err
+	}
+
+	query := r.URL.Query()
+	result := s3ListBucketResult{
+		Xmlns:             s3XMLNamespace,
+		Name:              bucket,
+		Prefix:            query.Get("prefix"),
+		Delimiter:         query.Get("delimiter"),
+		StartAfter:        query.Get("start-after"),
+		ContinuationToken: query.Get("continuation-token"),
+		EncodingType:      query.Get("encoding-type"),
+		MaxKeys:           s3DefaultMaxKeys,
+	}
+	if v := query.Get("max-keys"); v != "" {
+		maxKeys, err := strconv.Atoi(v)
+		if err != nil || maxKeys < 0 {
+			return &S3Error{http.StatusBadRequest, "InvalidArgument", "max-keys must be a non-negative integer"}
+		}
+		if maxKeys < result.MaxKeys {
+			result.MaxKeys = maxKeys
+		}
+	}
+	after := result.StartAfter
+	if result.ContinuationToken != "" {
+		token, err := base64.RawURLEncoding.DecodeString(result.ContinuationToken)
+		if err != nil {
+			return &S3Error{http.StatusBadRequest, "InvalidArgument", "The continuation token provided is incorrect"}
+		}
+		after = string(token)
+	}
+
+	keys, infos, err := s3Keys(config.Storage, dirName, result.Prefix)
+	if err != nil {
+		return err
+	}
+
+	encode := func(s string) string {
+		if result.EncodingType == "url" {
+			return url.QueryEscape(s)
+		}
+		return s
+	}
+	seenPrefixes := make(map[string]bool)
+	var last string
+	for i, key := range keys {
+		if key <= after {
+			continue
+		}
+		// Keys sharing a common prefix are rolled up into it.
+		if result.Delimiter != "" {
+			rest := strings.TrimPrefix(key, result.Prefix)
+			if j := strings.Index(rest, result.Delimiter); j >= 0 {
+				prefix := result.Prefix + rest[:j+len(result.Delimiter)]
+				if seenPrefixes[prefix] || prefix <= after {
+					continue
+				}
+				if result.KeyCount == result.MaxKeys {
+					result.IsTruncated = true
+					break
+				}
+				seenPrefixes[prefix] = true
+				result.CommonPrefixes = append(result.CommonPrefixes, s3CommonPrefixes{Prefix: encode(prefix)})
+				result.KeyCount++
+				last = prefix
+				continue
+			}
+		}
+
+		if result.KeyCount == result.MaxKeys {
+			result.IsTruncated = true
+			break
+		}
+		etag, err := s3ETag(config, path.Join(dirName, key))
+		if err != nil {
+			return err
+		}
+		result.Contents = append(result.Contents, s3Object{
+			Key:          encode(key),
+			LastModified: s3Time(infos[i].ModTime()),
+			ETag:         etag,
+			Size:         infos[i].Size(),
+			StorageClass: "STANDARD",
+		})
+		result.KeyCount++
+		last = key
+	}
+	if result.IsTruncated {
+		// A prefix continues after every key that starts with it.
+		if seenPrefixes[last] {
+			last += "\xff"
+		}
+		result.NextContinuationToken = base64.RawURLEncoding.EncodeToString([]byte(last))
+	}
+	if result.EncodingType == "url" {
+		result.Prefix = encode(result.Prefix)
+		result.Delimiter = encode(result.Delimiter)
+		result.StartAfter = encode(result.StartAfter)
+	}
+	return writeS3Response(w, result)
+}
+
+// s3Keys returns the sorted keys of the regular files under dirName that
+// start with prefix, along with their file infos.
+func s3Keys(storage Storage, dirName, prefix string) ([]string, []os.FileInfo, error) {
+	// Only the directory the prefix points into has to be walked.
+	root := dirName
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		root = path.Join(dirName, prefix[:i])
+	}
+
+	infos := make(map[string]os.FileInfo)
+	err := walkStorage(storage, root, func(name string, info os.FileInfo, err error) error {
+		switch {
+		case os.IsNotExist(err):
+			return nil
+		case err != nil:
+			return err
+		}
+		key := strings.TrimPrefix(name, dirName+"/")
+		if info.IsDir() && name != root && !strings.HasPrefix(key+"/", prefix) && !strings.HasPrefix(prefix, key+"/") {
+			return filepath.SkipDir
+		}
+		if info.Mode().IsRegular() && strings.HasPrefix(key, prefix) {
+			infos[key] = info
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keys := make([]string, 0, len(infos))
+	for key := range infos {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	sorted := make([]os.FileInfo, len(keys))
+	for i, key := range keys {
+		sorted[i] = infos[key]
+	}
+	return keys, sorted, nil
+}
+
+func handleS3GetObject(config Config, w http.ResponseWriter, r *http.Request, bucket, key string) error {
+	fileName, err := s3ObjectFile(config, bucket, key)
+	if err != nil {
+		return err
+	}
+	f, err := config.Storage.Open(fileName)
+	if os.IsNotExist(err) {
+		return errS3NoSuchKey
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return errS3NoSuchKey
+	}
+	etag, err := s3ETag(config, fileName)
+	if err != nil {
+		return err
+	}
+	mimeType, err := detectMimeType(config.Storage, fileName)
+	if err != nil {
+		return err
+	}
+
+	meta := NewFileMeta(key, info)
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Content-Type", mimeType)
+	w.Header().Set("X-Amz-Meta-Owner", meta.Owner)
+	w.Header().Set("X-Amz-Meta-Group", meta.Group)
+	w.Header().Set("X-Amz-Meta-Permissions", meta.Permissions)
+	http.ServeContent(w, r, info.Name(), info.ModTime(), f)
+	return nil
+}
+
+// handleS3PutObject writes the body to a temporary file next to the object,
+// and only renames it into place once the body has been checked. The
+// permissions can be set with x-amz-meta-permissions.
+func handleS3PutObject(config Config, hooks *Hooks, w http.ResponseWriter, r *http.Request, bucket, key string) error {
+	fileName, err := s3ObjectFile(config, bucket, key)
+	if err != nil {
+		return err
+	}
+	perms, err := s3Permissions(r)
+	if err != nil {
+		return err
+	}
+
+	// Keys ending in a slash are directory markers.
+	if strings.HasSuffix(key, "/") {
+		if _, err := io.Copy(ioutil.Discard, r.Body); err != nil {
+			return err
+		}
+		if err := config.Storage.MkdirAll(fileName, 0700); err != nil {
+			return err
+		}
+		w.Header().Set("ETag", `"`+hex.EncodeToString(md5.New().Sum(nil))+`"`)
+		return nil
+	}
+
+	var wantMD5 []byte
+	if v := r.Header.Get("Content-MD5"); v != "" {
+		if wantMD5, err = base64.StdEncoding.DecodeString(v); err != nil {
+			return &S3Error{http.StatusBadRequest, "InvalidDigest", "The Content-MD5 you specified was invalid"}
+		}
+	}
+
+	etag, err := putS3File(config, hooks, fileName, perms, r.Body, wantMD5)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("ETag", etag)
+	return nil
+}
+
+// putS3File writes an object with writeS3File, running the put hooks that
+// match it. Objects that hooks match are buffered so that the pre-hooks can
+// check them before they land.
+func putS3File(config Config, hooks *Hooks, fileName string, perms os.FileMode, contents io.Reader, wantMD5 []byte) (string, error) {
+	event := HookEvent{Operation: HookOperationPut, URLPath: fileName, FileName: path.Join(config.ContentRoot, fileName), Permissions: perms}
+	if !hooks.any(event) {
+		return writeS3File(config.Storage, fileName, perms, contents, wantMD5)
+	}
+
+	data, err := io.ReadAll(contents)
+	if err != nil {
+		return "", err
+	}
+	if sum := md5.Sum(data); wantMD5 != nil && !bytes.Equal(sum[:], wantMD5) {
+		return "", errS3BadDigest
+	}
+	event.Size = len(data)
+	if err := hooks.Pre(event, data); err != nil {
+		return "", err
+	}
+	etag, err := writeS3File(config.Storage, fileName, perms, bytes.NewReader(data), nil)
+	if err != nil {
+		return "", err
+	}
+	hooks.Post(event, data)
+	return etag, nil
+}
+
+// writeS3File atomically replaces fileName with the contents, returning the
+// quoted md5 etag.
+func writeS3File(storage Storage, fileName string, perms os.FileMode, contents io.Reader, wantMD5 []byte) (string, error) {
+	if err := storage.MkdirAll(path.Dir(fileName), 0700); err != nil {
+		return "", err
+	}
+	tmpName := tempFileName(fileName)
+	tmp, err := storage.OpenFile(tmpName, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", err
+	}
+	defer storage.Remove(tmpName)
+	defer tmp.Close()
+
+	hash := md5.New()
+	if _, err := io.Copy(io.MultiWriter(tmp, hash), contents); err != nil {
+		return "", err
+	}
+	sum := hash.Sum(nil)
+	if wantMD5 != nil && hex.EncodeToString(sum) != hex.EncodeToString(wantMD5) {
+		return "", errS3BadDigest
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+	if err := storage.Chmod(tmpName, perms); err != nil {
+		return "", err
+	}
+	if err := storage.Rename(tmpName, fileName); err != nil {
+		return "", err
+	}
+	return `"` + hex.EncodeToString(sum) + `"`, nil
+}
+
+func s3Permissions(r *http.Request) (os.FileMode, error) {
+	v := r.Header.Get("X-Amz-Meta-Permissions")
+	if v == "" {
+		return 0644, nil
+	}
+	perms, err := strconv.ParseUint(v, 8, 32)
+	if err != nil {
+		return 0, &S3Error{http.StatusBadRequest, "InvalidArgument", fmt.Sprintf("%q is not valid octal permissions", v)}
+	}
+	return os.FileMode(perms), nil
+}
+
+// handleS3DeleteObject succeeds even if the object doesn't exist, as S3 does.
+func handleS3DeleteObject(config Config, hooks *Hooks, w http.ResponseWriter, bucket, key string) error {
+	fileName, err := s3ObjectFile(config, bucket, key)
+	if err != nil {
+		return err
+	}
+	info, err := config.Storage.Lstat(fileName)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return err
+	case info.IsDir():
+		// Deleting a directory marker only removes the directory if it's empty.
+		if strings.HasSuffix(key, "/") {
+			var hookErr *HookError
+			if err := deleteFile(config, hooks, fileName, false); errors.As(err, &hookErr) {
+				return err
+			}
+		}
+	default:
+		if err := deleteFile(config, hooks, fileName, false); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// s3Upload is the state of a multipart upload, kept in its upload directory
+// along with the parts.
+type s3Upload struct {
+	Bucket      string      `json:"bucket"`
+	Key         string      `json:"key"`
+	Permissions os.FileMode `json:"permissions"`
+	Created     time.Time   `json:"created"`
+}
+
+type s3InitiateMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	UploadID string   `xml:"UploadId"`
+}
+
+func handleS3CreateMultipartUpload(config Config, w http.ResponseWriter, r *http.Request, bucket, key string) error {
+	if _, err := s3ObjectFile(config, bucket, key); err != nil {
+		return err
+	}
+	perms, err := s3Permissions(r)
+	if err != nil {
+		return err
+	}
+
+	uploadID := newDeliveryID()
+	dirName := s3UploadDir(config, uploadID)
+	if err := os.MkdirAll(dirName, 0700); err != nil {
+		return err
+	}
+	data, err := json.Marshal(s3Upload{Bucket: bucket, Key: key, Permissions: perms, Created: time.Now().UTC()})
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path.Join(dirName, "upload.json"), data, 0600); err != nil {
+		return err
+	}
+	return writeS3Response(w, s3InitiateMultipartUploadResult{Xmlns: s3XMLNamespace, Bucket: bucket, Key: key, UploadID: uploadID})
+}
+
+func s3UploadDir(config Config, uploadID string) string {
+	return filepath.Join(config.S3UploadDir, uploadID)
+}
+
+// loadS3Upload returns the directory of an upload for the bucket and key.
+func loadS3Upload(config Config, uploadID, bucket, key string) (string, s3Upload, error) {
+	var upload s3Upload
+	if _, err := hex.DecodeString(uploadID); err != nil || uploadID == "" {
+		return "", upload, errS3NoSuchUpload
+	}
+	dirName := s3UploadDir(config, uploadID)
+	data, err := ioutil.ReadFile(path.Join(dirName, "upload.json"))
+	if os.IsNotExist(err) {
+		return "", upload, errS3NoSuchUpload
+	} else if err != nil {
+		return "", upload, err
+	}
+	if err := json.Unmarshal(data, &upload); err != nil {
+		return "", upload, err
+	}
+	if upload.Bucket != bucket || upload.Key != key {
+		return "", upload, errS3NoSuchUpload
+	}
+	return dirName, upload, nil
+}
+
+func handleS3UploadPart(config Config, w http.ResponseWriter, r *http.Request, bucket, key string) error {
+	dirName, _, err := loadS3Upload(config, r.URL.Query().Get("uploadId"), bucket, key)
+	if err != nil {
+		return err
+	}
+	partNumber, err := strconv.Atoi(r.URL.Query().Get("partNumber"))
+	if err != nil || partNumber < 1 || partNumber > 10000 {
+		return &S3Error{http.StatusBadRequest, "InvalidArgument", "Part number must be an integer between 1 and 10000"}
+	}
+
+	etag, err := writeS3File(newDiskStorage(dirName), strconv.Itoa(partNumber), 0600, r.Body, nil)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("ETag", etag)
+	return nil
+}
+
+type s3CompleteMultipartUpload struct {
+	Parts []struct {
+		PartNumber int    `xml:"PartNumber"`
+		ETag       string `xml:"ETag"`
+	} `xml:"Part"`
+}
+
+type s3CompleteMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"CompleteMultipartUploadResult"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Location string   `xml:"Location"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	ETag     string   `xml:"ETag"`
+}
+
+// handleS3CompleteMultipartUpload joins the listed parts into the object.
+// Its etag is the md5 of the part md5s followed by the number of parts, as
+// with S3.
+func handleS3CompleteMultipartUpload(config Config, hooks *Hooks, w http.ResponseWriter, r *http.Request, bucket, key string) error {
+	dirName, upload, err := loadS3Upload(config, r.URL.Query().Get("uploadId"), bucket, key)
+	if err != nil {
+		return err
+	}
+	var complete s3CompleteMultipartUpload
+	if err := xml.NewDecoder(r.Body).Decode(&complete); err != nil {
+		var s3Err *S3Error
+		if errors.As(err, &s3Err) {
+			return err
+		}
+		return errS3MalformedXML
+	}
+	if len(complete.Parts) == 0 {
+		return errS3MalformedXML
+	}
+
+	// The parts are on disk in the upload directory, not in the storage.
+	parts := config
+	parts.Storage = newDiskStorage(dirName)
+	var readers []io.Reader
+	partsHash := md5.New()
+	for i, part := range complete.Parts {
+		if i > 0 && part.PartNumber <= complete.Parts[i-1].PartNumber {
+			return errS3InvalidOrder
+		}
+		partName := strconv.Itoa(part.PartNumber)
+		etag, err := s3ETag(parts, partName)
+		if os.IsNotExist(err) || etag == "" {
+			return errS3InvalidPart
+		} else if err != nil {
+			return err
+		}
+		if strings.Trim(part.ETag, `"`) != strings.Trim(etag, `"`) {
+			return errS3InvalidPart
+		}
+		sum, _ := hex.DecodeString(strings.Trim(etag, `"`))
+		partsHash.Write(sum)
+
+		f, err := parts.Storage.Open(partName)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		readers = append(readers, f)
+	}
+
+	fileName, err := s3ObjectFile(config, bucket, key)
+	if err != nil {
+		return err
+	}
+	if _, err := putS3File(config, hooks, fileName, upload.Permissions, io.MultiReader(readers...), nil); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(dirName); err != nil {
+		log.Printf("removing multipart upload: %v", err)
+	}
+
+	return writeS3Response(w, s3CompleteMultipartUploadResult{
+		Xmlns:    s3XMLNamespace,
+		Location: "/" + bucket + "/" + key,
+		Bucket:   bucket,
+		Key:      key,
+		ETag:     fmt.Sprintf(`"%s-%d"`, hex.EncodeToString(partsHash.Sum(nil)), len(complete.Parts)),
+	})
+}
+
+func handleS3AbortMultipartUpload(config Config, w http.ResponseWriter, r *http.Request, bucket, key string) error {
+	dirName, _, err := loadS3Upload(config, r.URL.Query().Get("uploadId"), bucket, key)
+	if err != nil {
+		return err
+	}
+	if err := os.RemoveAll(dirName); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// s3ETag returns the quoted md5 of a file, using the checksum cache.
+func s3ETag(config Config, fileName string) (string, error) {
+	checksums, err := fileChecksums(config, fileName, []string{"md5"})
+	if err != nil {
+		return "", err
+	}
+	return `"` + checksums["md5"] + `"`, nil
+}
+
+func s3Time(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05.000Z")
+}
+
+func writeS3Response(w http.ResponseWriter, v interface{}) error {
+	data, err := xml.Marshal(v)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(append([]byte(xml.Header), data...)); err != nil {
+		log.Println(err)
+	}
+	return nil
+}
+
+type s3ErrorResponse struct {
+	XMLName  xml.Name `xml:"Error"`
+	Code     string   `xml:"Code"`
+	Message  string   `xml:"Message"`
+	Resource string   `xml:"Resource"`
+}
+
+func writeS3Error(w http.ResponseWriter, r *http.Request, err error) {
+	s3Err := asS3Error(err)
+	if s3Err.StatusCode == http.StatusInternalServerError {
+		log.Println(err)
+	}
+	data, err := xml.Marshal(s3ErrorResponse{Code: s3Err.Code, Message: s3Err.Message, Resource: r.URL.Path})
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(s3Err.StatusCode)
+	if r.Method != http.MethodHead {
+		w.Write(append([]byte(xml.Header), data...))
+	}
+}
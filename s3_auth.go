@@ -0,0 +1,451 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	s3Algorithm       = "AWS4-HMAC-SHA256"
+	s3TimeFormat      = "20060102T150405Z"
+	s3UnsignedPayload = "UNSIGNED-PAYLOAD"
+	s3StreamingSigned = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+	s3EmptySha256     = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// s3MaxClockSkew is how far the request time may be from the server time.
+const s3MaxClockSkew = 15 * time.Minute
+
+// s3MaxChunkSize bounds the aws-chunked chunks, which are buffered to check
+// their signatures.
+const s3MaxChunkSize = 16 * 1024 * 1024
+
+// S3Credential is an access key that may sign S3 requests.
+type S3Credential struct {
+	AccessKeyID     string `json:"access_key_id"`
+	SecretAccessKey string `json:"secret_access_key"`
+}
+
+// loadS3Credentials reads a json list of S3 credentials.
+func loadS3Credentials(fileName string) ([]S3Credential, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	var credentials []S3Credential
+	if err := json.Unmarshal(data, &credentials); err != nil {
+		return nil, fmt.Errorf("%s: %v", fileName, err)
+	}
+	for _, credential := range credentials {
+		if credential.AccessKeyID == "" || credential.SecretAccessKey == "" {
+			return nil, fmt.Errorf("%s: credentials need an access key id and a secret access key", fileName)
+		}
+	}
+	return credentials, nil
+}
+
+var (
+	errS3AccessDenied      = &S3Error{http.StatusForbidden, "AccessDenied", "Access Denied"}
+	errS3InvalidAccessKey  = &S3Error{http.StatusForbidden, "InvalidAccessKeyId", "The access key id does not exist"}
+	errS3SignatureMismatch = &S3Error{http.StatusForbidden, "SignatureDoesNotMatch", "The request signature does not match the signature calculated by the server"}
+	errS3TimeSkewed        = &S3Error{http.StatusForbidden, "RequestTimeTooSkewed", "The difference between the request time and the server time is too large"}
+	errS3PresignExpired    = &S3Error{http.StatusForbidden, "AccessDenied", "Request has expired"}
+	errS3Sha256Mismatch    = &S3Error{http.StatusBadRequest, "XAmzContentSHA256Mismatch", "The provided x-amz-content-sha256 header does not match what was computed"}
+	errS3InvalidChunk      = &S3Error{http.StatusBadRequest, "IncompleteBody", "The aws-chunked body is malformed"}
+)
+
+// s3Signature is the parsed signature of a request, from either the
+// Authorization header or a presigned url.
+type s3Signature struct {
+	accessKeyID   string
+	date          time.Time
+	scope         string
+	region        string
+	signedHeaders []string
+	signature     string
+	// expires is only set for presigned urls.
+	expires time.Duration
+}
+
+// verifyS3Request checks the SigV4 signature of the request, and replaces
+// its body with one that checks the payload hash or chunk signatures as it
+// is read.
+func verifyS3Request(credentials []S3Credential, r *http.Request, now time.Time) error {
+	var sig s3Signature
+	var err error
+	presigned := r.URL.Query().Get("X-Amz-Algorithm") != ""
+	if presigned {
+		sig, err = parseS3Presigned(r.URL.Query())
+	} else {
+		sig, err = parseS3Authorization(r)
+	}
+	if err != nil {
+		return err
+	}
+
+	var secret string
+	for _, credential := range credentials {
+		if credential.AccessKeyID == sig.accessKeyID {
+			secret = credential.SecretAccessKey
+		}
+	}
+	if secret == "" {
+		return errS3InvalidAccessKey
+	}
+
+	if presigned {
+		if now.Before(sig.date.Add(-s3MaxClockSkew)) || now.After(sig.date.Add(sig.expires)) {
+			return errS3PresignExpired
+		}
+	} else if now.Sub(sig.date) > s3MaxClockSkew || sig.date.Sub(now) > s3MaxClockSkew {
+		return errS3TimeSkewed
+	}
+
+	payloadHash := s3UnsignedPayload
+	if !presigned {
+		payloadHash = r.Header.Get("X-Amz-Content-Sha256")
+		if payloadHash == "" {
+			return &S3Error{http.StatusBadRequest, "InvalidRequest", "Missing required header for this request: x-amz-content-sha256"}
+		}
+	}
+
+	key := s3SigningKey(secret, sig.date, sig.region)
+	stringToSign := strings.Join([]string{
+		s3Algorithm,
+		sig.date.Format(s3TimeFormat),
+		sig.scope,
+		sha256Hex([]byte(s3CanonicalRequest(r, sig.signedHeaders, payloadHash))),
+	}, "\n")
+	if !hmac.Equal([]byte(hex.EncodeToString(hmacSha256(key, stringToSign))), []byte(sig.signature)) {
+		return errS3SignatureMismatch
+	}
+
+	switch {
+	case payloadHash == s3UnsignedPayload:
+	case strings.HasPrefix(payloadHash, "STREAMING-"):
+		chunked := &s3ChunkedReader{
+			r:      bufio.NewReader(r.Body),
+			closer: r.Body,
+			signed: strings.HasPrefix(payloadHash, s3StreamingSigned),
+			key:    key,
+			date:   sig.date.Format(s3TimeFormat),
+			scope:  sig.scope,
+			prev:   sig.signature,
+		}
+		r.Body = chunked
+		if length := r.Header.Get("X-Amz-Decoded-Content-Length"); length != "" {
+			if r.ContentLength, err = strconv.ParseInt(length, 10, 64); err != nil {
+				return errS3InvalidChunk
+			}
+		}
+	default:
+		want, err := hex.DecodeString(payloadHash)
+		if err != nil || len(want) != sha256.Size {
+			return &S3Error{http.StatusBadRequest, "InvalidArgument", "Invalid x-amz-content-sha256 header"}
+		}
+		r.Body = &s3HashingReader{r: r.Body, hash: sha256.New(), want: want}
+	}
+	return nil
+}
+
+func parseS3Authorization(r *http.Request) (s3Signature, error) {
+	auth := r.Header.Get("Authorization")
+	if auth == "" {
+		return s3Signature{}, errS3AccessDenied
+	}
+	if !strings.HasPrefix(auth, s3Algorithm+" ") {
+		return s3Signature{}, &S3Error{http.StatusBadRequest, "InvalidArgument", "Only AWS4-HMAC-SHA256 signatures are supported"}
+	}
+
+	fields := make(map[string]string)
+	for _, field := range strings.Split(strings.TrimPrefix(auth, s3Algorithm+" "), ",") {
+		if i := strings.Index(field, "="); i > 0 {
+			fields[strings.TrimSpace(field[:i])] = strings.TrimSpace(field[i+1:])
+		}
+	}
+	return parseS3Signature(fields["Credential"], r.Header.Get("X-Amz-Date"), fields["SignedHeaders"], fields["Signature"])
+}
+
+func parseS3Presigned(query url.Values) (s3Signature, error) {
+	if query.Get("X-Amz-Algorithm") != s3Algorithm {
+		return s3Signature{}, &S3Error{http.StatusBadRequest, "InvalidArgument", "Only AWS4-HMAC-SHA256 signatures are supported"}
+	}
+	sig, err := parseS3Signature(query.Get("X-Amz-Credential"), query.Get("X-Amz-Date"), query.Get("X-Amz-SignedHeaders"), query.Get("X-Amz-Signature"))
+	if err != nil {
+		return sig, err
+	}
+	seconds, err := strconv.Atoi(query.Get("X-Amz-Expires"))
+	if err != nil || seconds < 1 || seconds > 7*24*60*60 {
+		return sig, &S3Error{http.StatusBadRequest, "AuthorizationQueryParametersError", "X-Amz-Expires must be between 1 and 604800 seconds"}
+	}
+	sig.expires = time.Duration(seconds) * time.Second
+	return sig, nil
+}
+
+func parseS3Signature(credential, date, signedHeaders, signature string) (s3Signature, error) {
+	malformed := &S3Error{http.StatusBadRequest, "AuthorizationHeaderMalformed", "The authorization is malformed"}
+
+	// The credential is ACCESS_KEY/DATE/REGION/s3/aws4_request.
+	parts := strings.Split(credential, "/")
+	if len(parts) != 5 || parts[3] != "s3" || parts[4] != "aws4_request" || signedHeaders == "" || signature == "" {
+		return s3Signature{}, malformed
+	}
+	t, err := time.Parse(s3TimeFormat, date)
+	if err != nil || t.Format("20060102") != parts[1] {
+		return s3Signature{}, malformed
+	}
+	return s3Signature{
+		accessKeyID:   parts[0],
+		date:          t,
+		scope:         strings.Join(parts[1:], "/"),
+		region:        parts[2],
+		signedHeaders: strings.Split(signedHeaders, ";"),
+		signature:     signature,
+	}, nil
+}
+
+// s3CanonicalRequest builds the canonical request as described in
+// https://docs.aws.amazon.com/IAM/latest/UserGuide/create-signed-request.html
+func s3CanonicalRequest(r *http.Request, signedHeaders []string, payloadHash string) string {
+	var query []string
+	for key, values := range r.URL.Query() {
+		if key == "X-Amz-Signature" {
+			continue
+		}
+		for _, value := range values {
+			query = append(query, s3URIEncode(key, true)+"="+s3URIEncode(value, true))
+		}
+	}
+	sort.Strings(query)
+
+	var headers strings.Builder
+	for _, name := range signedHeaders {
+		var value string
+		if name == "host" {
+			value = r.Host
+		} else {
+			value = strings.Join(r.Header.Values(name), ",")
+		}
+		headers.WriteString(name + ":" + strings.Join(strings.Fields(value), " ") + "\n")
+	}
+
+	return strings.Join([]string{
+		r.Method,
+		s3URIEncode(r.URL.Path, false),
+		strings.Join(query, "&"),
+		headers.String(),
+		strings.Join(signedHeaders, ";"),
+		payloadHash,
+	}, "\n")
+}
+
+// s3URIEncode percent encodes everything but the unreserved characters, and
+// slashes unless encodeSlash.
+func s3URIEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func s3SigningKey(secret string, date time.Time, region string) []byte {
+	key := hmacSha256([]byte("AWS4"+secret), date.Format("20060102"))
+	key = hmacSha256(key, region)
+	key = hmacSha256(key, "s3")
+	return hmacSha256(key, "aws4_request")
+}
+
+func hmacSha256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// s3HashingReader fails at the end of the body if it doesn't match the
+// signed payload hash.
+type s3HashingReader struct {
+	r    io.ReadCloser
+	hash hash.Hash
+	want []byte
+}
+
+func (x *s3HashingReader) Read(p []byte) (int, error) {
+	n, err := x.r.Read(p)
+	x.hash.Write(p[:n])
+	if err == io.EOF && !bytes.Equal(x.hash.Sum(nil), x.want) {
+		return n, errS3Sha256Mismatch
+	}
+	return n, err
+}
+
+func (x *s3HashingReader) Close() error {
+	return x.r.Close()
+}
+
+// s3ChunkedReader decodes an aws-chunked body, checking the signature of
+// each chunk when signed. Trailing headers are skipped.
+type s3ChunkedReader struct {
+	r      *bufio.Reader
+	closer io.Closer
+	signed bool
+	key    []byte
+	date   string
+	scope  string
+	prev   string
+
+	chunk []byte
+	done  bool
+}
+
+func (x *s3ChunkedReader) Read(p []byte) (int, error) {
+	for len(x.chunk) == 0 {
+		if x.done {
+			return 0, io.EOF
+		}
+		if err := x.readChunk(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, x.chunk)
+	x.chunk = x.chunk[n:]
+	return n, nil
+}
+
+func (x *s3ChunkedReader) Close() error {
+	return x.closer.Close()
+}
+
+// readChunk reads "SIZE[;chunk-signature=SIGNATURE]\r\nDATA\r\n". A body
+// that ends before the final empty chunk was cut off.
+func (x *s3ChunkedReader) readChunk() error {
+	line, err := x.readLine()
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	} else if err != nil {
+		return err
+	}
+	sizeField, signature := line, ""
+	if i := strings.Index(line, ";"); i >= 0 {
+		sizeField = line[:i]
+		signature = strings.TrimPrefix(line[i+1:], "chunk-signature=")
+	}
+	size, err := strconv.ParseInt(sizeField, 16, 64)
+	if err != nil || size < 0 || size > s3MaxChunkSize {
+		return errS3InvalidChunk
+	}
+
+	chunk := make([]byte, size)
+	if _, err := io.ReadFull(x.r, chunk); err != nil {
+		return errS3InvalidChunk
+	}
+
+	if x.signed {
+		stringToSign := strings.Join([]string{
+			s3Algorithm + "-PAYLOAD",
+			x.date,
+			x.scope,
+			x.prev,
+			s3EmptySha256,
+			sha256Hex(chunk),
+		}, "\n")
+		want := hex.EncodeToString(hmacSha256(x.key, stringToSign))
+		if !hmac.Equal([]byte(want), []byte(signature)) {
+			return errS3SignatureMismatch
+		}
+		x.prev = signature
+	}
+
+	if size == 0 {
+		// Skip the trailing headers up to the final empty line.
+		for {
+			line, err := x.readLine()
+			if err == io.EOF || (err == nil && line == "") {
+				break
+			}
+			if err != nil {
+				return err
+			}
+		}
+		x.done = true
+		return nil
+	}
+
+	if line, err := x.readLine(); err != nil || line != "" {
+		return errS3InvalidChunk
+	}
+	x.chunk = chunk
+	return nil
+}
+
+func (x *s3ChunkedReader) readLine() (string, error) {
+	line, err := x.r.ReadString('\n')
+	if err == io.EOF && line == "" {
+		return "", io.EOF
+	}
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	if !strings.HasSuffix(line, "\r\n") {
+		return "", errS3InvalidChunk
+	}
+	return strings.TrimSuffix(line, "\r\n"), nil
+}
+
+// S3Error is an S3 error response.
+type S3Error struct {
+	StatusCode int
+	Code       string
+	Message    string
+}
+
+func (x *S3Error) Error() string {
+	return x.Code + ": " + x.Message
+}
+
+// asS3Error returns err as an S3Error, treating unknown errors as internal.
+func asS3Error(err error) *S3Error {
+	var s3Err *S3Error
+	if errors.As(err, &s3Err) {
+		return s3Err
+	}
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		return &S3Error{http.StatusBadRequest, "IncompleteBody", "The request body ended early"}
+	}
+	// Hooks that reject a change are bad requests, like in the json api.
+	var hookErr *HookError
+	var exitErr *exec.ExitError
+	if errors.As(err, &hookErr) && !hookErr.TimedOut && errors.As(hookErr.Err, &exitErr) {
+		return &S3Error{http.StatusBadRequest, "InvalidRequest", strings.TrimSpace(err.Error() + ": " + hookErr.Stderr)}
+	}
+	return &S3Error{http.StatusInternalServerError, "InternalError", err.Error()}
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// sftpServer serves the content root over SFTP to clients whose public key is
+// in the authorized keys file.
+type sftpServer struct {
+	config    Config
+	hooks     *Hooks
+	sshConfig *ssh.ServerConfig
+}
+
+func newSFTPServer(config Config, hooks *Hooks) (*sftpServer, error) {
+	hostKey, err := os.ReadFile(config.SFTPHostKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.ParsePrivateKey(hostKey)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", config.SFTPHostKeyFile, err)
+	}
+
+	x := &sftpServer{config: config, hooks: hooks}
+	x.sshConfig = &ssh.ServerConfig{PublicKeyCallback: x.authenticate}
+	x.sshConfig.AddHostKey(signer)
+	return x, nil
+}
+
+// authenticate accepts the keys in the authorized keys file. The file is read
+// on each login, so that keys can be added and removed without a restart.
+func (x *sftpServer) authenticate(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	authorizedKeys, err := os.ReadFile(x.config.SFTPAuthorizedKeysFile)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	for len(authorizedKeys) > 0 {
+		authorizedKey, _, _, rest, err := ssh.ParseAuthorizedKey(authorizedKeys)
+		if err != nil {
+			break
+		}
+		if bytes.Equal(authorizedKey.Marshal(), key.Marshal()) {
+			return &ssh.Permissions{Extensions: map[string]string{"pubkey-fp": ssh.FingerprintSHA256(key)}}, nil
+		}
+		authorizedKeys = rest
+	}
+	return nil, fmt.Errorf("unknown public key for %s", conn.User())
+}
+
+func (x *sftpServer) Serve(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go x.serveConn(conn)
+	}
+}
+
+func (x *sftpServer) serveConn(conn net.Conn) {
+	sshConn, channels, requests, err := ssh.NewServerConn(conn, x.sshConfig)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	defer sshConn.Close()
+	go ssh.DiscardRequests(requests)
+
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "only sessions are supported")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		go x.serveSession(channel, requests)
+	}
+}
+
+// serveSession serves the sftp subsystem. Shells and commands are refused.
+func (x *sftpServer) serveSession(channel ssh.Channel, requests <-chan *ssh.Request) {
+	defer channel.Close()
+	for req := range requests {
+		if req.Type != "subsystem" || string(req.Payload) != "\x00\x00\x00\x04sftp" {
+			req.Reply(false, nil)
+			continue
+		}
+		req.Reply(true, nil)
+
+		fs := &sftpFileSystem{config: x.config, hooks: x.hooks}
+		server := sftp.NewRequestServer(channel, sftp.Handlers{FileGet: fs, FilePut: fs, FileCmd: fs, FileList: fs})
+		if err := server.Serve(); err != nil && err != io.EOF {
+			log.Println(err)
+		}
+		server.Close()
+		return
+	}
+}
+
+// sftpFileSystem is the content root as sftp handlers. Paths are confined to
+// the content root, and changes run the same hooks as the json api.
+type sftpFileSystem struct {
+	config Config
+	hooks  *Hooks
+}
+
+func (x *sftpFileSystem) fileName(urlPath string) string {
+	return path.Join(x.config.ContentRoot, urlPath)
+}
+
+func (x *sftpFileSystem) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	f, err := x.config.Storage.Open(sftpPath(r.Filepath))
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Filewrite writes to the file directly, unless hooks match it. Then the
+// contents are buffered so that the pre-hooks can check them before they land.
+func (x *sftpFileSystem) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	urlPath := sftpPath(r.Filepath)
+	fileName := x.fileName(urlPath)
+	flags := r.Pflags()
+
+	perms := os.FileMode(0644)
+	if r.AttrFlags().Permissions {
+		perms = r.Attributes().FileMode().Perm()
+	}
+
+	event := HookEvent{Operation: HookOperationPut, URLPath: urlPath, FileName: fileName, Permissions: perms}
+	if !x.hooks.any(event) {
+		osFlags := os.O_WRONLY
+		if flags.Creat {
+			osFlags |= os.O_CREATE
+		}
+		if flags.Trunc {
+			osFlags |= os.O_TRUNC
+		}
+		if flags.Excl {
+			osFlags |= os.O_EXCL
+		}
+		if flags.Append {
+			osFlags |= os.O_APPEND
+		}
+		f, err := x.config.Storage.OpenFile(urlPath, osFlags, perms)
+		if err != nil {
+			return nil, err
+		}
+		return f, nil
+	}
+
+	upload := &sftpUpload{storage: x.config.Storage, hooks: x.hooks, event: event}
+	info, err := x.config.Storage.Stat(urlPath)
+	switch {
+	case err == nil && info.IsDir():
+		return nil, fmt.Errorf("%s is not a file", urlPath)
+	case err == nil && flags.Excl:
+		return nil, os.ErrExist
+	case err == nil && !flags.Trunc:
+		// Partial writes are checked with the whole new contents.
+		if upload.contents, err = readFile(x.config.Storage, urlPath); err != nil {
+			return nil, err
+		}
+	case os.IsNotExist(err) && !flags.Creat:
+		return nil, err
+	case os.IsNotExist(err):
+		if _, err := x.config.Storage.Stat(path.Dir(urlPath)); err != nil {
+			return nil, err
+		}
+	case err != nil:
+		return nil, err
+	}
+	return upload, nil
+}
+
+func (x *sftpFileSystem) Filecmd(r *sftp.Request) error {
+	urlPath := sftpPath(r.Filepath)
+
+	switch r.Method {
+	case "Setstat":
+		return x.setstat(r, urlPath)
+	case "Mkdir":
+		perms := os.FileMode(0700)
+		if r.AttrFlags().Permissions {
+			perms = r.Attributes().FileMode().Perm()
+		}
+		return x.config.Storage.Mkdir(urlPath, perms)
+	case "Remove":
+		info, err := x.config.Storage.Lstat(urlPath)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return fmt.Errorf("%s is a directory", urlPath)
+		}
+		return sftpError(deleteFile(x.config, x.hooks, urlPath, false))
+	case "Rmdir":
+		info, err := x.config.Storage.Lstat(urlPath)
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("%s is not a directory", urlPath)
+		}
+		return sftpError(deleteFile(x.config, x.hooks, urlPath, false))
+	case "Rename":
+		return sftpError(renameFile(x.config, x.hooks, urlPath, sftpPath(r.Target)))
+	default:
+		// Links could point outside of the content root.
+		return sftp.ErrSSHFxOpUnsupported
+	}
+}
+
+func (x *sftpFileSystem) setstat(r *sftp.Request, urlPath string) error {
+	storage := x.config.Storage
+	attrs := r.Attributes()
+	flags := r.AttrFlags()
+	if flags.Size {
+		if err := storage.Truncate(urlPath, int64(attrs.Size)); err != nil {
+			return err
+		}
+	}
+	if flags.Permissions {
+		if err := storage.Chmod(urlPath, attrs.FileMode().Perm()); err != nil {
+			return err
+		}
+	}
+	if flags.UidGid {
+		if err := storage.Chown(urlPath, int(attrs.UID), int(attrs.GID)); err != nil {
+			return err
+		}
+	}
+	if flags.Acmodtime {
+		if err := storage.Chtimes(urlPath, attrs.AccessTime(), attrs.ModTime()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (x *sftpFileSystem) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	urlPath := sftpPath(r.Filepath)
+
+	switch r.Method {
+	case "List":
+		entries, err := x.config.Storage.ReadDir(urlPath)
+		if err != nil {
+			return nil, err
+		}
+		infos := make([]os.FileInfo, 0, len(entries))
+		for _, entry := range withoutTempFiles(entries) {
+			info, err := entry.Info()
+			if err != nil {
+				continue
+			}
+			infos = append(infos, info)
+		}
+		return sftpListerAt(infos), nil
+	case "Stat":
+		info, err := x.config.Storage.Stat(urlPath)
+		if err != nil {
+			return nil, err
+		}
+		return sftpListerAt{info}, nil
+	default:
+		return nil, sftp.ErrSSHFxOpUnsupported
+	}
+}
+
+// sftpPath cleans a request path so that it stays inside the content root.
+func sftpPath(p string) string {
+	return path.Clean("/" + p)
+}
+
+// sftpError adds the stderr of failed pre-hooks to the error sent to clients.
+func sftpError(err error) error {
+	var hookErr *HookError
+	if errors.As(err, &hookErr) {
+		log.Println(err)
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(hookErr.Stderr))
+	}
+	return err
+}
+
+type sftpListerAt []os.FileInfo
+
+func (x sftpListerAt) ListAt(infos []os.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(x)) {
+		return 0, io.EOF
+	}
+	n := copy(infos, x[offset:])
+	if n < len(infos) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// sftpUpload buffers the contents of a write, and writes them on Close if the
+// pre-hooks pass.
+type sftpUpload struct {
+	storage  Storage
+	hooks    *Hooks
+	event    HookEvent
+	mu       sync.Mutex
+	contents []byte
+}
+
+func (x *sftpUpload) WriteAt(p []byte, offset int64) (int, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if end := int(offset) + len(p); end > len(x.contents) {
+		x.contents = append(x.contents, make([]byte, end-len(x.contents))...)
+	}
+	return copy(x.contents[offset:], p), nil
+}
+
+func (x *sftpUpload) Close() error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.event.Size = len(x.contents)
+	if err := x.hooks.Pre(x.event, x.contents); err != nil {
+		return sftpError(err)
+	}
+	if err := writeFile(x.storage, x.event.URLPath, x.contents, x.event.Permissions); err != nil {
+		return err
+	}
+	x.hooks.Post(x.event, x.contents)
+	return nil
+}
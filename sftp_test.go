@@ -0,0 +1,210 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestSFTPServer(t *testing.T) {
+	mustMakeContentRoot(t)
+	defer mustDeleteContentRoot(t)
+
+	hostPrivateKey, hostKey := mustGenerateSSHKey(t)
+	_, clientKey := mustGenerateSSHKey(t)
+	_, otherKey := mustGenerateSSHKey(t)
+
+	config := newConfig(ContentRoot)
+	config.SFTPHostKeyFile = mustWriteSSHPrivateKey(t, hostPrivateKey)
+	config.SFTPAuthorizedKeysFile = filepath.Join(t.TempDir(), "authorized_keys")
+	if err := os.WriteFile(config.SFTPAuthorizedKeysFile, ssh.MarshalAuthorizedKey(clientKey.PublicKey()), 0600); err != nil {
+		t.Fatal(err)
+	}
+	config.Hooks = []Hook{{
+		Stage:      HookStagePre,
+		Paths:      []string{"/configs/*.yaml"},
+		Operations: []string{HookOperationPut},
+		Command:    []string{"sh", "-c", `if grep -q tab; then echo "$FILE_SERVER_HOOK_PATH: tabs are not allowed" >&2; exit 1; fi`},
+	}}
+	addr := mustServeSFTP(t, config)
+
+	t.Run("unknown key", func(t *testing.T) {
+		clientConfig := &ssh.ClientConfig{
+			User:            "partner",
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(otherKey)},
+			HostKeyCallback: ssh.FixedHostKey(hostKey.PublicKey()),
+		}
+		if conn, err := ssh.Dial("tcp", addr, clientConfig); err == nil {
+			conn.Close()
+			t.Fatal("got connection with an unknown key")
+		}
+	})
+
+	client := mustDialSFTP(t, addr, hostKey, clientKey)
+
+	t.Run("write and read", func(t *testing.T) {
+		if err := client.Mkdir("/dir"); err != nil {
+			t.Fatal(err)
+		}
+		f, err := client.OpenFile("/dir/file.txt", os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Write([]byte("hello\n")); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+		assertFileContents(t, "/dir/file.txt", 0644, "hello\n")
+		if err := client.Chmod("/dir/file.txt", 0600); err != nil {
+			t.Fatal(err)
+		}
+		assertFileContents(t, "/dir/file.txt", 0600, "hello\n")
+
+		f, err = client.Open("/dir/file.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		contents, err := io.ReadAll(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(contents) != "hello\n" {
+			t.Errorf("got contents %q", contents)
+		}
+
+		infos, err := client.ReadDir("/dir")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(infos) != 1 || infos[0].Name() != "file.txt" || infos[0].Size() != 6 {
+			t.Errorf("got entries %v", infos)
+		}
+	})
+
+	t.Run("paths stay inside the content root", func(t *testing.T) {
+		infos, err := client.ReadDir("/../..")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(infos) != 1 || infos[0].Name() != "dir" {
+			t.Errorf("got entries %v", infos)
+		}
+		if err := client.Symlink("/etc/passwd", "/dir/passwd"); err == nil {
+			t.Error("got symlink")
+		}
+	})
+
+	t.Run("pre hooks check writes and renames", func(t *testing.T) {
+		if err := client.Mkdir("/configs"); err != nil {
+			t.Fatal(err)
+		}
+		f, err := client.Create("/configs/app.yaml")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Write([]byte("key:\ttab\n")); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.Close(); err == nil || !strings.Contains(err.Error(), "/configs/app.yaml: tabs are not allowed") {
+			t.Errorf("got close error %v", err)
+		}
+		assertFileDoesNotExists(t, "/configs/app.yaml")
+
+		mustWriteFile(t, []byte("key:\ttab\n"), "/dir/app.yaml", 0644)
+		if err := client.Rename("/dir/app.yaml", "/configs/app.yaml"); err == nil {
+			t.Error("got rename of a rejected file")
+		}
+		assertFileDoesNotExists(t, "/configs/app.yaml")
+
+		mustWriteFile(t, []byte("key: value\n"), "/dir/app.yaml", 0644)
+		if err := client.Rename("/dir/app.yaml", "/configs/app.yaml"); err != nil {
+			t.Fatal(err)
+		}
+		assertFileContents(t, "/configs/app.yaml", 0644, "key: value\n")
+	})
+
+	t.Run("remove", func(t *testing.T) {
+		if err := client.RemoveDirectory("/dir"); err == nil {
+			t.Error("got removal of a non-empty directory")
+		}
+		if err := client.Remove("/dir/file.txt"); err != nil {
+			t.Fatal(err)
+		}
+		if err := client.RemoveDirectory("/dir"); err != nil {
+			t.Fatal(err)
+		}
+		assertFileDoesNotExists(t, "/dir")
+	})
+}
+
+func mustGenerateSSHKey(t *testing.T) (ed25519.PrivateKey, ssh.Signer) {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, signer
+}
+
+func mustWriteSSHPrivateKey(t *testing.T, key ed25519.PrivateKey) string {
+	t.Helper()
+	block, err := ssh.MarshalPrivateKey(key, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := filepath.Join(t.TempDir(), "host_key")
+	if err := os.WriteFile(name, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+func mustServeSFTP(t *testing.T, config Config) string {
+	t.Helper()
+	server, err := newSFTPServer(config, newHooks(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go server.Serve(listener)
+	return listener.Addr().String()
+}
+
+func mustDialSFTP(t *testing.T, addr string, hostKey, clientKey ssh.Signer) *sftp.Client {
+	t.Helper()
+	conn, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            "partner",
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(clientKey)},
+		HostKeyCallback: ssh.FixedHostKey(hostKey.PublicKey()),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
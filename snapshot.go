@@ -0,0 +1,495 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// snapshotsPath is where snapshots are listed, made, browsed and restored
+// instead of content.
+const snapshotsPath = "/.snapshots"
+
+var snapshotNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,127}$`)
+
+// Snapshots keeps point-in-time copies of the content directory in
+// directories of the SnapshotDir, named after the snapshots.
+//
+// The files of a snapshot that are unchanged since the previous one are hard
+// links to its files, which are never changed. The others are cloned where
+// the filesystem can share their blocks until they are written, and copied
+// otherwise. Restores clone or copy the files back next to the content
+// directory, and then swap them with its files.
+type Snapshots struct {
+	config Config
+	// content is the content directory on disk, under any wrappers of the
+	// storage.
+	content *diskStorage
+	// mu serializes making, restoring and removing snapshots.
+	mu sync.Mutex
+}
+
+func newSnapshots(config Config) *Snapshots {
+	if config.SnapshotDir == "" {
+		return nil
+	}
+	content, ok := diskStorageOf(config.Storage)
+	if !ok {
+		return nil
+	}
+	return &Snapshots{config: config, content: content}
+}
+
+// checkSnapshotDir returns an error if the snapshots of a storage can't be
+// kept in dir.
+func checkSnapshotDir(dir, contentRoot string, storage Storage) error {
+	if _, ok := diskStorageOf(storage); !ok {
+		return fmt.Errorf("snapshots need the disk storage")
+	}
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	absRoot, err := filepath.Abs(contentRoot)
+	if err != nil {
+		return err
+	}
+	if rel, err := filepath.Rel(absRoot, absDir); err == nil && rel != ".." && !strings.HasPrefix(rel, "../") {
+		return fmt.Errorf("the snapshot directory %s is in the content directory", dir)
+	}
+	return nil
+}
+
+// snapshotCopy counts how the files of a snapshot or restore were copied.
+type snapshotCopy struct {
+	linked, cloned, copied int
+}
+
+func (x *Snapshots) dir(name string) string {
+	return filepath.Join(x.config.SnapshotDir, name)
+}
+
+// List returns the snapshots, oldest first.
+func (x *Snapshots) List() ([]SnapshotData, error) {
+	entries, err := os.ReadDir(x.config.SnapshotDir)
+	if os.IsNotExist(err) {
+		return []SnapshotData{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	snapshots := []SnapshotData{}
+	for _, entry := range entries {
+		if !entry.IsDir() || !snapshotNamePattern.MatchString(entry.Name()) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		snapshots = append(snapshots, SnapshotData{Name: entry.Name(), Created: info.ModTime().UTC()})
+	}
+	sort.SliceStable(snapshots, func(i, j int) bool { return snapshots[i].Created.Before(snapshots[j].Created) })
+	return snapshots, nil
+}
+
+// Create makes a snapshot of the content directory, named after the time if
+// name is empty.
+func (x *Snapshots) Create(name string) (SnapshotData, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	created := time.Now().UTC()
+	if name == "" {
+		name = created.Format("20060102T150405Z")
+	}
+	if !snapshotNamePattern.MatchString(name) {
+		return SnapshotData{}, &statusError{http.StatusBadRequest, fmt.Sprintf("invalid snapshot name %q", name)}
+	}
+	if _, err := os.Lstat(x.dir(name)); err == nil {
+		return SnapshotData{}, &statusError{http.StatusConflict, fmt.Sprintf("snapshot %s already exists", name)}
+	}
+	snapshots, err := x.List()
+	if err != nil {
+		return SnapshotData{}, err
+	}
+	var previous string
+	var previousCreated time.Time
+	if len(snapshots) > 0 {
+		previous = x.dir(snapshots[len(snapshots)-1].Name)
+		previousCreated = snapshots[len(snapshots)-1].Created
+	}
+
+	if err := os.MkdirAll(x.config.SnapshotDir, 0700); err != nil {
+		return SnapshotData{}, err
+	}
+	// The snapshot is made under a name that isn't listed until it is done.
+	tmpDir := x.dir("." + newDeliveryID())
+	counts, err := copySnapshotTree(x.content.root, tmpDir, previous, previousCreated)
+	if err == nil {
+		err = os.Chtimes(tmpDir, created, created)
+	}
+	if err == nil {
+		err = os.Rename(tmpDir, x.dir(name))
+	}
+	if err != nil {
+		os.RemoveAll(tmpDir)
+		return SnapshotData{}, err
+	}
+	return newSnapshotData(name, created, counts), nil
+}
+
+// Restore replaces the contents of the content directory with those of a
+// snapshot. The snapshot is copied to a directory next to the content
+// directory first, so that a failed copy leaves the content as it was, and
+// then its files are swapped with those of the content directory by renames,
+// which are undone if any fails.
+func (x *Snapshots) Restore(name string) (SnapshotData, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	info, err := x.stat(name)
+	if err != nil {
+		return SnapshotData{}, err
+	}
+	root := filepath.Clean(x.content.root)
+	id := newDeliveryID()
+	restored := filepath.Join(filepath.Dir(root), "."+filepath.Base(root)+".restore-"+id)
+	replaced := filepath.Join(filepath.Dir(root), "."+filepath.Base(root)+".replaced-"+id)
+	defer os.RemoveAll(restored)
+	counts, err := copySnapshotTree(x.dir(name), restored, "", time.Time{})
+	if err != nil {
+		return SnapshotData{}, err
+	}
+	if err := os.Mkdir(replaced, 0700); err != nil {
+		return SnapshotData{}, err
+	}
+	defer os.RemoveAll(replaced)
+	if err := moveSnapshotEntries(root, replaced); err != nil {
+		return SnapshotData{}, err
+	}
+	if err := moveSnapshotEntries(restored, root); err != nil {
+		if err := moveSnapshotEntries(replaced, root); err != nil {
+			return SnapshotData{}, fmt.Errorf("restoring the replaced files from %s: %v", replaced, err)
+		}
+		return SnapshotData{}, err
+	}
+	if err := copySnapshotMeta(x.dir(name), root, info); err != nil {
+		return SnapshotData{}, err
+	}
+	return newSnapshotData(name, info.ModTime().UTC(), counts), nil
+}
+
+// moveSnapshotEntries moves the files of a directory to another. If a rename
+// fails, the files already moved are moved back.
+func moveSnapshotEntries(src, dst string) error {
+	entries, err := os.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for i, entry := range entries {
+		if err := os.Rename(filepath.Join(src, entry.Name()), filepath.Join(dst, entry.Name())); err != nil {
+			for _, moved := range entries[:i] {
+				os.Rename(filepath.Join(dst, moved.Name()), filepath.Join(src, moved.Name()))
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// Remove removes a snapshot. The files it shares with other snapshots are
+// kept by their links.
+func (x *Snapshots) Remove(name string) (SnapshotData, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	info, err := x.stat(name)
+	if err != nil {
+		return SnapshotData{}, err
+	}
+	if err := os.RemoveAll(x.dir(name)); err != nil {
+		return SnapshotData{}, err
+	}
+	return SnapshotData{Name: name, Created: info.ModTime().UTC()}, nil
+}
+
+func (x *Snapshots) stat(name string) (os.FileInfo, error) {
+	if !snapshotNamePattern.MatchString(name) {
+		return nil, &statusError{http.StatusNotFound, fmt.Sprintf("snapshot %s not found", name)}
+	}
+	info, err := os.Stat(x.dir(name))
+	if os.IsNotExist(err) || err == nil && !info.IsDir() {
+		return nil, &statusError{http.StatusNotFound, fmt.Sprintf("snapshot %s not found", name)}
+	}
+	return info, err
+}
+
+// storage returns the files of a snapshot read only, through the same
+// wrappers as the content directory.
+func (x *Snapshots) storage(name string) (Storage, error) {
+	if _, err := x.stat(name); err != nil {
+		return nil, err
+	}
+	base := newDiskStorage(x.dir(name))
+	return readOnlyStorage{Storage: withBase(x.config.Storage, base), root: base.root}, nil
+}
+
+func newSnapshotData(name string, created time.Time, counts snapshotCopy) SnapshotData {
+	return SnapshotData{Name: name, Created: created, Linked: counts.linked, Cloned: counts.cloned, Copied: counts.copied}
+}
+
+// copySnapshotTree copies the tree of src to dst, keeping the modes, owners,
+// modification times and extended attributes. The files that are the same in
+// previous, if not empty, which was made at previousCreated, are linked to
+// instead.
+func copySnapshotTree(src, dst, previous string, previousCreated time.Time) (snapshotCopy, error) {
+	var counts snapshotCopy
+	var dirs []string
+	err := filepath.WalkDir(src, func(srcName string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, srcName)
+		if err != nil {
+			return err
+		}
+		if isTempFileName(rel) {
+			return nil
+		}
+		dstName := filepath.Join(dst, rel)
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		switch {
+		case info.IsDir():
+			if err := os.Mkdir(dstName, 0700); err != nil && !(rel == "." && os.IsExist(err)) {
+				return err
+			}
+			// The modes and times of directories are set once they are
+			// filled.
+			dirs = append(dirs, rel)
+			return nil
+		case info.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(srcName)
+			if err != nil {
+				return err
+			}
+			if err := os.Symlink(target, dstName); err != nil {
+				return err
+			}
+			uid, gid := fileOwner(info)
+			return os.Lchown(dstName, int(uid), int(gid))
+		case !info.Mode().IsRegular():
+			// Devices, fifos and sockets are left out.
+			return nil
+		}
+
+		if previous != "" {
+			if prevInfo, err := os.Lstat(filepath.Join(previous, rel)); err == nil && sameSnapshotFile(srcName, filepath.Join(previous, rel), info, prevInfo, previousCreated) {
+				if err := os.Link(filepath.Join(previous, rel), dstName); err == nil {
+					counts.linked++
+					return nil
+				}
+			}
+		}
+		cloned, err := copySnapshotFile(srcName, dstName)
+		if err != nil {
+			return err
+		}
+		if cloned {
+			counts.cloned++
+		} else {
+			counts.copied++
+		}
+		return copySnapshotMeta(srcName, dstName, info)
+	})
+	if err != nil {
+		return counts, err
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		info, err := os.Lstat(filepath.Join(src, dirs[i]))
+		if err != nil {
+			return counts, err
+		}
+		if err := copySnapshotMeta(filepath.Join(src, dirs[i]), filepath.Join(dst, dirs[i]), info); err != nil {
+			return counts, err
+		}
+	}
+	return counts, nil
+}
+
+// sameSnapshotFile reports whether a file is unchanged since a snapshot made
+// at previousCreated. Its size, modification time, mode and owner must be the
+// same, and since clients can set the modification time, its contents too,
+// unless it has not changed since well before the snapshot.
+func sameSnapshotFile(name, prevName string, info, prevInfo os.FileInfo, previousCreated time.Time) bool {
+	uid, gid := fileOwner(info)
+	prevUID, prevGID := fileOwner(prevInfo)
+	if prevInfo.Mode() != info.Mode() || prevInfo.Size() != info.Size() ||
+		!prevInfo.ModTime().Equal(info.ModTime()) || prevUID != uid || prevGID != gid {
+		return false
+	}
+	// The change times of files lag the clock by up to a tick.
+	if changed, ok := fileChangeTime(info); ok && changed.Before(previousCreated.Add(-time.Second)) {
+		return true
+	}
+	same, err := sameFileContents(name, prevName)
+	return err == nil && same
+}
+
+// sameFileContents reports whether two files have the same contents.
+func sameFileContents(name, otherName string) (bool, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	other, err := os.Open(otherName)
+	if err != nil {
+		return false, err
+	}
+	defer other.Close()
+	buf, otherBuf := make([]byte, 32<<10), make([]byte, 32<<10)
+	for {
+		n, err := io.ReadFull(f, buf)
+		otherN, otherErr := io.ReadFull(other, otherBuf)
+		if !bytes.Equal(buf[:n], otherBuf[:otherN]) {
+			return false, nil
+		}
+		switch {
+		case err == io.EOF || err == io.ErrUnexpectedEOF:
+			return otherErr == err, nil
+		case err != nil:
+			return false, err
+		case otherErr != nil && otherErr != io.EOF && otherErr != io.ErrUnexpectedEOF:
+			return false, otherErr
+		}
+	}
+}
+
+// copySnapshotFile clones a file if the filesystem can, and copies it
+// otherwise. It reports whether the file was cloned.
+func copySnapshotFile(srcName, dstName string) (bool, error) {
+	src, err := os.Open(srcName)
+	if err != nil {
+		return false, err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(dstName, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return false, err
+	}
+	cloned := cloneFile(dst, src) == nil
+	if !cloned {
+		_, err = io.Copy(dst, src)
+	}
+	if err1 := dst.Close(); err == nil {
+		err = err1
+	}
+	return cloned, err
+}
+
+// copySnapshotMeta gives a copy the mode, owner, extended attributes and
+// modification time of its source.
+func copySnapshotMeta(srcName, dstName string, info os.FileInfo) error {
+	uid, gid := fileOwner(info)
+	if err := os.Lchown(dstName, int(uid), int(gid)); err != nil {
+		return err
+	}
+	if err := os.Chmod(dstName, info.Mode()&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)); err != nil {
+		return err
+	}
+	attrs, err := listXattrs(srcName)
+	if err != nil && !errors.Is(err, errXattrUnsupported) {
+		return err
+	}
+	for _, attr := range attrs {
+		value, err := getXattr(srcName, attr)
+		if err == nil {
+			err = setXattr(dstName, attr, value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return os.Chtimes(dstName, info.ModTime(), info.ModTime())
+}
+
+// isSnapshotsRequest reports whether the request is for the snapshots
+// endpoints.
+func isSnapshotsRequest(r *http.Request) bool {
+	return r.URL.Path == snapshotsPath || strings.HasPrefix(r.URL.Path, snapshotsPath+"/")
+}
+
+// handleSnapshots lists and makes snapshots at snapshotsPath, and browses,
+// restores and removes the snapshot under it.
+func handleSnapshots(config Config, snapshots *Snapshots, w http.ResponseWriter, r *http.Request) {
+	if snapshots == nil {
+		notFound(w, fmt.Errorf("snapshots are not enabled"))
+		return
+	}
+	rest := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, snapshotsPath), "/")
+	name, filePath, _ := strings.Cut(rest, "/")
+	switch {
+	case name == "" && r.Method == http.MethodGet:
+		list, err := snapshots.List()
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeResponse(w, ResponseBody{Status: "ok", Type: ResponseTypeSnapshots, Snapshots: list})
+	case name == "" && r.Method == http.MethodPost:
+		var request PostSnapshotRequest
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+				invalidJson(w, err)
+				return
+			}
+		}
+		snapshot, err := snapshots.Create(request.Name)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeResponse(w, ResponseBody{Status: "ok", Type: ResponseTypeSnapshot, Snapshot: &snapshot})
+	case name != "" && filePath == "restore" && r.Method == http.MethodPost:
+		snapshot, err := snapshots.Restore(name)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeResponse(w, ResponseBody{Status: "ok", Type: ResponseTypeRestored, Snapshot: &snapshot})
+	case name != "" && filePath == "" && r.Method == http.MethodDelete:
+		snapshot, err := snapshots.Remove(name)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeResponse(w, ResponseBody{Status: "ok", Type: ResponseTypeDeleted, Snapshot: &snapshot})
+	case name != "" && r.Method == http.MethodGet:
+		storage, err := snapshots.storage(name)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		snapshotConfig := config
+		snapshotConfig.Storage = storage
+		r2 := r.Clone(r.Context())
+		r2.URL.Path = "/" + filePath
+		r2.URL.RawPath = ""
+		handleGet(snapshotConfig, w, r2)
+	case name != "" && filePath != "":
+		forbidden(w, fmt.Sprintf("snapshot %s is read only", name))
+	default:
+		writeErrorResponse(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"os"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// cloneFile makes dst share the blocks of src, on filesystems that support
+// reflinks like btrfs and xfs.
+func cloneFile(dst, src *os.File) error {
+	return unix.IoctlFileClone(int(dst.Fd()), int(src.Fd()))
+}
+
+// fileChangeTime returns when the contents or metadata of a file last
+// changed, which unlike the modification time can't be set.
+func fileChangeTime(info os.FileInfo) (time.Time, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(stat.Ctim.Sec, stat.Ctim.Nsec), true
+}
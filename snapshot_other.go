@@ -0,0 +1,18 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"os"
+	"time"
+)
+
+func cloneFile(dst, src *os.File) error {
+	return errors.ErrUnsupported
+}
+
+func fileChangeTime(info os.FileInfo) (time.Time, bool) {
+	return time.Time{}, false
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSnapshots(t *testing.T) {
+	contentRoot := t.TempDir()
+	config := newConfig(contentRoot)
+	config.Storage = newDiskStorage(contentRoot)
+	config.SnapshotDir = t.TempDir()
+	handler := httpHandler(config)
+	request := func(t *testing.T, method, target, body string) (int, ResponseBody) {
+		t.Helper()
+		responseRecorder := httptest.NewRecorder()
+		handler.ServeHTTP(responseRecorder, httptest.NewRequest(method, target, strings.NewReader(body)))
+		var response ResponseBody
+		if err := json.NewDecoder(responseRecorder.Result().Body).Decode(&response); err != nil {
+			t.Fatal(err)
+		}
+		return responseRecorder.Code, response
+	}
+	assertContents := func(t *testing.T, storage Storage, name, want string) {
+		t.Helper()
+		contents, err := readFile(storage, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(contents) != want {
+			t.Errorf("got contents %q of %s, want %q", contents, name, want)
+		}
+	}
+
+	if err := config.Storage.MkdirAll("/docs", 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, contents := range map[string]string{"/docs/a.txt": "a\n", "/docs/b.txt": "b\n", "/c.txt": "c\n"} {
+		if err := writeFile(config.Storage, name, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := config.Storage.Symlink("docs/a.txt", "/link"); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("snapshots are made", func(t *testing.T) {
+		code, response := request(t, http.MethodPost, "/.snapshots", `{"name": "before"}`)
+		if code != http.StatusOK || response.Type != ResponseTypeSnapshot {
+			t.Fatalf("got %d %+v", code, response)
+		}
+		if snapshot := response.Snapshot; snapshot.Name != "before" || snapshot.Linked != 0 || snapshot.Cloned+snapshot.Copied != 3 {
+			t.Errorf("got snapshot %+v", snapshot)
+		}
+		if code, response := request(t, http.MethodPost, "/.snapshots", `{"name": "before"}`); code != http.StatusConflict {
+			t.Errorf("got %d %+v making a snapshot again", code, response)
+		}
+		if code, response := request(t, http.MethodPost, "/.snapshots", `{"name": "../up"}`); code != http.StatusBadRequest {
+			t.Errorf("got %d %+v making a snapshot with an invalid name", code, response)
+		}
+	})
+
+	t.Run("unchanged files are linked", func(t *testing.T) {
+		if err := writeFile(config.Storage, "/docs/a.txt", []byte("changed\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		code, response := request(t, http.MethodPost, "/.snapshots", `{"name": "after"}`)
+		if code != http.StatusOK {
+			t.Fatalf("got %d %+v", code, response)
+		}
+		if snapshot := response.Snapshot; snapshot.Linked != 2 || snapshot.Cloned+snapshot.Copied != 1 {
+			t.Errorf("got snapshot %+v", snapshot)
+		}
+		// The live files are never linked, so writing them in place leaves
+		// the snapshots alone.
+		if err := writeFile(config.Storage, "/c.txt", []byte("changed\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		assertContents(t, newDiskStorage(filepath.Join(config.SnapshotDir, "before")), "/c.txt", "c\n")
+		assertContents(t, newDiskStorage(filepath.Join(config.SnapshotDir, "after")), "/c.txt", "c\n")
+
+		code, response = request(t, http.MethodGet, "/.snapshots", "")
+		if code != http.StatusOK || len(response.Snapshots) != 2 || response.Snapshots[0].Name != "before" || response.Snapshots[1].Name != "after" {
+			t.Errorf("got %d %+v", code, response)
+		}
+	})
+
+	t.Run("snapshots are browsed read only", func(t *testing.T) {
+		code, response := request(t, http.MethodGet, "/.snapshots/before/docs/a.txt", "")
+		if code != http.StatusOK || response.File == nil || response.File.Contents != "a\n" || response.File.Path != "/docs/a.txt" {
+			t.Errorf("got %d %+v", code, response)
+		}
+		code, response = request(t, http.MethodGet, "/.snapshots/before/docs", "")
+		if code != http.StatusOK || response.Directory == nil || len(response.Directory.Entries) != 2 {
+			t.Errorf("got %d %+v", code, response)
+		}
+		if code, response := request(t, http.MethodPut, "/.snapshots/before/docs/a.txt", `{"contents": "x\n", "permissions": "0644"}`); code != http.StatusForbidden {
+			t.Errorf("got %d %+v writing to a snapshot", code, response)
+		}
+		if code, response := request(t, http.MethodGet, "/.snapshots/missing/docs", ""); code != http.StatusNotFound {
+			t.Errorf("got %d %+v browsing a missing snapshot", code, response)
+		}
+	})
+
+	t.Run("snapshots are restored", func(t *testing.T) {
+		if err := writeFile(config.Storage, "/new.txt", []byte("new\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		code, response := request(t, http.MethodPost, "/.snapshots/before/restore", "")
+		if code != http.StatusOK || response.Type != ResponseTypeRestored {
+			t.Fatalf("got %d %+v", code, response)
+		}
+		assertContents(t, config.Storage, "/docs/a.txt", "a\n")
+		assertContents(t, config.Storage, "/c.txt", "c\n")
+		if _, err := config.Storage.Stat("/new.txt"); !os.IsNotExist(err) {
+			t.Errorf("got error %v for a file made after the snapshot", err)
+		}
+		if target, err := config.Storage.Readlink("/link"); err != nil || target != "docs/a.txt" {
+			t.Errorf("got symlink %q, %v", target, err)
+		}
+		if info, err := config.Storage.Stat("/docs"); err != nil || info.Mode() != os.ModeDir|0755 {
+			t.Errorf("got directory %v, %v", info, err)
+		}
+
+		// Restored files are copies, which don't change the snapshot.
+		if err := writeFile(config.Storage, "/c.txt", []byte("changed again\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		assertContents(t, newDiskStorage(filepath.Join(config.SnapshotDir, "before")), "/c.txt", "c\n")
+
+		// The files are restored next to the content directory, and swapped.
+		entries, err := os.ReadDir(filepath.Dir(contentRoot))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, entry := range entries {
+			if strings.HasPrefix(entry.Name(), ".") {
+				t.Errorf("got %s left next to the content directory", entry.Name())
+			}
+		}
+	})
+
+	t.Run("files with the same metadata are compared", func(t *testing.T) {
+		info, err := config.Storage.Stat("/docs/b.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := writeFile(config.Storage, "/docs/b.txt", []byte("x\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := config.Storage.Chtimes("/docs/b.txt", info.ModTime(), info.ModTime()); err != nil {
+			t.Fatal(err)
+		}
+		code, response := request(t, http.MethodPost, "/.snapshots", `{"name": "same-metadata"}`)
+		if code != http.StatusOK {
+			t.Fatalf("got %d %+v", code, response)
+		}
+		assertContents(t, newDiskStorage(filepath.Join(config.SnapshotDir, "same-metadata")), "/docs/b.txt", "x\n")
+		assertContents(t, newDiskStorage(filepath.Join(config.SnapshotDir, "before")), "/docs/b.txt", "b\n")
+	})
+
+	t.Run("snapshots are removed", func(t *testing.T) {
+		code, response := request(t, http.MethodDelete, "/.snapshots/before", "")
+		if code != http.StatusOK || response.Type != ResponseTypeDeleted {
+			t.Fatalf("got %d %+v", code, response)
+		}
+		assertContents(t, newDiskStorage(filepath.Join(config.SnapshotDir, "after")), "/docs/b.txt", "b\n")
+		code, response = request(t, http.MethodGet, "/.snapshots", "")
+		if code != http.StatusOK || len(response.Snapshots) != 2 {
+			t.Errorf("got %d %+v", code, response)
+		}
+	})
+}
+
+func TestCheckSnapshotDir(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		dir     string
+		storage Storage
+		valid   bool
+	}{
+		{"outside", "snapshots", newDiskStorage(ContentRoot), true},
+		{"inside", ContentRoot + "/.snapshots", newDiskStorage(ContentRoot), false},
+		{"memory", "snapshots", newMemStorage(ContentRoot), false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			err := checkSnapshotDir(test.dir, ContentRoot, test.storage)
+			if valid := err == nil; valid != test.valid {
+				t.Errorf("got error %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,489 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Storage holds the served content. Names are slash separated paths from the
+// root of the storage, like the url paths of the api, and are cleaned so that
+// they stay inside it. Errors are *os.PathError and the like, as from the os
+// package.
+type Storage interface {
+	Stat(name string) (os.FileInfo, error)
+	Lstat(name string) (os.FileInfo, error)
+	Open(name string) (File, error)
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+	// ReadDir returns the entries of a directory sorted by name.
+	ReadDir(name string) ([]os.DirEntry, error)
+	Mkdir(name string, perm os.FileMode) error
+	MkdirAll(name string, perm os.FileMode) error
+	Remove(name string) error
+	RemoveAll(name string) error
+	Rename(oldName, newName string) error
+	Chmod(name string, mode os.FileMode) error
+	Chown(name string, uid, gid int) error
+	Lchown(name string, uid, gid int) error
+	Chtimes(name string, atime, mtime time.Time) error
+	Truncate(name string, size int64) error
+	// Symlink creates newName as a symlink to target, which is not resolved.
+	Symlink(target, newName string) error
+	Readlink(name string) (string, error)
+	// The extended attribute methods return errXattrUnsupported if the
+	// storage has none.
+	ListXattrs(name string) ([]string, error)
+	GetXattr(name, attr string) ([]byte, error)
+	SetXattr(name, attr string, value []byte) error
+	// RemoveXattr removes the attribute if it exists.
+	RemoveXattr(name, attr string) error
+}
+
+// storageUmask is applied to the permissions of new files and directories by
+// the storages that are not on the local disk, like the usual umask of a
+// process.
+const storageUmask = 0022
+
+// storageMaxSymlinks is how many symlinks a name may go through, as on Linux.
+const storageMaxSymlinks = 40
+
+const (
+	StorageDisk    = "disk"
+	StorageMemory  = "memory"
+	StorageObject  = "object"
+	StorageOverlay = "overlay"
+	StorageCAS     = "cas"
+)
+
+// newStorage returns a storage of the named kind for the content root of the
+// config.
+func newStorage(kind string, config Config) (Storage, error) {
+	switch kind {
+	case StorageDisk:
+		return newDiskStorage(config.ContentRoot), nil
+	case StorageMemory:
+		storage := newMemStorage(config.ContentRoot)
+		storage.maxSize = config.MemoryMaxSize
+		return storage, nil
+	case StorageObject:
+		return newObjectStorage(config.ContentRoot, config.ObjectStore)
+	case StorageOverlay:
+		if len(config.OverlayLowerDirs) == 0 {
+			return nil, fmt.Errorf("the overlay storage has no lower directories")
+		}
+		lowers := make([]Storage, len(config.OverlayLowerDirs))
+		for i, dir := range config.OverlayLowerDirs {
+			lowers[i] = newDiskStorage(dir)
+		}
+		return newOverlayStorage(config.ContentRoot, newDiskStorage(config.ContentRoot), lowers...), nil
+	case StorageCAS:
+		if config.CASDir == "" {
+			return nil, fmt.Errorf("the cas storage has no blob directory")
+		}
+		return newCASDiskStorage(config.ContentRoot, config.CASDir)
+	default:
+		return nil, fmt.Errorf("unknown storage %q", kind)
+	}
+}
+
+// storageWrapper is a Storage that changes what another one allows.
+type storageWrapper interface {
+	Unwrap() Storage
+}
+
+// withBase returns the wrappers of a storage around base instead of the
+// storage they wrap.
+func withBase(storage, base Storage) Storage {
+	switch x := storage.(type) {
+	case readOnlyStorage:
+		return readOnlyStorage{Storage: withBase(x.Storage, base), root: x.root}
+	case *limitedStorage:
+		return &limitedStorage{Storage: withBase(x.Storage, base), root: x.root, maxFileSize: x.maxFileSize}
+	case *encryptedStorage:
+		return newEncryptedStorage(withBase(x.Storage, base), x.root, x.keys)
+	case *compressedStorage:
+		return &compressedStorage{Storage: withBase(x.Storage, base), root: x.root, compression: x.compression, paths: x.paths}
+	default:
+		return base
+	}
+}
+
+// diskStorageOf returns the diskStorage under any wrappers of a storage.
+func diskStorageOf(storage Storage) (*diskStorage, bool) {
+	for {
+		wrapper, ok := storage.(storageWrapper)
+		if !ok {
+			break
+		}
+		storage = wrapper.Unwrap()
+	}
+	disk, ok := storage.(*diskStorage)
+	return disk, ok
+}
+
+// File is an open file of a Storage. It is both an http.File and a
+// webdav.File.
+type File interface {
+	io.Reader
+	io.ReaderAt
+	io.Writer
+	io.WriterAt
+	io.Seeker
+	io.Closer
+	Readdir(count int) ([]os.FileInfo, error)
+	Stat() (os.FileInfo, error)
+}
+
+// diskStorage stores the content in a directory on the local disk.
+type diskStorage struct {
+	root string
+}
+
+func newDiskStorage(root string) *diskStorage {
+	return &diskStorage{root: root}
+}
+
+// fileName returns the path on disk of name.
+func (x *diskStorage) fileName(name string) string {
+	return path.Join(x.root, path.Clean("/"+name))
+}
+
+func (x *diskStorage) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(x.fileName(name))
+}
+
+func (x *diskStorage) Lstat(name string) (os.FileInfo, error) {
+	return os.Lstat(x.fileName(name))
+}
+
+func (x *diskStorage) Open(name string) (File, error) {
+	return x.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (x *diskStorage) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	f, err := os.OpenFile(x.fileName(name), flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (x *diskStorage) ReadDir(name string) ([]os.DirEntry, error) {
+	return os.ReadDir(x.fileName(name))
+}
+
+func (x *diskStorage) Mkdir(name string, perm os.FileMode) error {
+	return os.Mkdir(x.fileName(name), perm)
+}
+
+func (x *diskStorage) MkdirAll(name string, perm os.FileMode) error {
+	return os.MkdirAll(x.fileName(name), perm)
+}
+
+func (x *diskStorage) Remove(name string) error {
+	return os.Remove(x.fileName(name))
+}
+
+func (x *diskStorage) RemoveAll(name string) error {
+	return os.RemoveAll(x.fileName(name))
+}
+
+func (x *diskStorage) Rename(oldName, newName string) error {
+	return os.Rename(x.fileName(oldName), x.fileName(newName))
+}
+
+func (x *diskStorage) Chmod(name string, mode os.FileMode) error {
+	return os.Chmod(x.fileName(name), mode)
+}
+
+func (x *diskStorage) Chown(name string, uid, gid int) error {
+	return os.Chown(x.fileName(name), uid, gid)
+}
+
+func (x *diskStorage) Lchown(name string, uid, gid int) error {
+	return os.Lchown(x.fileName(name), uid, gid)
+}
+
+func (x *diskStorage) Chtimes(name string, atime, mtime time.Time) error {
+	return os.Chtimes(x.fileName(name), atime, mtime)
+}
+
+func (x *diskStorage) Truncate(name string, size int64) error {
+	return os.Truncate(x.fileName(name), size)
+}
+
+func (x *diskStorage) Symlink(target, newName string) error {
+	return os.Symlink(target, x.fileName(newName))
+}
+
+func (x *diskStorage) Readlink(name string) (string, error) {
+	return os.Readlink(x.fileName(name))
+}
+
+func (x *diskStorage) ListXattrs(name string) ([]string, error) {
+	return listXattrs(x.fileName(name))
+}
+
+func (x *diskStorage) GetXattr(name, attr string) ([]byte, error) {
+	return getXattr(x.fileName(name), attr)
+}
+
+func (x *diskStorage) SetXattr(name, attr string, value []byte) error {
+	return setXattr(x.fileName(name), attr, value)
+}
+
+func (x *diskStorage) RemoveXattr(name, attr string) error {
+	return removeXattr(x.fileName(name), attr)
+}
+
+// readFile is os.ReadFile for a Storage.
+func readFile(storage Storage, name string) ([]byte, error) {
+	f, err := storage.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+// writeFile is os.WriteFile for a Storage.
+func writeFile(storage Storage, name string, data []byte, perm os.FileMode) error {
+	f, err := storage.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
+	return err
+}
+
+// tempFileInfix separates the name of a file from the id of a temporary file
+// replacing it.
+const tempFileInfix = ".tmp-"
+
+// tempFileName returns the name of a new temporary file next to name, which
+// can be renamed over it.
+func tempFileName(name string) string {
+	return path.Join(path.Dir(path.Clean("/"+name)), "."+path.Base(name)+tempFileInfix+newDeliveryID())
+}
+
+// isTempFileName reports whether name was made by tempFileName. Temporary
+// files are left out of listings, walks and change events.
+func isTempFileName(name string) bool {
+	base := path.Base(filepath.ToSlash(name))
+	i := strings.LastIndex(base, tempFileInfix)
+	if i < 1 || !strings.HasPrefix(base, ".") {
+		return false
+	}
+	id := base[i+len(tempFileInfix):]
+	_, err := hex.DecodeString(id)
+	return err == nil && len(id) == 32
+}
+
+// withoutTempFiles leaves the temporary files out of directory entries.
+func withoutTempFiles(entries []os.DirEntry) []os.DirEntry {
+	listed := entries[:0]
+	for _, entry := range entries {
+		if !isTempFileName(entry.Name()) {
+			listed = append(listed, entry)
+		}
+	}
+	return listed
+}
+
+// replaceFile writes the new contents of a file with write to a temporary
+// file next to it, which is synced and renamed over it, so that a failure
+// leaves the file as it was and readers see either version. The new file
+// keeps the permissions, owner and extended attributes of the old one.
+func replaceFile(storage Storage, name string, write func(f File) error) error {
+	info, err := storage.Lstat(name)
+	if err != nil {
+		return err
+	}
+	tmpName := tempFileName(name)
+	f, err := storage.OpenFile(tmpName, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	err = write(f)
+	if syncer, ok := f.(interface{ Sync() error }); ok && err == nil {
+		err = syncer.Sync()
+	}
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
+	if err == nil {
+		err = copyFileMeta(storage, name, tmpName, info)
+	}
+	if err == nil {
+		err = storage.Rename(tmpName, name)
+	}
+	if err != nil {
+		storage.Remove(tmpName)
+	}
+	return err
+}
+
+// copyFileMeta gives a file of a storage the permissions, owner and extended
+// attributes of another.
+func copyFileMeta(storage Storage, srcName, dstName string, info os.FileInfo) error {
+	uid, gid := fileOwner(info)
+	dstInfo, err := storage.Lstat(dstName)
+	if err != nil {
+		return err
+	}
+	// Only root may give files away, so the owner is only set if it differs,
+	// and a server that may not set it leaves the file its own.
+	if dstUID, dstGID := fileOwner(dstInfo); dstUID != uid || dstGID != gid {
+		if err := storage.Lchown(dstName, int(uid), int(gid)); err != nil && !errors.Is(err, syscall.EPERM) {
+			return err
+		}
+	}
+	if err := storage.Chmod(dstName, info.Mode()&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)); err != nil {
+		return err
+	}
+	attrs, err := storage.ListXattrs(srcName)
+	if errors.Is(err, errXattrUnsupported) || errors.Is(err, syscall.ENOTSUP) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, attr := range attrs {
+		value, err := storage.GetXattr(srcName, attr)
+		if err == nil {
+			err = storage.SetXattr(dstName, attr, value)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fileLocks serializes changes to files by their names.
+type fileLocks struct {
+	mu    sync.Mutex
+	locks map[string]*fileLock
+}
+
+type fileLock struct {
+	sync.Mutex
+	refs int
+}
+
+// lock locks the file with the name, and returns the function unlocking it.
+func (x *fileLocks) lock(name string) func() {
+	name = path.Clean("/" + name)
+	x.mu.Lock()
+	if x.locks == nil {
+		x.locks = make(map[string]*fileLock)
+	}
+	l := x.locks[name]
+	if l == nil {
+		l = &fileLock{}
+		x.locks[name] = l
+	}
+	l.refs++
+	x.mu.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		x.mu.Lock()
+		if l.refs--; l.refs == 0 {
+			delete(x.locks, name)
+		}
+		x.mu.Unlock()
+	}
+}
+
+// walkStorage is filepath.Walk for a Storage. The names passed to fn are names
+// of the storage.
+func walkStorage(storage Storage, name string, fn filepath.WalkFunc) error {
+	info, err := storage.Lstat(name)
+	if err != nil {
+		err = fn(name, nil, err)
+	} else {
+		err = walkStorageDir(storage, name, info, fn)
+	}
+	if err == filepath.SkipDir || err == filepath.SkipAll {
+		return nil
+	}
+	return err
+}
+
+func walkStorageDir(storage Storage, name string, info os.FileInfo, fn filepath.WalkFunc) error {
+	if !info.IsDir() {
+		return fn(name, info, nil)
+	}
+
+	entries, err := storage.ReadDir(name)
+	if err1 := fn(name, info, err); err != nil || err1 != nil {
+		return err1
+	}
+	entries = withoutTempFiles(entries)
+	for _, entry := range entries {
+		child := path.Join(name, entry.Name())
+		info, err := entry.Info()
+		if err != nil {
+			if err := fn(child, nil, err); err != nil && err != filepath.SkipDir {
+				return err
+			}
+			continue
+		}
+		if err := walkStorageDir(storage, child, info, fn); err != nil {
+			if !info.IsDir() || err != filepath.SkipDir {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// fileOwnerInfo is implemented by the FileInfos of storages that are not on
+// the local disk, which have no *syscall.Stat_t.
+type fileOwnerInfo interface {
+	Uid() uint32
+	Gid() uint32
+}
+
+// fileOwner returns the owner and group ids of a file.
+func fileOwner(info os.FileInfo) (uid, gid uint32) {
+	if owner, ok := info.(fileOwnerInfo); ok {
+		return owner.Uid(), owner.Gid()
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return stat.Uid, stat.Gid
+	}
+	return 0, 0
+}
+
+// storageFileInfo is the os.FileInfo of a file that is not on the local disk.
+// It has the owner that a *syscall.Stat_t has on disk.
+type storageFileInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+	uid     int
+	gid     int
+}
+
+func (x *storageFileInfo) Name() string       { return x.name }
+func (x *storageFileInfo) Size() int64        { return x.size }
+func (x *storageFileInfo) Mode() os.FileMode  { return x.mode }
+func (x *storageFileInfo) ModTime() time.Time { return x.modTime }
+func (x *storageFileInfo) IsDir() bool        { return x.mode.IsDir() }
+func (x *storageFileInfo) Sys() interface{}   { return nil }
+func (x *storageFileInfo) Uid() uint32        { return uint32(x.uid) }
+func (x *storageFileInfo) Gid() uint32        { return uint32(x.gid) }
@@ -0,0 +1,631 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// casRefPrefix starts the contents of the references of a casStorage.
+const casRefPrefix = "sha256:"
+
+// casTmpDir is where the blobs of files being written are kept until they
+// are closed.
+const casTmpDir = "/tmp"
+
+// casStorage stores the contents of files once, in blobs named by their
+// SHA-256 checksum. The tree storage has the directories and symlinks, and a
+// reference for each file, with the permissions, owner, modification time
+// and extended attributes of the file and the checksum of its contents.
+// Empty files have no blob, and files that aren't references are read from
+// the tree as they are, until they are written.
+//
+// The blobs count their references in a .refs file next to them, and are
+// removed when the last one is. Files opened for writing are written to a
+// new blob, which replaces the old one when the file is closed.
+type casStorage struct {
+	tree  Storage
+	blobs Storage
+	// mu serializes the changes of references and their counts.
+	mu sync.Mutex
+}
+
+func newCASStorage(tree, blobs Storage) *casStorage {
+	return &casStorage{tree: tree, blobs: blobs}
+}
+
+func casBlobName(sum string) string {
+	return "/" + sum[:2] + "/" + sum
+}
+
+func casRefsName(sum string) string {
+	return casBlobName(sum) + ".refs"
+}
+
+// casRefSize is the size of a reference to a blob.
+const casRefSize = len(casRefPrefix) + sha256.Size*2 + 1
+
+// readRef returns the checksum a reference refers to, which is empty for
+// empty files. Files that aren't references, such as those already in the
+// content directory, are plain files, which have their contents in the tree.
+func (x *casStorage) readRef(name string) (sum string, plain bool, err error) {
+	f, err := x.tree.Open(name)
+	if err != nil {
+		return "", false, err
+	}
+	defer f.Close()
+	data, err := io.ReadAll(io.LimitReader(f, int64(casRefSize)+1))
+	if err != nil {
+		return "", false, err
+	}
+	if len(data) == 0 {
+		return "", false, nil
+	}
+	sum, ok := strings.CutPrefix(strings.TrimSpace(string(data)), casRefPrefix)
+	if _, err := hex.DecodeString(sum); !ok || err != nil || len(sum) != sha256.Size*2 || len(data) > casRefSize {
+		return "", true, nil
+	}
+	return sum, false, nil
+}
+
+// writeRef points a reference at a blob. The reference is replaced, so that
+// it is never seen partly written, and keeps its permissions, owner and
+// extended attributes.
+func (x *casStorage) writeRef(name, sum string) error {
+	return replaceFile(x.tree, name, func(f File) error {
+		if sum == "" {
+			return nil
+		}
+		_, err := f.Write([]byte(casRefPrefix + sum + "\n"))
+		return err
+	})
+}
+
+// refs returns the reference count of a blob.
+func (x *casStorage) refs(sum string) (int, error) {
+	data, err := readFile(x.blobs, casRefsName(sum))
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(data)))
+}
+
+// addRefs changes the reference count of a blob, and removes the blob when
+// it has none left.
+func (x *casStorage) addRefs(sum string, n int) error {
+	if sum == "" {
+		return nil
+	}
+	refs, err := x.refs(sum)
+	if err != nil {
+		return err
+	}
+	if refs += n; refs > 0 {
+		return writeFile(x.blobs, casRefsName(sum), []byte(strconv.Itoa(refs)+"\n"), 0600)
+	}
+	if err := x.blobs.Remove(casBlobName(sum)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := x.blobs.Remove(casRefsName(sum)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// casFileInfo is the info of a reference with the size of its contents.
+type casFileInfo struct {
+	os.FileInfo
+	size int64
+}
+
+func (x *casFileInfo) Size() int64 { return x.size }
+func (x *casFileInfo) Uid() uint32 { uid, _ := fileOwner(x.FileInfo); return uid }
+func (x *casFileInfo) Gid() uint32 { _, gid := fileOwner(x.FileInfo); return gid }
+
+// fileInfo returns the info of a file with the size of its blob.
+func (x *casStorage) fileInfo(name string, info os.FileInfo) (os.FileInfo, error) {
+	if !info.Mode().IsRegular() {
+		return info, nil
+	}
+	sum, plain, err := x.readRef(name)
+	if err != nil || plain {
+		return info, err
+	}
+	if sum == "" {
+		return &casFileInfo{info, 0}, nil
+	}
+	blob, err := x.blobs.Stat(casBlobName(sum))
+	if err != nil {
+		return nil, err
+	}
+	return &casFileInfo{info, blob.Size()}, nil
+}
+
+func (x *casStorage) Stat(name string) (os.FileInfo, error) {
+	info, err := x.tree.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	return x.fileInfo(name, info)
+}
+
+func (x *casStorage) Lstat(name string) (os.FileInfo, error) {
+	info, err := x.tree.Lstat(name)
+	if err != nil {
+		return nil, err
+	}
+	return x.fileInfo(name, info)
+}
+
+func (x *casStorage) Open(name string) (File, error) {
+	return x.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (x *casStorage) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	writable := flag&(os.O_WRONLY|os.O_RDWR) != 0
+	// The reference is opened without truncating it, to check that the
+	// file may be opened and to create it.
+	ref, err := x.tree.OpenFile(name, flag&^(os.O_TRUNC|os.O_APPEND), perm)
+	if err != nil {
+		return nil, err
+	}
+	info, err := ref.Stat()
+	if err != nil {
+		ref.Close()
+		return nil, err
+	}
+	if info.IsDir() {
+		return &casDirFile{File: ref, storage: x, name: path.Clean("/" + name)}, nil
+	}
+	ref.Close()
+
+	src, err := x.openBlob(name)
+	if err != nil {
+		return nil, err
+	}
+	if !writable {
+		srcInfo, err := src.Stat()
+		if err != nil {
+			src.Close()
+			return nil, err
+		}
+		return &casFile{storage: x, name: name, info: &casFileInfo{info, srcInfo.Size()}, blob: src}, nil
+	}
+	defer src.Close()
+
+	if err := x.blobs.MkdirAll(casTmpDir, 0700); err != nil {
+		return nil, err
+	}
+	tmpName := path.Join(casTmpDir, newDeliveryID())
+	blob, err := x.blobs.OpenFile(tmpName, os.O_RDWR|os.O_CREATE|os.O_EXCL|flag&os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	f := &casFile{storage: x, name: name, info: info, blob: blob, tmpName: tmpName, dirty: flag&os.O_TRUNC != 0}
+	if flag&os.O_TRUNC == 0 {
+		_, err := io.Copy(blob, src)
+		if err == nil && flag&os.O_APPEND == 0 {
+			_, err = blob.Seek(0, io.SeekStart)
+		}
+		if err != nil {
+			f.discard()
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// openBlob opens the contents of a file.
+func (x *casStorage) openBlob(name string) (File, error) {
+	// The blob is opened before a change of the reference can remove it.
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	sum, plain, err := x.readRef(name)
+	if err != nil {
+		return nil, err
+	}
+	if plain {
+		return x.tree.Open(name)
+	}
+	if sum == "" {
+		return casEmptyBlob{bytes.NewReader(nil)}, nil
+	}
+	return x.blobs.Open(casBlobName(sum))
+}
+
+// casEmptyBlob is the contents of empty files, which have no blob.
+type casEmptyBlob struct {
+	*bytes.Reader
+}
+
+func (x casEmptyBlob) Write(p []byte) (int, error)                 { return 0, syscall.EBADF }
+func (x casEmptyBlob) WriteAt(p []byte, offset int64) (int, error) { return 0, syscall.EBADF }
+func (x casEmptyBlob) Readdir(count int) ([]os.FileInfo, error)    { return nil, syscall.ENOTDIR }
+func (x casEmptyBlob) Stat() (os.FileInfo, error)                  { return &storageFileInfo{mode: 0400}, nil }
+func (x casEmptyBlob) Close() error                                { return nil }
+
+// commit stores the contents of a closed file in a blob, and points its
+// reference at it.
+func (x *casStorage) commit(name, tmpName string) error {
+	f, err := x.blobs.Open(tmpName)
+	if err != nil {
+		return err
+	}
+	hash := sha256.New()
+	size, err := io.Copy(hash, f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	sum := hex.EncodeToString(hash.Sum(nil))
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if size == 0 {
+		sum = ""
+		if err := x.blobs.Remove(tmpName); err != nil {
+			return err
+		}
+	} else if _, err := x.blobs.Stat(casBlobName(sum)); err == nil {
+		if err := x.blobs.Remove(tmpName); err != nil {
+			return err
+		}
+	} else if os.IsNotExist(err) {
+		if err := x.blobs.MkdirAll(path.Dir(casBlobName(sum)), 0700); err != nil {
+			return err
+		}
+		if err := x.blobs.Chmod(tmpName, 0400); err != nil {
+			return err
+		}
+		if err := x.blobs.Rename(tmpName, casBlobName(sum)); err != nil {
+			return err
+		}
+	} else {
+		return err
+	}
+
+	// A plain file becomes a reference, without one to release.
+	old, _, err := x.readRef(name)
+	if err != nil {
+		return err
+	}
+	if old == sum {
+		// The reference is written anyway, for its modification time.
+		return x.writeRef(name, sum)
+	}
+	if err := x.addRefs(sum, 1); err != nil {
+		return err
+	}
+	if err := x.writeRef(name, sum); err != nil {
+		x.addRefs(sum, -1)
+		return err
+	}
+	return x.addRefs(old, -1)
+}
+
+func (x *casStorage) ReadDir(name string) ([]os.DirEntry, error) {
+	entries, err := x.tree.ReadDir(name)
+	if err != nil {
+		return nil, err
+	}
+	for i, entry := range entries {
+		if entry.Type().IsRegular() {
+			info, err := entry.Info()
+			if err == nil {
+				info, err = x.fileInfo(path.Join(name, entry.Name()), info)
+			}
+			if err != nil {
+				return nil, err
+			}
+			entries[i] = dirEntry{info}
+		}
+	}
+	return entries, nil
+}
+
+func (x *casStorage) Mkdir(name string, perm os.FileMode) error {
+	return x.tree.Mkdir(name, perm)
+}
+
+func (x *casStorage) MkdirAll(name string, perm os.FileMode) error {
+	return x.tree.MkdirAll(name, perm)
+}
+
+func (x *casStorage) Remove(name string) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	info, err := x.tree.Lstat(name)
+	if err != nil {
+		return x.tree.Remove(name)
+	}
+	var sum string
+	if info.Mode().IsRegular() {
+		if sum, _, err = x.readRef(name); err != nil {
+			return err
+		}
+	}
+	if err := x.tree.Remove(name); err != nil {
+		return err
+	}
+	return x.addRefs(sum, -1)
+}
+
+// RemoveAll is os.RemoveAll. The blobs of the files are released once they
+// are all removed.
+func (x *casStorage) RemoveAll(name string) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	sums, err := x.treeRefs(name)
+	if err != nil {
+		return err
+	}
+	if err := x.tree.RemoveAll(name); err != nil {
+		return err
+	}
+	for sum, refs := range sums {
+		if err := x.addRefs(sum, -refs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// treeRefs counts the references to each blob under name.
+func (x *casStorage) treeRefs(name string) (map[string]int, error) {
+	sums := make(map[string]int)
+	err := walkStorage(x.tree, name, func(name string, info os.FileInfo, err error) error {
+		switch {
+		case os.IsNotExist(err):
+			return nil
+		case err != nil:
+			return err
+		case !info.Mode().IsRegular():
+			return nil
+		}
+		sum, _, err := x.readRef(name)
+		if err != nil {
+			return err
+		}
+		if sum != "" {
+			sums[sum]++
+		}
+		return nil
+	})
+	return sums, err
+}
+
+func (x *casStorage) Rename(oldName, newName string) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	var replaced string
+	if info, err := x.tree.Lstat(newName); err == nil && info.Mode().IsRegular() && path.Clean("/"+oldName) != path.Clean("/"+newName) {
+		if replaced, _, err = x.readRef(newName); err != nil {
+			return err
+		}
+	}
+	if err := x.tree.Rename(oldName, newName); err != nil {
+		return err
+	}
+	return x.addRefs(replaced, -1)
+}
+
+func (x *casStorage) Chmod(name string, mode os.FileMode) error {
+	return x.tree.Chmod(name, mode)
+}
+
+func (x *casStorage) Chown(name string, uid, gid int) error {
+	return x.tree.Chown(name, uid, gid)
+}
+
+func (x *casStorage) Lchown(name string, uid, gid int) error {
+	return x.tree.Lchown(name, uid, gid)
+}
+
+func (x *casStorage) Chtimes(name string, atime, mtime time.Time) error {
+	return x.tree.Chtimes(name, atime, mtime)
+}
+
+// Truncate writes the truncated contents to a new blob.
+func (x *casStorage) Truncate(name string, size int64) error {
+	f, err := x.OpenFile(name, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	cf, ok := f.(*casFile)
+	if !ok {
+		f.Close()
+		return &os.PathError{Op: "truncate", Path: name, Err: syscall.EISDIR}
+	}
+	if err := x.blobs.Truncate(cf.tmpName, size); err != nil {
+		cf.discard()
+		return err
+	}
+	cf.dirty = true
+	return cf.Close()
+}
+
+func (x *casStorage) Symlink(target, newName string) error {
+	return x.tree.Symlink(target, newName)
+}
+
+func (x *casStorage) Readlink(name string) (string, error) {
+	return x.tree.Readlink(name)
+}
+
+func (x *casStorage) ListXattrs(name string) ([]string, error) {
+	return x.tree.ListXattrs(name)
+}
+
+func (x *casStorage) GetXattr(name, attr string) ([]byte, error) {
+	return x.tree.GetXattr(name, attr)
+}
+
+func (x *casStorage) SetXattr(name, attr string, value []byte) error {
+	return x.tree.SetXattr(name, attr, value)
+}
+
+func (x *casStorage) RemoveXattr(name, attr string) error {
+	return x.tree.RemoveXattr(name, attr)
+}
+
+// collectGarbage counts the references in the tree again, and removes the
+// blobs that have none and the blobs of files that were never closed. It
+// repairs the counts after a crash, and returns how many blobs it removed.
+func (x *casStorage) collectGarbage() (int, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	sums, err := x.treeRefs("/")
+	if err != nil {
+		return 0, err
+	}
+	if err := x.blobs.RemoveAll(casTmpDir); err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	err = walkStorage(x.blobs, "/", func(name string, info os.FileInfo, err error) error {
+		switch {
+		case os.IsNotExist(err):
+			return nil
+		case err != nil:
+			return err
+		case info.IsDir() || strings.HasSuffix(name, ".refs"):
+			return nil
+		}
+		sum := path.Base(name)
+		if sums[sum] > 0 {
+			return writeFile(x.blobs, casRefsName(sum), []byte(strconv.Itoa(sums[sum])+"\n"), 0600)
+		}
+		removed++
+		return x.addRefs(sum, -1)
+	})
+	return removed, err
+}
+
+// newCASDiskStorage stores the files of root once in blobDir, after
+// collecting the garbage left there.
+func newCASDiskStorage(root, blobDir string) (*casStorage, error) {
+	if err := os.MkdirAll(blobDir, 0700); err != nil {
+		return nil, err
+	}
+	storage := newCASStorage(newDiskStorage(root), newDiskStorage(blobDir))
+	removed, err := storage.collectGarbage()
+	if err != nil {
+		return nil, err
+	}
+	if removed > 0 {
+		log.Printf("removed %d unreferenced blobs from %s", removed, blobDir)
+	}
+	return storage, nil
+}
+
+// casFile is an open file of a casStorage. Files opened for writing write to
+// a new blob.
+type casFile struct {
+	storage *casStorage
+	name    string
+	info    os.FileInfo
+	blob    File
+	// tmpName is the new blob of a file opened for writing.
+	tmpName string
+	dirty   bool
+}
+
+func (x *casFile) Read(p []byte) (int, error) {
+	return x.blob.Read(p)
+}
+
+func (x *casFile) ReadAt(p []byte, offset int64) (int, error) {
+	return x.blob.ReadAt(p, offset)
+}
+
+func (x *casFile) Write(p []byte) (int, error) {
+	if x.tmpName == "" {
+		return 0, &os.PathError{Op: "write", Path: x.name, Err: syscall.EBADF}
+	}
+	x.dirty = true
+	return x.blob.Write(p)
+}
+
+func (x *casFile) WriteAt(p []byte, offset int64) (int, error) {
+	if x.tmpName == "" {
+		return 0, &os.PathError{Op: "write", Path: x.name, Err: syscall.EBADF}
+	}
+	x.dirty = true
+	return x.blob.WriteAt(p, offset)
+}
+
+func (x *casFile) Seek(offset int64, whence int) (int64, error) {
+	return x.blob.Seek(offset, whence)
+}
+
+func (x *casFile) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, &os.PathError{Op: "readdirent", Path: x.name, Err: syscall.ENOTDIR}
+}
+
+func (x *casFile) Stat() (os.FileInfo, error) {
+	if x.tmpName == "" {
+		return x.info, nil
+	}
+	blobInfo, err := x.blob.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return &casFileInfo{x.info, blobInfo.Size()}, nil
+}
+
+// Close stores the contents of a changed file.
+func (x *casFile) Close() error {
+	if x.tmpName == "" || !x.dirty {
+		x.discard()
+		return nil
+	}
+	if err := x.blob.Close(); err != nil {
+		x.storage.blobs.Remove(x.tmpName)
+		return err
+	}
+	if err := x.storage.commit(x.name, x.tmpName); err != nil {
+		x.storage.blobs.Remove(x.tmpName)
+		return err
+	}
+	return nil
+}
+
+// discard closes the file without storing it.
+func (x *casFile) discard() {
+	x.blob.Close()
+	if x.tmpName != "" {
+		x.storage.blobs.Remove(x.tmpName)
+	}
+}
+
+// casDirFile is an open directory of a casStorage, which lists the files
+// with the sizes of their contents.
+type casDirFile struct {
+	File
+	storage *casStorage
+	name    string
+}
+
+func (x *casDirFile) Readdir(count int) ([]os.FileInfo, error) {
+	infos, err := x.File.Readdir(count)
+	for i, info := range infos {
+		if info.Mode().IsRegular() {
+			if infos[i], err = x.storage.fileInfo(path.Join(x.name, info.Name()), info); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return infos, err
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"testing"
+)
+
+func TestCASStorage(t *testing.T) {
+	newTestStorage := func() (*casStorage, *memStorage) {
+		blobs := newMemStorage("blobs")
+		return newCASStorage(newMemStorage(ContentRoot), blobs), blobs
+	}
+	sum := func(contents string) string {
+		hash := sha256.Sum256([]byte(contents))
+		return hex.EncodeToString(hash[:])
+	}
+	assertRefs := func(t *testing.T, storage *casStorage, contents string, want int) {
+		t.Helper()
+		refs, err := storage.refs(sum(contents))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if refs != want {
+			t.Errorf("got %d references to %q, want %d", refs, contents, want)
+		}
+		_, err = storage.blobs.Stat(casBlobName(sum(contents)))
+		if exists := err == nil; exists != (want > 0) {
+			t.Errorf("got error %v for the blob of %q with %d references", err, contents, want)
+		}
+	}
+
+	t.Run("contents are stored once", func(t *testing.T) {
+		storage, _ := newTestStorage()
+		if err := storage.MkdirAll("/v1", 0755); err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range []string{"/v1/app.bin", "/v2.bin"} {
+			if err := writeFile(storage, name, []byte("release\n"), 0640); err != nil {
+				t.Fatal(err)
+			}
+		}
+		assertRefs(t, storage, "release\n", 2)
+
+		info, err := storage.Stat("/v2.bin")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() != 8 || info.Mode() != 0640 {
+			t.Errorf("got size %d and mode %v", info.Size(), info.Mode())
+		}
+		entries, err := storage.ReadDir("/v1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info, _ := entries[0].Info(); info.Size() != 8 {
+			t.Errorf("got listed size %d", info.Size())
+		}
+		contents, err := readFile(storage, "/v1/app.bin")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(contents) != "release\n" {
+			t.Errorf("got contents %q", contents)
+		}
+	})
+
+	t.Run("blobs are removed with their last reference", func(t *testing.T) {
+		storage, _ := newTestStorage()
+		if err := storage.MkdirAll("/dir", 0755); err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range []string{"/a.txt", "/b.txt", "/dir/c.txt"} {
+			if err := writeFile(storage, name, []byte("same\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		f, err := storage.OpenFile("/a.txt", os.O_WRONLY|os.O_APPEND, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Write([]byte("more\n")); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+		assertRefs(t, storage, "same\n", 2)
+		assertRefs(t, storage, "same\nmore\n", 1)
+
+		if err := storage.Rename("/a.txt", "/b.txt"); err != nil {
+			t.Fatal(err)
+		}
+		assertRefs(t, storage, "same\n", 1)
+		if err := storage.RemoveAll("/dir"); err != nil {
+			t.Fatal(err)
+		}
+		assertRefs(t, storage, "same\n", 0)
+		if err := storage.Truncate("/b.txt", 0); err != nil {
+			t.Fatal(err)
+		}
+		assertRefs(t, storage, "same\nmore\n", 0)
+		if info, err := storage.Stat("/b.txt"); err != nil || info.Size() != 0 {
+			t.Errorf("got truncated file %v, %v", info, err)
+		}
+	})
+
+	t.Run("garbage is collected", func(t *testing.T) {
+		storage, blobs := newTestStorage()
+		for _, name := range []string{"/kept.txt", "/also_kept.txt", "/removed.txt"} {
+			if err := writeFile(storage, name, []byte(name), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := writeFile(storage, "/same.txt", []byte("/kept.txt"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		// Like a crash before the counts were changed.
+		if err := storage.tree.Remove("/removed.txt"); err != nil {
+			t.Fatal(err)
+		}
+		if err := writeFile(blobs, casRefsName(sum("/kept.txt")), []byte("7\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := storage.OpenFile("/also_kept.txt", os.O_WRONLY, 0); err != nil {
+			t.Fatal(err)
+		}
+
+		removed, err := storage.collectGarbage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if removed != 1 {
+			t.Errorf("removed %d blobs, want 1", removed)
+		}
+		assertRefs(t, storage, "/removed.txt", 0)
+		assertRefs(t, storage, "/kept.txt", 2)
+		assertRefs(t, storage, "/also_kept.txt", 1)
+		if _, err := blobs.Stat(casTmpDir); !os.IsNotExist(err) {
+			t.Errorf("got error %v for the blobs of unclosed files", err)
+		}
+	})
+
+	t.Run("plain files are passed through", func(t *testing.T) {
+		storage, _ := newTestStorage()
+		if err := writeFile(storage.tree, "/plain.txt", []byte("not a reference\n"), 0640); err != nil {
+			t.Fatal(err)
+		}
+		if err := writeFile(storage, "/ref.txt", []byte("not a reference\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if info, err := storage.Stat("/plain.txt"); err != nil || info.Size() != 16 {
+			t.Errorf("got plain file %v, %v", info, err)
+		}
+		if contents, err := readFile(storage, "/plain.txt"); err != nil || string(contents) != "not a reference\n" {
+			t.Errorf("got plain contents %q, %v", contents, err)
+		}
+		if err := storage.Remove("/plain.txt"); err != nil {
+			t.Fatal(err)
+		}
+		assertRefs(t, storage, "not a reference\n", 1)
+
+		if err := writeFile(storage.tree, "/plain.txt", []byte("old\n"), 0640); err != nil {
+			t.Fatal(err)
+		}
+		f, err := storage.OpenFile("/plain.txt", os.O_WRONLY|os.O_APPEND, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Write([]byte("new\n")); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+		assertRefs(t, storage, "old\nnew\n", 1)
+		if ref, err := readFile(storage.tree, "/plain.txt"); err != nil || string(ref) != casRefPrefix+sum("old\nnew\n")+"\n" {
+			t.Errorf("got reference %q, %v", ref, err)
+		}
+		if info, err := storage.tree.Stat("/plain.txt"); err != nil || info.Mode() != 0640 {
+			t.Errorf("got reference %v, %v", info, err)
+		}
+		entries, err := storage.tree.ReadDir("/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 2 {
+			t.Errorf("got %d files, want plain.txt and ref.txt", len(entries))
+		}
+	})
+}
@@ -0,0 +1,664 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// compressedMagic starts the files of a compressedStorage that are stored
+// with a header.
+const compressedMagic = "FSCMP001"
+
+// compressedHeaderSize is the size of the magic, the compression and the
+// size of the contents.
+const compressedHeaderSize = len(compressedMagic) + 1 + 8
+
+const (
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+)
+
+// The compressions in the headers of files.
+const (
+	compressedStored byte = iota
+	compressedGzip
+	compressedZstd
+)
+
+// usagePath is where the physical and logical sizes of the files under a
+// path are reported instead of content.
+const usagePath = "/.usage"
+
+// compressedStorage compresses the contents of the files of another storage
+// whose path matches the policy, or all of them if it is empty. The patterns
+// of the policy are globs like those of archives, matched against the base
+// name of files if they have no slash, and against their path from the root
+// otherwise.
+//
+// Compressed files start with a header with the compression and the size of
+// their contents. Files that don't shrink and files outside the policy are
+// stored as is, unless they start like a header, in which case they are
+// stored with a header too. A file opened for writing that is compressed or
+// matches the policy is kept in memory until it is closed, when it replaces
+// the file. Reads decompress from the start of a file, and go on from where
+// the last read stopped.
+type compressedStorage struct {
+	Storage
+	// root names the storage in errors.
+	root        string
+	compression string
+	paths       []string
+	// locks serializes the changes to each file, which are read, changed in
+	// memory and rewritten.
+	locks fileLocks
+}
+
+func newCompressedStorage(storage Storage, root, compression string, paths []string) (*compressedStorage, error) {
+	switch compression {
+	case CompressionGzip, CompressionZstd:
+	default:
+		return nil, fmt.Errorf("unknown compression %q", compression)
+	}
+	for _, pattern := range paths {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid glob %q: %v", pattern, err)
+		}
+	}
+	return &compressedStorage{Storage: storage, root: root, compression: compression, paths: paths}, nil
+}
+
+func (x *compressedStorage) Unwrap() Storage {
+	return x.Storage
+}
+
+func (x *compressedStorage) pathError(op, name string, err error) error {
+	return &os.PathError{Op: op, Path: path.Join(x.root, path.Clean("/"+name)), Err: err}
+}
+
+// compresses reports whether the policy compresses a file.
+func (x *compressedStorage) compresses(name string) bool {
+	return len(x.paths) == 0 || globsMatch(x.paths, strings.TrimPrefix(path.Clean("/"+name), "/"))
+}
+
+// compressedHeader is the header of a stored file.
+type compressedHeader struct {
+	compression byte
+	size        int64
+}
+
+// readCompressedHeader returns the header of a file, or false if it is
+// stored as is.
+func readCompressedHeader(f io.ReaderAt) (compressedHeader, bool, error) {
+	data := make([]byte, compressedHeaderSize)
+	if _, err := f.ReadAt(data, 0); err == io.EOF || err == io.ErrUnexpectedEOF {
+		return compressedHeader{}, false, nil
+	} else if err != nil {
+		return compressedHeader{}, false, err
+	}
+	if string(data[:len(compressedMagic)]) != compressedMagic {
+		return compressedHeader{}, false, nil
+	}
+	return compressedHeader{
+		compression: data[len(compressedMagic)],
+		size:        int64(binary.BigEndian.Uint64(data[len(compressedMagic)+1:])),
+	}, true, nil
+}
+
+// compressedFileInfo is the info of a file with the size of its contents.
+type compressedFileInfo struct {
+	os.FileInfo
+	size        int64
+	compression byte
+}
+
+func (x *compressedFileInfo) Size() int64 { return x.size }
+func (x *compressedFileInfo) Uid() uint32 { uid, _ := fileOwner(x.FileInfo); return uid }
+func (x *compressedFileInfo) Gid() uint32 { _, gid := fileOwner(x.FileInfo); return gid }
+
+// fileInfo returns the info of a file with the size from its header.
+func (x *compressedStorage) fileInfo(name string, info os.FileInfo) (os.FileInfo, error) {
+	if !info.Mode().IsRegular() || info.Size() < int64(compressedHeaderSize) {
+		return info, nil
+	}
+	f, err := x.Storage.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	header, ok, err := readCompressedHeader(f)
+	if err != nil || !ok {
+		return info, err
+	}
+	return &compressedFileInfo{info, header.size, header.compression}, nil
+}
+
+func (x *compressedStorage) Stat(name string) (os.FileInfo, error) {
+	info, err := x.Storage.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	return x.fileInfo(name, info)
+}
+
+func (x *compressedStorage) Lstat(name string) (os.FileInfo, error) {
+	info, err := x.Storage.Lstat(name)
+	if err != nil {
+		return nil, err
+	}
+	return x.fileInfo(name, info)
+}
+
+func (x *compressedStorage) ReadDir(name string) ([]os.DirEntry, error) {
+	entries, err := x.Storage.ReadDir(name)
+	if err != nil {
+		return nil, err
+	}
+	for i, entry := range entries {
+		if entry.Type().IsRegular() {
+			info, err := entry.Info()
+			if err == nil {
+				info, err = x.fileInfo(path.Join(name, entry.Name()), info)
+			}
+			if err != nil {
+				return nil, err
+			}
+			entries[i] = dirEntry{info}
+		}
+	}
+	return entries, nil
+}
+
+func (x *compressedStorage) Open(name string) (File, error) {
+	return x.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (x *compressedStorage) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	writable := flag&(os.O_WRONLY|os.O_RDWR) != 0
+	underlyingFlag := flag
+	if writable {
+		// The start of the file is read on close, and compressed files are
+		// read to decompress them.
+		underlyingFlag = underlyingFlag&^os.O_WRONLY | os.O_RDWR
+	}
+	unlock := func() {}
+	if writable {
+		unlock = x.locks.lock(name)
+	}
+	f, err := x.Storage.OpenFile(name, underlyingFlag&^(os.O_TRUNC|os.O_APPEND), perm)
+	if err != nil {
+		unlock()
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		unlock()
+		return nil, err
+	}
+	if info.IsDir() {
+		unlock()
+		return &compressedDirFile{File: f, storage: x, name: path.Clean("/" + name)}, nil
+	}
+	header, compressed, err := readCompressedHeader(f)
+	if err != nil {
+		f.Close()
+		unlock()
+		return nil, err
+	}
+	if !writable {
+		if !compressed {
+			return f, nil
+		}
+		return &compressedFile{storage: x, name: name, file: f, info: info, header: header}, nil
+	}
+
+	if !compressed && !x.compresses(name) {
+		f.Close()
+		if f, err = x.Storage.OpenFile(name, underlyingFlag&^(os.O_CREATE|os.O_EXCL), perm); err != nil {
+			unlock()
+			return nil, err
+		}
+		return &compressedRawFile{File: f, storage: x, name: name, unlock: unlock}, nil
+	}
+	// Files in the policy that are stored as is are compressed once written.
+	file := &compressedFile{storage: x, name: name, file: f, info: info, flag: flag, writable: true, unlock: unlock}
+	if flag&os.O_TRUNC != 0 {
+		file.dirty = info.Size() > 0
+	} else if compressed {
+		file.header = header
+		if file.data, err = io.ReadAll(&compressedReader{file: file}); err != nil {
+			f.Close()
+			unlock()
+			return nil, err
+		}
+	} else if file.data, err = io.ReadAll(io.NewSectionReader(f, 0, info.Size())); err != nil {
+		f.Close()
+		unlock()
+		return nil, err
+	}
+	if flag&os.O_APPEND != 0 {
+		file.offset = int64(len(file.data))
+	}
+	return file, nil
+}
+
+// encode returns what is stored for the contents of a file.
+func (x *compressedStorage) encode(name string, data []byte) ([]byte, error) {
+	if x.compresses(name) && len(data) > 0 {
+		var buf bytes.Buffer
+		var w io.WriteCloser
+		var err error
+		switch x.compression {
+		case CompressionGzip:
+			buf.Write(compressedHeaderOf(compressedGzip, len(data)))
+			w = gzip.NewWriter(&buf)
+		case CompressionZstd:
+			buf.Write(compressedHeaderOf(compressedZstd, len(data)))
+			w, err = zstd.NewWriter(&buf)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		if buf.Len() < len(data) {
+			return buf.Bytes(), nil
+		}
+	}
+	if !bytes.HasPrefix(data, []byte(compressedMagic)) {
+		return data, nil
+	}
+	return append(compressedHeaderOf(compressedStored, len(data)), data...), nil
+}
+
+func compressedHeaderOf(compression byte, size int) []byte {
+	header := make([]byte, compressedHeaderSize)
+	copy(header, compressedMagic)
+	header[len(compressedMagic)] = compression
+	binary.BigEndian.PutUint64(header[len(compressedMagic)+1:], uint64(size))
+	return header
+}
+
+// write replaces a file with what is stored for its contents.
+func (x *compressedStorage) write(name string, data []byte) error {
+	stored, err := x.encode(name, data)
+	if err != nil {
+		return err
+	}
+	return replaceFile(x.Storage, name, func(f File) error {
+		_, err := f.Write(stored)
+		return err
+	})
+}
+
+// Truncate rewrites the truncated contents of compressed files.
+func (x *compressedStorage) Truncate(name string, size int64) error {
+	f, err := x.OpenFile(name, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	switch cf := f.(type) {
+	case *compressedRawFile:
+		f.Close()
+		if err := x.Storage.Truncate(name, size); err != nil {
+			return err
+		}
+		// Cutting off a file can leave what looks like a header.
+		if f, err = x.OpenFile(name, os.O_WRONLY, 0); err != nil {
+			return err
+		}
+		return f.Close()
+	case *compressedFile:
+		if size < 0 {
+			f.Close()
+			return x.pathError("truncate", name, syscall.EINVAL)
+		}
+		if size <= int64(len(cf.data)) {
+			cf.data = cf.data[:size]
+		} else {
+			cf.data = append(cf.data, make([]byte, size-int64(len(cf.data)))...)
+		}
+		cf.dirty = true
+		return cf.Close()
+	default:
+		f.Close()
+		return x.pathError("truncate", name, syscall.EISDIR)
+	}
+}
+
+// usage returns the sizes of the files under name, as read and as stored by
+// the storage under any other wrappers, like encryption.
+func (x *compressedStorage) usage(name string) (UsageData, error) {
+	usage := UsageData{Path: path.Clean("/" + name)}
+	stored := x.Storage
+	for {
+		wrapper, ok := stored.(storageWrapper)
+		if !ok {
+			break
+		}
+		stored = wrapper.Unwrap()
+	}
+	err := walkStorage(x.Storage, name, func(name string, info os.FileInfo, err error) error {
+		switch {
+		case os.IsNotExist(err):
+			return nil
+		case err != nil:
+			return err
+		case !info.Mode().IsRegular():
+			return nil
+		}
+		logical, err := x.fileInfo(name, info)
+		if err != nil {
+			return err
+		}
+		physical, err := stored.Lstat(name)
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		usage.Files++
+		usage.PhysicalSize += physical.Size()
+		usage.LogicalSize += logical.Size()
+		if info, ok := logical.(*compressedFileInfo); ok && info.compression != compressedStored {
+			usage.CompressedFiles++
+		}
+		return nil
+	})
+	return usage, err
+}
+
+// compressedStorageOf returns the compressedStorage under any wrappers of a
+// storage.
+func compressedStorageOf(storage Storage) (*compressedStorage, bool) {
+	for {
+		if x, ok := storage.(*compressedStorage); ok {
+			return x, true
+		}
+		wrapper, ok := storage.(storageWrapper)
+		if !ok {
+			return nil, false
+		}
+		storage = wrapper.Unwrap()
+	}
+}
+
+// isUsageRequest reports whether the request is for the usage endpoint.
+func isUsageRequest(r *http.Request) bool {
+	return r.URL.Path == usagePath || strings.HasPrefix(r.URL.Path, usagePath+"/")
+}
+
+// handleUsage reports the physical and logical sizes of the files under the
+// path after usagePath.
+func handleUsage(config Config, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeErrorResponse(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	storage, ok := compressedStorageOf(config.Storage)
+	if !ok {
+		notFound(w, fmt.Errorf("compression is not enabled"))
+		return
+	}
+	name := "/" + strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, usagePath), "/")
+	if _, err := storage.Storage.Stat(name); err != nil {
+		writeError(w, err)
+		return
+	}
+	usage, err := storage.usage(name)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	usage.Path = config.urlPath(usage.Path)
+	writeResponse(w, ResponseBody{
+		Status: "ok",
+		Type:   ResponseTypeUsage,
+		Usage:  &usage,
+	})
+}
+
+// compressedFile is an open file of a compressedStorage that is compressed
+// or is kept in memory for writing.
+type compressedFile struct {
+	storage *compressedStorage
+	name    string
+	file    File
+	info    os.FileInfo
+	flag    int
+	header  compressedHeader
+	offset  int64
+	// reader decompresses the file from the start, and is at readerOffset.
+	reader       *compressedReader
+	readerOffset int64
+
+	writable bool
+	data     []byte
+	dirty    bool
+	// unlock unlocks the file opened for writing when it is closed.
+	unlock func()
+}
+
+// compressedReader decompresses the contents of a file.
+type compressedReader struct {
+	file   *compressedFile
+	reader io.Reader
+	close  func()
+}
+
+func (x *compressedReader) Read(p []byte) (int, error) {
+	if x.reader == nil {
+		f := x.file
+		body := io.NewSectionReader(f.file, int64(compressedHeaderSize), f.info.Size()-int64(compressedHeaderSize))
+		switch f.header.compression {
+		case compressedStored:
+			x.reader = body
+		case compressedGzip:
+			r, err := gzip.NewReader(body)
+			if err != nil {
+				return 0, err
+			}
+			x.reader = r
+		case compressedZstd:
+			r, err := zstd.NewReader(body, zstd.WithDecoderConcurrency(1))
+			if err != nil {
+				return 0, err
+			}
+			x.reader, x.close = r, r.Close
+		default:
+			return 0, f.storage.pathError("read", f.name, fmt.Errorf("unknown compression %d", f.header.compression))
+		}
+		x.reader = io.LimitReader(x.reader, f.header.size)
+	}
+	return x.reader.Read(p)
+}
+
+func (x *compressedReader) Close() {
+	if x.close != nil {
+		x.close()
+	}
+}
+
+func (x *compressedFile) Read(p []byte) (int, error) {
+	n, err := x.ReadAt(p, x.offset)
+	x.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (x *compressedFile) ReadAt(p []byte, offset int64) (int, error) {
+	if offset < 0 {
+		return 0, x.storage.pathError("read", x.name, syscall.EINVAL)
+	}
+	if x.writable {
+		if x.flag&os.O_WRONLY != 0 {
+			return 0, x.storage.pathError("read", x.name, syscall.EBADF)
+		}
+		if offset >= int64(len(x.data)) {
+			return 0, io.EOF
+		}
+		n := copy(p, x.data[offset:])
+		if n < len(p) {
+			return n, io.EOF
+		}
+		return n, nil
+	}
+
+	if x.reader == nil || offset < x.readerOffset {
+		if x.reader != nil {
+			x.reader.Close()
+		}
+		x.reader, x.readerOffset = &compressedReader{file: x}, 0
+	}
+	if offset > x.readerOffset {
+		n, err := io.CopyN(io.Discard, x.reader, offset-x.readerOffset)
+		x.readerOffset += n
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := io.ReadFull(x.reader, p)
+	x.readerOffset += int64(n)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (x *compressedFile) Write(p []byte) (int, error) {
+	if x.flag&os.O_APPEND != 0 {
+		x.offset = int64(len(x.data))
+	}
+	n, err := x.WriteAt(p, x.offset)
+	x.offset += int64(n)
+	return n, err
+}
+
+func (x *compressedFile) WriteAt(p []byte, offset int64) (int, error) {
+	if !x.writable {
+		return 0, x.storage.pathError("write", x.name, syscall.EBADF)
+	}
+	if offset < 0 {
+		return 0, x.storage.pathError("write", x.name, syscall.EINVAL)
+	}
+	if end := offset + int64(len(p)); end > int64(len(x.data)) {
+		x.data = append(x.data, make([]byte, end-int64(len(x.data)))...)
+	}
+	x.dirty = true
+	return copy(x.data[offset:], p), nil
+}
+
+func (x *compressedFile) Seek(offset int64, whence int) (int64, error) {
+	size := x.header.size
+	if x.writable {
+		size = int64(len(x.data))
+	}
+	switch whence {
+	case io.SeekCurrent:
+		offset += x.offset
+	case io.SeekEnd:
+		offset += size
+	}
+	if offset < 0 {
+		return 0, x.storage.pathError("seek", x.name, syscall.EINVAL)
+	}
+	x.offset = offset
+	return offset, nil
+}
+
+func (x *compressedFile) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, x.storage.pathError("readdirent", x.name, syscall.ENOTDIR)
+}
+
+func (x *compressedFile) Stat() (os.FileInfo, error) {
+	if x.writable {
+		return &compressedFileInfo{x.info, int64(len(x.data)), x.header.compression}, nil
+	}
+	return &compressedFileInfo{x.info, x.header.size, x.header.compression}, nil
+}
+
+// Close stores the contents of a changed file.
+func (x *compressedFile) Close() error {
+	if x.unlock != nil {
+		unlock := x.unlock
+		x.unlock = nil
+		defer unlock()
+	}
+	if x.reader != nil {
+		x.reader.Close()
+	}
+	// The file is closed before it is replaced, since closing a file of a
+	// wrapped storage can write it too.
+	if err := x.file.Close(); err != nil || !x.writable || !x.dirty {
+		return err
+	}
+	return x.storage.write(x.name, x.data)
+}
+
+// compressedRawFile is a file outside the policy of a compressedStorage
+// opened for writing, which is written as is.
+type compressedRawFile struct {
+	File
+	storage *compressedStorage
+	name    string
+	// unlock unlocks the file when it is closed.
+	unlock func()
+}
+
+// Close stores the file with a header if it starts like one.
+func (x *compressedRawFile) Close() error {
+	if x.unlock != nil {
+		unlock := x.unlock
+		x.unlock = nil
+		defer unlock()
+	}
+	start := make([]byte, len(compressedMagic))
+	_, err := x.File.ReadAt(start, 0)
+	if err := x.File.Close(); err != nil {
+		return err
+	}
+	if err != nil || string(start) != compressedMagic {
+		return nil
+	}
+	data, err := readFile(x.storage.Storage, x.name)
+	if err != nil {
+		return err
+	}
+	return x.storage.write(x.name, data)
+}
+
+// compressedDirFile is an open directory of a compressedStorage, which lists
+// the files with the sizes of their contents.
+type compressedDirFile struct {
+	File
+	storage *compressedStorage
+	name    string
+}
+
+func (x *compressedDirFile) Readdir(count int) ([]os.FileInfo, error) {
+	infos, err := x.File.Readdir(count)
+	for i, info := range infos {
+		if info.Mode().IsRegular() {
+			if infos[i], err = x.storage.fileInfo(path.Join(x.name, info.Name()), info); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return infos, err
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestCompressedStorage(t *testing.T) {
+	logs := []byte(strings.Repeat("GET /index.html 200\n", 5000))
+
+	for _, compression := range []string{CompressionGzip, CompressionZstd} {
+		t.Run(compression, func(t *testing.T) {
+			disk := newMemStorage(ContentRoot)
+			storage, err := newCompressedStorage(disk, ContentRoot, compression, []string{"*.log", "logs/*"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := writeFile(storage, "/app.log", logs, 0640); err != nil {
+				t.Fatal(err)
+			}
+
+			stored, err := disk.Stat("/app.log")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stored.Size() >= int64(len(logs))/10 {
+				t.Errorf("got stored size %d of %d bytes", stored.Size(), len(logs))
+			}
+			info, err := storage.Stat("/app.log")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Size() != int64(len(logs)) || info.Mode() != 0640 {
+				t.Errorf("got size %d and mode %v", info.Size(), info.Mode())
+			}
+			entries, err := storage.ReadDir("/")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info, _ := entries[0].Info(); info.Size() != int64(len(logs)) {
+				t.Errorf("got listed size %d", info.Size())
+			}
+			if got, err := readFile(storage, "/app.log"); err != nil || !bytes.Equal(got, logs) {
+				t.Errorf("got other contents than written: %v", err)
+			}
+
+			f, err := storage.Open("/app.log")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			for _, offset := range []int64{60000, 20, 99990} {
+				p := make([]byte, 20)
+				n, err := f.ReadAt(p, offset)
+				if err != nil && err != io.EOF {
+					t.Fatal(err)
+				}
+				if want := logs[offset:min(int64(len(logs)), offset+20)]; !bytes.Equal(p[:n], want) {
+					t.Errorf("got %q at %d, want %q", p[:n], offset, want)
+				}
+			}
+		})
+	}
+
+	t.Run("policy", func(t *testing.T) {
+		disk := newMemStorage(ContentRoot)
+		storage, err := newCompressedStorage(disk, ContentRoot, CompressionGzip, []string{"*.log"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for name, contents := range map[string][]byte{
+			"/notes.txt":  logs,
+			"/small.log":  []byte("ok\n"),
+			"/header.txt": []byte(compressedMagic + "\x01 not really\n"),
+		} {
+			if err := writeFile(storage, name, contents, 0644); err != nil {
+				t.Fatal(err)
+			}
+			stored, err := readFile(disk, name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if name == "/header.txt" {
+				if !bytes.HasSuffix(stored, contents) || len(stored) != len(contents)+compressedHeaderSize {
+					t.Errorf("got %q stored for a file that starts like a header", stored)
+				}
+			} else if !bytes.Equal(stored, contents) {
+				t.Errorf("got %s compressed", name)
+			}
+			if got, err := readFile(storage, name); err != nil || !bytes.Equal(got, contents) {
+				t.Errorf("got contents %q of %s, %v", got, name, err)
+			}
+		}
+	})
+
+	t.Run("writes", func(t *testing.T) {
+		storage, err := newCompressedStorage(newMemStorage(ContentRoot), ContentRoot, CompressionZstd, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := writeFile(storage, "/app.log", logs, 0644); err != nil {
+			t.Fatal(err)
+		}
+		f, err := storage.OpenFile("/app.log", os.O_WRONLY|os.O_APPEND, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Write([]byte("done\n")); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+		want := append(append([]byte(nil), logs...), "done\n"...)
+		if got, err := readFile(storage, "/app.log"); err != nil || !bytes.Equal(got, want) {
+			t.Errorf("got other appended contents: %v", err)
+		}
+		if err := storage.Truncate("/app.log", 20); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := readFile(storage, "/app.log"); err != nil || string(got) != "GET /index.html 200\n" {
+			t.Errorf("got truncated contents %q, %v", got, err)
+		}
+	})
+
+	t.Run("appends are serialized", func(t *testing.T) {
+		disk := newMemStorage(ContentRoot)
+		storage, err := newCompressedStorage(disk, ContentRoot, CompressionGzip, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := writeFile(storage, "/app.log", logs, 0640); err != nil {
+			t.Fatal(err)
+		}
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				f, err := storage.OpenFile("/app.log", os.O_WRONLY|os.O_APPEND, 0)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				f.Write([]byte("done\n"))
+				if err := f.Close(); err != nil {
+					t.Error(err)
+				}
+			}()
+		}
+		wg.Wait()
+		want := append(append([]byte(nil), logs...), strings.Repeat("done\n", 10)...)
+		if got, err := readFile(storage, "/app.log"); err != nil || !bytes.Equal(got, want) {
+			t.Errorf("got other appended contents: %v", err)
+		}
+		if info, err := disk.Stat("/app.log"); err != nil || info.Mode() != 0640 {
+			t.Errorf("got file %v, %v", info, err)
+		}
+		if entries, err := disk.ReadDir("/"); err != nil || len(entries) != 1 {
+			t.Errorf("got %d files, %v, want only app.log", len(entries), err)
+		}
+	})
+}
+
+func TestUsage(t *testing.T) {
+	disk := newMemStorage(ContentRoot)
+	storage, err := newCompressedStorage(disk, ContentRoot, CompressionGzip, []string{"*.log"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.MkdirAll("/logs", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFile(storage, "/logs/app.log", []byte(strings.Repeat("a", 1000)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFile(storage, "/logs/notes.txt", []byte("notes\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFile(storage, "/other.txt", []byte("other\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := disk.Stat("/logs/app.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := newConfig(ContentRoot)
+	config.Storage = storage
+	handler := httpHandler(config)
+	runTest := func(t *testing.T, target string, wantStatus int, wantBody string) {
+		t.Helper()
+		responseRecorder := httptest.NewRecorder()
+		handler.ServeHTTP(responseRecorder, httptest.NewRequest(http.MethodGet, target, nil))
+		assertHttpResponse(t, responseRecorder.Result(), wantStatus, wantBody)
+	}
+
+	t.Run("usage of a directory", func(t *testing.T) {
+		runTest(t, "/.usage/logs", http.StatusOK, `{
+		  "status": "ok",
+		  "type": "usage",
+		  "usage": {
+		    "path": "/logs",
+		    "files": 2,
+		    "compressed_files": 1,
+		    "logical_size": 1006,
+		    "physical_size": `+strconv.FormatInt(stored.Size()+6, 10)+`
+		  }
+		}`)
+	})
+
+	t.Run("usage of encrypted files", func(t *testing.T) {
+		key, err := newEncryptionKey(bytes.Repeat([]byte{1}, encryptionKeySize))
+		if err != nil {
+			t.Fatal(err)
+		}
+		disk := newMemStorage(ContentRoot)
+		storage, err := newCompressedStorage(newEncryptedStorage(disk, ContentRoot, []encryptionKey{key}), ContentRoot, CompressionGzip, []string{"*.log"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := writeFile(storage, "/app.log", []byte(strings.Repeat("a", 1000)), 0644); err != nil {
+			t.Fatal(err)
+		}
+		stored, err := disk.Stat("/app.log")
+		if err != nil {
+			t.Fatal(err)
+		}
+		usage, err := storage.usage("/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if usage.PhysicalSize != stored.Size() || usage.LogicalSize != 1000 {
+			t.Errorf("got usage %+v, want a physical size of %d", usage, stored.Size())
+		}
+	})
+
+	t.Run("usage of a missing path", func(t *testing.T) {
+		runTest(t, "/.usage/missing", http.StatusNotFound, `{
+		  "status": "error",
+		  "type": "error",
+		  "error": {
+		    "code": 404,
+		    "error": "stat test/missing: no such file or directory"
+		  }
+		}`)
+	})
+}
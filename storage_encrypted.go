@@ -0,0 +1,638 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+)
+
+// encryptedMagic starts the files of an encryptedStorage.
+const encryptedMagic = "FSENC001"
+
+const (
+	encryptionKeySize   = 32
+	encryptionKeyIDSize = 8
+	// encryptedHeaderSize is the size of the magic, the id of the master key,
+	// and the nonce and sealed data key of a file.
+	encryptedHeaderSize = len(encryptedMagic) + encryptionKeyIDSize + 12 + encryptionKeySize + 16
+	// encryptedChunkSize is the size of the plaintext of each sealed chunk.
+	encryptedChunkSize = 64 << 10
+	// encryptedSealedChunkSize is the size of a sealed chunk, with its tag.
+	encryptedSealedChunkSize = encryptedChunkSize + 16
+)
+
+var (
+	errNotEncrypted         = errors.New("file is not encrypted")
+	errUnknownEncryptionKey = errors.New("file is encrypted with an unknown key")
+	errDecryption           = errors.New("file failed authentication")
+)
+
+// encryptionKey is a master key of an encryptedStorage.
+type encryptionKey struct {
+	id   [encryptionKeyIDSize]byte
+	aead cipher.AEAD
+}
+
+func newEncryptionKey(key []byte) (encryptionKey, error) {
+	aead, err := newAESGCM(key)
+	if err != nil {
+		return encryptionKey{}, err
+	}
+	var x encryptionKey
+	sum := sha256.Sum256(key)
+	copy(x.id[:], sum[:])
+	x.aead = aead
+	return x, nil
+}
+
+func newAESGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// loadEncryptionKeys reads the master keys of a key file, one hex encoded
+// 32 byte key per line. The first key encrypts, and the others are older keys
+// that files are rewrapped from. Empty lines and lines starting with # are
+// ignored.
+func loadEncryptionKeys(fileName string) ([]encryptionKey, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	var keys []encryptionKey
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, err := hex.DecodeString(line)
+		if err != nil || len(key) != encryptionKeySize {
+			return nil, fmt.Errorf("%s:%d: keys must be %d hex encoded bytes", fileName, i+1, encryptionKeySize)
+		}
+		k, err := newEncryptionKey(key)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s has no keys", fileName)
+	}
+	return keys, nil
+}
+
+// encryptedStorage encrypts the contents of the files of another storage
+// with AES-256-GCM. Each file has a data key of its own, sealed in its header
+// by a master key, and its contents are sealed in chunks of
+// encryptedChunkSize, so that reads decrypt only the chunks they need.
+//
+// The chunks are authenticated with their index and whether they are the
+// last one, so that they can't be reordered or cut off. A file opened for
+// writing is kept in memory, and gets a new data key when it is closed,
+// when it replaces the file. Directories, symlinks, modes, owners and
+// extended attributes are not encrypted.
+type encryptedStorage struct {
+	Storage
+	// root names the storage in errors.
+	root string
+	// keys are the master keys, the first of which seals new data keys.
+	keys []encryptionKey
+	// locks serializes the changes to each file, which are read, changed in
+	// memory and rewritten.
+	locks fileLocks
+}
+
+func newEncryptedStorage(storage Storage, root string, keys []encryptionKey) *encryptedStorage {
+	return &encryptedStorage{Storage: storage, root: root, keys: keys}
+}
+
+// newEncryptedStorageFromKeyFile encrypts storage with the keys of a key
+// file, after rewrapping the files sealed with older keys.
+func newEncryptedStorageFromKeyFile(storage Storage, root, keyFile string) (*encryptedStorage, error) {
+	keys, err := loadEncryptionKeys(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	x := newEncryptedStorage(storage, root, keys)
+	if len(keys) > 1 {
+		rewrapped, err := x.rewrap()
+		if err != nil {
+			return nil, err
+		}
+		if rewrapped > 0 {
+			log.Printf("rewrapped the data keys of %d files of %s", rewrapped, root)
+		}
+	}
+	return x, nil
+}
+
+func (x *encryptedStorage) Unwrap() Storage {
+	return x.Storage
+}
+
+func (x *encryptedStorage) pathError(op, name string, err error) error {
+	return &os.PathError{Op: op, Path: path.Join(x.root, path.Clean("/"+name)), Err: err}
+}
+
+// encryptedPlainSize returns the size of the plaintext of a file from its
+// size on the storage.
+func encryptedPlainSize(size int64) int64 {
+	body := size - int64(encryptedHeaderSize)
+	if body <= 0 {
+		return 0
+	}
+	chunks := (body + encryptedSealedChunkSize - 1) / encryptedSealedChunkSize
+	if plain := body - chunks*16; plain > 0 {
+		return plain
+	}
+	return 0
+}
+
+// encryptedFileInfo is the info of a file with the size of its plaintext.
+type encryptedFileInfo struct {
+	os.FileInfo
+	size int64
+}
+
+func (x *encryptedFileInfo) Size() int64 { return x.size }
+func (x *encryptedFileInfo) Uid() uint32 { uid, _ := fileOwner(x.FileInfo); return uid }
+func (x *encryptedFileInfo) Gid() uint32 { _, gid := fileOwner(x.FileInfo); return gid }
+
+func encryptedInfo(info os.FileInfo) os.FileInfo {
+	if !info.Mode().IsRegular() {
+		return info
+	}
+	return &encryptedFileInfo{info, encryptedPlainSize(info.Size())}
+}
+
+func (x *encryptedStorage) Stat(name string) (os.FileInfo, error) {
+	info, err := x.Storage.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	return encryptedInfo(info), nil
+}
+
+func (x *encryptedStorage) Lstat(name string) (os.FileInfo, error) {
+	info, err := x.Storage.Lstat(name)
+	if err != nil {
+		return nil, err
+	}
+	return encryptedInfo(info), nil
+}
+
+func (x *encryptedStorage) ReadDir(name string) ([]os.DirEntry, error) {
+	entries, err := x.Storage.ReadDir(name)
+	if err != nil {
+		return nil, err
+	}
+	for i, entry := range entries {
+		if entry.Type().IsRegular() {
+			info, err := entry.Info()
+			if err != nil {
+				return nil, err
+			}
+			entries[i] = dirEntry{encryptedInfo(info)}
+		}
+	}
+	return entries, nil
+}
+
+func (x *encryptedStorage) Open(name string) (File, error) {
+	return x.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (x *encryptedStorage) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	writable := flag&(os.O_WRONLY|os.O_RDWR) != 0
+	underlyingFlag := flag &^ (os.O_TRUNC | os.O_APPEND)
+	if writable {
+		// The contents are read to decrypt them, and rewritten on close.
+		underlyingFlag = underlyingFlag&^os.O_WRONLY | os.O_RDWR
+	}
+	unlock := func() {}
+	if writable {
+		unlock = x.locks.lock(name)
+	}
+	f, err := x.Storage.OpenFile(name, underlyingFlag, perm)
+	if err != nil {
+		unlock()
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		unlock()
+		return nil, err
+	}
+	if info.IsDir() {
+		unlock()
+		return &encryptedDirFile{f}, nil
+	}
+	file := &encryptedFile{storage: x, name: name, file: f, info: info, flag: flag, unlock: unlock}
+	if info.Size() > 0 && !(writable && flag&os.O_TRUNC != 0) {
+		if file.aead, err = x.readHeader(name, f); err != nil {
+			f.Close()
+			unlock()
+			return nil, err
+		}
+		file.size = encryptedPlainSize(info.Size())
+	}
+	if !writable {
+		return file, nil
+	}
+
+	file.writable = true
+	// New files are written on close, to seal their empty contents.
+	file.dirty = info.Size() == 0 || flag&os.O_TRUNC != 0
+	if file.aead != nil {
+		file.data = make([]byte, file.size)
+		if _, err := file.readAt(file.data, 0); err != nil && err != io.EOF {
+			f.Close()
+			unlock()
+			return nil, err
+		}
+	}
+	file.size = 0
+	if flag&os.O_APPEND != 0 {
+		file.offset = int64(len(file.data))
+	}
+	return file, nil
+}
+
+// readHeader unseals the data key of a file.
+func (x *encryptedStorage) readHeader(name string, f File) (cipher.AEAD, error) {
+	header := make([]byte, encryptedHeaderSize)
+	if _, err := f.ReadAt(header, 0); err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil, x.pathError("open", name, errNotEncrypted)
+	} else if err != nil {
+		return nil, err
+	}
+	key, err := x.unsealKey(header)
+	if err != nil {
+		return nil, x.pathError("open", name, err)
+	}
+	return newAESGCM(key)
+}
+
+// unsealKey returns the data key sealed in a header.
+func (x *encryptedStorage) unsealKey(header []byte) ([]byte, error) {
+	if string(header[:len(encryptedMagic)]) != encryptedMagic {
+		return nil, errNotEncrypted
+	}
+	id := header[len(encryptedMagic) : len(encryptedMagic)+encryptionKeyIDSize]
+	for _, key := range x.keys {
+		if bytes.Equal(key.id[:], id) {
+			nonce := header[len(encryptedMagic)+encryptionKeyIDSize:][:key.aead.NonceSize()]
+			sealed := header[len(encryptedMagic)+encryptionKeyIDSize+len(nonce):]
+			data, err := key.aead.Open(nil, nonce, sealed, header[:len(encryptedMagic)+encryptionKeyIDSize])
+			if err != nil {
+				return nil, errDecryption
+			}
+			return data, nil
+		}
+	}
+	return nil, errUnknownEncryptionKey
+}
+
+// sealKey returns the header of a file with a data key sealed by the current
+// master key.
+func (x *encryptedStorage) sealKey(dataKey []byte) ([]byte, error) {
+	key := x.keys[0]
+	header := make([]byte, 0, encryptedHeaderSize)
+	header = append(header, encryptedMagic...)
+	header = append(header, key.id[:]...)
+	nonce := make([]byte, key.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	header = append(header, nonce...)
+	return key.aead.Seal(header, nonce, dataKey, header[:len(encryptedMagic)+encryptionKeyIDSize]), nil
+}
+
+// encryptedChunkNonce returns the nonce and additional data of a chunk. The
+// nonce is the index of the chunk, since each data key seals the chunks of
+// one version of a file.
+func encryptedChunkNonce(index int64, last bool) (nonce, ad []byte) {
+	nonce = make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[4:], uint64(index))
+	ad = make([]byte, 9)
+	binary.BigEndian.PutUint64(ad, uint64(index))
+	if last {
+		ad[8] = 1
+	}
+	return nonce, ad
+}
+
+// write seals the contents of a file with a new data key, and replaces the
+// file with them.
+func (x *encryptedStorage) write(name string, data []byte) error {
+	dataKey := make([]byte, encryptionKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return err
+	}
+	aead, err := newAESGCM(dataKey)
+	if err != nil {
+		return err
+	}
+	header, err := x.sealKey(dataKey)
+	if err != nil {
+		return err
+	}
+
+	return replaceFile(x.Storage, name, func(f File) error {
+		sealed := header
+		for index := int64(0); ; index++ {
+			chunk := data[min(len(data), int(index)*encryptedChunkSize):min(len(data), int(index+1)*encryptedChunkSize)]
+			last := (index+1)*encryptedChunkSize >= int64(len(data))
+			nonce, ad := encryptedChunkNonce(index, last)
+			sealed = aead.Seal(sealed, nonce, chunk, ad)
+			if len(sealed) >= 1<<20 || last {
+				if _, err := f.Write(sealed); err != nil {
+					return err
+				}
+				sealed = sealed[:0]
+			}
+			if last {
+				return nil
+			}
+		}
+	})
+}
+
+// rewrap seals the data keys of the files sealed with older master keys
+// with the current one, keeping their modification times. It returns how
+// many files it rewrapped.
+func (x *encryptedStorage) rewrap() (int, error) {
+	rewrapped := 0
+	err := walkStorage(x.Storage, "/", func(name string, info os.FileInfo, err error) error {
+		switch {
+		case os.IsNotExist(err):
+			return nil
+		case err != nil:
+			return err
+		case !info.Mode().IsRegular() || info.Size() == 0:
+			return nil
+		}
+		ok, err := x.rewrapFile(name, info)
+		if ok {
+			rewrapped++
+		}
+		return err
+	})
+	return rewrapped, err
+}
+
+func (x *encryptedStorage) rewrapFile(name string, info os.FileInfo) (bool, error) {
+	defer x.locks.lock(name)()
+	f, err := x.Storage.Open(name)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	header := make([]byte, encryptedHeaderSize)
+	if _, err := f.ReadAt(header, 0); err != nil {
+		return false, x.pathError("rewrap", name, errNotEncrypted)
+	}
+	if bytes.Equal(header[len(encryptedMagic):][:encryptionKeyIDSize], x.keys[0].id[:]) {
+		return false, nil
+	}
+	dataKey, err := x.unsealKey(header)
+	if err != nil {
+		return false, x.pathError("rewrap", name, err)
+	}
+	if header, err = x.sealKey(dataKey); err != nil {
+		return false, err
+	}
+	// Only the header changes, and the chunks are copied as they are.
+	err = replaceFile(x.Storage, name, func(tmp File) error {
+		if _, err := tmp.Write(header); err != nil {
+			return err
+		}
+		_, err := io.Copy(tmp, io.NewSectionReader(f, int64(encryptedHeaderSize), info.Size()-int64(encryptedHeaderSize)))
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+	return true, x.Storage.Chtimes(name, info.ModTime(), info.ModTime())
+}
+
+// Truncate rewrites the truncated contents with a new data key.
+func (x *encryptedStorage) Truncate(name string, size int64) error {
+	f, err := x.OpenFile(name, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	ef, ok := f.(*encryptedFile)
+	if !ok {
+		f.Close()
+		return x.pathError("truncate", name, syscall.EISDIR)
+	}
+	if size < 0 {
+		f.Close()
+		return x.pathError("truncate", name, syscall.EINVAL)
+	}
+	if size <= int64(len(ef.data)) {
+		ef.data = ef.data[:size]
+	} else {
+		ef.data = append(ef.data, make([]byte, size-int64(len(ef.data)))...)
+	}
+	ef.dirty = true
+	return ef.Close()
+}
+
+// encryptedFile is an open file of an encryptedStorage. Files opened for
+// reading decrypt the chunks they read, and files opened for writing keep
+// their plaintext in data.
+type encryptedFile struct {
+	storage *encryptedStorage
+	name    string
+	file    File
+	info    os.FileInfo
+	flag    int
+	aead    cipher.AEAD
+	// size is the size of the plaintext of a file opened for reading.
+	size   int64
+	offset int64
+	// chunk is the last chunk read, with its index.
+	chunk      []byte
+	chunkIndex int64
+
+	writable bool
+	data     []byte
+	dirty    bool
+	// unlock unlocks the file opened for writing when it is closed.
+	unlock func()
+}
+
+// readChunk decrypts a chunk of a file opened for reading.
+func (x *encryptedFile) readChunk(index int64) ([]byte, error) {
+	if x.chunk != nil && x.chunkIndex == index {
+		return x.chunk, nil
+	}
+	chunks := (x.size + encryptedChunkSize - 1) / encryptedChunkSize
+	if chunks == 0 {
+		chunks = 1
+	}
+	size := int64(encryptedSealedChunkSize)
+	if index == chunks-1 {
+		size = x.size - index*encryptedChunkSize + 16
+	}
+	sealed := make([]byte, size)
+	if _, err := x.file.ReadAt(sealed, int64(encryptedHeaderSize)+index*encryptedSealedChunkSize); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	nonce, ad := encryptedChunkNonce(index, index == chunks-1)
+	chunk, err := x.aead.Open(sealed[:0], nonce, sealed, ad)
+	if err != nil {
+		return nil, x.storage.pathError("read", x.name, errDecryption)
+	}
+	x.chunk, x.chunkIndex = chunk, index
+	return chunk, nil
+}
+
+func (x *encryptedFile) readAt(p []byte, offset int64) (int, error) {
+	n := 0
+	for n < len(p) {
+		if offset >= x.size {
+			return n, io.EOF
+		}
+		index := offset / encryptedChunkSize
+		chunk, err := x.readChunk(index)
+		if err != nil {
+			return n, err
+		}
+		copied := copy(p[n:], chunk[offset-index*encryptedChunkSize:])
+		n += copied
+		offset += int64(copied)
+	}
+	return n, nil
+}
+
+func (x *encryptedFile) Read(p []byte) (int, error) {
+	n, err := x.ReadAt(p, x.offset)
+	x.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (x *encryptedFile) ReadAt(p []byte, offset int64) (int, error) {
+	if x.writable {
+		if x.flag&os.O_WRONLY != 0 {
+			return 0, x.storage.pathError("read", x.name, syscall.EBADF)
+		}
+		if offset >= int64(len(x.data)) {
+			return 0, io.EOF
+		}
+		n := copy(p, x.data[offset:])
+		if n < len(p) {
+			return n, io.EOF
+		}
+		return n, nil
+	}
+	if offset < 0 {
+		return 0, x.storage.pathError("read", x.name, syscall.EINVAL)
+	}
+	return x.readAt(p, offset)
+}
+
+func (x *encryptedFile) Write(p []byte) (int, error) {
+	if x.flag&os.O_APPEND != 0 {
+		x.offset = int64(len(x.data))
+	}
+	n, err := x.WriteAt(p, x.offset)
+	x.offset += int64(n)
+	return n, err
+}
+
+func (x *encryptedFile) WriteAt(p []byte, offset int64) (int, error) {
+	if !x.writable {
+		return 0, x.storage.pathError("write", x.name, syscall.EBADF)
+	}
+	if offset < 0 {
+		return 0, x.storage.pathError("write", x.name, syscall.EINVAL)
+	}
+	if end := offset + int64(len(p)); end > int64(len(x.data)) {
+		x.data = append(x.data, make([]byte, end-int64(len(x.data)))...)
+	}
+	x.dirty = true
+	return copy(x.data[offset:], p), nil
+}
+
+func (x *encryptedFile) Seek(offset int64, whence int) (int64, error) {
+	size := x.size
+	if x.writable {
+		size = int64(len(x.data))
+	}
+	switch whence {
+	case io.SeekCurrent:
+		offset += x.offset
+	case io.SeekEnd:
+		offset += size
+	}
+	if offset < 0 {
+		return 0, x.storage.pathError("seek", x.name, syscall.EINVAL)
+	}
+	x.offset = offset
+	return offset, nil
+}
+
+func (x *encryptedFile) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, x.storage.pathError("readdirent", x.name, syscall.ENOTDIR)
+}
+
+func (x *encryptedFile) Stat() (os.FileInfo, error) {
+	if x.writable {
+		return &encryptedFileInfo{x.info, int64(len(x.data))}, nil
+	}
+	return &encryptedFileInfo{x.info, x.size}, nil
+}
+
+// Close seals the contents of a changed file.
+func (x *encryptedFile) Close() error {
+	unlock := x.unlock
+	x.unlock = func() {}
+	defer unlock()
+	if x.writable && x.dirty {
+		if err := x.storage.write(x.name, x.data); err != nil {
+			x.file.Close()
+			return err
+		}
+	}
+	return x.file.Close()
+}
+
+// encryptedDirFile is an open directory of an encryptedStorage, which lists
+// the files with the sizes of their plaintext.
+type encryptedDirFile struct {
+	File
+}
+
+func (x *encryptedDirFile) Readdir(count int) ([]os.FileInfo, error) {
+	infos, err := x.File.Readdir(count)
+	for i, info := range infos {
+		infos[i] = encryptedInfo(info)
+	}
+	return infos, err
+}
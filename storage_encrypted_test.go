@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestEncryptedStorage(t *testing.T) {
+	newKey := func(t *testing.T, b byte) encryptionKey {
+		t.Helper()
+		key, err := newEncryptionKey(bytes.Repeat([]byte{b}, encryptionKeySize))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return key
+	}
+	contents := bytes.Repeat([]byte("0123456789abcdef"), encryptedChunkSize/16*2+100)
+
+	t.Run("files are encrypted", func(t *testing.T) {
+		disk := newMemStorage(ContentRoot)
+		storage := newEncryptedStorage(disk, ContentRoot, []encryptionKey{newKey(t, 1)})
+		if err := writeFile(storage, "/file.bin", contents, 0640); err != nil {
+			t.Fatal(err)
+		}
+
+		sealed, err := readFile(disk, "/file.bin")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(sealed, []byte("0123456789abcdef")) {
+			t.Error("got the plaintext in the underlying storage")
+		}
+		info, err := storage.Stat("/file.bin")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() != int64(len(contents)) || info.Mode() != 0640 {
+			t.Errorf("got size %d and mode %v", info.Size(), info.Mode())
+		}
+		entries, err := storage.ReadDir("/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info, _ := entries[0].Info(); info.Size() != int64(len(contents)) {
+			t.Errorf("got listed size %d", info.Size())
+		}
+		got, err := readFile(storage, "/file.bin")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, contents) {
+			t.Error("got other contents than written")
+		}
+	})
+
+	t.Run("ranges are read", func(t *testing.T) {
+		storage := newEncryptedStorage(newMemStorage(ContentRoot), ContentRoot, []encryptionKey{newKey(t, 1)})
+		if err := writeFile(storage, "/file.bin", contents, 0644); err != nil {
+			t.Fatal(err)
+		}
+		f, err := storage.Open("/file.bin")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		for _, offset := range []int64{0, encryptedChunkSize - 3, 2*encryptedChunkSize + 90} {
+			p := make([]byte, 20)
+			n, err := f.ReadAt(p, offset)
+			if err != nil && err != io.EOF {
+				t.Fatal(err)
+			}
+			if want := contents[offset:min(int64(len(contents)), offset+20)]; !bytes.Equal(p[:n], want) {
+				t.Errorf("got %q at %d, want %q", p[:n], offset, want)
+			}
+		}
+		if _, err := f.Seek(-10, io.SeekEnd); err != nil {
+			t.Fatal(err)
+		}
+		if tail, err := io.ReadAll(f); err != nil || !bytes.Equal(tail, contents[len(contents)-10:]) {
+			t.Errorf("got tail %q, %v", tail, err)
+		}
+	})
+
+	t.Run("changes are authenticated", func(t *testing.T) {
+		disk := newMemStorage(ContentRoot)
+		storage := newEncryptedStorage(disk, ContentRoot, []encryptionKey{newKey(t, 1)})
+		if err := writeFile(storage, "/file.bin", contents, 0644); err != nil {
+			t.Fatal(err)
+		}
+		sealed, err := readFile(disk, "/file.bin")
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Without the last chunk, the one before can't pass for the last.
+		if err := disk.Truncate("/file.bin", int64(encryptedHeaderSize+2*encryptedSealedChunkSize)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := readFile(storage, "/file.bin"); err == nil || !strings.HasSuffix(err.Error(), errDecryption.Error()) {
+			t.Errorf("got error %v reading a cut off file", err)
+		}
+		sealed[len(sealed)-1] ^= 1
+		if err := writeFile(disk, "/file.bin", sealed, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := readFile(storage, "/file.bin"); err == nil || !strings.HasSuffix(err.Error(), errDecryption.Error()) {
+			t.Errorf("got error %v reading a changed file", err)
+		}
+		if err := writeFile(disk, "/plain.txt", []byte("hello\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := readFile(storage, "/plain.txt"); err == nil || err.Error() != "open test/plain.txt: file is not encrypted" {
+			t.Errorf("got error %v reading a plaintext file", err)
+		}
+	})
+
+	t.Run("writes", func(t *testing.T) {
+		storage := newEncryptedStorage(newMemStorage(ContentRoot), ContentRoot, []encryptionKey{newKey(t, 1)})
+		if err := writeFile(storage, "/file.txt", []byte("hello\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		f, err := storage.OpenFile("/file.txt", os.O_WRONLY|os.O_APPEND, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Write([]byte("world\n")); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := readFile(storage, "/file.txt"); err != nil || string(got) != "hello\nworld\n" {
+			t.Errorf("got appended contents %q, %v", got, err)
+		}
+		if err := storage.Truncate("/file.txt", 5); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := readFile(storage, "/file.txt"); err != nil || string(got) != "hello" {
+			t.Errorf("got truncated contents %q, %v", got, err)
+		}
+		if err := writeFile(storage, "/empty.txt", nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if info, err := storage.Stat("/empty.txt"); err != nil || info.Size() != 0 {
+			t.Errorf("got empty file %v, %v", info, err)
+		}
+		if got, err := readFile(storage, "/empty.txt"); err != nil || len(got) != 0 {
+			t.Errorf("got empty contents %q, %v", got, err)
+		}
+	})
+
+	t.Run("appends are serialized", func(t *testing.T) {
+		storage := newEncryptedStorage(newMemStorage(ContentRoot), ContentRoot, []encryptionKey{newKey(t, 1)})
+		if err := writeFile(storage, "/file.txt", nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				f, err := storage.OpenFile("/file.txt", os.O_WRONLY|os.O_APPEND, 0)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				f.Write([]byte("a"))
+				if err := f.Close(); err != nil {
+					t.Error(err)
+				}
+			}()
+		}
+		wg.Wait()
+		if got, err := readFile(storage, "/file.txt"); err != nil || string(got) != strings.Repeat("a", 10) {
+			t.Errorf("got appended contents %q, %v", got, err)
+		}
+	})
+
+	t.Run("files are replaced", func(t *testing.T) {
+		mem := newMemStorage(ContentRoot)
+		storage := newEncryptedStorage(mem, ContentRoot, []encryptionKey{newKey(t, 1)})
+		if err := writeFile(storage, "/file.txt", []byte("hello\n"), 0640); err != nil {
+			t.Fatal(err)
+		}
+		if err := mem.SetXattr("/file.txt", "user.test", []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+		if err := writeFile(storage, "/file.txt", []byte("world\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		rotated := newEncryptedStorage(mem, ContentRoot, []encryptionKey{newKey(t, 2), newKey(t, 1)})
+		if _, err := rotated.rewrap(); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := readFile(rotated, "/file.txt"); err != nil || string(got) != "world\n" {
+			t.Errorf("got contents %q, %v", got, err)
+		}
+		if info, err := mem.Stat("/file.txt"); err != nil || info.Mode().Perm() != 0640 {
+			t.Errorf("got file %v, %v", info, err)
+		}
+		if value, err := mem.GetXattr("/file.txt", "user.test"); err != nil || string(value) != "value" {
+			t.Errorf("got xattr %q, %v", value, err)
+		}
+		entries, err := mem.ReadDir("/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 1 {
+			t.Errorf("got %d files, want only file.txt", len(entries))
+		}
+	})
+
+	t.Run("keys are rotated", func(t *testing.T) {
+		disk := newMemStorage(ContentRoot)
+		oldKey, newKey := newKey(t, 1), newKey(t, 2)
+		storage := newEncryptedStorage(disk, ContentRoot, []encryptionKey{oldKey})
+		if err := writeFile(storage, "/file.bin", contents, 0644); err != nil {
+			t.Fatal(err)
+		}
+		before, err := disk.Stat("/file.bin")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rotated := newEncryptedStorage(disk, ContentRoot, []encryptionKey{newKey, oldKey})
+		rewrapped, err := rotated.rewrap()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rewrapped != 1 {
+			t.Errorf("rewrapped %d files, want 1", rewrapped)
+		}
+		if rewrapped, err := rotated.rewrap(); err != nil || rewrapped != 0 {
+			t.Errorf("rewrapped %d files again, %v", rewrapped, err)
+		}
+		after, err := disk.Stat("/file.bin")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !after.ModTime().Equal(before.ModTime()) {
+			t.Errorf("got modification time %v, want %v", after.ModTime(), before.ModTime())
+		}
+
+		storage = newEncryptedStorage(disk, ContentRoot, []encryptionKey{newKey})
+		if got, err := readFile(storage, "/file.bin"); err != nil || !bytes.Equal(got, contents) {
+			t.Errorf("got other contents with the new key: %v", err)
+		}
+		storage = newEncryptedStorage(disk, ContentRoot, []encryptionKey{oldKey})
+		if _, err := readFile(storage, "/file.bin"); err == nil || !strings.HasSuffix(err.Error(), errUnknownEncryptionKey.Error()) {
+			t.Errorf("got error %v reading with the old key", err)
+		}
+	})
+}
+
+func TestLoadEncryptionKeys(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		data  string
+		keys  int
+		valid bool
+	}{
+		{"one key", strings.Repeat("ab", 32) + "\n", 1, true},
+		{"rotated", "# current\n" + strings.Repeat("cd", 32) + "\n\n" + strings.Repeat("ab", 32) + "\n", 2, true},
+		{"short key", strings.Repeat("ab", 16) + "\n", 0, false},
+		{"not hex", strings.Repeat("zz", 32) + "\n", 0, false},
+		{"no keys", "# none\n", 0, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			fileName := filepath.Join(t.TempDir(), "keys")
+			if err := ioutil.WriteFile(fileName, []byte(test.data), 0600); err != nil {
+				t.Fatal(err)
+			}
+			keys, err := loadEncryptionKeys(fileName)
+			if valid := err == nil; valid != test.valid {
+				t.Errorf("got error %v", err)
+			}
+			if len(keys) != test.keys {
+				t.Errorf("got %d keys, want %d", len(keys), test.keys)
+			}
+		})
+	}
+}
@@ -0,0 +1,911 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	memRead   = 4
+	memWrite  = 2
+	memSearch = 1
+)
+
+// memStorage keeps the content in memory. It checks permissions and sets
+// owners and timestamps the way the disk does for the user the server runs
+// as, so root may do anything. The root is only the name of the content root
+// in errors, so that they read like those of a diskStorage. Like it, the root
+// directory itself can be removed and made again.
+type memStorage struct {
+	root   string
+	uid    int
+	gid    int
+	groups []int
+	// maxSize limits the size of the contents of all files, like the size of
+	// a tmpfs, if not zero.
+	maxSize int64
+
+	mu  sync.Mutex
+	dir *memNode
+	// size is the size of the contents of the files in the tree.
+	size int64
+}
+
+// memNode is a file, directory or symlink. Open files keep their node, so
+// that they can still be used after the file is removed.
+type memNode struct {
+	mode  os.FileMode
+	uid   int
+	gid   int
+	atime time.Time
+	mtime time.Time
+	data  []byte
+	// removed is set once the node is out of the tree, so that the contents
+	// open files still write to no longer count towards the size.
+	removed bool
+	entries map[string]*memNode
+	target  string
+	xattrs  map[string][]byte
+}
+
+func newMemStorage(root string) *memStorage {
+	groups, _ := os.Getgroups()
+	x := &memStorage{root: root, uid: os.Getuid(), gid: os.Getgid(), groups: groups}
+	x.dir = x.newNode(os.ModeDir | 0755)
+	return x
+}
+
+// fileName returns the name of a file in errors.
+func (x *memStorage) fileName(name string) string {
+	return path.Join(x.root, path.Clean("/"+name))
+}
+
+func (x *memStorage) newNode(mode os.FileMode) *memNode {
+	now := time.Now()
+	node := &memNode{mode: mode &^ storageUmask, uid: x.uid, gid: x.gid, atime: now, mtime: now}
+	if mode.IsDir() {
+		node.entries = make(map[string]*memNode)
+	}
+	return node
+}
+
+// can reports whether the server may access the node in the wanted ways.
+func (x *memStorage) can(node *memNode, want os.FileMode) bool {
+	if x.uid == 0 {
+		return true
+	}
+	perm := node.mode.Perm()
+	switch {
+	case node.uid == x.uid:
+		perm >>= 6
+	case x.inGroup(node.gid):
+		perm >>= 3
+	}
+	return perm&want == want
+}
+
+func (x *memStorage) inGroup(gid int) bool {
+	if gid == x.gid {
+		return true
+	}
+	for _, group := range x.groups {
+		if group == gid {
+			return true
+		}
+	}
+	return false
+}
+
+func (x *memStorage) isOwner(node *memNode) bool {
+	return x.uid == 0 || node.uid == x.uid
+}
+
+// walk returns the node of name. Symlinks on the way are followed, and so is
+// the last one when follow is set. Links can't leave the storage: absolute
+// targets start at its root, and ".." stops there.
+func (x *memStorage) walk(name string, follow bool) (*memNode, error) {
+	if x.dir == nil {
+		return nil, syscall.ENOENT
+	}
+	stack := []*memNode{x.dir}
+	components := memSplit(name)
+	for links := 0; len(components) > 0; {
+		component := components[0]
+		components = components[1:]
+		node := stack[len(stack)-1]
+		if !node.mode.IsDir() {
+			return nil, syscall.ENOTDIR
+		}
+		switch component {
+		case ".":
+			continue
+		case "..":
+			if len(stack) > 1 {
+				stack = stack[:len(stack)-1]
+			}
+			continue
+		}
+		if !x.can(node, memSearch) {
+			return nil, syscall.EACCES
+		}
+		child, ok := node.entries[component]
+		if !ok {
+			return nil, syscall.ENOENT
+		}
+		if child.mode&os.ModeSymlink != 0 && (follow || len(components) > 0) {
+			if links++; links > storageMaxSymlinks {
+				return nil, syscall.ELOOP
+			}
+			if strings.HasPrefix(child.target, "/") {
+				stack = stack[:1]
+			}
+			components = append(memSplit(child.target), components...)
+			continue
+		}
+		stack = append(stack, child)
+	}
+	return stack[len(stack)-1], nil
+}
+
+// walkParent returns the directory name is in and its base name. The base
+// name of the root is empty.
+func (x *memStorage) walkParent(name string) (*memNode, string, error) {
+	name = path.Clean("/" + name)
+	if name == "/" {
+		return nil, "", nil
+	}
+	dir, err := x.walk(path.Dir(name), true)
+	switch {
+	case err != nil:
+		return nil, "", err
+	case !dir.mode.IsDir():
+		return nil, "", syscall.ENOTDIR
+	case !x.can(dir, memSearch):
+		return nil, "", syscall.EACCES
+	}
+	return dir, path.Base(name), nil
+}
+
+func memSplit(name string) []string {
+	var components []string
+	for _, component := range strings.Split(name, "/") {
+		if component != "" {
+			components = append(components, component)
+		}
+	}
+	return components
+}
+
+func (x *memStorage) info(name string, node *memNode) os.FileInfo {
+	info := &storageFileInfo{
+		name:    path.Base(x.fileName(name)),
+		size:    int64(len(node.data)),
+		mode:    node.mode,
+		modTime: node.mtime,
+		uid:     node.uid,
+		gid:     node.gid,
+	}
+	switch {
+	case node.mode.IsDir():
+		// Like the directories of most disk filesystems.
+		info.size = 4096
+	case node.mode&os.ModeSymlink != 0:
+		info.size = int64(len(node.target))
+	}
+	return info
+}
+
+func (x *memStorage) Stat(name string) (os.FileInfo, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	node, err := x.walk(name, true)
+	if err != nil {
+		return nil, &os.PathError{Op: "stat", Path: x.fileName(name), Err: err}
+	}
+	return x.info(name, node), nil
+}
+
+func (x *memStorage) Lstat(name string) (os.FileInfo, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	node, err := x.walk(name, false)
+	if err != nil {
+		return nil, &os.PathError{Op: "lstat", Path: x.fileName(name), Err: err}
+	}
+	return x.info(name, node), nil
+}
+
+func (x *memStorage) Open(name string) (File, error) {
+	return x.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (x *memStorage) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	node, err := x.openFile(name, flag, perm)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: x.fileName(name), Err: err}
+	}
+	return &memFile{storage: x, node: node, name: name, flag: flag}, nil
+}
+
+func (x *memStorage) openFile(name string, flag int, perm os.FileMode) (*memNode, error) {
+	node, err := x.walk(name, true)
+	switch {
+	case err == nil && flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL:
+		return nil, syscall.EEXIST
+	case err == syscall.ENOENT && flag&os.O_CREATE != 0:
+		dir, base, err := x.walkParent(name)
+		switch {
+		case err != nil:
+			return nil, err
+		case dir == nil:
+			return nil, syscall.ENOENT
+		case dir.entries[base] != nil:
+			// A dangling symlink.
+			return nil, syscall.ENOENT
+		case !x.can(dir, memWrite|memSearch):
+			return nil, syscall.EACCES
+		}
+		node = x.newNode(perm.Perm())
+		dir.entries[base] = node
+		dir.mtime = node.mtime
+		return node, nil
+	case err != nil:
+		return nil, err
+	}
+
+	writable := flag&(os.O_WRONLY|os.O_RDWR) != 0
+	switch {
+	case node.mode.IsDir() && writable:
+		return nil, syscall.EISDIR
+	case flag&os.O_WRONLY == 0 && !x.can(node, memRead):
+		return nil, syscall.EACCES
+	case writable && !x.can(node, memWrite):
+		return nil, syscall.EACCES
+	}
+	if writable && flag&os.O_TRUNC != 0 {
+		x.resize(node, 0)
+		node.mtime = time.Now()
+	}
+	return node, nil
+}
+
+func (x *memStorage) ReadDir(name string) ([]os.DirEntry, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	node, err := x.walk(name, true)
+	if err == nil && !node.mode.IsDir() && !x.can(node, memRead) {
+		err = syscall.EACCES
+	}
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: x.fileName(name), Err: err}
+	}
+	if !node.mode.IsDir() {
+		return nil, &os.PathError{Op: "readdirent", Path: x.fileName(name), Err: syscall.ENOTDIR}
+	}
+	if !x.can(node, memRead) {
+		return nil, &os.PathError{Op: "open", Path: x.fileName(name), Err: syscall.EACCES}
+	}
+
+	infos := x.readDir(name, node)
+	entries := make([]os.DirEntry, len(infos))
+	for i, info := range infos {
+		entries[i] = fs.FileInfoToDirEntry(info)
+	}
+	return entries, nil
+}
+
+// readDir returns the infos of the entries of a directory sorted by name.
+func (x *memStorage) readDir(name string, node *memNode) []os.FileInfo {
+	names := make([]string, 0, len(node.entries))
+	for entryName := range node.entries {
+		names = append(names, entryName)
+	}
+	sort.Strings(names)
+	infos := make([]os.FileInfo, len(names))
+	for i, entryName := range names {
+		infos[i] = x.info(path.Join("/", name, entryName), node.entries[entryName])
+	}
+	return infos
+}
+
+func (x *memStorage) Mkdir(name string, perm os.FileMode) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if err := x.mkdir(name, perm); err != nil {
+		return &os.PathError{Op: "mkdir", Path: x.fileName(name), Err: err}
+	}
+	return nil
+}
+
+func (x *memStorage) mkdir(name string, perm os.FileMode) error {
+	dir, base, err := x.walkParent(name)
+	switch {
+	case err != nil:
+		return err
+	case dir == nil && x.dir != nil:
+		return syscall.EEXIST
+	case dir == nil:
+		x.dir = x.newNode(os.ModeDir | perm.Perm())
+		return nil
+	case dir.entries[base] != nil:
+		return syscall.EEXIST
+	case !x.can(dir, memWrite|memSearch):
+		return syscall.EACCES
+	}
+	node := x.newNode(os.ModeDir | perm.Perm())
+	dir.entries[base] = node
+	dir.mtime = node.mtime
+	return nil
+}
+
+// MkdirAll is os.MkdirAll.
+func (x *memStorage) MkdirAll(name string, perm os.FileMode) error {
+	name = path.Clean("/" + name)
+	info, err := x.Stat(name)
+	switch {
+	case err == nil && info.IsDir():
+		return nil
+	case err == nil:
+		return &os.PathError{Op: "mkdir", Path: x.fileName(name), Err: syscall.ENOTDIR}
+	}
+	if name != "/" {
+		if err := x.MkdirAll(path.Dir(name), perm); err != nil {
+			return err
+		}
+	}
+	if err := x.Mkdir(name, perm); err != nil {
+		// Made at the same time by someone else.
+		if info, err1 := x.Lstat(name); err1 == nil && info.IsDir() {
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+// Remove removes a file or an empty directory.
+func (x *memStorage) Remove(name string) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if err := x.remove(name, false); err != nil {
+		return &os.PathError{Op: "remove", Path: x.fileName(name), Err: err}
+	}
+	return nil
+}
+
+// RemoveAll is os.RemoveAll.
+func (x *memStorage) RemoveAll(name string) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if err := x.remove(name, true); err != nil && err != syscall.ENOENT {
+		return &os.PathError{Op: "unlinkat", Path: x.fileName(name), Err: err}
+	}
+	return nil
+}
+
+func (x *memStorage) remove(name string, recursive bool) error {
+	dir, base, err := x.walkParent(name)
+	if err != nil {
+		return err
+	}
+	node := x.dir
+	if dir != nil {
+		node = dir.entries[base]
+	}
+	switch {
+	case node == nil:
+		return syscall.ENOENT
+	case dir != nil && !x.can(dir, memWrite|memSearch):
+		return syscall.EACCES
+	case node.mode.IsDir() && len(node.entries) > 0 && !recursive:
+		return syscall.ENOTEMPTY
+	case node.mode.IsDir() && recursive:
+		if err := x.removeEntries(node); err != nil {
+			return err
+		}
+	}
+
+	if dir == nil {
+		x.release(x.dir)
+		x.dir = nil
+		return nil
+	}
+	x.release(node)
+	delete(dir.entries, base)
+	dir.mtime = time.Now()
+	return nil
+}
+
+// removeEntries removes everything in a directory that it can, like
+// os.RemoveAll, and returns the first error.
+func (x *memStorage) removeEntries(dir *memNode) error {
+	if len(dir.entries) == 0 {
+		return nil
+	}
+	if !x.can(dir, memWrite|memSearch) {
+		return syscall.EACCES
+	}
+	var firstErr error
+	for name, node := range dir.entries {
+		if node.mode.IsDir() {
+			if err := x.removeEntries(node); err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				continue
+			}
+		}
+		x.release(node)
+		delete(dir.entries, name)
+	}
+	dir.mtime = time.Now()
+	return firstErr
+}
+
+// release takes a node removed from the tree, and everything under it, off
+// the size of the storage.
+func (x *memStorage) release(node *memNode) {
+	if node == nil || node.removed {
+		return
+	}
+	x.size -= int64(len(node.data))
+	node.removed = true
+	for _, entry := range node.entries {
+		x.release(entry)
+	}
+}
+
+// resize changes the size of the contents of a file. Growing the storage past
+// maxSize fails with ENOSPC, even for removed files, which only stop counting
+// once they are closed.
+func (x *memStorage) resize(node *memNode, size int64) error {
+	grow := size - int64(len(node.data))
+	if x.maxSize > 0 && grow > 0 && x.size+grow > x.maxSize {
+		return syscall.ENOSPC
+	}
+	if !node.removed {
+		x.size += grow
+	}
+	if grow <= 0 {
+		node.data = node.data[:size]
+		return nil
+	}
+	node.data = append(node.data, make([]byte, grow)...)
+	return nil
+}
+
+func (x *memStorage) Rename(oldName, newName string) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if err := x.rename(oldName, newName); err != nil {
+		return &os.LinkError{Op: "rename", Old: x.fileName(oldName), New: x.fileName(newName), Err: err}
+	}
+	return nil
+}
+
+func (x *memStorage) rename(oldName, newName string) error {
+	oldDir, oldBase, err := x.walkParent(oldName)
+	if err != nil {
+		return err
+	}
+	newDir, newBase, err := x.walkParent(newName)
+	if err != nil {
+		return err
+	}
+	if oldDir == nil || newDir == nil {
+		return syscall.EBUSY
+	}
+	node := oldDir.entries[oldBase]
+	switch {
+	case node == nil:
+		return syscall.ENOENT
+	case !x.can(oldDir, memWrite|memSearch), !x.can(newDir, memWrite|memSearch):
+		return syscall.EACCES
+	}
+
+	oldName, newName = path.Clean("/"+oldName), path.Clean("/"+newName)
+	if oldName == newName {
+		return nil
+	}
+	if node.mode.IsDir() && strings.HasPrefix(newName, oldName+"/") {
+		return syscall.EINVAL
+	}
+	if replaced := newDir.entries[newBase]; replaced != nil {
+		switch {
+		case replaced == node:
+			return nil
+		case node.mode.IsDir() && !replaced.mode.IsDir():
+			return syscall.ENOTDIR
+		case !node.mode.IsDir() && replaced.mode.IsDir():
+			return syscall.EISDIR
+		case replaced.mode.IsDir() && len(replaced.entries) > 0:
+			return syscall.ENOTEMPTY
+		}
+	}
+
+	x.release(newDir.entries[newBase])
+	delete(oldDir.entries, oldBase)
+	newDir.entries[newBase] = node
+	now := time.Now()
+	oldDir.mtime = now
+	newDir.mtime = now
+	return nil
+}
+
+func (x *memStorage) Chmod(name string, mode os.FileMode) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	node, err := x.walk(name, true)
+	if err == nil && !x.isOwner(node) {
+		err = syscall.EPERM
+	}
+	if err != nil {
+		return &os.PathError{Op: "chmod", Path: x.fileName(name), Err: err}
+	}
+	const changeable = os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+	node.mode = node.mode&^changeable | mode&changeable
+	return nil
+}
+
+func (x *memStorage) Chown(name string, uid, gid int) error {
+	return x.chown("chown", name, true, uid, gid)
+}
+
+func (x *memStorage) Lchown(name string, uid, gid int) error {
+	return x.chown("lchown", name, false, uid, gid)
+}
+
+// chown changes the owner and group. Ids of -1 are left unchanged. Only root
+// may give files away, but owners may change the group to one of their own.
+func (x *memStorage) chown(op, name string, follow bool, uid, gid int) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	node, err := x.walk(name, follow)
+	if err == nil && x.uid != 0 {
+		if !x.isOwner(node) || (uid != -1 && uid != node.uid) || (gid != -1 && !x.inGroup(gid)) {
+			err = syscall.EPERM
+		}
+	}
+	if err != nil {
+		return &os.PathError{Op: op, Path: x.fileName(name), Err: err}
+	}
+	if uid != -1 {
+		node.uid = uid
+	}
+	if gid != -1 {
+		node.gid = gid
+	}
+	return nil
+}
+
+// Chtimes is os.Chtimes, so zero times are left unchanged.
+func (x *memStorage) Chtimes(name string, atime, mtime time.Time) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	node, err := x.walk(name, true)
+	if err == nil && !x.isOwner(node) {
+		err = syscall.EPERM
+	}
+	if err != nil {
+		return &os.PathError{Op: "chtimes", Path: x.fileName(name), Err: err}
+	}
+	if !atime.IsZero() {
+		node.atime = atime
+	}
+	if !mtime.IsZero() {
+		node.mtime = mtime
+	}
+	return nil
+}
+
+func (x *memStorage) Truncate(name string, size int64) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	node, err := x.walk(name, true)
+	switch {
+	case err != nil:
+	case node.mode.IsDir():
+		err = syscall.EISDIR
+	case !x.can(node, memWrite):
+		err = syscall.EACCES
+	case size < 0:
+		err = syscall.EINVAL
+	default:
+		err = x.resize(node, size)
+	}
+	if err != nil {
+		return &os.PathError{Op: "truncate", Path: x.fileName(name), Err: err}
+	}
+	node.mtime = time.Now()
+	return nil
+}
+
+func (x *memStorage) Symlink(target, newName string) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	dir, base, err := x.walkParent(newName)
+	switch {
+	case err != nil:
+	case dir == nil, dir.entries[base] != nil:
+		err = syscall.EEXIST
+	case !x.can(dir, memWrite|memSearch):
+		err = syscall.EACCES
+	}
+	if err != nil {
+		return &os.LinkError{Op: "symlink", Old: target, New: x.fileName(newName), Err: err}
+	}
+	node := x.newNode(os.ModeSymlink)
+	// Symlinks are 0777 whatever the umask.
+	node.mode |= os.ModePerm
+	node.target = target
+	dir.entries[base] = node
+	dir.mtime = node.mtime
+	return nil
+}
+
+func (x *memStorage) Readlink(name string) (string, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	node, err := x.walk(name, false)
+	if err == nil && node.mode&os.ModeSymlink == 0 {
+		err = syscall.EINVAL
+	}
+	if err != nil {
+		return "", &os.PathError{Op: "readlink", Path: x.fileName(name), Err: err}
+	}
+	return node.target, nil
+}
+
+// The extended attributes return bare errnos, like the syscalls.
+
+func (x *memStorage) ListXattrs(name string) ([]string, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	node, err := x.walk(name, true)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for attr := range node.xattrs {
+		names = append(names, attr)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (x *memStorage) GetXattr(name, attr string) ([]byte, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	node, err := x.walk(name, true)
+	switch {
+	case err != nil:
+		return nil, err
+	case !x.can(node, memRead):
+		return nil, syscall.EACCES
+	}
+	value, ok := node.xattrs[attr]
+	if !ok {
+		return nil, syscall.ENODATA
+	}
+	return append([]byte{}, value...), nil
+}
+
+func (x *memStorage) SetXattr(name, attr string, value []byte) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	node, err := x.walk(name, true)
+	switch {
+	case err != nil:
+		return err
+	case !x.can(node, memWrite):
+		return syscall.EACCES
+	}
+	if node.xattrs == nil {
+		node.xattrs = make(map[string][]byte)
+	}
+	node.xattrs[attr] = append([]byte{}, value...)
+	return nil
+}
+
+func (x *memStorage) RemoveXattr(name, attr string) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	node, err := x.walk(name, true)
+	switch {
+	case err != nil:
+		return err
+	case !x.can(node, memWrite):
+		return syscall.EACCES
+	}
+	delete(node.xattrs, attr)
+	return nil
+}
+
+// memFile is an open file of a memStorage.
+type memFile struct {
+	storage *memStorage
+	node    *memNode
+	name    string
+	flag    int
+	offset  int64
+	// dirOffset is how many entries Readdir has returned.
+	dirOffset int
+	closed    bool
+}
+
+func (x *memFile) pathError(op string, err error) error {
+	return &os.PathError{Op: op, Path: x.storage.fileName(x.name), Err: err}
+}
+
+// check returns the error of an operation that the file can't do.
+func (x *memFile) check(op string, write bool) error {
+	switch {
+	case x.closed:
+		return x.pathError(op, os.ErrClosed)
+	case x.node.mode.IsDir() && op != "seek":
+		return x.pathError(op, syscall.EISDIR)
+	case write && x.flag&(os.O_WRONLY|os.O_RDWR) == 0:
+		return x.pathError(op, syscall.EBADF)
+	case !write && op != "seek" && x.flag&os.O_WRONLY != 0:
+		return x.pathError(op, syscall.EBADF)
+	}
+	return nil
+}
+
+func (x *memFile) Read(p []byte) (int, error) {
+	x.storage.mu.Lock()
+	defer x.storage.mu.Unlock()
+	if err := x.check("read", false); err != nil {
+		return 0, err
+	}
+	n, err := x.readAt(p, x.offset)
+	x.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (x *memFile) ReadAt(p []byte, offset int64) (int, error) {
+	x.storage.mu.Lock()
+	defer x.storage.mu.Unlock()
+	if err := x.check("read", false); err != nil {
+		return 0, err
+	}
+	if offset < 0 {
+		return 0, x.pathError("readat", errors.New("negative offset"))
+	}
+	return x.readAt(p, offset)
+}
+
+func (x *memFile) readAt(p []byte, offset int64) (int, error) {
+	if offset >= int64(len(x.node.data)) {
+		if len(p) == 0 {
+			return 0, nil
+		}
+		return 0, io.EOF
+	}
+	n := copy(p, x.node.data[offset:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (x *memFile) Write(p []byte) (int, error) {
+	x.storage.mu.Lock()
+	defer x.storage.mu.Unlock()
+	if err := x.check("write", true); err != nil {
+		return 0, err
+	}
+	if x.flag&os.O_APPEND != 0 {
+		x.offset = int64(len(x.node.data))
+	}
+	n, err := x.writeAt(p, x.offset)
+	x.offset += int64(n)
+	return n, err
+}
+
+func (x *memFile) WriteAt(p []byte, offset int64) (int, error) {
+	x.storage.mu.Lock()
+	defer x.storage.mu.Unlock()
+	if err := x.check("write", true); err != nil {
+		return 0, err
+	}
+	if x.flag&os.O_APPEND != 0 {
+		return 0, errors.New("os: invalid use of WriteAt on file opened with O_APPEND")
+	}
+	if offset < 0 {
+		return 0, x.pathError("writeat", errors.New("negative offset"))
+	}
+	return x.writeAt(p, offset)
+}
+
+func (x *memFile) writeAt(p []byte, offset int64) (int, error) {
+	if end := offset + int64(len(p)); end > int64(len(x.node.data)) {
+		if err := x.storage.resize(x.node, end); err != nil {
+			return 0, x.pathError("write", err)
+		}
+	}
+	x.node.mtime = time.Now()
+	return copy(x.node.data[offset:], p), nil
+}
+
+func (x *memFile) Seek(offset int64, whence int) (int64, error) {
+	x.storage.mu.Lock()
+	defer x.storage.mu.Unlock()
+	if err := x.check("seek", false); err != nil {
+		return 0, err
+	}
+	switch whence {
+	case io.SeekCurrent:
+		offset += x.offset
+	case io.SeekEnd:
+		offset += int64(len(x.node.data))
+	}
+	if offset < 0 {
+		return 0, x.pathError("seek", syscall.EINVAL)
+	}
+	x.offset = offset
+	if x.node.mode.IsDir() && offset == 0 {
+		x.dirOffset = 0
+	}
+	return offset, nil
+}
+
+// Readdir is os.File.Readdir.
+func (x *memFile) Readdir(count int) ([]os.FileInfo, error) {
+	x.storage.mu.Lock()
+	defer x.storage.mu.Unlock()
+	switch {
+	case x.closed:
+		return nil, x.pathError("readdirent", os.ErrClosed)
+	case !x.node.mode.IsDir():
+		return nil, x.pathError("readdirent", syscall.ENOTDIR)
+	}
+
+	infos := x.storage.readDir(x.name, x.node)
+	if x.dirOffset > len(infos) {
+		x.dirOffset = len(infos)
+	}
+	infos = infos[x.dirOffset:]
+	if count > 0 {
+		if len(infos) == 0 {
+			return nil, io.EOF
+		}
+		if count < len(infos) {
+			infos = infos[:count]
+		}
+	}
+	x.dirOffset += len(infos)
+	return infos, nil
+}
+
+func (x *memFile) Stat() (os.FileInfo, error) {
+	x.storage.mu.Lock()
+	defer x.storage.mu.Unlock()
+	if x.closed {
+		return nil, x.pathError("stat", os.ErrClosed)
+	}
+	return x.storage.info(x.name, x.node), nil
+}
+
+func (x *memFile) Close() error {
+	x.storage.mu.Lock()
+	defer x.storage.mu.Unlock()
+	if x.closed {
+		return x.pathError("close", os.ErrClosed)
+	}
+	x.closed = true
+	return nil
+}
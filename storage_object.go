@@ -0,0 +1,1242 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ObjectStore is the bucket of an object storage. Prefix, if set, is the key
+// prefix the content is kept under.
+type ObjectStore struct {
+	Endpoint        string `json:"endpoint"`
+	Region          string `json:"region"`
+	Bucket          string `json:"bucket"`
+	Prefix          string `json:"prefix"`
+	AccessKeyID     string `json:"access_key_id"`
+	SecretAccessKey string `json:"secret_access_key"`
+}
+
+// The metadata of the objects. Objects without it, like those uploaded by
+// other tools, are files owned by root with 0644 permissions.
+const (
+	objectMetaType        = "X-Amz-Meta-Type"
+	objectMetaPermissions = "X-Amz-Meta-Permissions"
+	objectMetaOwner       = "X-Amz-Meta-Owner"
+	objectMetaGroup       = "X-Amz-Meta-Group"
+	objectMetaModified    = "X-Amz-Meta-Modified"
+	// objectMetaXattrPrefix prefixes the extended attributes, whose names
+	// are hex encoded since metadata names are case insensitive.
+	objectMetaXattrPrefix = "X-Amz-Meta-Xattr-"
+)
+
+const (
+	objectTypeDirectory = "directory"
+	objectTypeSymlink   = "symlink"
+)
+
+// objectStorage keeps the content in an S3 compatible bucket. Files are
+// objects at their path, and directories are empty marker objects at their
+// path with a trailing slash. Paths that only have objects under them are
+// directories too. The permissions, owner and modification time are kept in
+// the metadata of the objects, but not enforced.
+//
+// Objects can't be changed in place, so files opened for writing are
+// buffered in memory and uploaded when closed, and renames copy the objects.
+// Symlinks are only followed at the end of a name.
+type objectStorage struct {
+	root   string
+	client *objectStoreClient
+	prefix string
+	uid    int
+	gid    int
+}
+
+func newObjectStorage(root string, store ObjectStore) (*objectStorage, error) {
+	client, err := newObjectStoreClient(store)
+	if err != nil {
+		return nil, err
+	}
+	prefix := strings.Trim(store.Prefix, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	return &objectStorage{root: root, client: client, prefix: prefix, uid: os.Getuid(), gid: os.Getgid()}, nil
+}
+
+// fileName returns the name of a file in errors.
+func (x *objectStorage) fileName(name string) string {
+	return path.Join(x.root, path.Clean("/"+name))
+}
+
+// key returns the key of the object of a file. The root has no object, and
+// keeps its metadata at "/" under the prefix.
+func (x *objectStorage) key(name string) string {
+	return x.prefix + strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+// dirKey returns the key of the marker object of a directory.
+func (x *objectStorage) dirKey(name string) string {
+	return x.key(name) + "/"
+}
+
+// listPrefix returns the prefix of the keys of the entries of a directory.
+func (x *objectStorage) listPrefix(name string) string {
+	if path.Clean("/"+name) == "/" {
+		return x.prefix
+	}
+	return x.dirKey(name)
+}
+
+// objectEntry is a file, directory or symlink found in the bucket.
+type objectEntry struct {
+	name string
+	// key is the object holding the metadata, which is empty for
+	// directories without a marker.
+	key  string
+	meta objectMeta
+	size int64
+}
+
+func (x *objectEntry) isDir() bool {
+	return x.meta.typ == objectTypeDirectory
+}
+
+func (x *objectEntry) isSymlink() bool {
+	return x.meta.typ == objectTypeSymlink
+}
+
+func (x *objectStorage) info(entry *objectEntry) os.FileInfo {
+	info := &storageFileInfo{
+		name:    path.Base(x.fileName(entry.name)),
+		size:    entry.size,
+		mode:    entry.meta.perm,
+		modTime: entry.meta.modified,
+		uid:     entry.meta.uid,
+		gid:     entry.meta.gid,
+	}
+	switch {
+	case entry.isDir():
+		info.mode |= os.ModeDir
+		// Like the directories of most disk filesystems.
+		info.size = 4096
+	case entry.isSymlink():
+		info.mode |= os.ModeSymlink
+	}
+	return info
+}
+
+// lookup finds the entry of name without following symlinks.
+func (x *objectStorage) lookup(name string) (*objectEntry, error) {
+	name = path.Clean("/" + name)
+	if name != "/" {
+		header, size, err := x.client.head(x.key(name))
+		if err == nil {
+			return &objectEntry{name: name, key: x.key(name), meta: parseObjectMeta(header, ""), size: size}, nil
+		} else if err != syscall.ENOENT {
+			return nil, err
+		}
+	}
+
+	header, _, err := x.client.head(x.dirKey(name))
+	if err == nil {
+		return &objectEntry{name: name, key: x.dirKey(name), meta: parseObjectMeta(header, objectTypeDirectory)}, nil
+	} else if err != syscall.ENOENT {
+		return nil, err
+	}
+
+	meta := objectMeta{typ: objectTypeDirectory, perm: 0755}
+	if name == "/" {
+		return &objectEntry{name: name, meta: meta}, nil
+	}
+	keys, _, _, err := x.client.list(x.dirKey(name), "", "", 1)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, syscall.ENOENT
+	}
+	return &objectEntry{name: name, meta: meta}, nil
+}
+
+// resolve finds the entry of name, following symlinks at its end. Links
+// can't leave the storage: absolute targets start at its root.
+func (x *objectStorage) resolve(name string) (*objectEntry, error) {
+	for links := 0; ; links++ {
+		entry, err := x.lookup(name)
+		if err != nil || !entry.isSymlink() {
+			return entry, err
+		}
+		if links == storageMaxSymlinks {
+			return nil, syscall.ELOOP
+		}
+		target, err := x.readlink(entry)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(target, "/") {
+			target = path.Join(path.Dir(entry.name), target)
+		}
+		name = path.Clean("/" + target)
+	}
+}
+
+// parent checks that the directory of name exists.
+func (x *objectStorage) parent(name string) error {
+	dir, err := x.resolve(path.Dir(path.Clean("/" + name)))
+	switch {
+	case err != nil:
+		return err
+	case !dir.isDir():
+		return syscall.ENOTDIR
+	}
+	return nil
+}
+
+func (x *objectStorage) readlink(entry *objectEntry) (string, error) {
+	body, err := x.client.get(entry.key, 0)
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+	target, err := io.ReadAll(body)
+	return string(target), err
+}
+
+// update changes the metadata of an entry. Directories without a marker get
+// one.
+func (x *objectStorage) update(entry *objectEntry, change func(meta *objectMeta)) error {
+	change(&entry.meta)
+	if entry.key == "" {
+		entry.key = x.dirKey(entry.name)
+		return x.client.put(entry.key, nil, entry.meta.header())
+	}
+	return x.client.copy(entry.key, entry.key, entry.meta.header())
+}
+
+func (x *objectStorage) newMeta(typ string, perm os.FileMode) objectMeta {
+	return objectMeta{typ: typ, perm: perm.Perm() &^ storageUmask, uid: x.uid, gid: x.gid, modified: time.Now()}
+}
+
+func (x *objectStorage) Stat(name string) (os.FileInfo, error) {
+	entry, err := x.resolve(name)
+	if err != nil {
+		return nil, &os.PathError{Op: "stat", Path: x.fileName(name), Err: err}
+	}
+	return x.info(entry), nil
+}
+
+func (x *objectStorage) Lstat(name string) (os.FileInfo, error) {
+	entry, err := x.lookup(name)
+	if err != nil {
+		return nil, &os.PathError{Op: "lstat", Path: x.fileName(name), Err: err}
+	}
+	return x.info(entry), nil
+}
+
+func (x *objectStorage) Open(name string) (File, error) {
+	return x.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (x *objectStorage) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	f, err := x.openFile(name, flag, perm)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: x.fileName(name), Err: err}
+	}
+	return f, nil
+}
+
+func (x *objectStorage) openFile(name string, flag int, perm os.FileMode) (*objectFile, error) {
+	writable := flag&(os.O_WRONLY|os.O_RDWR) != 0
+	entry, err := x.resolve(name)
+	switch {
+	case err == nil && flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL:
+		return nil, syscall.EEXIST
+	case err == syscall.ENOENT && flag&os.O_CREATE != 0:
+		if err := x.parent(name); err != nil {
+			return nil, err
+		}
+		entry = &objectEntry{name: path.Clean("/" + name), key: x.key(name), meta: x.newMeta("", perm)}
+		if err := x.client.put(entry.key, nil, entry.meta.header()); err != nil {
+			return nil, err
+		}
+		return &objectFile{storage: x, entry: entry, flag: flag, writable: true}, nil
+	case err != nil:
+		return nil, err
+	case entry.isDir() && writable:
+		return nil, syscall.EISDIR
+	}
+
+	f := &objectFile{storage: x, entry: entry, flag: flag, writable: writable}
+	if writable {
+		if flag&os.O_TRUNC != 0 {
+			f.dirty = true
+		} else if f.data, err = x.client.getBytes(entry.key); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+func (x *objectStorage) ReadDir(name string) ([]os.DirEntry, error) {
+	entry, err := x.resolve(name)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: x.fileName(name), Err: err}
+	}
+	if !entry.isDir() {
+		return nil, &os.PathError{Op: "readdirent", Path: x.fileName(name), Err: syscall.ENOTDIR}
+	}
+	infos, err := x.readDir(entry.name)
+	if err != nil {
+		return nil, &os.PathError{Op: "readdirent", Path: x.fileName(name), Err: err}
+	}
+	entries := make([]os.DirEntry, len(infos))
+	for i, info := range infos {
+		entries[i] = dirEntry{info}
+	}
+	return entries, nil
+}
+
+// readDir returns the infos of the entries of a directory sorted by name.
+// The metadata of each entry is another request.
+func (x *objectStorage) readDir(name string) ([]os.FileInfo, error) {
+	var infos []os.FileInfo
+	prefix := x.listPrefix(name)
+	var token string
+	for {
+		keys, prefixes, next, err := x.client.list(prefix, "/", token, 0)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range append(keys, prefixes...) {
+			entryName := strings.TrimSuffix(strings.TrimPrefix(key, prefix), "/")
+			if entryName == "" {
+				// The marker of the directory or of the root.
+				continue
+			}
+			entry, err := x.lookup(path.Join(name, entryName))
+			if err == syscall.ENOENT {
+				// Deleted since the listing.
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+			infos = append(infos, x.info(entry))
+		}
+		if next == "" {
+			break
+		}
+		token = next
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+	return infos, nil
+}
+
+func (x *objectStorage) Mkdir(name string, perm os.FileMode) error {
+	if err := x.mkdir(name, perm); err != nil {
+		return &os.PathError{Op: "mkdir", Path: x.fileName(name), Err: err}
+	}
+	return nil
+}
+
+// mkdir makes the marker of a directory. The root always exists, but only
+// has a marker, and so its own permissions, once it is made.
+func (x *objectStorage) mkdir(name string, perm os.FileMode) error {
+	name = path.Clean("/" + name)
+	if name == "/" {
+		if _, _, err := x.client.head(x.dirKey(name)); err != syscall.ENOENT {
+			if err == nil {
+				return syscall.EEXIST
+			}
+			return err
+		}
+	} else {
+		if _, err := x.lookup(name); err == nil {
+			return syscall.EEXIST
+		} else if err != syscall.ENOENT {
+			return err
+		}
+		if err := x.parent(name); err != nil {
+			return err
+		}
+	}
+	return x.client.put(x.dirKey(name), nil, x.newMeta(objectTypeDirectory, perm).header())
+}
+
+// MkdirAll is os.MkdirAll.
+func (x *objectStorage) MkdirAll(name string, perm os.FileMode) error {
+	name = path.Clean("/" + name)
+	info, err := x.Stat(name)
+	switch {
+	case err == nil && info.IsDir():
+		return nil
+	case err == nil:
+		return &os.PathError{Op: "mkdir", Path: x.fileName(name), Err: syscall.ENOTDIR}
+	}
+	if err := x.MkdirAll(path.Dir(name), perm); err != nil {
+		return err
+	}
+	if err := x.Mkdir(name, perm); err != nil {
+		// Made at the same time by someone else.
+		if info, err1 := x.Lstat(name); err1 == nil && info.IsDir() {
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+// Remove removes a file or an empty directory.
+func (x *objectStorage) Remove(name string) error {
+	if err := x.remove(name); err != nil {
+		return &os.PathError{Op: "remove", Path: x.fileName(name), Err: err}
+	}
+	return nil
+}
+
+func (x *objectStorage) remove(name string) error {
+	entry, err := x.lookup(name)
+	if err != nil {
+		return err
+	}
+	if entry.isDir() {
+		keys, _, _, err := x.client.list(x.listPrefix(entry.name), "", "", 2)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if key != x.dirKey(entry.name) {
+				return syscall.ENOTEMPTY
+			}
+		}
+		if entry.key == "" {
+			return nil
+		}
+	}
+	return x.client.delete(entry.key)
+}
+
+// RemoveAll is os.RemoveAll. It deletes the objects one at a time.
+func (x *objectStorage) RemoveAll(name string) error {
+	if err := x.removeAll(name); err != nil {
+		return &os.PathError{Op: "unlinkat", Path: x.fileName(name), Err: err}
+	}
+	return nil
+}
+
+func (x *objectStorage) removeAll(name string) error {
+	name = path.Clean("/" + name)
+	if name != "/" {
+		if err := x.client.delete(x.key(name)); err != nil && err != syscall.ENOENT {
+			return err
+		}
+	}
+	return x.client.listAll(x.listPrefix(name), func(key string) error {
+		if err := x.client.delete(key); err != nil && err != syscall.ENOENT {
+			return err
+		}
+		return nil
+	})
+}
+
+// Rename copies the objects to their new keys and then deletes them, so it
+// is not atomic.
+func (x *objectStorage) Rename(oldName, newName string) error {
+	if err := x.rename(oldName, newName); err != nil {
+		return &os.LinkError{Op: "rename", Old: x.fileName(oldName), New: x.fileName(newName), Err: err}
+	}
+	return nil
+}
+
+func (x *objectStorage) rename(oldName, newName string) error {
+	oldName, newName = path.Clean("/"+oldName), path.Clean("/"+newName)
+	if oldName == "/" || newName == "/" {
+		return syscall.EBUSY
+	}
+	entry, err := x.lookup(oldName)
+	if err != nil {
+		return err
+	}
+	if err := x.parent(newName); err != nil {
+		return err
+	}
+	if oldName == newName {
+		return nil
+	}
+	if entry.isDir() && strings.HasPrefix(newName, oldName+"/") {
+		return syscall.EINVAL
+	}
+
+	replaced, err := x.lookup(newName)
+	switch {
+	case err == syscall.ENOENT:
+	case err != nil:
+		return err
+	case entry.isDir() && !replaced.isDir():
+		return syscall.ENOTDIR
+	case !entry.isDir() && replaced.isDir():
+		return syscall.EISDIR
+	case replaced.isDir():
+		if err := x.remove(newName); err != nil {
+			return err
+		}
+	}
+
+	if !entry.isDir() {
+		if err := x.client.copy(entry.key, x.key(newName), nil); err != nil {
+			return err
+		}
+		return x.client.delete(entry.key)
+	}
+	oldPrefix, newPrefix := x.dirKey(oldName), x.dirKey(newName)
+	return x.client.listAll(oldPrefix, func(key string) error {
+		if err := x.client.copy(key, newPrefix+strings.TrimPrefix(key, oldPrefix), nil); err != nil {
+			return err
+		}
+		return x.client.delete(key)
+	})
+}
+
+func (x *objectStorage) Chmod(name string, mode os.FileMode) error {
+	entry, err := x.resolve(name)
+	if err == nil {
+		err = x.update(entry, func(meta *objectMeta) { meta.perm = mode.Perm() })
+	}
+	if err != nil {
+		return &os.PathError{Op: "chmod", Path: x.fileName(name), Err: err}
+	}
+	return nil
+}
+
+func (x *objectStorage) Chown(name string, uid, gid int) error {
+	entry, err := x.resolve(name)
+	return x.chown("chown", name, entry, err, uid, gid)
+}
+
+func (x *objectStorage) Lchown(name string, uid, gid int) error {
+	entry, err := x.lookup(name)
+	return x.chown("lchown", name, entry, err, uid, gid)
+}
+
+// chown changes the owner and group. Ids of -1 are left unchanged.
+func (x *objectStorage) chown(op, name string, entry *objectEntry, err error, uid, gid int) error {
+	if err == nil {
+		err = x.update(entry, func(meta *objectMeta) {
+			if uid != -1 {
+				meta.uid = uid
+			}
+			if gid != -1 {
+				meta.gid = gid
+			}
+		})
+	}
+	if err != nil {
+		return &os.PathError{Op: op, Path: x.fileName(name), Err: err}
+	}
+	return nil
+}
+
+// Chtimes only keeps the modification time, which is left unchanged if zero.
+func (x *objectStorage) Chtimes(name string, atime, mtime time.Time) error {
+	entry, err := x.resolve(name)
+	if err == nil && !mtime.IsZero() {
+		err = x.update(entry, func(meta *objectMeta) { meta.modified = mtime })
+	}
+	if err != nil {
+		return &os.PathError{Op: "chtimes", Path: x.fileName(name), Err: err}
+	}
+	return nil
+}
+
+func (x *objectStorage) Truncate(name string, size int64) error {
+	if err := x.truncate(name, size); err != nil {
+		return &os.PathError{Op: "truncate", Path: x.fileName(name), Err: err}
+	}
+	return nil
+}
+
+func (x *objectStorage) truncate(name string, size int64) error {
+	entry, err := x.resolve(name)
+	switch {
+	case err != nil:
+		return err
+	case entry.isDir():
+		return syscall.EISDIR
+	case size < 0:
+		return syscall.EINVAL
+	}
+	data, err := x.client.getBytes(entry.key)
+	if err != nil {
+		return err
+	}
+	if size <= int64(len(data)) {
+		data = data[:size]
+	} else {
+		data = append(data, make([]byte, size-int64(len(data)))...)
+	}
+	entry.meta.modified = time.Now()
+	return x.client.put(entry.key, data, entry.meta.header())
+}
+
+func (x *objectStorage) Symlink(target, newName string) error {
+	err := x.parent(newName)
+	if err == nil {
+		if _, err = x.lookup(newName); err == nil {
+			err = syscall.EEXIST
+		} else if err == syscall.ENOENT {
+			meta := x.newMeta(objectTypeSymlink, os.ModePerm)
+			// Symlinks are 0777 whatever the umask.
+			meta.perm = os.ModePerm
+			err = x.client.put(x.key(newName), []byte(target), meta.header())
+		}
+	}
+	if err != nil {
+		return &os.LinkError{Op: "symlink", Old: target, New: x.fileName(newName), Err: err}
+	}
+	return nil
+}
+
+func (x *objectStorage) Readlink(name string) (string, error) {
+	entry, err := x.lookup(name)
+	if err == nil && !entry.isSymlink() {
+		err = syscall.EINVAL
+	}
+	var target string
+	if err == nil {
+		target, err = x.readlink(entry)
+	}
+	if err != nil {
+		return "", &os.PathError{Op: "readlink", Path: x.fileName(name), Err: err}
+	}
+	return target, nil
+}
+
+// The extended attributes return bare errnos, like the syscalls. They are
+// kept in the metadata, which S3 limits to 2KB in all.
+
+func (x *objectStorage) ListXattrs(name string) ([]string, error) {
+	entry, err := x.resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for attr := range entry.meta.xattrs {
+		names = append(names, attr)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (x *objectStorage) GetXattr(name, attr string) ([]byte, error) {
+	entry, err := x.resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	value, ok := entry.meta.xattrs[attr]
+	if !ok {
+		return nil, syscall.ENODATA
+	}
+	return value, nil
+}
+
+func (x *objectStorage) SetXattr(name, attr string, value []byte) error {
+	entry, err := x.resolve(name)
+	if err != nil {
+		return err
+	}
+	return x.update(entry, func(meta *objectMeta) {
+		if meta.xattrs == nil {
+			meta.xattrs = make(map[string][]byte)
+		}
+		meta.xattrs[attr] = value
+	})
+}
+
+func (x *objectStorage) RemoveXattr(name, attr string) error {
+	entry, err := x.resolve(name)
+	if err != nil {
+		return err
+	}
+	if _, ok := entry.meta.xattrs[attr]; !ok {
+		return nil
+	}
+	return x.update(entry, func(meta *objectMeta) { delete(meta.xattrs, attr) })
+}
+
+// objectMeta is the metadata of an object.
+type objectMeta struct {
+	typ      string
+	perm     os.FileMode
+	uid      int
+	gid      int
+	modified time.Time
+	xattrs   map[string][]byte
+}
+
+// parseObjectMeta reads the metadata of an object from its headers. The type
+// of directory markers is known from their key.
+func parseObjectMeta(header http.Header, typ string) objectMeta {
+	meta := objectMeta{typ: header.Get(objectMetaType), perm: 0644}
+	if typ != "" {
+		meta.typ = typ
+	}
+	if meta.typ == objectTypeDirectory {
+		meta.perm = 0755
+	}
+	if perm, err := strconv.ParseUint(header.Get(objectMetaPermissions), 8, 32); err == nil {
+		meta.perm = os.FileMode(perm).Perm()
+	}
+	meta.uid, _ = strconv.Atoi(header.Get(objectMetaOwner))
+	meta.gid, _ = strconv.Atoi(header.Get(objectMetaGroup))
+	if modified, err := time.Parse(time.RFC3339Nano, header.Get(objectMetaModified)); err == nil {
+		meta.modified = modified
+	} else {
+		meta.modified, _ = http.ParseTime(header.Get("Last-Modified"))
+	}
+	for name, values := range header {
+		if !strings.HasPrefix(name, objectMetaXattrPrefix) || len(values) == 0 {
+			continue
+		}
+		attr, err := hex.DecodeString(strings.TrimPrefix(name, objectMetaXattrPrefix))
+		if err != nil {
+			continue
+		}
+		value, err := base64.StdEncoding.DecodeString(values[0])
+		if err != nil {
+			continue
+		}
+		if meta.xattrs == nil {
+			meta.xattrs = make(map[string][]byte)
+		}
+		meta.xattrs[string(attr)] = value
+	}
+	return meta
+}
+
+func (x objectMeta) header() http.Header {
+	header := http.Header{}
+	if x.typ != "" {
+		header.Set(objectMetaType, x.typ)
+	}
+	header.Set(objectMetaPermissions, fmt.Sprintf("%04o", x.perm.Perm()))
+	header.Set(objectMetaOwner, strconv.Itoa(x.uid))
+	header.Set(objectMetaGroup, strconv.Itoa(x.gid))
+	header.Set(objectMetaModified, x.modified.UTC().Format(time.RFC3339Nano))
+	for attr, value := range x.xattrs {
+		header.Set(objectMetaXattrPrefix+hex.EncodeToString([]byte(attr)), base64.StdEncoding.EncodeToString(value))
+	}
+	return header
+}
+
+// objectFile is an open file of an objectStorage. Files opened for writing
+// are buffered, and uploaded on Close if they changed. Reads of other files
+// stream the object from the read offset.
+type objectFile struct {
+	storage  *objectStorage
+	entry    *objectEntry
+	flag     int
+	writable bool
+
+	mu     sync.Mutex
+	offset int64
+	closed bool
+	// data and dirty are only used when writable.
+	data  []byte
+	dirty bool
+	// body is being read from bodyOffset.
+	body       io.ReadCloser
+	bodyOffset int64
+	// dirInfos are read on the first Readdir.
+	dirInfos []os.FileInfo
+}
+
+func (x *objectFile) pathError(op string, err error) error {
+	return &os.PathError{Op: op, Path: x.storage.fileName(x.entry.name), Err: err}
+}
+
+// check returns the error of an operation that the file can't do.
+func (x *objectFile) check(op string, write bool) error {
+	switch {
+	case x.closed:
+		return x.pathError(op, os.ErrClosed)
+	case x.entry.isDir() && op != "seek":
+		return x.pathError(op, syscall.EISDIR)
+	case write && !x.writable:
+		return x.pathError(op, syscall.EBADF)
+	case !write && op != "seek" && x.flag&os.O_WRONLY != 0:
+		return x.pathError(op, syscall.EBADF)
+	}
+	return nil
+}
+
+func (x *objectFile) Read(p []byte) (int, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if err := x.check("read", false); err != nil {
+		return 0, err
+	}
+	if x.writable {
+		n, err := x.readAt(p, x.offset)
+		x.offset += int64(n)
+		if err == io.EOF && n > 0 {
+			err = nil
+		}
+		return n, err
+	}
+
+	if x.body != nil && x.bodyOffset != x.offset {
+		x.body.Close()
+		x.body = nil
+	}
+	if x.body == nil {
+		if x.offset >= x.entry.size {
+			return 0, io.EOF
+		}
+		body, err := x.storage.client.get(x.entry.key, x.offset)
+		if err != nil {
+			return 0, x.pathError("read", err)
+		}
+		x.body, x.bodyOffset = body, x.offset
+	}
+	n, err := x.body.Read(p)
+	x.offset += int64(n)
+	x.bodyOffset = x.offset
+	if err != nil && err != io.EOF {
+		err = x.pathError("read", err)
+	}
+	return n, err
+}
+
+func (x *objectFile) ReadAt(p []byte, offset int64) (int, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if err := x.check("read", false); err != nil {
+		return 0, err
+	}
+	if offset < 0 {
+		return 0, x.pathError("readat", syscall.EINVAL)
+	}
+	if x.writable {
+		return x.readAt(p, offset)
+	}
+
+	if offset >= x.entry.size {
+		if len(p) == 0 {
+			return 0, nil
+		}
+		return 0, io.EOF
+	}
+	body, err := x.storage.client.get(x.entry.key, offset)
+	if err != nil {
+		return 0, x.pathError("read", err)
+	}
+	defer body.Close()
+	n, err := io.ReadFull(body, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (x *objectFile) readAt(p []byte, offset int64) (int, error) {
+	if offset >= int64(len(x.data)) {
+		if len(p) == 0 {
+			return 0, nil
+		}
+		return 0, io.EOF
+	}
+	n := copy(p, x.data[offset:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (x *objectFile) Write(p []byte) (int, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if err := x.check("write", true); err != nil {
+		return 0, err
+	}
+	if x.flag&os.O_APPEND != 0 {
+		x.offset = int64(len(x.data))
+	}
+	n := x.writeAt(p, x.offset)
+	x.offset += int64(n)
+	return n, nil
+}
+
+func (x *objectFile) WriteAt(p []byte, offset int64) (int, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if err := x.check("write", true); err != nil {
+		return 0, err
+	}
+	if x.flag&os.O_APPEND != 0 {
+		return 0, fmt.Errorf("os: invalid use of WriteAt on file opened with O_APPEND")
+	}
+	if offset < 0 {
+		return 0, x.pathError("writeat", syscall.EINVAL)
+	}
+	return x.writeAt(p, offset), nil
+}
+
+func (x *objectFile) writeAt(p []byte, offset int64) int {
+	if end := offset + int64(len(p)); end > int64(len(x.data)) {
+		x.data = append(x.data, make([]byte, end-int64(len(x.data)))...)
+	}
+	x.dirty = true
+	return copy(x.data[offset:], p)
+}
+
+func (x *objectFile) Seek(offset int64, whence int) (int64, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if err := x.check("seek", false); err != nil {
+		return 0, err
+	}
+	switch whence {
+	case io.SeekCurrent:
+		offset += x.offset
+	case io.SeekEnd:
+		offset += x.size()
+	}
+	if offset < 0 {
+		return 0, x.pathError("seek", syscall.EINVAL)
+	}
+	x.offset = offset
+	return offset, nil
+}
+
+func (x *objectFile) size() int64 {
+	if x.writable {
+		return int64(len(x.data))
+	}
+	return x.entry.size
+}
+
+// Readdir is os.File.Readdir.
+func (x *objectFile) Readdir(count int) ([]os.FileInfo, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	switch {
+	case x.closed:
+		return nil, x.pathError("readdirent", os.ErrClosed)
+	case !x.entry.isDir():
+		return nil, x.pathError("readdirent", syscall.ENOTDIR)
+	}
+	if x.dirInfos == nil {
+		infos, err := x.storage.readDir(x.entry.name)
+		if err != nil {
+			return nil, x.pathError("readdirent", err)
+		}
+		x.dirInfos = append(infos, nil)[:len(infos)]
+	}
+
+	infos := x.dirInfos
+	if count > 0 {
+		if len(infos) == 0 {
+			return nil, io.EOF
+		}
+		if count < len(infos) {
+			infos = infos[:count]
+		}
+	}
+	x.dirInfos = x.dirInfos[len(infos):]
+	return infos, nil
+}
+
+func (x *objectFile) Stat() (os.FileInfo, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.closed {
+		return nil, x.pathError("stat", os.ErrClosed)
+	}
+	info := x.storage.info(x.entry).(*storageFileInfo)
+	if !x.entry.isDir() {
+		info.size = x.size()
+	}
+	return info, nil
+}
+
+// Close uploads the changes of a file opened for writing.
+func (x *objectFile) Close() error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.closed {
+		return x.pathError("close", os.ErrClosed)
+	}
+	x.closed = true
+	if x.body != nil {
+		x.body.Close()
+	}
+	if !x.dirty {
+		return nil
+	}
+	x.entry.meta.modified = time.Now()
+	if err := x.storage.client.put(x.entry.key, x.data, x.entry.meta.header()); err != nil {
+		return x.pathError("close", err)
+	}
+	return nil
+}
+
+// dirEntry is an os.DirEntry of an os.FileInfo.
+type dirEntry struct {
+	info os.FileInfo
+}
+
+func (x dirEntry) Name() string               { return x.info.Name() }
+func (x dirEntry) IsDir() bool                { return x.info.IsDir() }
+func (x dirEntry) Type() os.FileMode          { return x.info.Mode().Type() }
+func (x dirEntry) Info() (os.FileInfo, error) { return x.info, nil }
+
+// objectStoreClient makes SigV4 signed requests to the path style urls of an
+// S3 compatible api.
+type objectStoreClient struct {
+	endpoint *url.URL
+	store    ObjectStore
+	http     *http.Client
+}
+
+func newObjectStoreClient(store ObjectStore) (*objectStoreClient, error) {
+	endpoint, err := url.Parse(store.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if endpoint.Scheme != "http" && endpoint.Scheme != "https" {
+		return nil, fmt.Errorf("%q is not an http or https url", store.Endpoint)
+	}
+	if store.Bucket == "" {
+		return nil, fmt.Errorf("the bucket is not set")
+	}
+	if store.Region == "" {
+		store.Region = "us-east-1"
+	}
+	return &objectStoreClient{endpoint: endpoint, store: store, http: &http.Client{Timeout: time.Minute}}, nil
+}
+
+// objectStoreError is an error response of the api.
+type objectStoreError struct {
+	StatusCode int    `xml:"-"`
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+}
+
+func (x *objectStoreError) Error() string {
+	return fmt.Sprintf("object store: %d %s: %s", x.StatusCode, x.Code, x.Message)
+}
+
+// do sends a request for a key. Missing keys are syscall.ENOENT and denied
+// requests are syscall.EACCES, so that they read like errors of the disk.
+func (x *objectStoreClient) do(method, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	u := *x.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + x.store.Bucket + "/" + key
+	u.RawPath = s3URIEncode(u.Path, false)
+	u.RawQuery = strings.ReplaceAll(query.Encode(), "+", "%20")
+	r, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		r.Header[name] = values
+	}
+	x.sign(r, body, time.Now())
+
+	resp, err := x.http.Do(r)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		return nil, syscall.ENOENT
+	case http.StatusForbidden:
+		return nil, syscall.EACCES
+	}
+	respErr := &objectStoreError{StatusCode: resp.StatusCode}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	xml.Unmarshal(data, respErr)
+	return nil, respErr
+}
+
+// sign adds a SigV4 signature of the headers and payload to a request.
+func (x *objectStoreClient) sign(r *http.Request, body []byte, now time.Time) {
+	payloadHash := sha256Hex(body)
+	r.Header.Set("X-Amz-Date", now.UTC().Format(s3TimeFormat))
+	r.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signedHeaders := []string{"host"}
+	for name := range r.Header {
+		name = strings.ToLower(name)
+		if strings.HasPrefix(name, "x-amz-") || name == "range" {
+			signedHeaders = append(signedHeaders, name)
+		}
+	}
+	sort.Strings(signedHeaders)
+
+	scope := now.UTC().Format("20060102") + "/" + x.store.Region + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{
+		s3Algorithm,
+		now.UTC().Format(s3TimeFormat),
+		scope,
+		sha256Hex([]byte(s3CanonicalRequest(r, signedHeaders, payloadHash))),
+	}, "\n")
+	signature := hex.EncodeToString(hmacSha256(s3SigningKey(x.store.SecretAccessKey, now.UTC(), x.store.Region), stringToSign))
+	r.Header.Set("Authorization", s3Algorithm+" Credential="+x.store.AccessKeyID+"/"+scope+
+		", SignedHeaders="+strings.Join(signedHeaders, ";")+", Signature="+signature)
+}
+
+// head returns the headers and size of an object.
+func (x *objectStoreClient) head(key string) (http.Header, int64, error) {
+	resp, err := x.do(http.MethodHead, key, nil, nil, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	resp.Body.Close()
+	return resp.Header, resp.ContentLength, nil
+}
+
+// get returns the body of an object from offset.
+func (x *objectStoreClient) get(key string, offset int64) (io.ReadCloser, error) {
+	header := http.Header{}
+	if offset > 0 {
+		header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := x.do(http.MethodGet, key, nil, header, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (x *objectStoreClient) getBytes(key string) ([]byte, error) {
+	body, err := x.get(key, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	return io.ReadAll(body)
+}
+
+func (x *objectStoreClient) put(key string, body []byte, header http.Header) error {
+	resp, err := x.do(http.MethodPut, key, nil, header, body)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// copy copies an object. The metadata is replaced when header is set, which
+// lets an object be copied to itself to change it.
+func (x *objectStoreClient) copy(srcKey, dstKey string, header http.Header) error {
+	if header == nil {
+		header = http.Header{"X-Amz-Metadata-Directive": {"COPY"}}
+	} else {
+		header = header.Clone()
+		header.Set("X-Amz-Metadata-Directive", "REPLACE")
+	}
+	header.Set("X-Amz-Copy-Source", s3URIEncode("/"+x.store.Bucket+"/"+srcKey, false))
+	resp, err := x.do(http.MethodPut, dstKey, nil, header, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// Copies can fail after the status was sent.
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	respErr := &objectStoreError{StatusCode: resp.StatusCode}
+	if xml.Unmarshal(data, respErr) == nil && respErr.Code != "" {
+		return respErr
+	}
+	return nil
+}
+
+// delete deletes an object. S3 succeeds for missing keys too.
+func (x *objectStoreClient) delete(key string) error {
+	resp, err := x.do(http.MethodDelete, key, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+type objectStoreListResult struct {
+	Contents []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+	CommonPrefixes []struct {
+		Prefix string `xml:"Prefix"`
+	} `xml:"CommonPrefixes"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// list returns a page of the keys and common prefixes under prefix, and the
+// token of the next page if there is one. maxKeys of 0 is the default.
+func (x *objectStoreClient) list(prefix, delimiter, token string, maxKeys int) (keys, prefixes []string, next string, err error) {
+	query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+	if delimiter != "" {
+		query.Set("delimiter", delimiter)
+	}
+	if token != "" {
+		query.Set("continuation-token", token)
+	}
+	if maxKeys > 0 {
+		query.Set("max-keys", strconv.Itoa(maxKeys))
+	}
+	resp, err := x.do(http.MethodGet, "", query, nil, nil)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	defer resp.Body.Close()
+	var result objectStoreListResult
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, nil, "", err
+	}
+	for _, content := range result.Contents {
+		keys = append(keys, content.Key)
+	}
+	for _, commonPrefix := range result.CommonPrefixes {
+		prefixes = append(prefixes, commonPrefix.Prefix)
+	}
+	return keys, prefixes, result.NextContinuationToken, nil
+}
+
+// listAll calls fn with every key under prefix.
+func (x *objectStoreClient) listAll(prefix string, fn func(key string) error) error {
+	var token string
+	for {
+		keys, _, next, err := x.list(prefix, "", token, 0)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if err := fn(key); err != nil {
+				return err
+			}
+		}
+		if next == "" {
+			return nil
+		}
+		token = next
+	}
+}
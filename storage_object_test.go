@@ -0,0 +1,378 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const fakeObjectStoreBucket = "content"
+
+// fakeObjectStore is an in-process S3 compatible api with the requests an
+// objectStorage makes, for a single bucket.
+type fakeObjectStore struct {
+	mu      sync.Mutex
+	objects map[string]fakeObject
+	// maxKeys is the default page size of listings.
+	maxKeys int
+}
+
+type fakeObject struct {
+	data     []byte
+	meta     http.Header
+	modified time.Time
+}
+
+// newFakeObjectStore serves a fakeObjectStore until the test ends, and
+// returns the config of a bucket on it.
+func newFakeObjectStore(t *testing.T) (*fakeObjectStore, ObjectStore) {
+	t.Helper()
+	fake := &fakeObjectStore{objects: make(map[string]fakeObject), maxKeys: 1000}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	return fake, ObjectStore{
+		Endpoint:        server.URL,
+		Region:          "us-east-1",
+		Bucket:          fakeObjectStoreBucket,
+		AccessKeyID:     s3TestCredentials[0].AccessKeyID,
+		SecretAccessKey: s3TestCredentials[0].SecretAccessKey,
+	}
+}
+
+func (x *fakeObjectStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := verifyS3Request(s3TestCredentials, r, time.Now()); err != nil {
+		writeS3Error(w, r, err)
+		return
+	}
+	key, ok := strings.CutPrefix(r.URL.Path, "/"+fakeObjectStoreBucket+"/")
+	if !ok {
+		writeS3Error(w, r, errS3NoSuchBucket)
+		return
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	switch {
+	case r.Method == http.MethodGet && key == "" && r.URL.Query().Get("list-type") == "2":
+		x.list(w, r)
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		object, ok := x.objects[key]
+		if !ok {
+			writeS3Error(w, r, errS3NoSuchKey)
+			return
+		}
+		for name, values := range object.meta {
+			w.Header()[name] = values
+		}
+		http.ServeContent(w, r, "", object.modified, bytes.NewReader(object.data))
+	case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+		source, err := url.PathUnescape(r.Header.Get("X-Amz-Copy-Source"))
+		if err != nil {
+			writeS3Error(w, r, errS3InvalidKey)
+			return
+		}
+		object, ok := x.objects[strings.TrimPrefix(source, "/"+fakeObjectStoreBucket+"/")]
+		if !ok {
+			writeS3Error(w, r, errS3NoSuchKey)
+			return
+		}
+		if r.Header.Get("X-Amz-Metadata-Directive") == "REPLACE" {
+			object.meta = fakeObjectMeta(r.Header)
+		}
+		object.modified = time.Now()
+		x.objects[key] = object
+		writeS3Response(w, struct {
+			XMLName xml.Name `xml:"CopyObjectResult"`
+		}{})
+	case r.Method == http.MethodPut:
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeS3Error(w, r, err)
+			return
+		}
+		x.objects[key] = fakeObject{data: data, meta: fakeObjectMeta(r.Header), modified: time.Now()}
+	case r.Method == http.MethodDelete:
+		delete(x.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeS3Error(w, r, &S3Error{http.StatusMethodNotAllowed, "MethodNotAllowed", "The specified method is not allowed"})
+	}
+}
+
+func fakeObjectMeta(header http.Header) http.Header {
+	meta := http.Header{}
+	for name, values := range header {
+		if strings.HasPrefix(name, "X-Amz-Meta-") {
+			meta[name] = values
+		}
+	}
+	return meta
+}
+
+// list is ListObjectsV2. The continuation tokens are the last key or common
+// prefix of the page.
+func (x *fakeObjectStore) list(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	prefix, delimiter, token := query.Get("prefix"), query.Get("delimiter"), query.Get("continuation-token")
+	maxKeys := x.maxKeys
+	if v := query.Get("max-keys"); v != "" {
+		maxKeys, _ = strconv.Atoi(v)
+	}
+
+	var keys []string
+	for key := range x.objects {
+		if strings.HasPrefix(key, prefix) && key > token && !(delimiter != "" && strings.HasSuffix(token, delimiter) && strings.HasPrefix(key, token)) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	var result objectStoreListResult
+	var last string
+	count := 0
+	for _, key := range keys {
+		if i := strings.Index(key[len(prefix):], delimiter); delimiter != "" && i >= 0 {
+			commonPrefix := key[:len(prefix)+i+len(delimiter)]
+			if commonPrefix == last {
+				continue
+			}
+			if count == maxKeys {
+				result.NextContinuationToken = last
+				break
+			}
+			result.CommonPrefixes = append(result.CommonPrefixes, struct {
+				Prefix string `xml:"Prefix"`
+			}{commonPrefix})
+			last = commonPrefix
+		} else {
+			if count == maxKeys {
+				result.NextContinuationToken = last
+				break
+			}
+			result.Contents = append(result.Contents, struct {
+				Key string `xml:"Key"`
+			}{key})
+			last = key
+		}
+		count++
+	}
+	writeS3Response(w, struct {
+		XMLName xml.Name `xml:"ListBucketResult"`
+		objectStoreListResult
+	}{objectStoreListResult: result})
+}
+
+func TestObjectStorage(t *testing.T) {
+	newTestStorage := func(t *testing.T, prefix string) (*fakeObjectStore, *objectStorage) {
+		t.Helper()
+		fake, store := newFakeObjectStore(t)
+		store.Prefix = prefix
+		storage, err := newObjectStorage(ContentRoot, store)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fake, storage
+	}
+	keys := func(fake *fakeObjectStore) []string {
+		fake.mu.Lock()
+		defer fake.mu.Unlock()
+		var keys []string
+		for key := range fake.objects {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		return keys
+	}
+
+	t.Run("files and directories are objects with metadata", func(t *testing.T) {
+		fake, storage := newTestStorage(t, "files")
+		if err := storage.MkdirAll("/a/b", 0750); err != nil {
+			t.Fatal(err)
+		}
+		if err := writeFile(storage, "/a/b/file.txt", []byte("hello\n"), 0640); err != nil {
+			t.Fatal(err)
+		}
+		if err := storage.Chown("/a/b/file.txt", 1000, 1001); err != nil {
+			t.Fatal(err)
+		}
+		if err := storage.SetXattr("/a/b/file.txt", "user.Color", []byte("blue")); err != nil {
+			t.Fatal(err)
+		}
+
+		want := []string{"files/a/", "files/a/b/", "files/a/b/file.txt"}
+		if got := keys(fake); !reflect.DeepEqual(got, want) {
+			t.Errorf("got keys %q, want %q", got, want)
+		}
+		object := fake.objects["files/a/b/file.txt"]
+		if string(object.data) != "hello\n" || object.meta.Get(objectMetaPermissions) != "0640" ||
+			object.meta.Get(objectMetaOwner) != "1000" || object.meta.Get(objectMetaGroup) != "1001" {
+			t.Errorf("got object %q with metadata %v", object.data, object.meta)
+		}
+
+		info, err := storage.Stat("/a/b/file.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if uid, gid := fileOwner(info); uid != 1000 || gid != 1001 || info.Mode() != 0640 || info.Size() != 6 {
+			t.Errorf("got owner %d:%d, mode %v and size %d", uid, gid, info.Mode(), info.Size())
+		}
+		if info, err = storage.Stat("/a/b"); err != nil || info.Mode() != os.ModeDir|0750 {
+			t.Errorf("got directory %v, %v", info, err)
+		}
+		if value, err := storage.GetXattr("/a/b/file.txt", "user.Color"); err != nil || string(value) != "blue" {
+			t.Errorf("got xattr %q, %v", value, err)
+		}
+	})
+
+	t.Run("keys without markers are in directories", func(t *testing.T) {
+		fake, storage := newTestStorage(t, "")
+		fake.objects["photos/2024/cat.jpg"] = fakeObject{data: []byte("meow"), modified: time.Now()}
+
+		info, err := storage.Stat("/photos/2024")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode() != os.ModeDir|0755 {
+			t.Errorf("got mode %v", info.Mode())
+		}
+		if info, err = storage.Stat("/photos/2024/cat.jpg"); err != nil || info.Mode() != 0644 {
+			t.Errorf("got file %v, %v", info, err)
+		}
+		entries, err := storage.ReadDir("/photos")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 1 || entries[0].Name() != "2024" || !entries[0].IsDir() {
+			t.Errorf("got entries %v", entries)
+		}
+
+		if err := storage.Chmod("/photos", 0700); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := fake.objects["photos/"]; !ok {
+			t.Errorf("changing a directory without a marker did not make one")
+		}
+	})
+
+	t.Run("listings are paged", func(t *testing.T) {
+		fake, storage := newTestStorage(t, "")
+		fake.maxKeys = 2
+		var want []string
+		for i := range 5 {
+			name := fmt.Sprintf("dir%d", i)
+			if err := storage.MkdirAll("/"+name+"/sub", 0755); err != nil {
+				t.Fatal(err)
+			}
+			want = append(want, name)
+		}
+
+		entries, err := storage.ReadDir("/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+		if !reflect.DeepEqual(names, want) {
+			t.Errorf("got names %q, want %q", names, want)
+		}
+
+		if err := storage.RemoveAll("/"); err != nil {
+			t.Fatal(err)
+		}
+		if got := keys(fake); len(got) != 0 {
+			t.Errorf("got keys %q after removing all", got)
+		}
+	})
+
+	t.Run("renames copy the objects", func(t *testing.T) {
+		fake, storage := newTestStorage(t, "")
+		if err := storage.MkdirAll("/a/b", 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := writeFile(storage, "/a/b/file.txt", []byte("hello\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := storage.Rename("/a", "/c"); err != nil {
+			t.Fatal(err)
+		}
+		want := []string{"c/", "c/b/", "c/b/file.txt"}
+		if got := keys(fake); !reflect.DeepEqual(got, want) {
+			t.Errorf("got keys %q, want %q", got, want)
+		}
+		if info, err := storage.Stat("/c/b/file.txt"); err != nil || info.Mode() != 0600 {
+			t.Errorf("got file %v, %v", info, err)
+		}
+	})
+
+	t.Run("reads are ranged", func(t *testing.T) {
+		_, storage := newTestStorage(t, "")
+		if err := writeFile(storage, "/file.txt", []byte("hello world\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		f, err := storage.Open("/file.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		if _, err := f.Seek(6, io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+		contents, err := io.ReadAll(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(contents) != "world\n" {
+			t.Errorf("got contents %q", contents)
+		}
+		p := make([]byte, 4)
+		if n, err := f.ReadAt(p, 1); err != nil || string(p[:n]) != "ello" {
+			t.Errorf("got %q, %v", p[:n], err)
+		}
+	})
+
+	t.Run("errors are like the disk", func(t *testing.T) {
+		_, storage := newTestStorage(t, "")
+		if err := storage.MkdirAll("/a/b", 0755); err != nil {
+			t.Fatal(err)
+		}
+		for _, test := range []struct {
+			err  error
+			want string
+		}{
+			{storage.Remove("/a"), "remove test/a: directory not empty"},
+			{storage.Rename("/a", "/a/b/c"), "rename test/a test/a/b/c: invalid argument"},
+			{storage.Mkdir("/a", 0755), "mkdir test/a: file exists"},
+			{storage.Truncate("/missing.txt", 0), "truncate test/missing.txt: no such file or directory"},
+		} {
+			if test.err == nil || test.err.Error() != test.want {
+				t.Errorf("got error %v, want %s", test.err, test.want)
+			}
+		}
+	})
+
+	t.Run("requests are signed", func(t *testing.T) {
+		_, store := newFakeObjectStore(t)
+		store.SecretAccessKey = "wrong"
+		storage, err := newObjectStorage(ContentRoot, store)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := storage.Stat("/file.txt"); !os.IsPermission(err) {
+			t.Errorf("got error %v with the wrong secret", err)
+		}
+	})
+}
@@ -0,0 +1,756 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// overlayWhiteoutPrefix prefixes the names of the whiteouts, which hide the
+// file of the same name in the lower layers.
+const overlayWhiteoutPrefix = ".wh."
+
+// overlayOpaque is a whiteout in a directory that hides the directories of
+// the same name in the lower layers.
+const overlayOpaque = overlayWhiteoutPrefix + overlayWhiteoutPrefix + ".opq"
+
+// overlayStorage stacks storages like overlayfs. Names resolve to the
+// topmost layer that has them, and directories list the entries of all the
+// layers. Only the top layer is changed: files and directories of lower
+// layers are copied up to it before they are changed, and removing them
+// leaves whiteouts, files named .wh.<name> as in aufs, that hide them.
+// Directories of lower layers can't be renamed, as with overlayfs without
+// redirect_dir.
+//
+// Like for objectStorage, symlinks resolve across the layers only at the end
+// of a name. The names of whiteouts are reserved and not found.
+type overlayStorage struct {
+	root string
+	// layers are the top layer, then the lower ones from the top down.
+	layers []Storage
+}
+
+func newOverlayStorage(root string, upper Storage, lowers ...Storage) *overlayStorage {
+	return &overlayStorage{root: root, layers: append([]Storage{upper}, lowers...)}
+}
+
+func (x *overlayStorage) upper() Storage {
+	return x.layers[0]
+}
+
+// fileName returns the name of a file in errors.
+func (x *overlayStorage) fileName(name string) string {
+	return path.Join(x.root, path.Clean("/"+name))
+}
+
+func (x *overlayStorage) pathError(op, name string, err error) error {
+	return &os.PathError{Op: op, Path: x.fileName(name), Err: err}
+}
+
+// isReserved reports whether a name has a whiteout in it.
+func (x *overlayStorage) isReserved(name string) bool {
+	for _, part := range strings.Split(name, "/") {
+		if strings.HasPrefix(part, overlayWhiteoutPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func whiteoutName(name string) string {
+	return path.Join(path.Dir(name), overlayWhiteoutPrefix+path.Base(name))
+}
+
+// exists reports whether name is in a layer.
+func exists(layer Storage, name string) (bool, error) {
+	_, err := layer.Lstat(name)
+	switch {
+	case err == nil:
+		return true, nil
+	case os.IsNotExist(err) || isNotDir(err):
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+func isNotDir(err error) bool {
+	pathErr, ok := err.(*os.PathError)
+	return ok && pathErr.Err == syscall.ENOTDIR
+}
+
+// overlayFile is a name in a layer.
+type overlayFile struct {
+	layer int
+	info  os.FileInfo
+}
+
+// lookup returns the layers that have name, from the top down, stopping at
+// the first one that hides the layers below it. The first is the one name
+// resolves to, and the others are only there for directories, which are
+// merged. Symlinks are not followed.
+func (x *overlayStorage) lookup(name string) ([]overlayFile, error) {
+	name = path.Clean("/" + name)
+	if x.isReserved(name) {
+		return nil, nil
+	}
+	var dirs []string
+	for dir := path.Dir(name); name != "/"; dir = path.Dir(dir) {
+		dirs = append([]string{dir}, dirs...)
+		if dir == "/" {
+			break
+		}
+	}
+
+	var files []overlayFile
+	for i, layer := range x.layers {
+		visible, hidesBelow, err := x.visible(layer, dirs, name)
+		if err != nil {
+			return nil, err
+		}
+		if visible {
+			info, err := layer.Lstat(name)
+			switch {
+			case err == nil:
+				files = append(files, overlayFile{i, info})
+				if !info.IsDir() {
+					hidesBelow = true
+				} else if opaque, err := exists(layer, path.Join(name, overlayOpaque)); err != nil {
+					return nil, err
+				} else if opaque {
+					hidesBelow = true
+				}
+			case !os.IsNotExist(err) && !isNotDir(err):
+				return nil, err
+			}
+		}
+		if hidesBelow {
+			break
+		}
+	}
+	return files, nil
+}
+
+// visible reports whether name can be in a layer, since its directories are
+// there and it is not whited out, and whether the layer hides name in the
+// layers below it.
+func (x *overlayStorage) visible(layer Storage, dirs []string, name string) (visible, hidesBelow bool, err error) {
+	for i, dir := range dirs {
+		info, err := layer.Lstat(dir)
+		switch {
+		case os.IsNotExist(err) || isNotDir(err):
+			return false, hidesBelow, nil
+		case err != nil:
+			return false, false, err
+		case !info.IsDir():
+			return false, true, nil
+		}
+		child := name
+		if i+1 < len(dirs) {
+			child = dirs[i+1]
+		}
+		if whiteout, err := exists(layer, whiteoutName(child)); err != nil || whiteout {
+			return false, true, err
+		}
+		opaque, err := exists(layer, path.Join(dir, overlayOpaque))
+		if err != nil {
+			return false, false, err
+		}
+		hidesBelow = hidesBelow || opaque
+	}
+	return true, hidesBelow, nil
+}
+
+// find returns the file name resolves to without following symlinks.
+func (x *overlayStorage) find(op, name string) (overlayFile, error) {
+	files, err := x.lookup(name)
+	if err != nil {
+		return overlayFile{}, err
+	}
+	if len(files) == 0 {
+		return overlayFile{}, x.pathError(op, name, syscall.ENOENT)
+	}
+	return files[0], nil
+}
+
+// resolve follows the symlinks at the end of name, and returns the name they
+// lead to.
+func (x *overlayStorage) resolve(op, name string) (string, overlayFile, error) {
+	name = path.Clean("/" + name)
+	for links := 0; ; links++ {
+		file, err := x.find(op, name)
+		if err != nil || file.info.Mode()&os.ModeSymlink == 0 {
+			return name, file, err
+		}
+		if links == storageMaxSymlinks {
+			return "", file, x.pathError(op, name, syscall.ELOOP)
+		}
+		target, err := x.layers[file.layer].Readlink(name)
+		if err != nil {
+			return "", file, err
+		}
+		if !strings.HasPrefix(target, "/") {
+			target = path.Join(path.Dir(name), target)
+		}
+		name = path.Clean("/" + target)
+	}
+}
+
+// inLower reports whether a lower layer has name, so that removing it needs
+// a whiteout.
+func (x *overlayStorage) inLower(name string) (bool, error) {
+	files, err := x.lookup(name)
+	if err != nil {
+		return false, err
+	}
+	for _, file := range files {
+		if file.layer > 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// copyUp copies name and its directories to the top layer, if they are not
+// there yet. The contents of directories are not copied.
+func (x *overlayStorage) copyUp(name string) error {
+	name = path.Clean("/" + name)
+	if name != "/" {
+		if err := x.copyUp(path.Dir(name)); err != nil {
+			return err
+		}
+	}
+	file, err := x.find("stat", name)
+	if err != nil || file.layer == 0 {
+		return err
+	}
+	lower, upper := x.layers[file.layer], x.upper()
+
+	mode := file.info.Mode()
+	switch {
+	case mode.IsDir():
+		if err := upper.Mkdir(name, mode.Perm()); err != nil {
+			return err
+		}
+	case mode&os.ModeSymlink != 0:
+		target, err := lower.Readlink(name)
+		if err != nil {
+			return err
+		}
+		return upper.Symlink(target, name)
+	case mode.IsRegular():
+		if err := copyFile(lower, upper, name, mode.Perm()); err != nil {
+			return err
+		}
+	default:
+		return x.pathError("copyup", name, syscall.EINVAL)
+	}
+
+	// The owner and group are kept where allowed, like a cp -p.
+	uid, gid := fileOwner(file.info)
+	if err := upper.Lchown(name, int(uid), int(gid)); err != nil && !os.IsPermission(err) {
+		return err
+	}
+	if err := upper.Chmod(name, mode.Perm()); err != nil {
+		return err
+	}
+	if attrs, err := lower.ListXattrs(name); err == nil {
+		for _, attr := range attrs {
+			if value, err := lower.GetXattr(name, attr); err == nil {
+				upper.SetXattr(name, attr, value)
+			}
+		}
+	}
+	return upper.Chtimes(name, file.info.ModTime(), file.info.ModTime())
+}
+
+// copyFile copies the contents of a file from one storage to another.
+func copyFile(from, to Storage, name string, perm os.FileMode) error {
+	src, err := from.Open(name)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := to.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
+
+// prepareCreate copies up the directory of name and removes the whiteout of
+// name, before name is created in the top layer. It returns whether there
+// was a whiteout.
+func (x *overlayStorage) prepareCreate(op, name string) (bool, error) {
+	if x.isReserved(name) {
+		return false, x.pathError(op, name, syscall.EINVAL)
+	}
+	dir, err := x.find(op, path.Dir(name))
+	switch {
+	case err != nil:
+		return false, err
+	case !dir.info.IsDir():
+		return false, x.pathError(op, name, syscall.ENOTDIR)
+	}
+	if err := x.copyUp(path.Dir(name)); err != nil {
+		return false, err
+	}
+	whiteout, err := exists(x.upper(), whiteoutName(name))
+	if err != nil || !whiteout {
+		return false, err
+	}
+	return true, x.upper().Remove(whiteoutName(name))
+}
+
+// whiteout hides name in the lower layers.
+func (x *overlayStorage) whiteout(name string) error {
+	if err := x.copyUp(path.Dir(name)); err != nil {
+		return err
+	}
+	return writeFile(x.upper(), whiteoutName(name), nil, 0600)
+}
+
+func (x *overlayStorage) Stat(name string) (os.FileInfo, error) {
+	_, file, err := x.resolve("stat", name)
+	return file.info, err
+}
+
+func (x *overlayStorage) Lstat(name string) (os.FileInfo, error) {
+	file, err := x.find("lstat", name)
+	return file.info, err
+}
+
+func (x *overlayStorage) Open(name string) (File, error) {
+	return x.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (x *overlayStorage) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	name = path.Clean("/" + name)
+	target, file, err := x.resolve("open", name)
+	switch {
+	case err == nil && flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL:
+		return nil, x.pathError("open", name, syscall.EEXIST)
+	case os.IsNotExist(err) && flag&os.O_CREATE != 0:
+		// A dangling symlink creates its target, like on disk.
+		if _, err := x.prepareCreate("open", target); err != nil {
+			return nil, err
+		}
+		return x.upper().OpenFile(target, flag, perm)
+	case err != nil:
+		return nil, err
+	case flag&(os.O_WRONLY|os.O_RDWR|os.O_TRUNC|os.O_APPEND) != 0:
+		if err := x.copyUp(target); err != nil {
+			return nil, err
+		}
+		return x.upper().OpenFile(target, flag, perm)
+	}
+
+	f, err := x.layers[file.layer].OpenFile(target, flag, perm)
+	if err != nil || !file.info.IsDir() {
+		return f, err
+	}
+	return &overlayDirFile{File: f, storage: x, name: target}, nil
+}
+
+func (x *overlayStorage) ReadDir(name string) ([]os.DirEntry, error) {
+	name, _, err := x.resolve("open", name)
+	if err != nil {
+		return nil, err
+	}
+	return x.readDir(name)
+}
+
+// readDir merges the entries of a directory in all the layers it is in.
+func (x *overlayStorage) readDir(name string) ([]os.DirEntry, error) {
+	files, err := x.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, x.pathError("open", name, syscall.ENOENT)
+	}
+
+	seen := make(map[string]bool)
+	var merged []os.DirEntry
+	for _, file := range files {
+		if !file.info.IsDir() {
+			continue
+		}
+		entries, err := x.layers[file.layer].ReadDir(name)
+		if err != nil {
+			return nil, err
+		}
+		// The whiteouts of a layer only hide the entries of lower ones.
+		var whiteouts []string
+		for _, entry := range entries {
+			entryName := entry.Name()
+			if hidden, ok := strings.CutPrefix(entryName, overlayWhiteoutPrefix); ok {
+				whiteouts = append(whiteouts, hidden)
+				continue
+			}
+			if !seen[entryName] {
+				seen[entryName] = true
+				merged = append(merged, entry)
+			}
+		}
+		for _, hidden := range whiteouts {
+			seen[hidden] = true
+		}
+	}
+	sort.Slice(merged, func(i, j int) bool { return merged[i].Name() < merged[j].Name() })
+	return merged, nil
+}
+
+func (x *overlayStorage) Mkdir(name string, perm os.FileMode) error {
+	name = path.Clean("/" + name)
+	if name == "/" {
+		if _, err := x.find("mkdir", name); err == nil {
+			return x.pathError("mkdir", name, syscall.EEXIST)
+		}
+		return x.upper().Mkdir(name, perm)
+	}
+	if _, err := x.find("mkdir", name); err == nil {
+		return x.pathError("mkdir", name, syscall.EEXIST)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	whiteout, err := x.prepareCreate("mkdir", name)
+	if err != nil {
+		return err
+	}
+	if err := x.upper().Mkdir(name, perm); err != nil {
+		return err
+	}
+	if whiteout {
+		// The directory replaces a removed one, whose entries in the lower
+		// layers stay removed.
+		return writeFile(x.upper(), path.Join(name, overlayOpaque), nil, 0600)
+	}
+	return nil
+}
+
+// MkdirAll is os.MkdirAll.
+func (x *overlayStorage) MkdirAll(name string, perm os.FileMode) error {
+	name = path.Clean("/" + name)
+	info, err := x.Stat(name)
+	switch {
+	case err == nil && info.IsDir():
+		return nil
+	case err == nil:
+		return x.pathError("mkdir", name, syscall.ENOTDIR)
+	}
+	if name != "/" {
+		if err := x.MkdirAll(path.Dir(name), perm); err != nil {
+			return err
+		}
+	}
+	if err := x.Mkdir(name, perm); err != nil {
+		if info, err1 := x.Lstat(name); err1 == nil && info.IsDir() {
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+func (x *overlayStorage) Remove(name string) error {
+	name = path.Clean("/" + name)
+	file, err := x.find("remove", name)
+	if err != nil {
+		return err
+	}
+	if file.info.IsDir() {
+		entries, err := x.readDir(name)
+		if err != nil {
+			return err
+		}
+		if len(entries) > 0 {
+			return x.pathError("remove", name, syscall.ENOTEMPTY)
+		}
+	}
+	return x.remove(name, file)
+}
+
+// remove removes name from the top layer, which for directories also removes
+// their whiteouts, and then whites it out if a lower layer has it.
+func (x *overlayStorage) remove(name string, file overlayFile) error {
+	if name == "/" {
+		return x.pathError("remove", name, syscall.EBUSY)
+	}
+	if file.layer == 0 {
+		if err := x.upper().RemoveAll(name); err != nil {
+			return err
+		}
+	}
+	lower, err := x.inLower(name)
+	if err != nil || !lower {
+		return err
+	}
+	return x.whiteout(name)
+}
+
+// RemoveAll is os.RemoveAll. Removing the root only empties it, since the
+// lower layers can't be changed.
+func (x *overlayStorage) RemoveAll(name string) error {
+	name = path.Clean("/" + name)
+	file, err := x.find("unlinkat", name)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if name != "/" {
+		return x.remove(name, file)
+	}
+	entries, err := x.readDir(name)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := x.RemoveAll(path.Join(name, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (x *overlayStorage) Rename(oldName, newName string) error {
+	if err := x.rename(oldName, newName); err != nil {
+		if pathErr, ok := err.(*os.PathError); ok {
+			err = pathErr.Err
+		}
+		return &os.LinkError{Op: "rename", Old: x.fileName(oldName), New: x.fileName(newName), Err: err}
+	}
+	return nil
+}
+
+func (x *overlayStorage) rename(oldName, newName string) error {
+	oldName, newName = path.Clean("/"+oldName), path.Clean("/"+newName)
+	if oldName == "/" || newName == "/" {
+		return syscall.EBUSY
+	}
+	file, err := x.find("rename", oldName)
+	if err != nil {
+		return err
+	}
+	if x.isReserved(newName) {
+		return syscall.EINVAL
+	}
+	dir, err := x.find("rename", path.Dir(newName))
+	switch {
+	case err != nil:
+		return err
+	case !dir.info.IsDir():
+		return syscall.ENOTDIR
+	case oldName == newName:
+		return nil
+	case file.info.IsDir() && strings.HasPrefix(newName, oldName+"/"):
+		return syscall.EINVAL
+	}
+	oldInLower, err := x.inLower(oldName)
+	if err != nil {
+		return err
+	}
+	if file.info.IsDir() && oldInLower {
+		return syscall.EXDEV
+	}
+
+	replaced, err := x.find("rename", newName)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return err
+	case file.info.IsDir() && !replaced.info.IsDir():
+		return syscall.ENOTDIR
+	case !file.info.IsDir() && replaced.info.IsDir():
+		return syscall.EISDIR
+	case replaced.info.IsDir():
+		entries, err := x.readDir(newName)
+		if err != nil {
+			return err
+		}
+		if len(entries) > 0 {
+			return syscall.ENOTEMPTY
+		}
+		if replaced.layer == 0 {
+			if err := x.upper().RemoveAll(newName); err != nil {
+				return err
+			}
+		}
+	}
+	newInLower, err := x.inLower(newName)
+	if err != nil {
+		return err
+	}
+
+	if err := x.copyUp(oldName); err != nil {
+		return err
+	}
+	if _, err := x.prepareCreate("rename", newName); err != nil {
+		return err
+	}
+	if err := x.upper().Rename(oldName, newName); err != nil {
+		return err
+	}
+	if file.info.IsDir() && newInLower {
+		if err := writeFile(x.upper(), path.Join(newName, overlayOpaque), nil, 0600); err != nil {
+			return err
+		}
+	}
+	if oldInLower {
+		return x.whiteout(oldName)
+	}
+	return nil
+}
+
+// change copies up the file name resolves to and changes it in the top
+// layer.
+func (x *overlayStorage) change(op, name string, follow bool, fn func(upper Storage, name string) error) error {
+	var err error
+	if follow {
+		name, _, err = x.resolve(op, name)
+	} else {
+		_, err = x.find(op, name)
+	}
+	if err != nil {
+		return err
+	}
+	if err := x.copyUp(name); err != nil {
+		return err
+	}
+	return fn(x.upper(), name)
+}
+
+func (x *overlayStorage) Chmod(name string, mode os.FileMode) error {
+	return x.change("chmod", name, true, func(upper Storage, name string) error {
+		return upper.Chmod(name, mode)
+	})
+}
+
+func (x *overlayStorage) Chown(name string, uid, gid int) error {
+	return x.change("chown", name, true, func(upper Storage, name string) error {
+		return upper.Chown(name, uid, gid)
+	})
+}
+
+func (x *overlayStorage) Lchown(name string, uid, gid int) error {
+	return x.change("lchown", name, false, func(upper Storage, name string) error {
+		return upper.Lchown(name, uid, gid)
+	})
+}
+
+func (x *overlayStorage) Chtimes(name string, atime, mtime time.Time) error {
+	return x.change("chtimes", name, true, func(upper Storage, name string) error {
+		return upper.Chtimes(name, atime, mtime)
+	})
+}
+
+func (x *overlayStorage) Truncate(name string, size int64) error {
+	return x.change("truncate", name, true, func(upper Storage, name string) error {
+		return upper.Truncate(name, size)
+	})
+}
+
+func (x *overlayStorage) Symlink(target, newName string) error {
+	newName = path.Clean("/" + newName)
+	if _, err := x.find("symlink", newName); err == nil {
+		return &os.LinkError{Op: "symlink", Old: target, New: x.fileName(newName), Err: syscall.EEXIST}
+	}
+	if _, err := x.prepareCreate("symlink", newName); err != nil {
+		return err
+	}
+	return x.upper().Symlink(target, newName)
+}
+
+func (x *overlayStorage) Readlink(name string) (string, error) {
+	file, err := x.find("readlink", name)
+	if err != nil {
+		return "", err
+	}
+	return x.layers[file.layer].Readlink(name)
+}
+
+// The extended attribute methods return bare errnos, like the syscalls.
+
+func (x *overlayStorage) ListXattrs(name string) ([]string, error) {
+	name, file, err := x.resolve("stat", name)
+	if err != nil {
+		return nil, syscall.ENOENT
+	}
+	return x.layers[file.layer].ListXattrs(name)
+}
+
+func (x *overlayStorage) GetXattr(name, attr string) ([]byte, error) {
+	name, file, err := x.resolve("stat", name)
+	if err != nil {
+		return nil, syscall.ENOENT
+	}
+	return x.layers[file.layer].GetXattr(name, attr)
+}
+
+func (x *overlayStorage) SetXattr(name, attr string, value []byte) error {
+	return x.xattrError(x.change("setxattr", name, true, func(upper Storage, name string) error {
+		return upper.SetXattr(name, attr, value)
+	}))
+}
+
+func (x *overlayStorage) RemoveXattr(name, attr string) error {
+	return x.xattrError(x.change("removexattr", name, true, func(upper Storage, name string) error {
+		return upper.RemoveXattr(name, attr)
+	}))
+}
+
+func (x *overlayStorage) xattrError(err error) error {
+	if pathErr, ok := err.(*os.PathError); ok {
+		return pathErr.Err
+	}
+	return err
+}
+
+// overlayDirFile is an open directory of an overlayStorage, which lists the
+// entries of all the layers.
+type overlayDirFile struct {
+	File
+	storage *overlayStorage
+	name    string
+	// infos are read on the first Readdir.
+	infos []os.FileInfo
+}
+
+// Readdir is os.File.Readdir.
+func (x *overlayDirFile) Readdir(count int) ([]os.FileInfo, error) {
+	if x.infos == nil {
+		entries, err := x.storage.readDir(x.name)
+		if err != nil {
+			return nil, err
+		}
+		x.infos = make([]os.FileInfo, 0, len(entries))
+		for _, entry := range entries {
+			info, err := entry.Info()
+			if err != nil {
+				return nil, err
+			}
+			x.infos = append(x.infos, info)
+		}
+	}
+
+	infos := x.infos
+	if count > 0 {
+		if len(infos) == 0 {
+			return nil, io.EOF
+		}
+		if count < len(infos) {
+			infos = infos[:count]
+		}
+	}
+	x.infos = x.infos[len(infos):]
+	return infos, nil
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"reflect"
+	"syscall"
+	"testing"
+)
+
+func TestOverlayStorage(t *testing.T) {
+	newTestStorage := func(t *testing.T) (upper, lower *memStorage, storage *overlayStorage) {
+		t.Helper()
+		upper, lower = newMemStorage(ContentRoot), newMemStorage("base")
+		for name, contents := range map[string]string{
+			"/default.txt":       "default\n",
+			"/overridden.txt":    "default\n",
+			"/conf/a.txt":        "a\n",
+			"/conf/b.txt":        "b\n",
+			"/conf/nested/c.txt": "c\n",
+		} {
+			if err := lower.MkdirAll(path.Dir(name), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := writeFile(lower, name, []byte(contents), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := writeFile(upper, "/overridden.txt", []byte("override\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return upper, lower, newOverlayStorage(ContentRoot, upper, lower)
+	}
+	assertContents := func(t *testing.T, storage Storage, name, want string) {
+		t.Helper()
+		contents, err := readFile(storage, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(contents) != want {
+			t.Errorf("got contents %q of %s, want %q", contents, name, want)
+		}
+	}
+	assertNames := func(t *testing.T, storage Storage, name string, want ...string) {
+		t.Helper()
+		entries, err := storage.ReadDir(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+		if !reflect.DeepEqual(names, want) {
+			t.Errorf("got entries %q of %s, want %q", names, name, want)
+		}
+	}
+
+	t.Run("reads resolve top down", func(t *testing.T) {
+		_, _, storage := newTestStorage(t)
+		assertContents(t, storage, "/default.txt", "default\n")
+		assertContents(t, storage, "/overridden.txt", "override\n")
+		info, err := storage.Stat("/overridden.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode() != 0600 {
+			t.Errorf("got mode %v", info.Mode())
+		}
+		assertNames(t, storage, "/", "conf", "default.txt", "overridden.txt")
+	})
+
+	t.Run("changes copy up", func(t *testing.T) {
+		upper, lower, storage := newTestStorage(t)
+		if err := storage.Chmod("/conf/nested/c.txt", 0600); err != nil {
+			t.Fatal(err)
+		}
+		f, err := storage.OpenFile("/conf/a.txt", os.O_WRONLY|os.O_APPEND, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Write([]byte("more\n")); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		assertContents(t, upper, "/conf/a.txt", "a\nmore\n")
+		assertContents(t, upper, "/conf/nested/c.txt", "c\n")
+		assertContents(t, lower, "/conf/a.txt", "a\n")
+		if info, err := lower.Stat("/conf/nested/c.txt"); err != nil || info.Mode() != 0644 {
+			t.Errorf("got lower file %v, %v", info, err)
+		}
+		if info, err := upper.Stat("/conf/nested"); err != nil || info.Mode() != os.ModeDir|0755 {
+			t.Errorf("got copied up directory %v, %v", info, err)
+		}
+		assertNames(t, storage, "/conf", "a.txt", "b.txt", "nested")
+	})
+
+	t.Run("removes leave whiteouts", func(t *testing.T) {
+		upper, lower, storage := newTestStorage(t)
+		if err := storage.Remove("/conf/a.txt"); err != nil {
+			t.Fatal(err)
+		}
+		if err := storage.Remove("/overridden.txt"); err != nil {
+			t.Fatal(err)
+		}
+		if err := storage.Remove("/conf"); err == nil || err.Error() != "remove test/conf: directory not empty" {
+			t.Errorf("got error %v removing a directory with lower entries", err)
+		}
+
+		if _, err := storage.Stat("/overridden.txt"); !os.IsNotExist(err) {
+			t.Errorf("got error %v for a removed file", err)
+		}
+		if _, err := lower.Stat("/overridden.txt"); err != nil {
+			t.Errorf("the lower file was removed: %v", err)
+		}
+		if _, err := upper.Stat("/conf/.wh.a.txt"); err != nil {
+			t.Errorf("got no whiteout: %v", err)
+		}
+		if _, err := storage.Stat("/conf/.wh.a.txt"); !os.IsNotExist(err) {
+			t.Errorf("got error %v for a whiteout", err)
+		}
+		assertNames(t, storage, "/conf", "b.txt", "nested")
+		assertNames(t, storage, "/", "conf", "default.txt")
+
+		if err := writeFile(storage, "/conf/a.txt", []byte("new\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		assertContents(t, storage, "/conf/a.txt", "new\n")
+	})
+
+	t.Run("directories made again hide the lower ones", func(t *testing.T) {
+		_, _, storage := newTestStorage(t)
+		if err := storage.RemoveAll("/conf"); err != nil {
+			t.Fatal(err)
+		}
+		if err := storage.Mkdir("/conf", 0755); err != nil {
+			t.Fatal(err)
+		}
+		assertNames(t, storage, "/conf")
+		if _, err := storage.Stat("/conf/nested/c.txt"); !os.IsNotExist(err) {
+			t.Errorf("got error %v for a file of a removed directory", err)
+		}
+	})
+
+	t.Run("renames", func(t *testing.T) {
+		_, _, storage := newTestStorage(t)
+		if err := storage.Rename("/default.txt", "/conf/renamed.txt"); err != nil {
+			t.Fatal(err)
+		}
+		assertContents(t, storage, "/conf/renamed.txt", "default\n")
+		if _, err := storage.Stat("/default.txt"); !os.IsNotExist(err) {
+			t.Errorf("got error %v for a renamed file", err)
+		}
+		if err := storage.Rename("/conf", "/etc"); err == nil || err.(*os.LinkError).Err != syscall.EXDEV {
+			t.Errorf("got error %v renaming a lower directory", err)
+		}
+	})
+
+	t.Run("listings are merged", func(t *testing.T) {
+		_, _, storage := newTestStorage(t)
+		if err := writeFile(storage, "/conf/d.txt", []byte("d\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := storage.Remove("/conf/b.txt"); err != nil {
+			t.Fatal(err)
+		}
+		config := newConfig(ContentRoot)
+		config.Storage = storage
+		responseRecorder := httptest.NewRecorder()
+		httpHandler(config).ServeHTTP(responseRecorder, httptest.NewRequest(http.MethodGet, "/conf", nil))
+
+		var response ResponseBody
+		if err := json.NewDecoder(responseRecorder.Result().Body).Decode(&response); err != nil {
+			t.Fatal(err)
+		}
+		if response.Directory == nil {
+			t.Fatalf("got response %+v", response)
+		}
+		var entries []string
+		for _, entry := range response.Directory.Entries {
+			entries = append(entries, entry.Path+" "+entry.Type)
+		}
+		want := []string{"/conf/a.txt file", "/conf/d.txt file", "/conf/nested directory"}
+		if !reflect.DeepEqual(entries, want) {
+			t.Errorf("got entries %q, want %q", entries, want)
+		}
+	})
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestDiskStorage(t *testing.T) {
+	mustMakeContentRoot(t)
+	defer mustDeleteContentRoot(t)
+
+	storage := newDiskStorage(ContentRoot)
+
+	t.Run("names stay inside the root", func(t *testing.T) {
+		if err := writeFile(storage, "../../file.txt", []byte("hello\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		assertFileContents(t, "/file.txt", 0600, "hello\n")
+
+		contents, err := readFile(storage, "/dir/../../file.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(contents) != "hello\n" {
+			t.Errorf("got contents %q", contents)
+		}
+	})
+
+	t.Run("walk", func(t *testing.T) {
+		mustMkDir(t, "/a", 0755)
+		mustMkDir(t, "/a/skipped", 0755)
+		mustWriteFile(t, []byte{}, "/a/skipped/file.txt", 0644)
+		mustWriteFile(t, []byte{}, "/a/file.txt", 0644)
+		mustWriteFile(t, []byte{}, "/a/"+path.Base(tempFileName("/a/file.txt")), 0600)
+
+		var names []string
+		err := walkStorage(storage, "/", func(name string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			names = append(names, name)
+			if name == "/a/skipped" {
+				return filepath.SkipDir
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []string{"/", "/a", "/a/file.txt", "/a/skipped", "/file.txt"}
+		if !reflect.DeepEqual(names, want) {
+			t.Errorf("got names %q, want %q", names, want)
+		}
+	})
+}
+
+func TestMemStorage(t *testing.T) {
+	t.Run("permissions", func(t *testing.T) {
+		storage := newMemStorage(ContentRoot)
+		storage.uid, storage.gid, storage.groups = 1000, 1000, nil
+
+		if err := writeFile(storage, "/file.txt", []byte("hello\n"), 0666); !os.IsPermission(err) {
+			t.Errorf("got error %v writing to a directory of root", err)
+		}
+		if err := storage.Chmod("/", 0777); !os.IsPermission(err) {
+			t.Errorf("got error %v changing a directory of root", err)
+		}
+
+		storage.uid = 0
+		if err := storage.Chmod("/", 0777); err != nil {
+			t.Fatal(err)
+		}
+		storage.uid = 1000
+		if err := writeFile(storage, "/file.txt", []byte("hello\n"), 0666); err != nil {
+			t.Fatal(err)
+		}
+		info, err := storage.Stat("/file.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if uid, gid := fileOwner(info); uid != 1000 || gid != 1000 || info.Mode() != 0644 {
+			t.Errorf("got owner %d:%d and mode %v", uid, gid, info.Mode())
+		}
+
+		if err := storage.Chmod("/file.txt", 0400); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := storage.OpenFile("/file.txt", os.O_WRONLY, 0); !os.IsPermission(err) {
+			t.Errorf("got error %v opening a read only file for writing", err)
+		}
+		if err := storage.Chown("/file.txt", 0, -1); !os.IsPermission(err) {
+			t.Errorf("got error %v giving a file away", err)
+		}
+	})
+
+	t.Run("files of others are replaced", func(t *testing.T) {
+		storage := newMemStorage(ContentRoot)
+		if err := storage.Chmod("/", 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := writeFile(storage, "/file.txt", []byte("hello\n"), 0666); err != nil {
+			t.Fatal(err)
+		}
+		if err := storage.Chmod("/file.txt", 0666); err != nil {
+			t.Fatal(err)
+		}
+		storage.uid, storage.gid, storage.groups = 1000, 1000, nil
+
+		if err := replaceFile(storage, "/file.txt", func(f File) error {
+			_, err := f.Write([]byte("world\n"))
+			return err
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if contents, err := readFile(storage, "/file.txt"); err != nil || string(contents) != "world\n" {
+			t.Errorf("got contents %q, %v", contents, err)
+		}
+		info, err := storage.Stat("/file.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if uid, _ := fileOwner(info); uid != 1000 || info.Mode() != 0666 {
+			t.Errorf("got owner %d and mode %v", uid, info.Mode())
+		}
+	})
+
+	t.Run("size limit", func(t *testing.T) {
+		storage := newMemStorage(ContentRoot)
+		storage.maxSize = 10
+		if err := writeFile(storage, "/file.txt", []byte("hello\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := storage.Truncate("/file.txt", 100000000000); !errors.Is(err, syscall.ENOSPC) {
+			t.Errorf("got error %v truncating past the limit", err)
+		}
+		if err := writeFileAt(storage, "/file.txt", []byte("!"), 100000000000); !errors.Is(err, syscall.ENOSPC) {
+			t.Errorf("got error %v writing past the limit", err)
+		}
+		if err := writeFile(storage, "/other.txt", []byte("world\n"), 0644); !errors.Is(err, syscall.ENOSPC) {
+			t.Errorf("got error %v writing another file past the limit", err)
+		}
+
+		if err := storage.Remove("/file.txt"); err != nil {
+			t.Fatal(err)
+		}
+		if err := writeFile(storage, "/other.txt", []byte("world!!!!\n"), 0644); err != nil {
+			t.Errorf("got error %v writing to the space of a removed file", err)
+		}
+		if err := storage.Truncate("/other.txt", 4); err != nil {
+			t.Fatal(err)
+		}
+		if err := writeFile(storage, "/file.txt", []byte("hello\n"), 0644); err != nil {
+			t.Errorf("got error %v writing to the space of a truncated file", err)
+		}
+		if err := storage.Rename("/file.txt", "/other.txt"); err != nil {
+			t.Fatal(err)
+		}
+		if err := writeFile(storage, "/last.txt", []byte("bye\n"), 0644); err != nil {
+			t.Errorf("got error %v writing to the space of a replaced file", err)
+		}
+	})
+
+	t.Run("timestamps", func(t *testing.T) {
+		storage := newMemStorage(ContentRoot)
+		past := time.Now().Add(-time.Hour).Truncate(time.Second)
+		if err := storage.Chtimes("/", past, past); err != nil {
+			t.Fatal(err)
+		}
+		if err := writeFile(storage, "/file.txt", []byte("hello\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		info, err := storage.Stat("/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !info.ModTime().After(past) {
+			t.Errorf("creating a file did not change the directory modification time")
+		}
+
+		if err := storage.Chtimes("/file.txt", past, past); err != nil {
+			t.Fatal(err)
+		}
+		if info, err = storage.Stat("/file.txt"); err != nil {
+			t.Fatal(err)
+		}
+		if !info.ModTime().Equal(past) {
+			t.Errorf("got modification time %v, want %v", info.ModTime(), past)
+		}
+	})
+
+	t.Run("errors are like the disk", func(t *testing.T) {
+		storage := newMemStorage(ContentRoot)
+		if err := storage.MkdirAll("/a/b", 0755); err != nil {
+			t.Fatal(err)
+		}
+		for _, test := range []struct {
+			err  error
+			want string
+		}{
+			{storage.Remove("/a"), "remove test/a: directory not empty"},
+			{storage.Rename("/a", "/a/b/c"), "rename test/a test/a/b/c: invalid argument"},
+			{storage.Mkdir("/a", 0755), "mkdir test/a: file exists"},
+			{storage.Truncate("/missing.txt", 0), "truncate test/missing.txt: no such file or directory"},
+		} {
+			if test.err == nil || test.err.Error() != test.want {
+				t.Errorf("got error %v, want %s", test.err, test.want)
+			}
+		}
+	})
+
+	t.Run("symlinks stay inside the storage", func(t *testing.T) {
+		storage := newMemStorage(ContentRoot)
+		if err := writeFile(storage, "/file.txt", []byte("hello\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := storage.Symlink("../../file.txt", "/link"); err != nil {
+			t.Fatal(err)
+		}
+		contents, err := readFile(storage, "/link")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(contents) != "hello\n" {
+			t.Errorf("got contents %q", contents)
+		}
+	})
+}
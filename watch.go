@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// watchHistorySize is how many recent events are kept for resuming streams.
+const watchHistorySize = 1024
+
+// watchBufferSize is how many events a subscriber may fall behind before it
+// is disconnected. It can then resume from its last event id.
+const watchBufferSize = 256
+
+const watchHeartbeatInterval = 15 * time.Second
+
+// Watcher watches the content root for changes and fans them out to
+// subscribers. It starts watching on the first subscription and keeps the
+// recent history so that clients can resume from the last event they saw.
+type Watcher struct {
+	config Config
+
+	mu          sync.Mutex
+	started     bool
+	lastID      uint64
+	history     []WatchEvent
+	subscribers map[*watchSubscription]bool
+}
+
+type watchSubscription struct {
+	urlPath   string
+	recursive bool
+	events    chan WatchEvent
+}
+
+func newWatcher(config Config) *Watcher {
+	return &Watcher{config: config, subscribers: make(map[*watchSubscription]bool)}
+}
+
+// Subscribe returns a subscription to events for urlPath and the events after
+// lastID that are still in the history. A lastID of 0 replays nothing. The
+// urlPath is relative to the mount of the config, if any, while the events
+// have the paths clients see.
+func (x *Watcher) Subscribe(urlPath string, recursive bool, lastID uint64) (*watchSubscription, []WatchEvent, error) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	if !x.started {
+		if err := x.startBackend(); err != nil {
+			return nil, nil, err
+		}
+		x.started = true
+	}
+
+	sub := &watchSubscription{
+		urlPath:   x.config.urlPath(path.Clean("/" + urlPath)),
+		recursive: recursive,
+		events:    make(chan WatchEvent, watchBufferSize),
+	}
+	x.subscribers[sub] = true
+
+	var replay []WatchEvent
+	if lastID > 0 {
+		for _, event := range x.history {
+			if event.ID > lastID && sub.matches(event) {
+				replay = append(replay, event)
+			}
+		}
+	}
+	return sub, replay, nil
+}
+
+func (x *Watcher) Unsubscribe(sub *watchSubscription) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.subscribers[sub] {
+		delete(x.subscribers, sub)
+		close(sub.events)
+	}
+}
+
+// publish records a change to relPath, a slash separated path relative to the
+// content root. oldRelPath is only set for renames.
+func (x *Watcher) publish(eventType, relPath, oldRelPath string) {
+	if isTempFileName(relPath) {
+		return
+	}
+	// A temporary file renamed over a file replaces its contents.
+	if isTempFileName(oldRelPath) {
+		eventType, oldRelPath = WatchEventModify, ""
+	}
+	event := WatchEvent{Type: eventType, Path: x.config.urlPath(path.Join("/", relPath))}
+	if oldRelPath != "" {
+		event.OldPath = x.config.urlPath(path.Join("/", oldRelPath))
+	}
+	if eventType != WatchEventDelete {
+		info, err := x.config.Storage.Lstat(relPath)
+		if err != nil {
+			// Already gone again. The delete event follows.
+			return
+		}
+		meta := NewFileMeta(event.Path, info)
+		event.Meta = &meta
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	x.lastID++
+	event.ID = x.lastID
+	x.history = append(x.history, event)
+	if len(x.history) > watchHistorySize {
+		x.history = x.history[len(x.history)-watchHistorySize:]
+	}
+
+	for sub := range x.subscribers {
+		if !sub.matches(event) {
+			continue
+		}
+		select {
+		case sub.events <- event:
+		default:
+			// Too far behind. Closing the stream lets the client resume.
+			delete(x.subscribers, sub)
+			close(sub.events)
+		}
+	}
+}
+
+// matches reports whether the event is for the watched path, one of its
+// children, or any descendant when recursive.
+func (x *watchSubscription) matches(event WatchEvent) bool {
+	return x.matchesPath(event.Path) || (event.OldPath != "" && x.matchesPath(event.OldPath))
+}
+
+func (x *watchSubscription) matchesPath(urlPath string) bool {
+	switch {
+	case urlPath == x.urlPath, path.Dir(urlPath) == x.urlPath:
+		return true
+	case x.recursive && x.urlPath == "/":
+		return true
+	default:
+		return x.recursive && strings.HasPrefix(urlPath, x.urlPath+"/")
+	}
+}
+
+// isWatchRequest reports whether a GET asks for an event stream.
+func isWatchRequest(r *http.Request) bool {
+	return r.Method == http.MethodGet &&
+		(r.URL.Query().Get("watch") == "true" || strings.Contains(r.Header.Get("Accept"), "text/event-stream"))
+}
+
+// handleWatch streams change events for the request path as server-sent
+// events until the client disconnects.
+func handleWatch(config Config, watcher *Watcher, w http.ResponseWriter, r *http.Request) {
+	if _, err := config.Storage.Stat(r.URL.Path); err != nil {
+		if os.IsNotExist(err) {
+			notFound(w, err)
+		} else {
+			internalServerError(w, err)
+		}
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		internalServerError(w, fmt.Errorf("streaming is not supported"))
+		return
+	}
+
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("last_event_id")
+	}
+	var lastID uint64
+	if lastEventID != "" {
+		var err error
+		if lastID, err = strconv.ParseUint(lastEventID, 10, 64); err != nil {
+			badRequest(w, fmt.Sprintf("invalid last event id %q", lastEventID))
+			return
+		}
+	}
+
+	sub, replay, err := watcher.Subscribe(r.URL.Path, r.URL.Query().Get("recursive") == "true", lastID)
+	if err != nil {
+		internalServerError(w, err)
+		return
+	}
+	defer watcher.Unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	for _, event := range replay {
+		if err := writeServerSentEvent(w, event); err != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(watchHeartbeatInterval)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+		case event, ok := <-sub.events:
+			if !ok {
+				return
+			}
+			if err := writeServerSentEvent(w, event); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+func writeServerSentEvent(w http.ResponseWriter, event WatchEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+	return err
+}
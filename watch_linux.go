@@ -0,0 +1,206 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+const inotifyMask = syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MODIFY | syscall.IN_ATTRIB |
+	syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_DONT_FOLLOW | syscall.IN_ONLYDIR
+
+// startBackend watches with inotify, falling back to polling if it's disabled
+// or unavailable, for example when out of inotify watches. Storages that
+// aren't on the local disk are always polled.
+func (x *Watcher) startBackend() error {
+	storage, ok := diskStorageOf(x.config.Storage)
+	if x.config.WatchPolling || !ok {
+		return x.startPolling()
+	}
+
+	watcher, err := newInotifyWatcher(x, storage.root)
+	if err != nil {
+		log.Printf("inotify is unavailable, polling for changes instead: %v", err)
+		return x.startPolling()
+	}
+	go watcher.run()
+	return nil
+}
+
+type inotifyWatcher struct {
+	watcher *Watcher
+	root    string
+	fd      int
+	file    *os.File
+	// dirs maps watch descriptors to directories relative to the content root.
+	dirs map[int]string
+}
+
+func newInotifyWatcher(watcher *Watcher, root string) (*inotifyWatcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+
+	// The non-blocking fd lets the os.File reads use the runtime poller.
+	x := &inotifyWatcher{
+		watcher: watcher,
+		root:    root,
+		fd:      fd,
+		file:    os.NewFile(uintptr(fd), "inotify"),
+		dirs:    make(map[int]string),
+	}
+	if err := x.addRecursive("", false); err != nil {
+		x.file.Close()
+		return nil, err
+	}
+	return x, nil
+}
+
+// addRecursive watches relPath and every directory below it. When emit is
+// true, a create event is published for each entry found, since they may
+// have been created before the watch was in place.
+func (x *inotifyWatcher) addRecursive(relPath string, emit bool) error {
+	root := x.root
+	return filepath.Walk(path.Join(root, relPath), func(fileName string, info os.FileInfo, err error) error {
+		switch {
+		case os.IsNotExist(err):
+			return nil
+		case err != nil:
+			return err
+		}
+		rel, err := filepath.Rel(root, fileName)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if emit {
+			x.watcher.publish(WatchEventCreate, rel, "")
+		}
+		if !info.IsDir() {
+			return nil
+		}
+
+		wd, err := syscall.InotifyAddWatch(x.fd, fileName, inotifyMask)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			rel = ""
+		}
+		x.dirs[wd] = rel
+		return nil
+	})
+}
+
+func (x *inotifyWatcher) run() {
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := x.file.Read(buf)
+		if err != nil {
+			log.Printf("reading inotify events: %v", err)
+			return
+		}
+		x.handle(buf[:n])
+	}
+}
+
+// handle publishes a batch of inotify events. A move within the content root
+// is a pair of events with the same cookie, which is published as a rename.
+// An unpaired move is published as a create or delete.
+func (x *inotifyWatcher) handle(buf []byte) {
+	movedFrom := make(map[uint32]string)
+	var movedFromOrder []uint32
+	var lastModified string
+
+	for offset := 0; offset+syscall.SizeofInotifyEvent <= len(buf); {
+		raw := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+		nameStart := offset + syscall.SizeofInotifyEvent
+		offset = nameStart + int(raw.Len)
+		name := strings.TrimRight(string(buf[nameStart:offset]), "\x00")
+
+		if raw.Mask&syscall.IN_Q_OVERFLOW != 0 {
+			log.Printf("inotify queue overflowed, some changes were not published")
+			continue
+		}
+		if raw.Mask&syscall.IN_IGNORED != 0 {
+			delete(x.dirs, int(raw.Wd))
+			continue
+		}
+		dir, ok := x.dirs[int(raw.Wd)]
+		if !ok {
+			continue
+		}
+		relPath := path.Join(dir, name)
+		isDir := raw.Mask&syscall.IN_ISDIR != 0
+
+		switch {
+		case raw.Mask&syscall.IN_CREATE != 0 && isDir:
+			if err := x.addRecursive(relPath, true); err != nil {
+				log.Printf("watching %s: %v", relPath, err)
+			}
+		case raw.Mask&syscall.IN_CREATE != 0:
+			x.watcher.publish(WatchEventCreate, relPath, "")
+		case raw.Mask&syscall.IN_DELETE != 0:
+			x.watcher.publish(WatchEventDelete, relPath, "")
+		case raw.Mask&syscall.IN_MOVED_FROM != 0:
+			movedFrom[raw.Cookie] = relPath
+			movedFromOrder = append(movedFromOrder, raw.Cookie)
+		case raw.Mask&syscall.IN_MOVED_TO != 0:
+			oldRelPath, ok := movedFrom[raw.Cookie]
+			delete(movedFrom, raw.Cookie)
+			switch {
+			case ok:
+				x.renameDirs(oldRelPath, relPath)
+				x.watcher.publish(WatchEventRename, relPath, oldRelPath)
+			case isDir:
+				if err := x.addRecursive(relPath, true); err != nil {
+					log.Printf("watching %s: %v", relPath, err)
+				}
+			default:
+				x.watcher.publish(WatchEventCreate, relPath, "")
+			}
+		case raw.Mask&(syscall.IN_MODIFY|syscall.IN_ATTRIB) != 0:
+			// Writes come in many small events, so collapse repeats.
+			if relPath != lastModified {
+				x.watcher.publish(WatchEventModify, relPath, "")
+			}
+		}
+
+		if raw.Mask&(syscall.IN_MODIFY|syscall.IN_ATTRIB) != 0 {
+			lastModified = relPath
+		} else {
+			lastModified = ""
+		}
+	}
+
+	for _, cookie := range movedFromOrder {
+		if relPath, ok := movedFrom[cookie]; ok {
+			x.removeDirs(relPath)
+			x.watcher.publish(WatchEventDelete, relPath, "")
+		}
+	}
+}
+
+// renameDirs updates the watched directories moved from oldRelPath.
+func (x *inotifyWatcher) renameDirs(oldRelPath, relPath string) {
+	for wd, dir := range x.dirs {
+		if dir == oldRelPath || strings.HasPrefix(dir, oldRelPath+"/") {
+			x.dirs[wd] = relPath + strings.TrimPrefix(dir, oldRelPath)
+		}
+	}
+}
+
+// removeDirs stops watching directories moved out of the content root.
+func (x *inotifyWatcher) removeDirs(relPath string) {
+	for wd, dir := range x.dirs {
+		if dir == relPath || strings.HasPrefix(dir, relPath+"/") {
+			syscall.InotifyRmWatch(x.fd, uint32(wd))
+			delete(x.dirs, wd)
+		}
+	}
+}
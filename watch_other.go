@@ -0,0 +1,8 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+func (x *Watcher) startBackend() error {
+	return x.startPolling()
+}
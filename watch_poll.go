@@ -0,0 +1,103 @@
+package main
+
+import (
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// pollWatcher detects changes by periodically walking the content root and
+// comparing it to the previous walk. Renames show up as a delete and a create.
+type pollWatcher struct {
+	watcher  *Watcher
+	snapshot map[string]pollEntry
+}
+
+type pollEntry struct {
+	mode    os.FileMode
+	size    int64
+	modTime time.Time
+}
+
+func (x *Watcher) startPolling() error {
+	poller := &pollWatcher{watcher: x}
+	snapshot, err := poller.scan()
+	if err != nil {
+		return err
+	}
+	poller.snapshot = snapshot
+	go poller.run(x.config.WatchPollInterval)
+	return nil
+}
+
+func (x *pollWatcher) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		snapshot, err := x.scan()
+		if err != nil {
+			log.Printf("polling for changes: %v", err)
+			continue
+		}
+		x.diff(snapshot)
+		x.snapshot = snapshot
+	}
+}
+
+func (x *pollWatcher) scan() (map[string]pollEntry, error) {
+	snapshot := make(map[string]pollEntry)
+	err := walkStorage(x.watcher.config.Storage, "/", func(name string, info os.FileInfo, err error) error {
+		switch {
+		case os.IsNotExist(err):
+			// Deleted during the walk.
+			return nil
+		case err != nil:
+			return err
+		}
+		if name == "/" {
+			return nil
+		}
+		snapshot[strings.TrimPrefix(name, "/")] = pollEntry{info.Mode(), info.Size(), info.ModTime()}
+		return nil
+	})
+	return snapshot, err
+}
+
+// diff publishes the changes between the last snapshot and the next one.
+// Directory size and mtime changes are ignored since they only reflect
+// changes to their entries, which are reported on their own.
+func (x *pollWatcher) diff(next map[string]pollEntry) {
+	var created, modified, deleted []string
+	for relPath, entry := range next {
+		prev, ok := x.snapshot[relPath]
+		switch {
+		case !ok:
+			created = append(created, relPath)
+		case prev.mode != entry.mode:
+			modified = append(modified, relPath)
+		case !entry.mode.IsDir() && (prev.size != entry.size || !prev.modTime.Equal(entry.modTime)):
+			modified = append(modified, relPath)
+		}
+	}
+	for relPath := range x.snapshot {
+		if _, ok := next[relPath]; !ok {
+			deleted = append(deleted, relPath)
+		}
+	}
+
+	// Sorting puts parents before their children.
+	sort.Strings(created)
+	sort.Strings(modified)
+	sort.Sort(sort.Reverse(sort.StringSlice(deleted)))
+	for _, relPath := range deleted {
+		x.watcher.publish(WatchEventDelete, relPath, "")
+	}
+	for _, relPath := range created {
+		x.watcher.publish(WatchEventCreate, relPath, "")
+	}
+	for _, relPath := range modified {
+		x.watcher.publish(WatchEventModify, relPath, "")
+	}
+}
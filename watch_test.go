@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandleWatch(t *testing.T) {
+	for _, polling := range []bool{false, true} {
+		name := "inotify"
+		if polling {
+			name = "polling"
+		}
+
+		t.Run(name, func(t *testing.T) {
+			mustMakeContentRoot(t)
+			defer mustDeleteContentRoot(t)
+
+			config := newConfig(ContentRoot)
+			config.WatchPolling = polling
+			config.WatchPollInterval = 10 * time.Millisecond
+			server := httptest.NewServer(httpHandler(config))
+			defer server.Close()
+
+			mustMkDir(t, "/dir", 0700)
+			events := mustWatch(t, server.URL+"/dir?watch=true&recursive=true", "")
+			defer events.Close()
+
+			mustMkDir(t, "/dir/sub", 0700)
+			assertNextWatchEvent(t, events, WatchEventCreate, "/dir/sub", "")
+			mustWriteFile(t, []byte("hello\n"), "/dir/sub/file.txt", 0600)
+			assertNextWatchEvent(t, events, WatchEventCreate, "/dir/sub/file.txt", "")
+			if err := os.Remove(path.Join(ContentRoot, "/dir/sub/file.txt")); err != nil {
+				t.Fatal(err)
+			}
+			assertNextWatchEvent(t, events, WatchEventDelete, "/dir/sub/file.txt", "")
+			mustWriteFile(t, []byte("hello\n"), "/outside.txt", 0600)
+			mustWriteFile(t, []byte("hello\n"), "/dir/last.txt", 0600)
+			assertNextWatchEvent(t, events, WatchEventCreate, "/dir/last.txt", "")
+		})
+	}
+
+	t.Run("rename", func(t *testing.T) {
+		mustMakeContentRoot(t)
+		defer mustDeleteContentRoot(t)
+
+		server := httptest.NewServer(httpHandler(newConfig(ContentRoot)))
+		defer server.Close()
+
+		mustWriteFile(t, []byte("hello\n"), "/old.txt", 0600)
+		events := mustWatch(t, server.URL+"/?watch=true", "")
+		defer events.Close()
+
+		if err := os.Rename(path.Join(ContentRoot, "/old.txt"), path.Join(ContentRoot, "/new.txt")); err != nil {
+			t.Fatal(err)
+		}
+		event := assertNextWatchEvent(t, events, WatchEventRename, "/new.txt", "/old.txt")
+		if event.Meta == nil || event.Meta.Size != 6 {
+			t.Errorf("want rename event with metadata, got %+v", event.Meta)
+		}
+	})
+
+	t.Run("replaced files", func(t *testing.T) {
+		mustMakeContentRoot(t)
+		defer mustDeleteContentRoot(t)
+
+		server := httptest.NewServer(httpHandler(newConfig(ContentRoot)))
+		defer server.Close()
+
+		mustWriteFile(t, []byte("hello\n"), "/file.txt", 0600)
+		events := mustWatch(t, server.URL+"/?watch=true", "")
+		defer events.Close()
+
+		storage := newDiskStorage(ContentRoot)
+		if err := replaceFile(storage, "/file.txt", func(f File) error {
+			_, err := f.Write([]byte("world\n"))
+			return err
+		}); err != nil {
+			t.Fatal(err)
+		}
+		// Like a replacement still being written.
+		mustWriteFile(t, []byte("partial"), "/"+path.Base(tempFileName("/file.txt")), 0600)
+		// No events of the temporary files come before the next one.
+		mustWriteFile(t, []byte("hello\n"), "/last.txt", 0600)
+		assertNextWatchEvent(t, events, WatchEventCreate, "/last.txt", "")
+		resp, err := http.Get(server.URL + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var body ResponseBody
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		if len(body.Directory.Entries) != 2 {
+			t.Errorf("got entries %+v, want file.txt and last.txt", body.Directory.Entries)
+		}
+	})
+
+	t.Run("resume from last event id", func(t *testing.T) {
+		mustMakeContentRoot(t)
+		defer mustDeleteContentRoot(t)
+
+		server := httptest.NewServer(httpHandler(newConfig(ContentRoot)))
+		defer server.Close()
+
+		first := mustWatch(t, server.URL+"/?watch=true", "")
+		defer first.Close()
+		mustWriteFile(t, []byte("hello\n"), "/a.txt", 0600)
+		lastEvent := assertNextWatchEvent(t, first, WatchEventCreate, "/a.txt", "")
+		mustWriteFile(t, []byte("hello\n"), "/b.txt", 0600)
+		assertNextWatchEvent(t, first, WatchEventCreate, "/b.txt", "")
+
+		resumed := mustWatch(t, server.URL+"/?watch=true", strconv.FormatUint(lastEvent.ID, 10))
+		defer resumed.Close()
+		assertNextWatchEvent(t, resumed, WatchEventCreate, "/b.txt", "")
+	})
+
+	t.Run("path does not exist", func(t *testing.T) {
+		mustMakeContentRoot(t)
+		defer mustDeleteContentRoot(t)
+
+		httpRequest := httptest.NewRequest(http.MethodGet, "/dne?watch=true", nil)
+		responseRecorder := httptest.NewRecorder()
+		httpHandler(newConfig(ContentRoot)).ServeHTTP(responseRecorder, httpRequest)
+		assertHttpResponse(t, responseRecorder.Result(), http.StatusNotFound, `{
+          "status": "error",
+          "type": "error",
+          "error": {
+            "code": 404,
+            "error": "stat test/dne: no such file or directory"
+          }
+        }`)
+	})
+}
+
+type watchStream struct {
+	resp   *http.Response
+	events chan WatchEvent
+}
+
+func (x *watchStream) Close() {
+	x.resp.Body.Close()
+}
+
+// mustWatch opens an event stream and decodes its events in the background.
+func mustWatch(t *testing.T, url, lastEventID string) *watchStream {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertResponseHasStatusCode(t, resp, http.StatusOK)
+	assertResponseHasHeader(t, resp, "Content-Type", "text/event-stream")
+
+	stream := &watchStream{resp: resp, events: make(chan WatchEvent, 100)}
+	go func() {
+		defer close(stream.events)
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if !strings.HasPrefix(line, "data: ") {
+				continue
+			}
+			var event WatchEvent
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event); err != nil {
+				return
+			}
+			stream.events <- event
+		}
+	}()
+	return stream
+}
+
+// assertNextWatchEvent checks the next event that isn't a modify event, since
+// writes cause an unpredictable number of them.
+func assertNextWatchEvent(t *testing.T, stream *watchStream, wantType, wantPath, wantOldPath string) WatchEvent {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case event, ok := <-stream.events:
+			if !ok {
+				t.Fatalf("event stream closed, want %s event for %s", wantType, wantPath)
+			}
+			if event.Type == WatchEventModify {
+				continue
+			}
+			if event.Type != wantType || event.Path != wantPath || event.OldPath != wantOldPath {
+				t.Fatalf("want %s event for %s (from %q), got %s event for %s (from %q)",
+					wantType, wantPath, wantOldPath, event.Type, event.Path, event.OldPath)
+			}
+			return event
+		case <-timeout:
+			t.Fatalf("timed out waiting for %s event for %s", wantType, wantPath)
+		}
+	}
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// webhookDeliveriesPath is where recent deliveries are listed instead of content.
+const webhookDeliveriesPath = "/.webhooks/deliveries"
+
+// webhookHistorySize is how many finished deliveries are kept for inspection.
+const webhookHistorySize = 100
+
+// webhookMaxBackoff caps the exponential backoff between attempts.
+const webhookMaxBackoff = time.Hour
+
+const webhookTimeout = 10 * time.Second
+
+const (
+	WebhookDeliveryPending   = "pending"
+	WebhookDeliveryDelivered = "delivered"
+	WebhookDeliveryFailed    = "failed"
+)
+
+// Webhook is a url that is sent the events for paths matching any of its
+// globs. Empty Paths or Events match everything.
+type Webhook struct {
+	URL    string   `json:"url"`
+	Paths  []string `json:"paths"`
+	Events []string `json:"events"`
+	// Secret signs the payloads with HMAC-SHA256 when set.
+	Secret string `json:"secret"`
+}
+
+// loadWebhooks reads a json list of webhooks.
+func loadWebhooks(fileName string) ([]Webhook, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	var webhooks []Webhook
+	if err := json.Unmarshal(data, &webhooks); err != nil {
+		return nil, fmt.Errorf("%s: %v", fileName, err)
+	}
+	for _, webhook := range webhooks {
+		if webhook.URL == "" {
+			return nil, fmt.Errorf("%s: webhook has no url", fileName)
+		}
+		for _, pattern := range webhook.Paths {
+			if _, err := path.Match(pattern, "/"); err != nil {
+				return nil, fmt.Errorf("%s: invalid path glob %q", fileName, pattern)
+			}
+		}
+	}
+	return webhooks, nil
+}
+
+// matches reports whether the event is one the webhook subscribed to.
+func (x Webhook) matches(event WatchEvent) bool {
+	if len(x.Events) > 0 && !containsString(x.Events, event.Type) {
+		return false
+	}
+	if len(x.Paths) == 0 {
+		return true
+	}
+	for _, pattern := range x.Paths {
+		if ok, _ := path.Match(pattern, event.Path); ok {
+			return true
+		}
+		if ok, _ := path.Match(pattern, event.OldPath); ok && event.OldPath != "" {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(items []string, s string) bool {
+	for _, item := range items {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Webhooks delivers watch events to the configured webhooks. Pending
+// deliveries are kept in the queue directory, if configured, so that they
+// survive restarts.
+type Webhooks struct {
+	config Config
+	client *http.Client
+
+	mu       sync.Mutex
+	pending  map[string]*WebhookDelivery
+	finished []WebhookDelivery
+}
+
+// newWebhooks starts delivering the events of the watchers to the configured
+// webhooks, along with any deliveries left in the queue.
+func newWebhooks(config Config, watchers ...*Watcher) *Webhooks {
+	x := &Webhooks{
+		config:  config,
+		client:  &http.Client{Timeout: webhookTimeout},
+		pending: make(map[string]*WebhookDelivery),
+	}
+	if config.WebhookQueueDir != "" {
+		if err := os.MkdirAll(config.WebhookQueueDir, 0700); err != nil {
+			log.Printf("webhook queue: %v", err)
+		}
+		x.loadQueue()
+	}
+	if len(config.Webhooks) == 0 {
+		return x
+	}
+	for _, watcher := range watchers {
+		// Subscribe before returning so that no changes are missed.
+		sub, _, err := watcher.Subscribe("/", true, 0)
+		if err != nil {
+			log.Printf("webhooks: %v", err)
+			continue
+		}
+		go x.run(watcher, sub)
+	}
+	return x
+}
+
+// run turns watch events into deliveries. Subscriptions that fall behind are
+// resumed from the last event seen.
+func (x *Webhooks) run(watcher *Watcher, sub *watchSubscription) {
+	var lastID uint64
+	for {
+		for event := range sub.events {
+			x.enqueue(event)
+			lastID = event.ID
+		}
+
+		var replay []WatchEvent
+		var err error
+		sub, replay, err = watcher.Subscribe("/", true, lastID)
+		if err != nil {
+			log.Printf("webhooks: %v", err)
+			return
+		}
+		for _, event := range replay {
+			x.enqueue(event)
+			lastID = event.ID
+		}
+	}
+}
+
+func (x *Webhooks) enqueue(event WatchEvent) {
+	for _, webhook := range x.config.Webhooks {
+		if !webhook.matches(event) {
+			continue
+		}
+		delivery := &WebhookDelivery{
+			ID:      newDeliveryID(),
+			URL:     webhook.URL,
+			Status:  WebhookDeliveryPending,
+			Created: time.Now().UTC(),
+			Event:   event,
+		}
+		x.mu.Lock()
+		x.pending[delivery.ID] = delivery
+		x.save(delivery)
+		x.mu.Unlock()
+		go x.attempt(delivery.ID)
+	}
+}
+
+// attempt tries a delivery once, then either finishes it or schedules the
+// next attempt.
+func (x *Webhooks) attempt(id string) {
+	x.mu.Lock()
+	delivery, ok := x.pending[id]
+	if !ok {
+		x.mu.Unlock()
+		return
+	}
+	payload := WebhookPayload{Delivery: delivery.ID, Event: delivery.Event}
+	url := delivery.URL
+	x.mu.Unlock()
+
+	result := WebhookAttempt{Time: time.Now().UTC()}
+	webhook, ok := x.webhook(url)
+	if ok {
+		result.StatusCode, result.Error = x.post(webhook, payload)
+	} else {
+		result.Error = "webhook is no longer configured"
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	delivery.Attempts = append(delivery.Attempts, result)
+	switch {
+	case result.Error == "":
+		delivery.Status = WebhookDeliveryDelivered
+	case !ok || len(delivery.Attempts) >= x.config.WebhookMaxAttempts:
+		delivery.Status = WebhookDeliveryFailed
+	default:
+		backoff := x.backoff(len(delivery.Attempts))
+		next := time.Now().UTC().Add(backoff)
+		delivery.NextAttempt = &next
+		x.save(delivery)
+		time.AfterFunc(backoff, func() { x.attempt(id) })
+		return
+	}
+
+	delivery.NextAttempt = nil
+	delete(x.pending, id)
+	x.unsave(delivery)
+	x.finished = append(x.finished, *delivery)
+	if len(x.finished) > webhookHistorySize {
+		x.finished = x.finished[len(x.finished)-webhookHistorySize:]
+	}
+}
+
+// backoff doubles the configured backoff with each failed attempt.
+func (x *Webhooks) backoff(attempts int) time.Duration {
+	backoff := x.config.WebhookBackoff
+	for i := 1; i < attempts && backoff < webhookMaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > webhookMaxBackoff {
+		backoff = webhookMaxBackoff
+	}
+	return backoff
+}
+
+func (x *Webhooks) webhook(url string) (Webhook, bool) {
+	for _, webhook := range x.config.Webhooks {
+		if webhook.URL == url {
+			return webhook, true
+		}
+	}
+	return Webhook{}, false
+}
+
+// post sends the payload, returning the status code and an error message
+// unless the webhook responded with a 2xx status.
+func (x *Webhooks) post(webhook Webhook, payload WebhookPayload) (int, string) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return 0, err.Error()
+	}
+	req, err := http.NewRequest(http.MethodPost, webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err.Error()
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-File-Server-Delivery", payload.Delivery)
+	req.Header.Set("X-File-Server-Event", payload.Event.Type)
+	if webhook.Secret != "" {
+		req.Header.Set("X-File-Server-Signature", signWebhookPayload(webhook.Secret, body))
+	}
+
+	resp, err := x.client.Do(req)
+	if err != nil {
+		return 0, err.Error()
+	}
+	defer resp.Body.Close()
+	ioutil.ReadAll(resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, resp.Status
+	}
+	return resp.StatusCode, ""
+}
+
+// signWebhookPayload returns the X-File-Server-Signature header value.
+func signWebhookPayload(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Deliveries returns the pending and recently finished deliveries, oldest
+// first.
+func (x *Webhooks) Deliveries() []WebhookDelivery {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	deliveries := make([]WebhookDelivery, 0, len(x.finished)+len(x.pending))
+	deliveries = append(deliveries, x.finished...)
+	for _, delivery := range x.pending {
+		deliveries = append(deliveries, *delivery)
+	}
+	sort.SliceStable(deliveries, func(i, j int) bool {
+		return deliveries[i].Created.Before(deliveries[j].Created)
+	})
+	return deliveries
+}
+
+// loadQueue schedules the deliveries left in the queue directory.
+func (x *Webhooks) loadQueue() {
+	fileNames, err := filepath.Glob(filepath.Join(x.config.WebhookQueueDir, "*.json"))
+	if err != nil {
+		log.Printf("webhook queue: %v", err)
+		return
+	}
+	for _, fileName := range fileNames {
+		data, err := ioutil.ReadFile(fileName)
+		if err != nil {
+			log.Printf("webhook queue: %v", err)
+			continue
+		}
+		var delivery WebhookDelivery
+		if err := json.Unmarshal(data, &delivery); err != nil {
+			log.Printf("webhook queue: %s: %v", fileName, err)
+			continue
+		}
+
+		// Attempts already scheduled read the pending deliveries.
+		x.mu.Lock()
+		x.pending[delivery.ID] = &delivery
+		x.mu.Unlock()
+		var delay time.Duration
+		if delivery.NextAttempt != nil {
+			delay = time.Until(*delivery.NextAttempt)
+		}
+		id := delivery.ID
+		time.AfterFunc(delay, func() { x.attempt(id) })
+	}
+}
+
+// save writes a pending delivery to the queue directory. Errors are only
+// logged, the delivery is still attempted.
+func (x *Webhooks) save(delivery *WebhookDelivery) {
+	if x.config.WebhookQueueDir == "" {
+		return
+	}
+	data, err := json.Marshal(delivery)
+	if err != nil {
+		log.Printf("webhook queue: %v", err)
+		return
+	}
+	// Write and rename so that a crash never leaves a partial file.
+	fileName := x.queueFileName(delivery)
+	if err := ioutil.WriteFile(fileName+".tmp", data, 0600); err != nil {
+		log.Printf("webhook queue: %v", err)
+		return
+	}
+	if err := os.Rename(fileName+".tmp", fileName); err != nil {
+		log.Printf("webhook queue: %v", err)
+	}
+}
+
+func (x *Webhooks) unsave(delivery *WebhookDelivery) {
+	if x.config.WebhookQueueDir == "" {
+		return
+	}
+	if err := os.Remove(x.queueFileName(delivery)); err != nil && !os.IsNotExist(err) {
+		log.Printf("webhook queue: %v", err)
+	}
+}
+
+func (x *Webhooks) queueFileName(delivery *WebhookDelivery) string {
+	return filepath.Join(x.config.WebhookQueueDir, delivery.ID+".json")
+}
+
+func newDeliveryID() string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(buf)
+}
+
+// isWebhookDeliveriesRequest reports whether the request is for the webhook
+// deliveries endpoint.
+func isWebhookDeliveriesRequest(r *http.Request) bool {
+	return strings.TrimSuffix(r.URL.Path, "/") == webhookDeliveriesPath
+}
+
+// handleWebhookDeliveries lists the pending and recent webhook deliveries.
+func handleWebhookDeliveries(webhooks *Webhooks, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeErrorResponse(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	deliveries := webhooks.Deliveries()
+	if status := r.URL.Query().Get("status"); status != "" {
+		filtered := deliveries[:0]
+		for _, delivery := range deliveries {
+			if delivery.Status == status {
+				filtered = append(filtered, delivery)
+			}
+		}
+		deliveries = filtered
+	}
+	writeResponse(w, ResponseBody{
+		Status:     "ok",
+		Type:       ResponseTypeDeliveries,
+		Deliveries: deliveries,
+	})
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWebhooks(t *testing.T) {
+	t.Run("signed deliveries with retries", func(t *testing.T) {
+		mustMakeContentRoot(t)
+		defer mustDeleteContentRoot(t)
+		mustMkDir(t, "/incoming", 0700)
+
+		receiver := newWebhookReceiver(2)
+		defer receiver.Close()
+
+		config := newConfig(ContentRoot)
+		config.WebhookBackoff = 10 * time.Millisecond
+		config.Webhooks = []Webhook{{
+			URL:    receiver.URL,
+			Paths:  []string{"/incoming/*"},
+			Events: []string{WatchEventCreate},
+			Secret: "secret",
+		}}
+		server := httptest.NewServer(httpHandler(config))
+		defer server.Close()
+
+		mustWriteFile(t, []byte("hello\n"), "/other.txt", 0600)
+		mustWriteFile(t, []byte("hello\n"), "/incoming/hello.txt", 0600)
+
+		deliveries := waitForWebhookDeliveries(t, server.URL, WebhookDeliveryDelivered, 1)
+		delivery := deliveries[0]
+		if delivery.Event.Path != "/incoming/hello.txt" || delivery.Event.Type != WatchEventCreate {
+			t.Errorf("want create event for /incoming/hello.txt, got %+v", delivery.Event)
+		}
+		if len(delivery.Attempts) != 3 || delivery.Attempts[0].StatusCode != http.StatusInternalServerError {
+			t.Errorf("want 2 failed attempts and 1 successful one, got %+v", delivery.Attempts)
+		}
+
+		requests := receiver.Requests()
+		last := requests[len(requests)-1]
+		if want := signWebhookPayload("secret", last.body); last.signature != want {
+			t.Errorf("want signature %q, got %q", want, last.signature)
+		}
+		var payload WebhookPayload
+		if err := json.Unmarshal(last.body, &payload); err != nil {
+			t.Fatal(err)
+		}
+		if payload.Delivery != delivery.ID || payload.Event.Path != "/incoming/hello.txt" {
+			t.Errorf("want payload for delivery %s, got %+v", delivery.ID, payload)
+		}
+	})
+
+	t.Run("fails after max attempts", func(t *testing.T) {
+		mustMakeContentRoot(t)
+		defer mustDeleteContentRoot(t)
+
+		receiver := newWebhookReceiver(-1)
+		defer receiver.Close()
+
+		config := newConfig(ContentRoot)
+		config.WebhookBackoff = 10 * time.Millisecond
+		config.WebhookMaxAttempts = 2
+		config.Webhooks = []Webhook{{URL: receiver.URL, Events: []string{WatchEventCreate}}}
+		server := httptest.NewServer(httpHandler(config))
+		defer server.Close()
+
+		mustWriteFile(t, []byte("hello\n"), "/hello.txt", 0600)
+
+		delivery := waitForWebhookDeliveries(t, server.URL, WebhookDeliveryFailed, 1)[0]
+		if len(delivery.Attempts) != 2 {
+			t.Errorf("want 2 attempts, got %+v", delivery.Attempts)
+		}
+	})
+
+	t.Run("resumes queued deliveries", func(t *testing.T) {
+		mustMakeContentRoot(t)
+		defer mustDeleteContentRoot(t)
+
+		receiver := newWebhookReceiver(0)
+		defer receiver.Close()
+
+		queueDir, err := ioutil.TempDir("", "webhooks")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(queueDir)
+
+		// Several deliveries, so that attempts run while the queue loads.
+		for _, id := range []string{"queued-1", "queued-2", "queued-3"} {
+			queued := WebhookDelivery{
+				ID:      id,
+				URL:     receiver.URL,
+				Status:  WebhookDeliveryPending,
+				Created: time.Now().UTC(),
+				Event:   WatchEvent{ID: 1, Type: WatchEventDelete, Path: "/gone.txt"},
+			}
+			data, err := json.Marshal(queued)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(filepath.Join(queueDir, id+".json"), data, 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		config := newConfig(ContentRoot)
+		config.WebhookQueueDir = queueDir
+		config.Webhooks = []Webhook{{URL: receiver.URL}}
+		server := httptest.NewServer(httpHandler(config))
+		defer server.Close()
+
+		for _, delivery := range waitForWebhookDeliveries(t, server.URL, WebhookDeliveryDelivered, 3) {
+			if !strings.HasPrefix(delivery.ID, "queued-") {
+				t.Errorf("want queued delivery, got %+v", delivery)
+			}
+			if _, err := os.Stat(filepath.Join(queueDir, delivery.ID+".json")); !os.IsNotExist(err) {
+				t.Errorf("want delivered queue file removed, got %v", err)
+			}
+		}
+	})
+}
+
+func TestLoadWebhooks(t *testing.T) {
+	f, err := ioutil.TempFile("", "webhooks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString(`[{"url": "http://localhost/hook", "paths": ["/incoming/["]}]`); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	if _, err := loadWebhooks(f.Name()); err == nil {
+		t.Error("want error for invalid path glob")
+	}
+}
+
+type webhookRequest struct {
+	signature string
+	body      []byte
+}
+
+// webhookReceiver is a stand-in webhook endpoint that fails the first
+// failures requests, or every request if failures is negative.
+type webhookReceiver struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	failures int
+	requests []webhookRequest
+}
+
+func newWebhookReceiver(failures int) *webhookReceiver {
+	x := &webhookReceiver{failures: failures}
+	x.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		x.mu.Lock()
+		defer x.mu.Unlock()
+		x.requests = append(x.requests, webhookRequest{r.Header.Get("X-File-Server-Signature"), body})
+		if x.failures != 0 {
+			x.failures--
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	return x
+}
+
+func (x *webhookReceiver) Requests() []webhookRequest {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	return append([]webhookRequest(nil), x.requests...)
+}
+
+// waitForWebhookDeliveries polls the deliveries endpoint until count
+// deliveries have the status.
+func waitForWebhookDeliveries(t *testing.T, serverURL string, status string, count int) []WebhookDelivery {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		resp, err := http.Get(serverURL + webhookDeliveriesPath + "?status=" + status)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var body ResponseBody
+		err = json.NewDecoder(resp.Body).Decode(&body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if body.Type != ResponseTypeDeliveries {
+			t.Fatalf("want deliveries response, got %+v", body)
+		}
+		if len(body.Deliveries) >= count {
+			return body.Deliveries
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("want %d %s deliveries, got %+v", count, status, body.Deliveries)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
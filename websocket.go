@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/websocket"
+)
+
+// webSocketPath is where the websocket endpoint is served instead of content.
+const webSocketPath = "/.websocket"
+
+const (
+	WebSocketOpGet         = "get"
+	WebSocketOpPut         = "put"
+	WebSocketOpPost        = "post"
+	WebSocketOpDelete      = "delete"
+	WebSocketOpPatch       = "patch"
+	WebSocketOpSubscribe   = "subscribe"
+	WebSocketOpUnsubscribe = "unsubscribe"
+)
+
+var webSocketOpMethods = map[string]string{
+	WebSocketOpGet:    http.MethodGet,
+	WebSocketOpPut:    http.MethodPut,
+	WebSocketOpPost:   http.MethodPost,
+	WebSocketOpDelete: http.MethodDelete,
+	WebSocketOpPatch:  http.MethodPatch,
+}
+
+// handleWebSocket serves a websocket that multiplexes api requests and watch
+// subscriptions. Requests are handled in order, while events are sent as
+// they happen.
+func handleWebSocket(config Config, watcher *Watcher, hooks *Hooks, w http.ResponseWriter, r *http.Request) {
+	websocket.Server{Handshake: checkWebSocketOrigin(config.WebSocketOrigins), Handler: func(ws *websocket.Conn) {
+		session := &webSocketSession{
+			config:        config,
+			watcher:       watcher,
+			hooks:         hooks,
+			ws:            ws,
+			subscriptions: make(map[string]*watchSubscription),
+		}
+		defer session.close()
+		session.serve()
+	}}.ServeHTTP(w, r)
+}
+
+// checkWebSocketOrigin accepts the handshakes from pages of the same host or
+// of one of the allowed origins, so that other sites can't use the cookies or
+// network of a browser to reach the api. Clients that aren't browsers, like
+// command line tools, send no Origin and are accepted.
+func checkWebSocketOrigin(allowed []string) func(*websocket.Config, *http.Request) error {
+	return func(wsConfig *websocket.Config, r *http.Request) error {
+		origin, err := websocket.Origin(wsConfig, r)
+		if err != nil {
+			return err
+		}
+		if origin == nil || strings.EqualFold(origin.Host, r.Host) {
+			return nil
+		}
+		for _, allowedOrigin := range allowed {
+			if strings.EqualFold(strings.TrimSuffix(allowedOrigin, "/"), origin.Scheme+"://"+origin.Host) {
+				return nil
+			}
+		}
+		return fmt.Errorf("origin %s is not allowed", origin)
+	}
+}
+
+type webSocketSession struct {
+	config  Config
+	watcher *Watcher
+	hooks   *Hooks
+	ws      *websocket.Conn
+
+	sendMu sync.Mutex
+
+	mu            sync.Mutex
+	subscriptions map[string]*watchSubscription
+}
+
+func (x *webSocketSession) serve() {
+	for {
+		var req WebSocketRequest
+		if err := websocket.JSON.Receive(x.ws, &req); err != nil {
+			if _, ok := err.(*json.SyntaxError); ok {
+				response := errorResponseBody(http.StatusBadRequest, fmt.Sprintf("invalid json: %v", err))
+				x.send(WebSocketMessage{Response: &response})
+				continue
+			}
+			return
+		}
+
+		var response ResponseBody
+		var forward func()
+		switch req.Op {
+		case WebSocketOpSubscribe:
+			response, forward = x.subscribe(req)
+		case WebSocketOpUnsubscribe:
+			response = x.unsubscribe(req.ID)
+		default:
+			response = x.do(req)
+		}
+		x.send(WebSocketMessage{ID: req.ID, Response: &response})
+		if forward != nil {
+			go forward()
+		}
+	}
+}
+
+func (x *webSocketSession) send(msg WebSocketMessage) {
+	x.sendMu.Lock()
+	defer x.sendMu.Unlock()
+	// Send errors mean the connection is gone, which ends serve too.
+	websocket.JSON.Send(x.ws, msg)
+}
+
+// do runs a request through the json api and returns its response.
+func (x *webSocketSession) do(req WebSocketRequest) ResponseBody {
+	method, ok := webSocketOpMethods[req.Op]
+	if !ok {
+		return errorResponseBody(http.StatusBadRequest, fmt.Sprintf("unknown op %q", req.Op))
+	}
+
+	query := url.Values{}
+	for key, value := range req.Query {
+		query.Set(key, value)
+	}
+	target := url.URL{Path: path.Clean("/" + req.Path), RawQuery: query.Encode()}
+	r, err := http.NewRequest(method, target.String(), bytes.NewReader(req.Body))
+	if err != nil {
+		return errorResponseBody(http.StatusBadRequest, err.Error())
+	}
+	r.Header.Set("Content-Type", "application/json")
+
+	w := newBufferedResponse()
+	handleRequest(x.config, x.hooks, w, r)
+
+	if !strings.HasPrefix(w.header.Get("Content-Type"), "application/json") {
+		return errorResponseBody(http.StatusBadRequest, "only json responses can be sent over a websocket")
+	}
+	var response ResponseBody
+	if err := json.Unmarshal(w.body.Bytes(), &response); err != nil {
+		return errorResponseBody(http.StatusInternalServerError, err.Error())
+	}
+	return response
+}
+
+// subscribe subscribes to watch events for a path, and returns a function
+// that forwards them until unsubscribed. The request id identifies the
+// subscription.
+func (x *webSocketSession) subscribe(req WebSocketRequest) (ResponseBody, func()) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if req.ID == "" {
+		return errorResponseBody(http.StatusBadRequest, "subscriptions require an id"), nil
+	}
+	if _, ok := x.subscriptions[req.ID]; ok {
+		return errorResponseBody(http.StatusBadRequest, fmt.Sprintf("subscription %q already exists", req.ID)), nil
+	}
+	if _, err := x.config.Storage.Stat(req.Path); err != nil {
+		if os.IsNotExist(err) {
+			return errorResponseBody(http.StatusNotFound, err.Error()), nil
+		}
+		log.Println(err)
+		return errorResponseBody(http.StatusInternalServerError, err.Error()), nil
+	}
+
+	sub, replay, err := x.watcher.Subscribe(req.Path, req.Recursive, req.LastEventID)
+	if err != nil {
+		log.Println(err)
+		return errorResponseBody(http.StatusInternalServerError, err.Error()), nil
+	}
+	x.subscriptions[req.ID] = sub
+
+	forward := func() {
+		for i := range replay {
+			x.send(WebSocketMessage{Subscription: req.ID, Event: &replay[i]})
+		}
+		for event := range sub.events {
+			event := event
+			x.send(WebSocketMessage{Subscription: req.ID, Event: &event})
+		}
+		// The watcher closes the subscription if we fall behind.
+		x.mu.Lock()
+		defer x.mu.Unlock()
+		if x.subscriptions[req.ID] == sub {
+			delete(x.subscriptions, req.ID)
+			x.send(WebSocketMessage{Subscription: req.ID, Response: &ResponseBody{Status: "ok", Type: ResponseTypeUnsubscribed}})
+		}
+	}
+	return ResponseBody{Status: "ok", Type: ResponseTypeSubscribed}, forward
+}
+
+func (x *webSocketSession) unsubscribe(id string) ResponseBody {
+	x.mu.Lock()
+	sub, ok := x.subscriptions[id]
+	delete(x.subscriptions, id)
+	x.mu.Unlock()
+
+	if !ok {
+		return errorResponseBody(http.StatusNotFound, fmt.Sprintf("subscription %q does not exist", id))
+	}
+	x.watcher.Unsubscribe(sub)
+	return ResponseBody{Status: "ok", Type: ResponseTypeUnsubscribed}
+}
+
+func (x *webSocketSession) close() {
+	x.mu.Lock()
+	subscriptions := x.subscriptions
+	x.subscriptions = make(map[string]*watchSubscription)
+	x.mu.Unlock()
+
+	for _, sub := range subscriptions {
+		x.watcher.Unsubscribe(sub)
+	}
+}
+
+// bufferedResponse is an http.ResponseWriter that keeps the response in memory.
+type bufferedResponse struct {
+	header http.Header
+	code   int
+	body   bytes.Buffer
+}
+
+func newBufferedResponse() *bufferedResponse {
+	return &bufferedResponse{header: make(http.Header), code: http.StatusOK}
+}
+
+func (x *bufferedResponse) Header() http.Header {
+	return x.header
+}
+
+func (x *bufferedResponse) Write(data []byte) (int, error) {
+	return x.body.Write(data)
+}
+
+func (x *bufferedResponse) WriteHeader(code int) {
+	x.code = code
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+func TestHandleWebSocket(t *testing.T) {
+	mustMakeContentRoot(t)
+	defer mustDeleteContentRoot(t)
+
+	server := httptest.NewServer(httpHandler(newConfig(ContentRoot)))
+	defer server.Close()
+
+	ws := mustDialWebSocket(t, server.URL)
+	defer ws.Close()
+
+	t.Run("put and get", func(t *testing.T) {
+		mustSendWebSocketRequest(t, ws, WebSocketRequest{
+			ID:   "1",
+			Op:   WebSocketOpPut,
+			Path: "/hello.txt",
+			Body: json.RawMessage(`{"permissions": "0600", "contents": "hello\n"}`),
+		})
+		msg := mustReceiveWebSocketMessage(t, ws)
+		assertWebSocketResponse(t, msg, "1", ResponseTypeFile)
+
+		mustSendWebSocketRequest(t, ws, WebSocketRequest{
+			ID:    "2",
+			Op:    WebSocketOpGet,
+			Path:  "/hello.txt",
+			Query: map[string]string{"checksum": "md5"},
+		})
+		msg = mustReceiveWebSocketMessage(t, ws)
+		assertWebSocketResponse(t, msg, "2", ResponseTypeFile)
+		if msg.Response.File.Contents != "hello\n" {
+			t.Errorf("want contents %q, got %q", "hello\n", msg.Response.File.Contents)
+		}
+		if got := msg.Response.File.Checksums["md5"]; got != "b1946ac92492d2347c6235b4d2611184" {
+			t.Errorf("want md5 checksum, got %q", got)
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		mustSendWebSocketRequest(t, ws, WebSocketRequest{ID: "3", Op: WebSocketOpGet, Path: "/missing.txt"})
+		msg := mustReceiveWebSocketMessage(t, ws)
+		assertWebSocketResponse(t, msg, "3", ResponseTypeError)
+		if msg.Response.Error.Code != http.StatusNotFound {
+			t.Errorf("want code %d, got %d", http.StatusNotFound, msg.Response.Error.Code)
+		}
+
+		mustSendWebSocketRequest(t, ws, WebSocketRequest{ID: "4", Op: "chmod", Path: "/hello.txt"})
+		msg = mustReceiveWebSocketMessage(t, ws)
+		assertWebSocketResponse(t, msg, "4", ResponseTypeError)
+		if want := `unknown op "chmod"`; msg.Response.Error.Error != want {
+			t.Errorf("want error %q, got %q", want, msg.Response.Error.Error)
+		}
+
+		mustSendWebSocketRequest(t, ws, WebSocketRequest{
+			ID:    "5",
+			Op:    WebSocketOpGet,
+			Path:  "/hello.txt",
+			Query: map[string]string{"raw": "true"},
+		})
+		msg = mustReceiveWebSocketMessage(t, ws)
+		assertWebSocketResponse(t, msg, "5", ResponseTypeError)
+	})
+
+	t.Run("subscriptions", func(t *testing.T) {
+		mustMkDir(t, "/a", 0700)
+		mustMkDir(t, "/b", 0700)
+
+		for _, id := range []string{"a", "b"} {
+			mustSendWebSocketRequest(t, ws, WebSocketRequest{ID: id, Op: WebSocketOpSubscribe, Path: "/" + id})
+			assertWebSocketResponse(t, mustReceiveWebSocketMessage(t, ws), id, ResponseTypeSubscribed)
+		}
+
+		mustWriteFile(t, []byte("hello\n"), "/b/file.txt", 0600)
+		assertNextWebSocketEvent(t, ws, "b", WatchEventCreate, "/b/file.txt")
+
+		mustSendWebSocketRequest(t, ws, WebSocketRequest{ID: "a", Op: WebSocketOpUnsubscribe})
+		assertWebSocketResponse(t, mustReceiveWebSocketResponse(t, ws), "a", ResponseTypeUnsubscribed)
+
+		mustSendWebSocketRequest(t, ws, WebSocketRequest{
+			ID:   "6",
+			Op:   WebSocketOpPost,
+			Path: "/a",
+			Body: json.RawMessage(`[{"name": "file.txt", "permissions": "0600"}]`),
+		})
+		assertWebSocketResponse(t, mustReceiveWebSocketResponse(t, ws), "6", ResponseTypeDirectory)
+
+		// Events are in order, so one for b after the post means none came for a.
+		mustWriteFile(t, []byte("hello\n"), "/b/last.txt", 0600)
+		assertNextWebSocketEvent(t, ws, "b", WatchEventCreate, "/b/last.txt")
+
+		mustSendWebSocketRequest(t, ws, WebSocketRequest{ID: "c", Op: WebSocketOpSubscribe, Path: "/c"})
+		msg := mustReceiveWebSocketResponse(t, ws)
+		assertWebSocketResponse(t, msg, "c", ResponseTypeError)
+		if msg.Response.Error.Code != http.StatusNotFound {
+			t.Errorf("want code %d, got %d", http.StatusNotFound, msg.Response.Error.Code)
+		}
+	})
+}
+
+func TestWebSocketOrigin(t *testing.T) {
+	mustMakeContentRoot(t)
+	defer mustDeleteContentRoot(t)
+
+	config := newConfig(ContentRoot)
+	config.WebSocketOrigins = []string{"https://app.example.com"}
+	server := httptest.NewServer(httpHandler(config))
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + webSocketPath
+
+	for _, test := range []struct {
+		origin string
+		valid  bool
+	}{
+		{server.URL, true},
+		{"https://app.example.com", true},
+		{"https://evil.example.com", false},
+		{"http://app.example.com", false},
+	} {
+		t.Run(test.origin, func(t *testing.T) {
+			ws, err := websocket.Dial(url, "", test.origin)
+			if valid := err == nil; valid != test.valid {
+				t.Errorf("got error %v", err)
+			}
+			if ws != nil {
+				ws.Close()
+			}
+		})
+	}
+}
+
+func mustDialWebSocket(t *testing.T, serverURL string) *websocket.Conn {
+	url := "ws" + strings.TrimPrefix(serverURL, "http") + webSocketPath
+	ws, err := websocket.Dial(url, "", serverURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ws
+}
+
+func mustSendWebSocketRequest(t *testing.T, ws *websocket.Conn, req WebSocketRequest) {
+	if err := websocket.JSON.Send(ws, req); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func mustReceiveWebSocketMessage(t *testing.T, ws *websocket.Conn) WebSocketMessage {
+	if err := ws.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	var msg WebSocketMessage
+	if err := websocket.JSON.Receive(ws, &msg); err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+// mustReceiveWebSocketResponse skips events sent before the next response.
+func mustReceiveWebSocketResponse(t *testing.T, ws *websocket.Conn) WebSocketMessage {
+	for {
+		msg := mustReceiveWebSocketMessage(t, ws)
+		if msg.Event == nil {
+			return msg
+		}
+	}
+}
+
+func assertWebSocketResponse(t *testing.T, msg WebSocketMessage, id string, responseType string) {
+	t.Helper()
+	if msg.ID != id || msg.Response == nil {
+		t.Fatalf("want response to %q, got %+v", id, msg)
+	}
+	if msg.Response.Type != responseType {
+		t.Fatalf("want response type %q, got %+v", responseType, msg.Response)
+	}
+}
+
+// assertNextWebSocketEvent skips modify events, which may or may not follow
+// a create depending on the watch backend.
+func assertNextWebSocketEvent(t *testing.T, ws *websocket.Conn, subscription string, eventType string, eventPath string) {
+	t.Helper()
+	for {
+		msg := mustReceiveWebSocketMessage(t, ws)
+		if msg.Event == nil {
+			t.Fatalf("want event, got %+v", msg)
+		}
+		if msg.Event.Type == WatchEventModify {
+			continue
+		}
+		if msg.Subscription != subscription || msg.Event.Type != eventType || msg.Event.Path != eventPath {
+			t.Fatalf("want %s %s event for %q, got %q %+v", eventType, eventPath, subscription, msg.Subscription, msg.Event)
+		}
+		return
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var errXattrNotAllowed = errors.New("extended attribute namespace is not allowed")
+
+var errXattrUnsupported = errors.New("extended attributes are not supported on this platform")
+
+var errXattrReserved = errors.New("extended attribute is reserved for the server")
+
+// readXattrs returns the base64 encoded extended attributes of name that
+// belong to one of namespaces, without those of the server.
+func readXattrs(storage Storage, name string, namespaces []string) (map[string]string, error) {
+	names, err := storage.ListXattrs(name)
+	if err != nil {
+		return nil, err
+	}
+
+	xattrs := make(map[string]string)
+	for _, attr := range names {
+		if !xattrAllowed(attr, namespaces) || xattrReserved(attr) {
+			continue
+		}
+		value, err := storage.GetXattr(name, attr)
+		if err != nil {
+			return nil, err
+		}
+		xattrs[attr] = base64.StdEncoding.EncodeToString(value)
+	}
+	return xattrs, nil
+}
+
+// parseXattrs validates and decodes the xattrs of a PatchFileRequest. Null
+// values are returned in remove.
+func parseXattrs(data map[string]*string, namespaces []string) (set map[string][]byte, remove []string, err error) {
+	set = make(map[string][]byte)
+	for name, value := range data {
+		if !xattrAllowed(name, namespaces) {
+			return nil, nil, fmt.Errorf("%w: %s", errXattrNotAllowed, name)
+		}
+		if xattrReserved(name) {
+			return nil, nil, fmt.Errorf("%w: %s", errXattrReserved, name)
+		}
+		if value == nil {
+			remove = append(remove, name)
+			continue
+		}
+		decoded, err := base64.StdEncoding.DecodeString(*value)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid base64 value for %s: %v", name, err)
+		}
+		set[name] = decoded
+	}
+	return set, remove, nil
+}
+
+func xattrAllowed(name string, namespaces []string) bool {
+	for _, namespace := range namespaces {
+		if strings.HasPrefix(name, namespace+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// xattrReserved reports whether an extended attribute is kept by the server,
+// which clients can't read or change.
+func xattrReserved(name string) bool {
+	return name == expiryXattr || strings.HasPrefix(name, checksumXattrPrefix)
+}
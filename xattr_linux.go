@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"syscall"
+)
+
+func listXattrs(fileName string) ([]string, error) {
+	size, err := syscall.Listxattr(fileName, nil)
+	if err != nil || size == 0 {
+		return nil, err
+	}
+	buf := make([]byte, size)
+	size, err = syscall.Listxattr(fileName, buf)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, name := range bytes.Split(buf[:size], []byte{0}) {
+		if len(name) > 0 {
+			names = append(names, string(name))
+		}
+	}
+	return names, nil
+}
+
+func getXattr(fileName, name string) ([]byte, error) {
+	size, err := syscall.Getxattr(fileName, name, nil)
+	if err != nil || size == 0 {
+		return []byte{}, err
+	}
+	buf := make([]byte, size)
+	size, err = syscall.Getxattr(fileName, name, buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:size], nil
+}
+
+func setXattr(fileName, name string, value []byte) error {
+	return syscall.Setxattr(fileName, name, value, 0)
+}
+
+// removeXattr removes the attribute if it exists.
+func removeXattr(fileName, name string) error {
+	if err := syscall.Removexattr(fileName, name); err != nil && err != syscall.ENODATA {
+		return err
+	}
+	return nil
+}
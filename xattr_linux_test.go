@@ -0,0 +1,157 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestXattrs(t *testing.T) {
+	runTest := func(t *testing.T, method, target, reqBody string, wantStatus int, wantBody string) {
+		t.Helper()
+		httpRequest := httptest.NewRequest(method, target, strings.NewReader(reqBody))
+		responseRecorder := httptest.NewRecorder()
+		httpHandler(newConfig(ContentRoot)).ServeHTTP(responseRecorder, httpRequest)
+		assertHttpResponse(t, responseRecorder.Result(), wantStatus, wantBody)
+	}
+
+	t.Run("get file with xattrs", func(t *testing.T) {
+		mustMakeContentRoot(t)
+		defer mustDeleteContentRoot(t)
+
+		mustWriteFile(t, []byte("hello\n"), "/file.txt", 0644)
+		mustSetXattr(t, "/file.txt", "user.build_id", "1234")
+		mustSetXattr(t, "/file.txt", "trusted.hidden", "secret")
+		mustSetXattr(t, "/file.txt", expiryXattr, "2999-01-01T00:00:00Z")
+		runTest(t, http.MethodGet, "/file.txt?xattrs=true", "", http.StatusOK, `{
+          "status": "ok",
+          "type": "file",
+          "file": {
+            "name": "file.txt",
+            "path": "/file.txt",
+            "mime_type": "text/plain; charset=utf-8",
+            "owner": "0",
+            "group": "0",
+            "size": 6,
+            "permissions": "0644",
+            "xattrs": {"user.build_id": "MTIzNA=="},
+            "expires_at": "2999-01-01T00:00:00Z",
+            "contents": "hello\n"
+          }
+        }`)
+	})
+
+	t.Run("get directory with xattrs", func(t *testing.T) {
+		mustMakeContentRoot(t)
+		defer mustDeleteContentRoot(t)
+
+		mustMkDir(t, "/dir", 0700)
+		mustWriteFile(t, []byte("hello\n"), "/dir/file.txt", 0644)
+		mustSetXattr(t, "/dir/file.txt", "user.build_id", "1234")
+		runTest(t, http.MethodGet, "/dir?xattrs=true", "", http.StatusOK, `{
+          "status": "ok",
+          "type": "directory",
+          "directory": {
+            "name": "dir",
+            "path": "/dir",
+            "owner": "0",
+            "group": "0",
+            "size": 4096,
+            "permissions": "0700",
+            "entries": [
+              {
+                "name": "file.txt",
+                "path": "/dir/file.txt",
+                "mime_type": "text/plain; charset=utf-8",
+                "owner": "0",
+                "group": "0",
+                "permissions": "0644",
+                "size": 6,
+                "xattrs": {"user.build_id": "MTIzNA=="},
+                "type": "file"
+              }
+            ]
+          }
+        }`)
+	})
+
+	t.Run("set and remove xattrs", func(t *testing.T) {
+		mustMakeContentRoot(t)
+		defer mustDeleteContentRoot(t)
+
+		mustWriteFile(t, []byte("hello\n"), "/file.txt", 0644)
+		mustSetXattr(t, "/file.txt", "user.old", "1")
+		runTest(t, http.MethodPatch, "/file.txt?xattrs=true",
+			`{"xattrs": {"user.new": "Mg==", "user.old": null}}`,
+			http.StatusOK,
+			`{
+			  "status": "ok",
+			  "type": "meta",
+			  "meta": {
+				"name": "file.txt",
+				"path": "/file.txt",
+				"mime_type": "text/plain; charset=utf-8",
+				"owner": "0",
+				"group": "0",
+				"permissions": "0644",
+				"size": 6,
+				"xattrs": {"user.new": "Mg=="}
+			  }
+			}`)
+	})
+
+	t.Run("namespace not allowed", func(t *testing.T) {
+		mustMakeContentRoot(t)
+		defer mustDeleteContentRoot(t)
+
+		mustWriteFile(t, []byte("hello\n"), "/file.txt", 0644)
+		runTest(t, http.MethodPatch, "/file.txt", `{"xattrs": {"trusted.x": "MQ=="}}`, http.StatusForbidden, `{
+          "status": "error",
+          "type": "error",
+          "error": {
+            "code": 403,
+            "error": "extended attribute namespace is not allowed: trusted.x"
+          }
+        }`)
+	})
+
+	t.Run("reserved xattr", func(t *testing.T) {
+		mustMakeContentRoot(t)
+		defer mustDeleteContentRoot(t)
+
+		mustWriteFile(t, []byte("hello\n"), "/file.txt", 0644)
+		runTest(t, http.MethodPatch, "/file.txt", `{"xattrs": {"user.file-server.expires_at": null}}`, http.StatusForbidden, `{
+          "status": "error",
+          "type": "error",
+          "error": {
+            "code": 403,
+            "error": "extended attribute is reserved for the server: user.file-server.expires_at"
+          }
+        }`)
+	})
+
+	t.Run("invalid base64", func(t *testing.T) {
+		mustMakeContentRoot(t)
+		defer mustDeleteContentRoot(t)
+
+		mustWriteFile(t, []byte("hello\n"), "/file.txt", 0644)
+		runTest(t, http.MethodPatch, "/file.txt", `{"xattrs": {"user.x": "!"}}`, http.StatusBadRequest, `{
+          "status": "error",
+          "type": "error",
+          "error": {
+            "code": 400,
+            "error": "invalid base64 value for user.x: illegal base64 data at input byte 0"
+          }
+        }`)
+	})
+}
+
+func mustSetXattr(t *testing.T, name, attr, value string) {
+	t.Helper()
+	if err := syscall.Setxattr(path.Join(ContentRoot, name), attr, []byte(value), 0); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,20 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+func listXattrs(fileName string) ([]string, error) {
+	return nil, errXattrUnsupported
+}
+
+func getXattr(fileName, name string) ([]byte, error) {
+	return nil, errXattrUnsupported
+}
+
+func setXattr(fileName, name string, value []byte) error {
+	return errXattrUnsupported
+}
+
+func removeXattr(fileName, name string) error {
+	return errXattrUnsupported
+}